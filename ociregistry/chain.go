@@ -0,0 +1,40 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociregistry
+
+// Chain returns the result of applying each of the given wrappers
+// in turn to base: the first wrapper is applied to base, the second
+// to the result of that, and so on, so the last wrapper is the
+// outermost one, seeing calls first.
+//
+// This makes a stack of wrappers read top-down. For example:
+//
+//	r := ociregistry.Chain(ocimem.New(),
+//		ocifilter.ReadOnly,
+//		func(r ociregistry.Interface) ociregistry.Interface {
+//			return ocifilter.Sub(r, "some/prefix")
+//		},
+//	)
+//
+// is equivalent to:
+//
+//	r := ocifilter.Sub(ocifilter.ReadOnly(ocimem.New()), "some/prefix")
+func Chain(base Interface, wrappers ...func(Interface) Interface) Interface {
+	r := base
+	for _, wrap := range wrappers {
+		r = wrap(r)
+	}
+	return r
+}
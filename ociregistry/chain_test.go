@@ -0,0 +1,85 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociregistry_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/go-quicktest/qt"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ocidebug"
+	"cuelabs.dev/go/oci/ociregistry/ocifilter"
+	"cuelabs.dev/go/oci/ociregistry/ocimem"
+	"cuelabs.dev/go/oci/ociregistry/ocitest"
+)
+
+func TestChain(t *testing.T) {
+	ctx := context.Background()
+	base := ocimem.New()
+	content := ocitest.NewRegistry(t, base).MustPushContent(ocitest.RegistryContent{
+		"foo/a": {
+			Blobs: map[string]string{
+				"b1": "hello",
+			},
+		},
+		"bar/b": {
+			Blobs: map[string]string{
+				"b1": "hello",
+			},
+		},
+	})
+	dig := content["foo/a"].Blobs["b1"].Digest
+
+	var log []string
+	r := ociregistry.Chain(base,
+		func(r ociregistry.Interface) ociregistry.Interface {
+			return ocidebug.New(r, func(f string, a ...any) {
+				log = append(log, fmt.Sprintf(f, a...))
+			})
+		},
+		ocifilter.ReadOnly,
+		func(r ociregistry.Interface) ociregistry.Interface {
+			return ocifilter.Select(r, func(repo string) bool {
+				return strings.HasPrefix(repo, "foo/")
+			})
+		},
+	)
+
+	// Reads of selected repositories go through all the layers.
+	desc, err := r.ResolveBlob(ctx, "foo/a", dig)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.Equals(desc.Digest, dig))
+	qt.Assert(t, qt.HasLen(log, 2))
+	qt.Assert(t, qt.StringContains(log[0], "ResolveBlob"))
+
+	// The outermost Select layer rejects other repositories
+	// before they reach the inner layers.
+	_, err = r.ResolveBlob(ctx, "bar/b", dig)
+	qt.Assert(t, qt.ErrorIs(err, ociregistry.ErrNameUnknown))
+
+	// The ReadOnly layer rejects writes before they reach
+	// the debug layer.
+	_, err = r.PushBlob(ctx, "foo/a", ociregistry.Descriptor{
+		MediaType: "application/octet-stream",
+		Digest:    "sha256:2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+		Size:      5,
+	}, strings.NewReader("hello"))
+	qt.Assert(t, qt.ErrorIs(err, ociregistry.ErrUnsupported))
+	qt.Assert(t, qt.HasLen(log, 2))
+}
@@ -0,0 +1,92 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociregistry_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/go-quicktest/qt"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ocimem"
+	"cuelabs.dev/go/oci/ociregistry/ocitest"
+)
+
+func TestCollect(t *testing.T) {
+	ctx := context.Background()
+	r := ocimem.New()
+	ocitest.NewRegistry(t, r).MustPushContent(ocitest.RegistryContent{
+		"foo": {
+			Blobs: map[string]string{
+				"scratch": "{}",
+			},
+			Manifests: map[string]ociregistry.Manifest{
+				"m": {
+					MediaType: "application/vnd.oci.image.manifest.v1+json",
+					Config: ociregistry.Descriptor{
+						Digest: "scratch",
+					},
+				},
+			},
+			Tags: map[string]string{
+				"a": "m",
+				"b": "m",
+				"c": "m",
+			},
+		},
+	})
+
+	tags, err := ociregistry.CollectAll(ctx, r.Tags(ctx, "foo", ""))
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.DeepEquals(tags, []string{"a", "b", "c"}))
+
+	for n, want := range map[int][]string{
+		-1: {"a", "b", "c"},
+		0:  {},
+		1:  {"a"},
+		2:  {"a", "b"},
+		3:  {"a", "b", "c"},
+		10: {"a", "b", "c"},
+	} {
+		tags, err := ociregistry.CollectN(ctx, r.Tags(ctx, "foo", ""), n)
+		qt.Assert(t, qt.IsNil(err))
+		qt.Assert(t, qt.DeepEquals(tags, want), qt.Commentf("n=%d", n))
+	}
+
+	// Errors from the iterator are returned.
+	_, err = ociregistry.CollectAll(ctx, r.Tags(ctx, "nonexistent", ""))
+	qt.Assert(t, qt.ErrorIs(err, ociregistry.ErrNameUnknown))
+
+	// Iteration stops when the context is done.
+	ctx1, cancel := context.WithCancel(ctx)
+	var got []string
+	tags, err = ociregistry.CollectAll(ctx1, func(yield func(string, error) bool) {
+		r.Tags(ctx, "foo", "")(func(tag string, err error) bool {
+			got = append(got, tag)
+			if tag == "b" {
+				cancel()
+			}
+			return yield(tag, err)
+		})
+	})
+	qt.Assert(t, qt.ErrorIs(err, context.Canceled))
+	qt.Assert(t, qt.DeepEquals(tags, []string{"a"}))
+	qt.Assert(t, qt.DeepEquals(got, []string{"a", "b"}))
+
+	_, err = ociregistry.CollectN(ctx1, ociregistry.ErrorSeq[string](errors.New("unused")), 0)
+	qt.Assert(t, qt.ErrorIs(err, context.Canceled))
+}
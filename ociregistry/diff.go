@@ -0,0 +1,165 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociregistry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// DiffResult holds the differences between two registries
+// as found by [Diff]. Each slice is sorted by repository and then tag.
+type DiffResult struct {
+	// OnlyInA holds the tags that are present in the first
+	// registry but not the second.
+	OnlyInA []TagDiff
+
+	// OnlyInB holds the tags that are present in the second
+	// registry but not the first.
+	OnlyInB []TagDiff
+
+	// Divergent holds the tags that are present in both registries
+	// but refer to different manifests.
+	Divergent []TagDiff
+}
+
+// IsEmpty reports whether no differences were found.
+func (d DiffResult) IsEmpty() bool {
+	return len(d.OnlyInA) == 0 && len(d.OnlyInB) == 0 && len(d.Divergent) == 0
+}
+
+// TagDiff describes a tag that differs between two registries.
+type TagDiff struct {
+	Repo string
+	Tag  string
+
+	// A and B hold the digest of the manifest that the tag refers
+	// to in the first and second registry respectively,
+	// or the empty string if the tag is absent there.
+	A, B Digest
+}
+
+// Diff compares the tags in the given repositories of registries a and b,
+// which is useful for checking that one has been replicated to the
+// other. If repos is nil, all the repositories in either registry are
+// compared; otherwise repos may be in any order. A repository that
+// doesn't exist in one of the registries is treated as having no
+// tags there.
+//
+// Tags are compared by the digest that they resolve to, so only
+// list and resolve operations are used: no content is downloaded, and
+// the blobs and manifests that tagged manifests refer to aren't checked.
+func Diff(ctx context.Context, a, b Interface, repos []string) (DiffResult, error) {
+	if repos == nil {
+		var err error
+		repos, err = allRepositories(ctx, a, b)
+		if err != nil {
+			return DiffResult{}, err
+		}
+	} else {
+		// Sort the repositories so that the result is sorted.
+		repos = slices.Clone(repos)
+		slices.Sort(repos)
+		repos = slices.Compact(repos)
+	}
+	var result DiffResult
+	for _, repo := range repos {
+		aTags, err := resolveTags(ctx, a, repo)
+		if err != nil {
+			return DiffResult{}, err
+		}
+		bTags, err := resolveTags(ctx, b, repo)
+		if err != nil {
+			return DiffResult{}, err
+		}
+		for _, tag := range sortedKeys(aTags) {
+			d := TagDiff{
+				Repo: repo,
+				Tag:  tag,
+				A:    aTags[tag],
+				B:    bTags[tag],
+			}
+			switch {
+			case d.B == "":
+				result.OnlyInA = append(result.OnlyInA, d)
+			case d.A != d.B:
+				result.Divergent = append(result.Divergent, d)
+			}
+		}
+		for _, tag := range sortedKeys(bTags) {
+			if _, ok := aTags[tag]; !ok {
+				result.OnlyInB = append(result.OnlyInB, TagDiff{
+					Repo: repo,
+					Tag:  tag,
+					B:    bTags[tag],
+				})
+			}
+		}
+	}
+	return result, nil
+}
+
+// allRepositories returns the sorted union of the
+// repositories in registries a and b.
+func allRepositories(ctx context.Context, a, b Interface) ([]string, error) {
+	aRepos, err := All(a.Repositories(ctx, ""))
+	if err != nil {
+		return nil, fmt.Errorf("cannot list repositories: %w", err)
+	}
+	bRepos, err := All(b.Repositories(ctx, ""))
+	if err != nil {
+		return nil, fmt.Errorf("cannot list repositories: %w", err)
+	}
+	repos := append(aRepos, bRepos...)
+	slices.Sort(repos)
+	return slices.Compact(repos), nil
+}
+
+// resolveTags returns a map from each tag in the given
+// repository to the digest that it refers to.
+func resolveTags(ctx context.Context, r Interface, repo string) (map[string]Digest, error) {
+	tags, err := All(r.Tags(ctx, repo, ""))
+	if err != nil {
+		if errors.Is(err, ErrNameUnknown) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("cannot list tags in %q: %w", repo, err)
+	}
+	m := make(map[string]Digest)
+	for _, tag := range tags {
+		desc, err := r.ResolveTag(ctx, repo, tag)
+		if err != nil {
+			if errors.Is(err, ErrManifestUnknown) || errors.Is(err, ErrNameUnknown) {
+				// The tag or the repository has been
+				// deleted since the tag was listed.
+				continue
+			}
+			return nil, fmt.Errorf("cannot resolve %s:%s: %w", repo, tag, err)
+		}
+		m[tag] = desc.Digest
+	}
+	return m, nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
@@ -0,0 +1,169 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociregistry_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-quicktest/qt"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ocimem"
+	"cuelabs.dev/go/oci/ociregistry/ocitest"
+)
+
+func TestDiff(t *testing.T) {
+	ctx := context.Background()
+	manifests := func(names ...string) map[string]ociregistry.Manifest {
+		m := make(map[string]ociregistry.Manifest)
+		for _, name := range names {
+			m[name] = ociregistry.Manifest{
+				MediaType: "application/vnd.oci.image.manifest.v1+json",
+				Config: ociregistry.Descriptor{
+					Digest: "config",
+				},
+				Annotations: map[string]string{
+					"name": name,
+				},
+			}
+		}
+		return m
+	}
+	blobs := map[string]string{
+		"config": "{}",
+	}
+	a := ocimem.New()
+	aContent := ocitest.NewRegistry(t, a).MustPushContent(ocitest.RegistryContent{
+		"shared": {
+			Blobs:     blobs,
+			Manifests: manifests("m1", "m2", "m3"),
+			Tags: map[string]string{
+				"same":      "m1",
+				"different": "m2",
+				"onlya":     "m3",
+			},
+		},
+		"onlya/repo": {
+			Blobs:     blobs,
+			Manifests: manifests("m1"),
+			Tags: map[string]string{
+				"latest": "m1",
+			},
+		},
+	})
+	b := ocimem.New()
+	bContent := ocitest.NewRegistry(t, b).MustPushContent(ocitest.RegistryContent{
+		"shared": {
+			Blobs:     blobs,
+			Manifests: manifests("m1", "m4", "m5"),
+			Tags: map[string]string{
+				"same":      "m1",
+				"different": "m4",
+				"onlyb":     "m5",
+			},
+		},
+		"onlyb/repo": {
+			Blobs:     blobs,
+			Manifests: manifests("m1"),
+			Tags: map[string]string{
+				"latest": "m1",
+			},
+		},
+	})
+	aDigest := func(repo, name string) ociregistry.Digest {
+		return aContent[repo].Manifests[name].Digest
+	}
+	bDigest := func(repo, name string) ociregistry.Digest {
+		return bContent[repo].Manifests[name].Digest
+	}
+
+	result, err := ociregistry.Diff(ctx, a, b, nil)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.IsFalse(result.IsEmpty()))
+	qt.Check(t, qt.DeepEquals(result, ociregistry.DiffResult{
+		OnlyInA: []ociregistry.TagDiff{{
+			Repo: "onlya/repo",
+			Tag:  "latest",
+			A:    aDigest("onlya/repo", "m1"),
+		}, {
+			Repo: "shared",
+			Tag:  "onlya",
+			A:    aDigest("shared", "m3"),
+		}},
+		OnlyInB: []ociregistry.TagDiff{{
+			Repo: "onlyb/repo",
+			Tag:  "latest",
+			B:    bDigest("onlyb/repo", "m1"),
+		}, {
+			Repo: "shared",
+			Tag:  "onlyb",
+			B:    bDigest("shared", "m5"),
+		}},
+		Divergent: []ociregistry.TagDiff{{
+			Repo: "shared",
+			Tag:  "different",
+			A:    aDigest("shared", "m2"),
+			B:    bDigest("shared", "m4"),
+		}},
+	}))
+
+	// Only the given repositories are compared.
+	result, err = ociregistry.Diff(ctx, a, b, []string{"onlya/repo"})
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.DeepEquals(result, ociregistry.DiffResult{
+		OnlyInA: []ociregistry.TagDiff{{
+			Repo: "onlya/repo",
+			Tag:  "latest",
+			A:    aDigest("onlya/repo", "m1"),
+		}},
+	}))
+
+	// The result is sorted even when the given repositories aren't,
+	// and repeated repositories are only compared once.
+	result, err = ociregistry.Diff(ctx, a, b, []string{"shared", "onlyb/repo", "onlya/repo", "shared"})
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.DeepEquals(result.OnlyInA, []ociregistry.TagDiff{{
+		Repo: "onlya/repo",
+		Tag:  "latest",
+		A:    aDigest("onlya/repo", "m1"),
+	}, {
+		Repo: "shared",
+		Tag:  "onlya",
+		A:    aDigest("shared", "m3"),
+	}}))
+	qt.Check(t, qt.HasLen(result.Divergent, 1))
+
+	// A registry has no differences from itself.
+	result, err = ociregistry.Diff(ctx, a, a, nil)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.IsTrue(result.IsEmpty()))
+
+	// A repository that's deleted after its tags have been
+	// listed is treated as having no tags.
+	deleted := &ociregistry.Funcs{
+		Repositories_: a.Repositories,
+		Tags_:         a.Tags,
+		ResolveTag_: func(ctx context.Context, repo string, tag string) (ociregistry.Descriptor, error) {
+			if repo == "onlya/repo" {
+				return ociregistry.Descriptor{}, ociregistry.ErrNameUnknown
+			}
+			return a.ResolveTag(ctx, repo, tag)
+		},
+	}
+	result, err = ociregistry.Diff(ctx, deleted, b, []string{"onlya/repo"})
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.IsTrue(result.IsEmpty()))
+}
@@ -30,6 +30,11 @@ var _ Interface = (*Funcs)(nil)
 // the corresponding method will return an iterator that returns no items and
 // returns ErrUnsupported from its Err method.
 //
+// The error is created by calling NewError if it's non-nil; otherwise it
+// wraps ErrUnsupported and mentions the name of the method.
+// This makes it straightforward to build a partial registry by setting
+// only the fields for the operations it supports.
+//
 // If Funcs is nil itself, all methods will behave as if the corresponding field was nil,
 // so (*ociregistry.Funcs)(nil) is a useful placeholder to implement Interface.
 //
@@ -133,10 +138,10 @@ func (f *Funcs) PushBlobChunked(ctx context.Context, repo string, chunkSize int)
 }
 
 func (f *Funcs) PushBlobChunkedResume(ctx context.Context, repo, id string, offset int64, chunkSize int) (BlobWriter, error) {
-	if f != nil && f.PushBlobChunked_ != nil {
+	if f != nil && f.PushBlobChunkedResume_ != nil {
 		return f.PushBlobChunkedResume_(ctx, repo, id, offset, chunkSize)
 	}
-	return nil, f.newError(ctx, "PushBlobChunked", repo)
+	return nil, f.newError(ctx, "PushBlobChunkedResume", repo)
 }
 
 func (f *Funcs) MountBlob(ctx context.Context, fromRepo, toRepo string, digest Digest) (Descriptor, error) {
@@ -0,0 +1,155 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociregistry_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/go-quicktest/qt"
+
+	"cuelabs.dev/go/oci/ociregistry"
+)
+
+const someDigest = "sha256:ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff"
+
+// funcsCalls holds a call to every method in ociregistry.Interface,
+// keyed by method name.
+var funcsCalls = map[string]func(ctx context.Context, r ociregistry.Interface) error{
+	"GetBlob": func(ctx context.Context, r ociregistry.Interface) error {
+		_, err := r.GetBlob(ctx, "foo", someDigest)
+		return err
+	},
+	"GetBlobRange": func(ctx context.Context, r ociregistry.Interface) error {
+		_, err := r.GetBlobRange(ctx, "foo", someDigest, 0, 1)
+		return err
+	},
+	"GetManifest": func(ctx context.Context, r ociregistry.Interface) error {
+		_, err := r.GetManifest(ctx, "foo", someDigest)
+		return err
+	},
+	"GetTag": func(ctx context.Context, r ociregistry.Interface) error {
+		_, err := r.GetTag(ctx, "foo", "latest")
+		return err
+	},
+	"ResolveBlob": func(ctx context.Context, r ociregistry.Interface) error {
+		_, err := r.ResolveBlob(ctx, "foo", someDigest)
+		return err
+	},
+	"ResolveManifest": func(ctx context.Context, r ociregistry.Interface) error {
+		_, err := r.ResolveManifest(ctx, "foo", someDigest)
+		return err
+	},
+	"ResolveTag": func(ctx context.Context, r ociregistry.Interface) error {
+		_, err := r.ResolveTag(ctx, "foo", "latest")
+		return err
+	},
+	"PushBlob": func(ctx context.Context, r ociregistry.Interface) error {
+		_, err := r.PushBlob(ctx, "foo", ociregistry.Descriptor{}, strings.NewReader(""))
+		return err
+	},
+	"PushBlobChunked": func(ctx context.Context, r ociregistry.Interface) error {
+		_, err := r.PushBlobChunked(ctx, "foo", 0)
+		return err
+	},
+	"PushBlobChunkedResume": func(ctx context.Context, r ociregistry.Interface) error {
+		_, err := r.PushBlobChunkedResume(ctx, "foo", "id", 0, 0)
+		return err
+	},
+	"MountBlob": func(ctx context.Context, r ociregistry.Interface) error {
+		_, err := r.MountBlob(ctx, "bar", "foo", someDigest)
+		return err
+	},
+	"PushManifest": func(ctx context.Context, r ociregistry.Interface) error {
+		_, err := r.PushManifest(ctx, "foo", "latest", nil, "")
+		return err
+	},
+	"DeleteBlob": func(ctx context.Context, r ociregistry.Interface) error {
+		return r.DeleteBlob(ctx, "foo", someDigest)
+	},
+	"DeleteManifest": func(ctx context.Context, r ociregistry.Interface) error {
+		return r.DeleteManifest(ctx, "foo", someDigest)
+	},
+	"DeleteTag": func(ctx context.Context, r ociregistry.Interface) error {
+		return r.DeleteTag(ctx, "foo", "latest")
+	},
+	"Repositories": func(ctx context.Context, r ociregistry.Interface) error {
+		_, err := ociregistry.All(r.Repositories(ctx, ""))
+		return err
+	},
+	"Tags": func(ctx context.Context, r ociregistry.Interface) error {
+		_, err := ociregistry.All(r.Tags(ctx, "foo", ""))
+		return err
+	},
+	"Referrers": func(ctx context.Context, r ociregistry.Interface) error {
+		_, err := ociregistry.All(r.Referrers(ctx, "foo", someDigest, ""))
+		return err
+	},
+}
+
+func TestFuncsPartial(t *testing.T) {
+	errImplemented := errors.New("implemented")
+	r := &ociregistry.Funcs{
+		GetBlob_: func(ctx context.Context, repo string, digest ociregistry.Digest) (ociregistry.BlobReader, error) {
+			return nil, errImplemented
+		},
+		PushBlobChunked_: func(ctx context.Context, repo string, chunkSize int) (ociregistry.BlobWriter, error) {
+			return nil, errImplemented
+		},
+		Tags_: func(ctx context.Context, repo string, startAfter string) ociregistry.Seq[string] {
+			return ociregistry.ErrorSeq[string](errImplemented)
+		},
+	}
+	ctx := context.Background()
+	for name, call := range funcsCalls {
+		t.Run(name, func(t *testing.T) {
+			err := call(ctx, r)
+			switch name {
+			case "GetBlob", "PushBlobChunked", "Tags":
+				qt.Assert(t, qt.ErrorIs(err, errImplemented))
+			default:
+				qt.Assert(t, qt.ErrorIs(err, ociregistry.ErrUnsupported))
+				qt.Assert(t, qt.ErrorMatches(err, name+`: .*`))
+			}
+		})
+	}
+}
+
+func TestFuncsNil(t *testing.T) {
+	ctx := context.Background()
+	for name, call := range funcsCalls {
+		t.Run(name, func(t *testing.T) {
+			err := call(ctx, (*ociregistry.Funcs)(nil))
+			qt.Assert(t, qt.ErrorIs(err, ociregistry.ErrUnsupported))
+		})
+	}
+}
+
+func TestFuncsNewError(t *testing.T) {
+	r := &ociregistry.Funcs{
+		NewError: func(ctx context.Context, methodName, repo string) error {
+			return errors.New(methodName + " in " + repo + " not available")
+		},
+	}
+	ctx := context.Background()
+	for name, call := range funcsCalls {
+		t.Run(name, func(t *testing.T) {
+			err := call(ctx, r)
+			qt.Assert(t, qt.ErrorMatches(err, name+` in (foo)? not available`))
+		})
+	}
+}
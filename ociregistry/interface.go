@@ -59,6 +59,7 @@ package ociregistry
 import (
 	"context"
 	"io"
+	"strings"
 
 	"cuelabs.dev/go/oci/ociregistry/ociref"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
@@ -230,6 +231,41 @@ type Lister interface {
 	Referrers(ctx context.Context, repo string, digest Digest, artifactType string) Seq[Descriptor]
 }
 
+// PrefixLister may optionally be implemented by a registry that
+// can efficiently list only the repositories under a given
+// namespace. See [RepositoriesWithPrefix].
+type PrefixLister interface {
+	// RepositoriesWithPrefix is like [Lister.Repositories] except
+	// that only repositories whose names start with prefix
+	// are included.
+	RepositoriesWithPrefix(ctx context.Context, prefix string, startAfter string) Seq[string]
+}
+
+// RepositoriesWithPrefix returns an iterator over the repositories
+// in r whose names start with prefix, in lexical order, starting
+// after startAfter if it's non-empty.
+//
+// If r implements [PrefixLister], its RepositoriesWithPrefix method
+// is used; otherwise the results of r.Repositories are filtered.
+func RepositoriesWithPrefix(ctx context.Context, r Interface, prefix string, startAfter string) Seq[string] {
+	if r, ok := r.(PrefixLister); ok {
+		return r.RepositoriesWithPrefix(ctx, prefix, startAfter)
+	}
+	return func(yield func(string, error) bool) {
+		r.Repositories(ctx, startAfter)(func(repo string, err error) bool {
+			if err != nil {
+				return yield("", err)
+			}
+			if strings.HasPrefix(repo, prefix) {
+				return yield(repo, nil)
+			}
+			// Repositories are in lexical order, so all the names with
+			// the prefix are adjacent: stop when we've gone past them.
+			return repo < prefix
+		})
+	}
+}
+
 // BlobWriter provides a handle for uploading a blob to a registry.
 type BlobWriter interface {
 	// Write writes more data to the blob. When resuming, the
@@ -270,5 +306,9 @@ type BlobWriter interface {
 type BlobReader interface {
 	io.ReadCloser
 	// Descriptor returns the descriptor for the blob.
+	//
+	// The Size field is -1 when the size of the content isn't
+	// known in advance, for example because a remote registry
+	// didn't report it. The content must still match the digest.
 	Descriptor() Descriptor
 }
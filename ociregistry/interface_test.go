@@ -0,0 +1,81 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociregistry
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/go-quicktest/qt"
+)
+
+func TestRepositoriesWithPrefixFallback(t *testing.T) {
+	ctx := context.Background()
+	var seen []string
+	r := &Funcs{
+		Repositories_: func(ctx context.Context, startAfter string) Seq[string] {
+			return func(yield func(string, error) bool) {
+				for _, repo := range []string{"a", "b/x", "b/y", "c", "d"} {
+					if repo <= startAfter {
+						continue
+					}
+					seen = append(seen, repo)
+					if !yield(repo, nil) {
+						return
+					}
+				}
+			}
+		},
+	}
+	repos, err := All(RepositoriesWithPrefix(ctx, r, "b/", ""))
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.DeepEquals(repos, []string{"b/x", "b/y"}))
+	// The iteration stops as soon as it's gone past the prefix.
+	qt.Assert(t, qt.DeepEquals(seen, []string{"a", "b/x", "b/y", "c"}))
+
+	repos, err = All(RepositoriesWithPrefix(ctx, r, "b/", "b/x"))
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.DeepEquals(repos, []string{"b/y"}))
+}
+
+func TestRepositoriesWithPrefixFallbackError(t *testing.T) {
+	r := &Funcs{
+		Repositories_: func(ctx context.Context, startAfter string) Seq[string] {
+			return ErrorSeq[string](fmt.Errorf("some error"))
+		},
+	}
+	_, err := All(RepositoriesWithPrefix(context.Background(), r, "b/", ""))
+	qt.Assert(t, qt.ErrorMatches(err, `some error`))
+}
+
+func TestRepositoriesWithPrefixUsesPrefixLister(t *testing.T) {
+	r := prefixLister{
+		Funcs: &Funcs{},
+		repos: []string{"b/only"},
+	}
+	repos, err := All(RepositoriesWithPrefix(context.Background(), r, "b/", ""))
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.DeepEquals(repos, []string{"b/only"}))
+}
+
+type prefixLister struct {
+	*Funcs
+	repos []string
+}
+
+func (r prefixLister) RepositoriesWithPrefix(ctx context.Context, prefix string, startAfter string) Seq[string] {
+	return SliceSeq(r.repos)
+}
@@ -64,8 +64,12 @@ func (req *Request) construct() (method string, url string) {
 		return "PATCH", req.uploadPath()
 	case ReqBlobCompleteUpload:
 		// Note: this is specific to the ociserver implementation.
-		// TODO this is bogus when the upload ID contains query parameters.
+		// The upload ID is encoded in the path, so any query
+		// parameters within it can't clash with the digest parameter.
 		return "PUT", req.uploadPath() + "?digest=" + req.Digest
+	case ReqBlobUploadCancel:
+		// Note: this is specific to the ociserver implementation.
+		return "DELETE", req.uploadPath()
 	case ReqManifestGet:
 		return "GET", "/v2/" + req.Repo + "/manifests/" + req.tagOrDigest()
 	case ReqManifestHead:
@@ -77,7 +81,7 @@ func (req *Request) construct() (method string, url string) {
 	case ReqTagsList:
 		return "GET", "/v2/" + req.Repo + "/tags/list" + req.listParams()
 	case ReqReferrersList:
-		return "GET", "/v2/" + req.Repo + "/referrers/" + req.Digest
+		return "GET", "/v2/" + req.Repo + "/referrers/" + req.Digest + req.referrersParams()
 	case ReqCatalogList:
 		return "GET", "/v2/_catalog" + req.listParams()
 	default:
@@ -85,6 +89,10 @@ func (req *Request) construct() (method string, url string) {
 	}
 }
 
+// uploadPath returns the path used for the upload with
+// ID req.UploadID. The ID is base64-encoded so that it's
+// preserved exactly, even when it's itself a URL holding query
+// parameters (as is the case for IDs returned by ociclient).
 func (req *Request) uploadPath() string {
 	return "/v2/" + req.Repo + "/blobs/uploads/" + base64.RawURLEncoding.EncodeToString([]byte(req.UploadID))
 }
@@ -103,6 +111,13 @@ func (req *Request) listParams() string {
 	return ""
 }
 
+func (req *Request) referrersParams() string {
+	if req.ArtifactType == "" {
+		return ""
+	}
+	return "?" + url.Values{"artifactType": {req.ArtifactType}}.Encode()
+}
+
 func (req *Request) tagOrDigest() string {
 	if req.Tag != "" {
 		return req.Tag
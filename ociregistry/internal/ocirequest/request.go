@@ -18,6 +18,7 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"math"
 	"net/url"
 	"strconv"
 	"strings"
@@ -65,6 +66,10 @@ type Request struct {
 	//	ReqBlobCompleteUpload
 	//	ReqReferrersList
 	//
+	// For ReqBlobStartUpload, it holds the digest from the mount query
+	// parameter when a mount was requested without a from parameter, and
+	// is empty otherwise.
+	//
 	// Valid for these manifest requests when they're referring to a digest
 	// rather than a tag:
 	//	ReqManifestGet
@@ -86,14 +91,19 @@ type Request struct {
 	FromRepo string
 
 	// UploadID holds the upload identifier as used for
-	// chunked uploads.
+	// chunked uploads. It's opaque and may hold any
+	// valid UTF-8, including a URL with query parameters.
 	// Valid for:
 	//	ReqBlobUploadInfo
 	//	ReqBlobUploadChunk
+	//	ReqBlobCompleteUpload
+	//	ReqBlobUploadCancel
 	UploadID string
 
 	// ListN holds the maximum count for listing.
 	// It's -1 to specify that all items should be returned.
+	// Zero (from an explicit n=0 query parameter) specifies
+	// that no items should be returned.
 	//
 	// Valid for:
 	//	ReqTagsList
@@ -109,6 +119,13 @@ type Request struct {
 	//	ReqCatalog
 	//	ReqReferrers
 	ListLast string
+
+	// ArtifactType holds the artifact type to filter
+	// referrers by, if any.
+	//
+	// Valid for:
+	//	ReqReferrersList
+	ArtifactType string
 }
 
 type Kind int
@@ -180,6 +197,12 @@ const (
 	// Catalog endpoints (out-of-spec)
 	// 	GET	/v2/_catalog
 	ReqCatalogList
+
+	// DELETE	/v2/<name>/blobs/uploads/<reference>	204	404
+	// NOTE: this is described in the distribution spec's
+	// list of endpoints but isn't really part of the OCI spec.
+	// It's last so that the values of the other kinds are unchanged.
+	ReqBlobUploadCancel
 )
 
 // Parse parses the given HTTP method and URL as an OCI registry request.
@@ -241,10 +264,10 @@ func parse(method string, u *url.URL) (*Request, error) {
 			rreq.FromRepo = urlq.Get("from")
 			if rreq.FromRepo == "" {
 				// There's no "from" argument so fall back to
-				// a regular chunked upload.
+				// a regular chunked upload. Keep the digest so that
+				// the server can avoid the upload when the blob
+				// is already present in the repository.
 				rreq.Kind = ReqBlobStartUpload
-				// TODO does the "mount" query argument actually take effect in some way?
-				rreq.Digest = ""
 				return &rreq, nil
 			}
 			if !ociref.IsValidRepository(rreq.FromRepo) {
@@ -324,6 +347,8 @@ func parse(method string, u *url.URL) (*Request, error) {
 			rreq.Kind = ReqBlobUploadInfo
 		case "PATCH":
 			rreq.Kind = ReqBlobUploadChunk
+		case "DELETE":
+			rreq.Kind = ReqBlobUploadCancel
 		case "PUT":
 			rreq.Kind = ReqBlobCompleteUpload
 			rreq.Digest = urlq.Get("digest")
@@ -392,6 +417,7 @@ func parse(method string, u *url.URL) (*Request, error) {
 		// We'll set ListN to be future-proof.
 		rreq.ListN = -1
 		rreq.Digest = last
+		rreq.ArtifactType = urlq.Get("artifactType")
 		rreq.Kind = ReqReferrersList
 		return &rreq, nil
 	}
@@ -418,20 +444,87 @@ func cutLast(s, sep string) (before, after string, found bool) {
 	return "", s, false
 }
 
-// ParseRange extracts the start and end offsets from a Content-Range string.
+// ErrRangeValue is returned by [ParseRangeErr] when a range
+// is well formed but its offsets are out of bounds.
+var ErrRangeValue = errors.New("range offsets out of bounds")
+
+// ParseRange extracts the start and end offsets from a Content-Range
+// or upload status Range string.
 // The resulting start is inclusive and the end exclusive, to match Go convention,
-// whereas Content-Range is inclusive on both ends.
+// whereas the header values are inclusive on both ends.
+//
+// An optional "bytes=" or "bytes " prefix is allowed, because
+// some servers include one. The range "0-0" is treated as empty
+// rather than holding a single byte: that's what registries
+// conventionally return for an upload with no content yet,
+// and it's what [RangeString] produces for an empty range.
+// Similarly, an end one less than a non-zero start, as produced by
+// RangeString for an empty range at that offset, is treated as empty.
+// ParseRange reports false if either offset is not a non-negative
+// integer, if the end precedes the start by more than one,
+// or if the exclusive end offset can't be represented as an int64.
 func ParseRange(s string) (start, end int64, ok bool) {
-	p0s, p1s, ok := strings.Cut(s, "-")
-	if !ok {
-		return 0, 0, false
+	start, end, err := ParseRangeErr(s)
+	return start, end, err == nil
+}
+
+// ParseRangeErr is like [ParseRange] but returns an error describing
+// why the range is invalid. The error wraps [ErrRangeValue] when
+// s has the form of a range but an offset is negative or too large,
+// or the end precedes the start.
+func ParseRangeErr(s string) (start, end int64, err error) {
+	s = strings.TrimPrefix(s, "bytes=")
+	s = strings.TrimPrefix(s, "bytes ")
+	// Find the separator, allowing for a minus sign
+	// on the start offset.
+	i := strings.Index(s, "-")
+	if i == 0 {
+		if j := strings.Index(s[1:], "-"); j >= 0 {
+			i = j + 1
+		} else {
+			i = -1
+		}
+	}
+	if i < 0 {
+		return 0, 0, fmt.Errorf("invalid range %q: no separator", s)
+	}
+	p0, err := parseOffset(s[:i])
+	if err != nil {
+		return 0, 0, err
+	}
+	p1, err := parseOffset(s[i+1:])
+	if err != nil {
+		return 0, 0, err
+	}
+	switch {
+	case p1 < p0-1:
+		return 0, 0, fmt.Errorf("%w: end %d precedes start %d", ErrRangeValue, p1, p0)
+	case p1 == math.MaxInt64:
+		return 0, 0, fmt.Errorf("%w: end %d is too large", ErrRangeValue, p1)
+	}
+	if p0 == 0 && p1 == 0 {
+		return 0, 0, nil
+	}
+	return p0, p1 + 1, nil
+}
+
+func parseOffset(s string) (int64, error) {
+	digits := strings.TrimPrefix(s, "-")
+	if digits == "" || digits[0] < '0' || digits[0] > '9' {
+		// Avoid accepting a plus sign, which ParseInt allows.
+		return 0, fmt.Errorf("invalid offset %q", s)
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		if errors.Is(err, strconv.ErrRange) {
+			return 0, fmt.Errorf("%w: offset %s is too large", ErrRangeValue, s)
+		}
+		return 0, fmt.Errorf("invalid offset %q", s)
 	}
-	p0, err0 := strconv.ParseInt(p0s, 10, 64)
-	p1, err1 := strconv.ParseInt(p1s, 10, 64)
-	if p1 > 0 {
-		p1++
+	if n < 0 {
+		return 0, fmt.Errorf("%w: offset %d is negative", ErrRangeValue, n)
 	}
-	return p0, p1, err0 == nil && err1 == nil
+	return n, nil
 }
 
 // RangeString formats a pair of start and end offsets in the Content-Range form.
@@ -15,6 +15,8 @@
 package ocirequest
 
 import (
+	"errors"
+	"math"
 	"net/url"
 	"testing"
 
@@ -103,6 +105,43 @@ var parseRequestTests = []struct {
 		Repo:     "myorg/myrepo",
 		UploadID: "blahblah",
 	},
+}, {
+	testName: "cancelUpload",
+	method:   "DELETE",
+	url:      "/v2/myorg/myrepo/blobs/uploads/YmxhaGJsYWg",
+	wantRequest: &Request{
+		Kind:     ReqBlobUploadCancel,
+		Repo:     "myorg/myrepo",
+		UploadID: "blahblah",
+	},
+}, {
+	testName: "uploadChunkWithQueryInUploadID",
+	method:   "PATCH",
+	url:      "/v2/myorg/myrepo/blobs/uploads/aHR0cHM6Ly9yZWdpc3RyeS5leGFtcGxlL3YyL2Zvby9ibG9icy91cGxvYWRzL2FiYz9wYXJhbT14Jl9zdGF0ZT15JTJGeg",
+	wantRequest: &Request{
+		Kind:     ReqBlobUploadChunk,
+		Repo:     "myorg/myrepo",
+		UploadID: "https://registry.example/v2/foo/blobs/uploads/abc?param=x&_state=y%2Fz",
+	},
+}, {
+	testName: "getUploadInfoWithQueryInUploadID",
+	method:   "GET",
+	url:      "/v2/myorg/myrepo/blobs/uploads/aHR0cHM6Ly9yZWdpc3RyeS5leGFtcGxlL3YyL2Zvby9ibG9icy91cGxvYWRzL2FiYz9wYXJhbT14Jl9zdGF0ZT15JTJGeg",
+	wantRequest: &Request{
+		Kind:     ReqBlobUploadInfo,
+		Repo:     "myorg/myrepo",
+		UploadID: "https://registry.example/v2/foo/blobs/uploads/abc?param=x&_state=y%2Fz",
+	},
+}, {
+	testName: "completeUploadWithQueryInUploadID",
+	method:   "PUT",
+	url:      "/v2/myorg/myrepo/blobs/uploads/aHR0cHM6Ly9yZWdpc3RyeS5leGFtcGxlL3YyL2Zvby9ibG9icy91cGxvYWRzL2FiYz9wYXJhbT14Jl9zdGF0ZT15JTJGeg?digest=sha256:c659529df24a1878f6df8d93c652280235a50b95e862d8e5cb566ee5b9ed6386",
+	wantRequest: &Request{
+		Kind:     ReqBlobCompleteUpload,
+		Repo:     "myorg/myrepo",
+		UploadID: "https://registry.example/v2/foo/blobs/uploads/abc?param=x&_state=y%2Fz",
+		Digest:   "sha256:c659529df24a1878f6df8d93c652280235a50b95e862d8e5cb566ee5b9ed6386",
+	},
 }, {
 	testName: "mount",
 	method:   "POST",
@@ -128,10 +167,32 @@ var parseRequestTests = []struct {
 	method:   "POST",
 	url:      "/v2/x/y/blobs/uploads/?mount=sha256:c659529df24a1878f6df8d93c652280235a50b95e862d8e5cb566ee5b9ed6386",
 	wantRequest: &Request{
-		Kind: ReqBlobStartUpload,
-		Repo: "x/y",
+		Kind:   ReqBlobStartUpload,
+		Repo:   "x/y",
+		Digest: "sha256:c659529df24a1878f6df8d93c652280235a50b95e862d8e5cb566ee5b9ed6386",
 	},
 	wantConstruct: "/v2/x/y/blobs/uploads/",
+}, {
+	testName: "referrers",
+	method:   "GET",
+	url:      "/v2/foo/referrers/sha256:681aef2367e055f33cb8a6ab9c3090931f6eefd0c3ef15c6e4a79bdadfdb8982",
+	wantRequest: &Request{
+		Kind:   ReqReferrersList,
+		Repo:   "foo",
+		Digest: "sha256:681aef2367e055f33cb8a6ab9c3090931f6eefd0c3ef15c6e4a79bdadfdb8982",
+		ListN:  -1,
+	},
+}, {
+	testName: "referrersWithArtifactType",
+	method:   "GET",
+	url:      "/v2/foo/referrers/sha256:681aef2367e055f33cb8a6ab9c3090931f6eefd0c3ef15c6e4a79bdadfdb8982?artifactType=application%2Fvnd.example%2Bjson",
+	wantRequest: &Request{
+		Kind:         ReqReferrersList,
+		Repo:         "foo",
+		Digest:       "sha256:681aef2367e055f33cb8a6ab9c3090931f6eefd0c3ef15c6e4a79bdadfdb8982",
+		ListN:        -1,
+		ArtifactType: "application/vnd.example+json",
+	},
 }, {
 	testName: "manifestHead",
 	method:   "HEAD",
@@ -181,3 +242,112 @@ func canonURL(ustr string) string {
 	u.RawQuery = qv.Encode()
 	return u.String()
 }
+
+var parseRangeTests = []struct {
+	s         string
+	wantStart int64
+	wantEnd   int64
+	wantOK    bool
+	// wantValueErr holds whether ParseRangeErr
+	// should return an ErrRangeValue error.
+	wantValueErr bool
+}{{
+	s:      "0-0",
+	wantOK: true,
+}, {
+	s:       "0-1",
+	wantEnd: 2,
+	wantOK:  true,
+}, {
+	s:       "0-99",
+	wantEnd: 100,
+	wantOK:  true,
+}, {
+	s:         "100-199",
+	wantStart: 100,
+	wantEnd:   200,
+	wantOK:    true,
+}, {
+	s:         "5-5",
+	wantStart: 5,
+	wantEnd:   6,
+	wantOK:    true,
+}, {
+	s:       "bytes=0-99",
+	wantEnd: 100,
+	wantOK:  true,
+}, {
+	s:       "bytes 0-99",
+	wantEnd: 100,
+	wantOK:  true,
+}, {
+	s: "",
+}, {
+	s: "0",
+}, {
+	s: "0-",
+}, {
+	s: "-5",
+}, {
+	s:            "0--1",
+	wantValueErr: true,
+}, {
+	s:            "-1-5",
+	wantValueErr: true,
+}, {
+	s: "--5",
+}, {
+	s: "+1-5",
+}, {
+	s:         "10-9",
+	wantStart: 10,
+	wantEnd:   10,
+	wantOK:    true,
+}, {
+	s:            "10-8",
+	wantValueErr: true,
+}, {
+	s: "a-b",
+}, {
+	s: "0-bar",
+}, {
+	s:         "9223372036854775806-9223372036854775806",
+	wantStart: math.MaxInt64 - 1,
+	wantEnd:   math.MaxInt64,
+	wantOK:    true,
+}, {
+	s:            "0-9223372036854775807",
+	wantValueErr: true,
+}, {
+	s:            "0-9223372036854775808",
+	wantValueErr: true,
+}, {
+	s:            "9223372036854775808-9223372036854775809",
+	wantValueErr: true,
+}}
+
+func TestParseRange(t *testing.T) {
+	for _, test := range parseRangeTests {
+		t.Run(test.s, func(t *testing.T) {
+			start, end, ok := ParseRange(test.s)
+			qt.Assert(t, qt.Equals(ok, test.wantOK))
+			_, _, err := ParseRangeErr(test.s)
+			qt.Assert(t, qt.Equals(err == nil, test.wantOK))
+			if !ok {
+				qt.Check(t, qt.Equals(errors.Is(err, ErrRangeValue), test.wantValueErr), qt.Commentf("error: %v", err))
+				return
+			}
+			qt.Check(t, qt.Equals(start, test.wantStart))
+			qt.Check(t, qt.Equals(end, test.wantEnd))
+		})
+	}
+}
+
+func TestRangeStringRoundTrip(t *testing.T) {
+	for _, r := range [][2]int64{{0, 0}, {0, 2}, {0, 100}, {100, 200}, {5, 6}, {10, 10}} {
+		start, end, ok := ParseRange(RangeString(r[0], r[1]))
+		qt.Assert(t, qt.IsTrue(ok))
+		qt.Check(t, qt.Equals(start, r[0]))
+		qt.Check(t, qt.Equals(end, r[1]))
+	}
+}
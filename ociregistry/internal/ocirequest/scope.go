@@ -0,0 +1,69 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocirequest
+
+import (
+	"fmt"
+
+	"cuelabs.dev/go/oci/ociregistry/ociauth"
+)
+
+// RequiredScope returns the auth scope that's required
+// to make the request.
+func (r *Request) RequiredScope() ociauth.Scope {
+	switch r.Kind {
+	case ReqPing:
+		return ociauth.Scope{}
+	case ReqBlobGet,
+		ReqBlobHead,
+		ReqManifestGet,
+		ReqManifestHead,
+		ReqTagsList,
+		ReqReferrersList:
+		return ociauth.NewScope(ociauth.ResourceScope{
+			ResourceType: ociauth.TypeRepository,
+			Resource:     r.Repo,
+			Action:       ociauth.ActionPull,
+		})
+	case ReqBlobDelete,
+		ReqBlobStartUpload,
+		ReqBlobUploadBlob,
+		ReqBlobUploadInfo,
+		ReqBlobUploadChunk,
+		ReqBlobCompleteUpload,
+		ReqBlobUploadCancel,
+		ReqManifestPut,
+		ReqManifestDelete:
+		return ociauth.NewScope(ociauth.ResourceScope{
+			ResourceType: ociauth.TypeRepository,
+			Resource:     r.Repo,
+			Action:       ociauth.ActionPush,
+		})
+	case ReqBlobMount:
+		return ociauth.NewScope(ociauth.ResourceScope{
+			ResourceType: ociauth.TypeRepository,
+			Resource:     r.Repo,
+			Action:       ociauth.ActionPush,
+		}, ociauth.ResourceScope{
+			ResourceType: ociauth.TypeRepository,
+			Resource:     r.FromRepo,
+			Action:       ociauth.ActionPull,
+		})
+	case ReqCatalogList:
+		return ociauth.NewScope(ociauth.CatalogScope)
+	default:
+		panic(fmt.Errorf("unexpected request kind %v", r.Kind))
+	}
+}
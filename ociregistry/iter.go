@@ -14,6 +14,8 @@
 
 package ociregistry
 
+import "context"
+
 // TODO(go1.23) when we can depend on Go 1.23, this should be:
 // type Seq[T any] = iter.Seq2[T, error]
 
@@ -36,6 +38,39 @@ func All[T any](it Seq[T]) (_ []T, _err error) {
 	return xs, _err
 }
 
+// CollectAll is like [All] except that it stops and returns
+// ctx.Err() if the context is done before the iterator
+// has finished.
+func CollectAll[T any](ctx context.Context, it Seq[T]) ([]T, error) {
+	return CollectN(ctx, it, -1)
+}
+
+// CollectN returns at most n items from the iterator, stopping
+// the iteration early when it has them. If n is negative, it
+// returns all the items. It returns the first error from the
+// iterator, or ctx.Err() if the context is done before it has
+// finished, along with the items collected so far.
+func CollectN[T any](ctx context.Context, it Seq[T], n int) (_ []T, _err error) {
+	xs := []T{}
+	if n == 0 {
+		return xs, ctx.Err()
+	}
+	// TODO(go1.23) for x, err := range it
+	it(func(x T, err error) bool {
+		if err != nil {
+			_err = err
+			return false
+		}
+		if err := ctx.Err(); err != nil {
+			_err = err
+			return false
+		}
+		xs = append(xs, x)
+		return n < 0 || len(xs) < n
+	})
+	return xs, _err
+}
+
 func SliceSeq[T any](xs []T) Seq[T] {
 	return func(yield func(T, error) bool) {
 		for _, x := range xs {
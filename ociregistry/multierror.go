@@ -0,0 +1,110 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociregistry
+
+import (
+	"strings"
+)
+
+// MultiError aggregates the errors from a batch operation
+// that acts on several items, such as copying or deleting
+// many manifests, so that partial failure can be reported.
+//
+// The zero value is ready to use.
+type MultiError struct {
+	Errors []*ItemError
+}
+
+// ItemError holds the error for a single item
+// in a batch operation.
+type ItemError struct {
+	// Repo holds the repository of the item.
+	Repo string
+
+	// Digest holds the digest of the item. It may
+	// be empty when the error pertains to the repository
+	// as a whole.
+	Digest Digest
+
+	// Err holds the underlying error.
+	Err error
+}
+
+// Unwrap returns the underlying error.
+func (e *ItemError) Unwrap() error {
+	return e.Err
+}
+
+func (e *ItemError) Error() string {
+	var buf strings.Builder
+	buf.WriteString(e.Repo)
+	if e.Digest != "" {
+		buf.WriteString("@")
+		buf.WriteString(string(e.Digest))
+	}
+	buf.WriteString(": ")
+	buf.WriteString(e.Err.Error())
+	return buf.String()
+}
+
+// Add adds an error for the item with the given repository and digest.
+// It does nothing if err is nil.
+func (e *MultiError) Add(repo string, digest Digest, err error) {
+	if err == nil {
+		return
+	}
+	e.Errors = append(e.Errors, &ItemError{
+		Repo:   repo,
+		Digest: digest,
+		Err:    err,
+	})
+}
+
+// Err returns e if it holds any errors, or nil otherwise.
+// This makes it convenient to return a MultiError from
+// a function without returning a non-nil error when
+// nothing has failed.
+func (e *MultiError) Err() error {
+	if len(e.Errors) == 0 {
+		return nil
+	}
+	return e
+}
+
+// Unwrap allows [errors.Is] and [errors.As] to
+// see the errors inside e.
+func (e *MultiError) Unwrap() []error {
+	errs := make([]error, len(e.Errors))
+	for i, err := range e.Errors {
+		errs[i] = err
+	}
+	return errs
+}
+
+func (e *MultiError) Error() string {
+	switch len(e.Errors) {
+	case 0:
+		return "no errors"
+	case 1:
+		return e.Errors[0].Error()
+	}
+	var buf strings.Builder
+	buf.WriteString(e.Errors[0].Error())
+	for _, err := range e.Errors[1:] {
+		buf.WriteString("; ")
+		buf.WriteString(err.Error())
+	}
+	return buf.String()
+}
@@ -0,0 +1,52 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociregistry
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/go-quicktest/qt"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestMultiError(t *testing.T) {
+	var merr MultiError
+	qt.Assert(t, qt.IsNil(merr.Err()))
+	merr.Add("foo", "", nil)
+	qt.Assert(t, qt.IsNil(merr.Err()))
+
+	dig := digest.FromString("x")
+	merr.Add("foo", dig, fmt.Errorf("cannot copy: %w", ErrBlobUnknown))
+	merr.Add("bar", "", NewHTTPError(ErrDenied, http.StatusForbidden, nil, nil))
+	err := merr.Err()
+	qt.Assert(t, qt.IsNotNil(err))
+	qt.Check(t, qt.ErrorMatches(err, `foo@`+string(dig)+`: cannot copy: blob unknown: blob unknown to registry; bar: 403 Forbidden: denied: requested access to the resource is denied`))
+
+	qt.Check(t, qt.ErrorIs(err, ErrBlobUnknown))
+	qt.Check(t, qt.ErrorIs(err, ErrDenied))
+	qt.Check(t, qt.IsFalse(errors.Is(err, ErrManifestUnknown)))
+
+	var herr HTTPError
+	qt.Assert(t, qt.ErrorAs(err, &herr))
+	qt.Check(t, qt.Equals(herr.StatusCode(), http.StatusForbidden))
+
+	var itemErr *ItemError
+	qt.Assert(t, qt.ErrorAs(err, &itemErr))
+	qt.Check(t, qt.Equals(itemErr.Repo, "foo"))
+	qt.Check(t, qt.Equals(itemErr.Digest, dig))
+}
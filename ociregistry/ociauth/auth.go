@@ -17,8 +17,20 @@ import (
 	"cuelabs.dev/go/oci/ociregistry"
 )
 
+// defaultMaxAccessTokens holds the maximum number of access
+// tokens retained for each registry when
+// StdTransportParams.MaxAccessTokens is zero.
+const defaultMaxAccessTokens = 100
+
+// defaultOAuthClientID holds the client_id sent to the
+// token server when StdTransportParams.ClientID is empty.
 // TODO decide on a good value for this.
-const oauthClientID = "cuelabs-ociauth"
+const defaultOAuthClientID = "cuelabs-ociauth"
+
+// defaultSchemePriority holds the authentication schemes to respond
+// to, most preferred first, when StdTransportParams.SchemePriority
+// is nil.
+var defaultSchemePriority = []string{"basic", "bearer"}
 
 var ErrNoAuth = fmt.Errorf("no authorization token available to add to request")
 
@@ -29,10 +41,16 @@ var ErrNoAuth = fmt.Errorf("no authorization token available to add to request")
 //
 // See https://distribution.github.io/distribution/spec/auth/token/ for an overview.
 type stdTransport struct {
-	config     Config
-	transport  http.RoundTripper
-	mu         sync.Mutex
-	registries map[string]*registry
+	config        Config
+	transport     http.RoundTripper
+	refreshMargin time.Duration
+	clientID      string
+	inspectToken  func(token string) (Scope, bool)
+	tokenAuth     func(req *http.Request) error
+	maxTokens     int
+	schemes       []string
+	mu            sync.Mutex
+	registries    map[string]*registry
 }
 
 type StdTransportParams struct {
@@ -44,6 +62,70 @@ type StdTransportParams struct {
 	// HTTPClient is used to make the underlying HTTP requests.
 	// If it's nil, [http.DefaultTransport] will be used.
 	Transport http.RoundTripper
+
+	// RefreshMargin, if positive, enables background token refresh:
+	// when an access token that expires within RefreshMargin is
+	// used for a request, a new token is acquired asynchronously
+	// so that later requests can use it without waiting for the
+	// token server. The request itself proceeds with the existing
+	// token. At most one refresh is in flight for any given scope.
+	RefreshMargin time.Duration
+
+	// ClientID holds the OAuth client_id sent to the token server
+	// when using a refresh token to acquire an access token.
+	// If it's empty, a default value will be used.
+	ClientID string
+
+	// InspectToken, if non-nil, is called with each access token
+	// acquired from a token server. If it returns true, the returned
+	// scope is recorded as the scope actually granted by the token,
+	// replacing the scope that was requested, so the token will not
+	// be reused for operations that it does not cover. If it returns
+	// false, the token is treated as opaque.
+	//
+	// [JWTScope] can be used to inspect tokens that are JWTs
+	// holding an "access" claim.
+	InspectToken func(token string) (granted Scope, ok bool)
+
+	// MaxAccessTokens holds the maximum number of access tokens
+	// retained for any given registry. Each distinct scope can
+	// require a new token, so without a limit a long-running
+	// process that accesses many repositories would retain
+	// tokens indefinitely. When the limit is exceeded, the least
+	// recently used tokens are discarded, and will be acquired
+	// again if needed. Tokens taken from the Config are
+	// always retained, as they can't be acquired again.
+	//
+	// If it's zero, a default limit of 100 is used.
+	// If it's negative, there is no limit.
+	MaxAccessTokens int
+
+	// TokenEndpointAuth, if non-nil, is called to add authorization
+	// to each request made to a token server (the realm in a
+	// registry's Www-Authenticate challenge). It's called after the
+	// usual credentials from Config have been added, so it can add
+	// headers or replace those credentials. If it returns an error,
+	// the token request fails with that error.
+	//
+	// This is for environments where the token server sits behind
+	// a proxy or gateway that requires authorization of its own,
+	// separate from the registry credentials: for example an
+	// API key header or a Proxy-Authorization header. Requests
+	// to the registry itself are not affected.
+	TokenEndpointAuth func(req *http.Request) error
+
+	// SchemePriority holds the authentication schemes that
+	// the transport will respond to, most preferred first,
+	// for example []string{"bearer", "basic"}. When a 401 response
+	// offers challenges for more than one scheme, the one
+	// that comes first in this list is used. Challenges for schemes
+	// that aren't in the list are ignored, so leaving out "basic"
+	// ensures that credentials are never sent using basic
+	// authentication in response to a registry's challenge.
+	//
+	// The supported schemes are "basic" and "bearer"; case is not
+	// significant. If it's nil, []string{"basic", "bearer"} is used.
+	SchemePriority []string
 }
 
 // NewStdTransport returns an [http.RoundTripper] implementation that
@@ -63,6 +145,10 @@ type StdTransportParams struct {
 // with the request context (see [ContextWithRequestInfo]). Any other
 // auth scope inside the context (see [ContextWithScope]) may also be
 // taken into account when acquiring new tokens.
+//
+// A request whose context holds a bearer token for its host
+// and scope (see [ContextWithBearerToken]) is sent with that
+// token and no further processing.
 func NewStdTransport(p StdTransportParams) http.RoundTripper {
 	if p.Config == nil {
 		p.Config = emptyConfig{}
@@ -70,20 +156,52 @@ func NewStdTransport(p StdTransportParams) http.RoundTripper {
 	if p.Transport == nil {
 		p.Transport = http.DefaultTransport
 	}
+	if p.ClientID == "" {
+		p.ClientID = defaultOAuthClientID
+	}
+	if p.MaxAccessTokens == 0 {
+		p.MaxAccessTokens = defaultMaxAccessTokens
+	}
+	schemes := defaultSchemePriority
+	if p.SchemePriority != nil {
+		schemes = make([]string, len(p.SchemePriority))
+		for i, scheme := range p.SchemePriority {
+			schemes[i] = strings.ToLower(scheme)
+		}
+	}
 	return &stdTransport{
-		config:     p.Config,
-		transport:  p.Transport,
-		registries: make(map[string]*registry),
+		config:        p.Config,
+		transport:     p.Transport,
+		refreshMargin: p.RefreshMargin,
+		clientID:      p.ClientID,
+		inspectToken:  p.InspectToken,
+		tokenAuth:     p.TokenEndpointAuth,
+		maxTokens:     p.MaxAccessTokens,
+		schemes:       schemes,
+		registries:    make(map[string]*registry),
 	}
 }
 
 // registry holds currently known auth information for a registry.
 type registry struct {
-	host      string
-	transport http.RoundTripper
-	config    Config
-	initOnce  sync.Once
-	initErr   error
+	host          string
+	transport     http.RoundTripper
+	config        Config
+	refreshMargin time.Duration
+	clientID      string
+	inspectToken  func(token string) (Scope, bool)
+	tokenAuth     func(req *http.Request) error
+	maxTokens     int // maximum size of accessTokens; no limit if <= 0.
+
+	// initMu guards the init fields that follow it.
+	initMu sync.Mutex
+	// initDone is non-nil when init is in progress or has
+	// completed. It's closed when init completes.
+	initDone chan struct{}
+	// initialized records that init has completed
+	// with the result held in initErr.
+	initialized bool
+	initErr     error
 
 	// mu guards the fields that follow it.
 	mu sync.Mutex
@@ -94,9 +212,20 @@ type registry struct {
 	// but hold a zero authHeader.
 	wwwAuthenticate *authHeader
 
+	// accessTokens holds the currently known access tokens,
+	// least recently used first.
 	accessTokens []*scopedToken
 	refreshToken string
 	basic        *userPass
+
+	// refreshing holds the scopes (in canonical string form)
+	// for which a background token refresh is in progress.
+	refreshing map[string]bool
+
+	// picky records that the token server has rejected a request
+	// for more scope than was required, so only the required
+	// scope should be requested.
+	picky bool
 }
 
 type scopedToken struct {
@@ -115,6 +244,27 @@ type userPass struct {
 
 var forever = time.Date(99999, time.January, 1, 0, 0, 0, 0, time.UTC)
 
+// timeNow returns the current time.
+// It's defined as a variable so it can be patched in tests.
+var timeNow = time.Now
+
+// CallsRequestHook reports whether t is a transport created by
+// [NewStdTransport], which calls any function added to the
+// request context by [ContextWithRequestHook].
+func CallsRequestHook(t http.RoundTripper) bool {
+	_, ok := t.(*stdTransport)
+	return ok
+}
+
+// send calls any request hook in the context of req and
+// then sends req with t.
+func send(t http.RoundTripper, req *http.Request) (*http.Response, error) {
+	if hook := RequestHookFromContext(req.Context()); hook != nil {
+		hook(req)
+	}
+	return t.RoundTrip(req)
+}
+
 // RoundTrip implements [http.RoundTripper.RoundTrip].
 func (a *stdTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 	// From the [http.RoundTripper] docs:
@@ -131,29 +281,47 @@ func (a *stdTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 		}
 	}()
 
+	if req.URL.Scheme != "https" && SecureAuthOnlyFromContext(req.Context()) {
+		// Don't risk exposing credentials over an insecure connection.
+		needBodyClose = false
+		return send(a.transport, req)
+	}
+	if tok := bearerTokenForRequest(req); tok != "" {
+		// The caller has supplied the token to use, so
+		// there's nothing more for us to do.
+		req.Header.Set("Authorization", "Bearer "+tok)
+		needBodyClose = false
+		return send(a.transport, req)
+	}
+
 	a.mu.Lock()
 	r := a.registries[req.URL.Host]
 	if r == nil {
 		r = &registry{
-			host:      req.URL.Host,
-			config:    a.config,
-			transport: a.transport,
+			host:          req.URL.Host,
+			config:        a.config,
+			transport:     a.transport,
+			refreshMargin: a.refreshMargin,
+			clientID:      a.clientID,
+			inspectToken:  a.inspectToken,
+			tokenAuth:     a.tokenAuth,
+			maxTokens:     a.maxTokens,
 		}
 		a.registries[r.host] = r
 	}
 	a.mu.Unlock()
-	if err := r.init(); err != nil {
-		return nil, err
-	}
 
 	ctx := req.Context()
+	if err := r.init(ctx); err != nil {
+		return nil, err
+	}
 	requiredScope := RequestInfoFromContext(ctx).RequiredScope
 	wantScope := ScopeFromContext(ctx)
 
 	if err := r.setAuthorization(ctx, req, requiredScope, wantScope); err != nil {
 		return nil, err
 	}
-	resp, err := r.transport.RoundTrip(req)
+	resp, err := send(r.transport, req)
 
 	// The underlying transport should now have closed the request body
 	// so we don't have to.
@@ -164,7 +332,7 @@ func (a *stdTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 	if resp.StatusCode != http.StatusUnauthorized {
 		return resp, nil
 	}
-	challenge := challengeFromResponse(resp)
+	challenge := challengeFromResponse(resp, a.schemes)
 	if challenge == nil {
 		return resp, nil
 	}
@@ -185,7 +353,7 @@ func (a *stdTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 			return nil, err
 		}
 	}
-	resp, err = r.transport.RoundTrip(req)
+	resp, err = send(r.transport, req)
 	if err != nil {
 		return nil, err
 	}
@@ -221,11 +389,13 @@ func (r *registry) setAuthorization(ctx context.Context, req *http.Request, requ
 	// Remove tokens that have expired or will expire soon so that
 	// the caller doesn't start using a token only for it to expire while it's
 	// making the request.
-	r.deleteExpiredTokens(time.Now().UTC().Add(time.Second))
+	now := timeNow().UTC()
+	r.deleteExpiredTokens(now.Add(time.Second))
 
 	if accessToken := r.accessTokenForScope(requiredScope); accessToken != nil {
 		// We have a potentially valid access token. Use it.
 		req.Header.Set("Authorization", "Bearer "+accessToken.token)
+		r.maybeRefreshInBackground(ctx, accessToken, now)
 		return nil
 	}
 	if r.wwwAuthenticate == nil {
@@ -246,6 +416,9 @@ func (r *registry) setAuthorization(ctx context.Context, req *http.Request, requ
 
 		accessToken, err := r.acquireAccessToken(ctx, requiredScope, wantScope)
 		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return fmt.Errorf("cannot acquire access token: %w", ctxErr)
+			}
 			// Avoid using %w to wrap the error because we don't want the
 			// caller of RoundTrip (usually ociclient) to assume that the
 			// error applies to the target server rather than the token server.
@@ -282,38 +455,150 @@ func (r *registry) setAuthorizationFromChallenge(ctx context.Context, req *http.
 	return false, false, nil
 }
 
+// maybeRefreshInBackground starts acquiring a replacement for tok
+// if background refresh is enabled and tok will expire within the
+// refresh margin. When the new token arrives, it replaces tok.
+//
+// It must be called with r.mu held.
+func (r *registry) maybeRefreshInBackground(ctx context.Context, tok *scopedToken, now time.Time) {
+	if r.refreshMargin <= 0 || tok.expires.Sub(now) > r.refreshMargin {
+		return
+	}
+	if r.wwwAuthenticate == nil || r.wwwAuthenticate.scheme != "bearer" {
+		// We don't know how to acquire a new token.
+		return
+	}
+	key := tok.scope.Canonical().String()
+	if r.refreshing[key] {
+		return
+	}
+	if r.refreshing == nil {
+		r.refreshing = make(map[string]bool)
+	}
+	r.refreshing[key] = true
+
+	// Acquire the token using a copy of the auth information so that
+	// we don't hold r.mu while talking to the token server.
+	r1 := &registry{
+		host:            r.host,
+		transport:       r.transport,
+		config:          r.config,
+		clientID:        r.clientID,
+		inspectToken:    r.inspectToken,
+		tokenAuth:       r.tokenAuth,
+		wwwAuthenticate: r.wwwAuthenticate,
+		refreshToken:    r.refreshToken,
+		basic:           r.basic,
+		picky:           r.picky,
+	}
+	tok0RefreshToken := r.refreshToken
+	// The refresh should not be cut short when the request that
+	// triggered it completes.
+	ctx = context.WithoutCancel(ctx)
+	go func() {
+		_, err := r1.acquireAccessToken(ctx, tok.scope, Scope{})
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		delete(r.refreshing, key)
+		if err != nil {
+			// Continue to use the existing token; when it
+			// expires, a new one will be acquired in the usual way.
+			return
+		}
+		if r1.picky {
+			r.picky = true
+		}
+		if r1.refreshToken != tok0RefreshToken {
+			// The token server gave us a new refresh token.
+			r.refreshToken = r1.refreshToken
+		}
+		r.accessTokens = slices.DeleteFunc(r.accessTokens, func(t *scopedToken) bool {
+			return t == tok
+		})
+		for _, tok := range r1.accessTokens {
+			r.addAccessToken(tok)
+		}
+	}()
+}
+
 // init initializes the registry instance by acquiring auth information from
 // the Config, if available. As this might be slow (invoking EntryForRegistry
 // can end up invoking slow external commands), we ensure that it's only
 // done once.
-// TODO it's possible that this could take a very long time, during which
-// the outer context is cancelled, but we'll ignore that. We probably shouldn't.
-func (r *registry) init() error {
-	inner := func() error {
-		info, err := r.config.EntryForRegistry(r.host)
-		if err != nil {
-			return fmt.Errorf("cannot acquire auth info for registry %q: %v", r.host, err)
+//
+// If ctx is done before the information has been acquired, init returns
+// the context's error. If the Config implements [ContextConfig], the
+// lookup itself is canceled too, and a later call will try again;
+// otherwise the lookup continues in the background and its result is
+// used by later calls.
+func (r *registry) init(ctx context.Context) error {
+	for {
+		r.initMu.Lock()
+		if r.initialized {
+			r.initMu.Unlock()
+			return r.initErr
 		}
-		r.refreshToken = info.RefreshToken
-		if info.AccessToken != "" {
-			r.accessTokens = append(r.accessTokens, &scopedToken{
-				scope:   UnlimitedScope(),
-				token:   info.AccessToken,
-				expires: forever,
-			})
+		if r.initDone == nil {
+			r.initDone = make(chan struct{})
+			go r.runInit(ctx, r.initDone)
 		}
-		if info.Username != "" && info.Password != "" {
-			r.basic = &userPass{
-				username: info.Username,
-				password: info.Password,
-			}
+		done := r.initDone
+		r.initMu.Unlock()
+
+		select {
+		case <-done:
+			// Check the result, or try again if the
+			// lookup was canceled by another caller.
+		case <-ctx.Done():
+			return ctx.Err()
 		}
-		return nil
 	}
-	r.initOnce.Do(func() {
-		r.initErr = inner()
-	})
-	return r.initErr
+}
+
+// runInit acquires the auth information for init
+// and closes done when it has completed.
+func (r *registry) runInit(ctx context.Context, done chan struct{}) {
+	info, err := configEntry(ctx, r.config, r.host)
+	r.initMu.Lock()
+	defer r.initMu.Unlock()
+	defer close(done)
+	if err != nil {
+		if ctx.Err() != nil {
+			// The lookup was canceled. Allow a later caller
+			// with a live context to try again.
+			r.initDone = nil
+			return
+		}
+		r.initialized = true
+		r.initErr = fmt.Errorf("cannot acquire auth info for registry %q: %v", r.host, err)
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.refreshToken = info.RefreshToken
+	if info.AccessToken != "" {
+		r.accessTokens = append(r.accessTokens, &scopedToken{
+			scope:   UnlimitedScope(),
+			token:   info.AccessToken,
+			expires: forever,
+		})
+	}
+	if info.Username != "" && info.Password != "" {
+		r.basic = &userPass{
+			username: info.Username,
+			password: info.Password,
+		}
+	}
+	r.initialized = true
+}
+
+// configEntry returns the auth information for the given host
+// from config, passing ctx to it if it implements [ContextConfig].
+func configEntry(ctx context.Context, config Config, host string) (ConfigEntry, error) {
+	if config, ok := config.(ContextConfig); ok {
+		return config.EntryForRegistryContext(ctx, host)
+	}
+	return config.EntryForRegistry(host)
 }
 
 // acquireAccessToken tries to acquire an access token for authorizing a request.
@@ -326,11 +611,14 @@ func (r *registry) init() error {
 // This method assumes that there has been a previous 401 response with
 // a Www-Authenticate: Bearer... header.
 func (r *registry) acquireAccessToken(ctx context.Context, requiredScope, wantScope Scope) (string, error) {
-	scope := requiredScope.Union(wantScope)
+	scope := requiredScope
+	if !r.picky {
+		scope = requiredScope.Union(wantScope)
+	}
 	tok, err := r.acquireToken(ctx, scope)
 	if err != nil {
 		var herr ociregistry.HTTPError
-		if !errors.As(err, &herr) || herr.StatusCode() != http.StatusUnauthorized {
+		if !errors.As(err, &herr) || herr.StatusCode() != http.StatusUnauthorized || r.picky {
 			return "", err
 		}
 		// The documentation says this:
@@ -345,13 +633,21 @@ func (r *registry) acquireAccessToken(ctx context.Context, requiredScope, wantSc
 		// such requests anyway, so if we've got an unauthorized error
 		// and wantScope goes beyond requiredScope, it may be because
 		// the server is rejecting the request.
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		wider := !requiredScope.Contains(scope)
 		scope = requiredScope
 		tok, err = r.acquireToken(ctx, scope)
 		if err != nil {
 			return "", err
 		}
-		// TODO mark the registry as picky about tokens so we don't
-		// attempt twice every time?
+		if wider {
+			// The server rejected the wider scope but not the
+			// required one, so avoid making two requests every
+			// time by asking for only what's required from now on.
+			r.picky = true
+		}
 	}
 	if tok.RefreshToken != "" {
 		r.refreshToken = tok.RefreshToken
@@ -364,13 +660,21 @@ func (r *registry) acquireAccessToken(ctx context.Context, requiredScope, wantSc
 		return "", fmt.Errorf("no access token found in auth server response")
 	}
 	var expires time.Time
-	now := time.Now().UTC()
+	now := timeNow().UTC()
 	if tok.ExpiresIn == 0 {
 		expires = now.Add(60 * time.Second) // TODO link to where this is mentioned
 	} else {
 		expires = now.Add(time.Duration(tok.ExpiresIn) * time.Second)
 	}
-	r.accessTokens = append(r.accessTokens, &scopedToken{
+	if r.inspectToken != nil {
+		// The token server may have granted less than we asked
+		// for; record what the token actually allows so that we
+		// don't use it for requests it can't authorize.
+		if granted, ok := r.inspectToken(accessToken); ok {
+			scope = granted
+		}
+	}
+	r.addAccessToken(&scopedToken{
 		scope:   scope,
 		token:   accessToken,
 		expires: expires,
@@ -391,7 +695,7 @@ func (r *registry) acquireToken(ctx context.Context, scope Scope) (*wireToken, e
 		if service := r.wwwAuthenticate.params["service"]; service != "" {
 			v.Set("service", service)
 		}
-		v.Set("client_id", oauthClientID)
+		v.Set("client_id", r.clientID)
 		v.Set("grant_type", "refresh_token")
 		v.Set("refresh_token", r.refreshToken)
 		req, err := http.NewRequestWithContext(ctx, "POST", realm, strings.NewReader(v.Encode()))
@@ -404,7 +708,7 @@ func (r *registry) acquireToken(ctx context.Context, scope Scope) (*wireToken, e
 			return tok, nil
 		}
 		var herr ociregistry.HTTPError
-		if !errors.As(err, &herr) || herr.StatusCode() != http.StatusNotFound {
+		if !errors.As(err, &herr) || herr.StatusCode() != http.StatusNotFound || ctx.Err() != nil {
 			return tok, err
 		}
 		// The request to the endpoint returned 404 from the POST request,
@@ -470,7 +774,16 @@ type wireToken struct {
 	ExpiresIn int `json:"expires_in"`
 }
 
+// doTokenRequest sends req to the token server and returns the token in
+// the response. It aborts when the request's context is done, returning
+// the context's error.
 func (r *registry) doTokenRequest(req *http.Request) (*wireToken, error) {
+	ctx := req.Context()
+	if r.tokenAuth != nil {
+		if err := r.tokenAuth(req); err != nil {
+			return nil, fmt.Errorf("cannot add token endpoint authorization: %w", err)
+		}
+	}
 	client := &http.Client{
 		Transport: r.transport,
 	}
@@ -480,11 +793,14 @@ func (r *registry) doTokenRequest(req *http.Request) (*wireToken, error) {
 	}
 	defer resp.Body.Close()
 	data, bodyErr := io.ReadAll(resp.Body)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	if resp.StatusCode != http.StatusOK {
 		return nil, ociregistry.NewHTTPError(nil, resp.StatusCode, resp, data)
 	}
 	if bodyErr != nil {
-		return nil, fmt.Errorf("error reading response body: %v", err)
+		return nil, fmt.Errorf("error reading response body: %v", bodyErr)
 	}
 	var tok wireToken
 	if err := json.Unmarshal(data, &tok); err != nil {
@@ -502,16 +818,42 @@ func (r *registry) deleteExpiredTokens(now time.Time) {
 	})
 }
 
+// accessTokenForScope returns a token that covers the given scope,
+// or nil if there is none. The returned token is marked as
+// most recently used.
 func (r *registry) accessTokenForScope(scope Scope) *scopedToken {
-	for _, tok := range r.accessTokens {
+	for i, tok := range r.accessTokens {
 		if tok.scope.Contains(scope) {
 			// TODO prefer tokens with less scope?
+			r.accessTokens = append(slices.Delete(r.accessTokens, i, i+1), tok)
 			return tok
 		}
 	}
 	return nil
 }
 
+// addAccessToken adds tok as the most recently used access token,
+// discarding the least recently used tokens if there are
+// now too many. Tokens that never expire (those from the Config)
+// are never discarded, and nor is tok itself.
+func (r *registry) addAccessToken(tok *scopedToken) {
+	r.accessTokens = append(r.accessTokens, tok)
+	excess := len(r.accessTokens) - r.maxTokens
+	if r.maxTokens <= 0 || excess <= 0 {
+		return
+	}
+	kept := r.accessTokens[:0]
+	for _, t := range r.accessTokens {
+		if excess > 0 && t != tok && t.expires != forever {
+			excess--
+			continue
+		}
+		kept = append(kept, t)
+	}
+	clear(r.accessTokens[len(kept):])
+	r.accessTokens = kept
+}
+
 type emptyConfig struct{}
 
 func (emptyConfig) EntryForRegistry(host string) (ConfigEntry, error) {
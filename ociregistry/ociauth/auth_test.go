@@ -11,6 +11,7 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -380,6 +381,132 @@ func TestConfigHasAccessToken(t *testing.T) {
 	assertRequest(context.Background(), t, ts, "/test", client, Scope{})
 }
 
+func TestContextBearerToken(t *testing.T) {
+	accessToken := "somevalue"
+	authSrv := newAuthServer(t, func(req *http.Request) (any, *httpError) {
+		t.Errorf("unexpected token request")
+		return nil, &httpError{
+			statusCode: http.StatusInternalServerError,
+		}
+	})
+	ts := newTargetServer(t, func(req *http.Request) *httpError {
+		if req.Header.Get("Authorization") != "Bearer "+accessToken {
+			return &httpError{
+				statusCode: http.StatusUnauthorized,
+				header: http.Header{
+					"Www-Authenticate": []string{fmt.Sprintf("Bearer realm=%q,service=someService,scope=%q", authSrv, "repository:foo:pull")},
+				},
+			}
+		}
+		return nil
+	})
+	client := &http.Client{
+		Transport: NewStdTransport(StdTransportParams{
+			Config: configFunc(func(host string) (ConfigEntry, error) {
+				t.Errorf("unexpected config lookup for %q", host)
+				return ConfigEntry{}, nil
+			}),
+		}),
+	}
+	ctx := ContextWithBearerToken(context.Background(), BearerToken{
+		Host:  ts.Host,
+		Scope: ParseScope("repository:foo:pull,push"),
+		Token: accessToken,
+	})
+	assertRequest(ctx, t, ts, "/test", client, ParseScope("repository:foo:pull"))
+
+	// A rejected token is reported to the caller as is.
+	ctx = ContextWithBearerToken(context.Background(), BearerToken{
+		Host:  ts.Host,
+		Scope: UnlimitedScope(),
+		Token: "badtoken",
+	})
+	req, err := http.NewRequestWithContext(ctx, "GET", ts.String()+"/test", nil)
+	qt.Assert(t, qt.IsNil(err))
+	resp, err := client.Do(req)
+	qt.Assert(t, qt.IsNil(err))
+	resp.Body.Close()
+	qt.Assert(t, qt.Equals(resp.StatusCode, http.StatusUnauthorized))
+}
+
+func TestContextBearerTokenScoped(t *testing.T) {
+	const accessToken = "somevalue"
+	var (
+		mu          sync.Mutex
+		storageAuth []string
+		lookups     []string
+	)
+	// storageSrv stands in for blob storage that the
+	// registry redirects to. It must never see the token.
+	storageSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		storageAuth = append(storageAuth, req.Header.Get("Authorization"))
+		mu.Unlock()
+		w.Write([]byte("test ok"))
+	}))
+	defer storageSrv.Close()
+	ts := newTargetServer(t, func(req *http.Request) *httpError {
+		if req.Header.Get("Authorization") != "Bearer "+accessToken {
+			return &httpError{
+				statusCode: http.StatusUnauthorized,
+			}
+		}
+		if req.URL.Path == "/test/redirect" {
+			return &httpError{
+				statusCode: http.StatusTemporaryRedirect,
+				header: http.Header{
+					"Location": []string{storageSrv.URL + "/blob"},
+				},
+			}
+		}
+		return nil
+	})
+	client := &http.Client{
+		Transport: NewStdTransport(StdTransportParams{
+			Config: configFunc(func(host string) (ConfigEntry, error) {
+				mu.Lock()
+				lookups = append(lookups, host)
+				mu.Unlock()
+				return ConfigEntry{}, nil
+			}),
+		}),
+	}
+	ctx := ContextWithBearerToken(context.Background(), BearerToken{
+		Host:  ts.Host,
+		Scope: ParseScope("repository:foo:pull"),
+		Token: accessToken,
+	})
+	ctx = ContextWithRequestInfo(ctx, RequestInfo{
+		RequiredScope: ParseScope("repository:foo:pull"),
+	})
+
+	// The token isn't forwarded to the target of a redirect.
+	req, err := http.NewRequestWithContext(ctx, "POST", ts.String()+"/test/redirect", strings.NewReader("test body"))
+	qt.Assert(t, qt.IsNil(err))
+	resp, err := client.Do(req)
+	qt.Assert(t, qt.IsNil(err))
+	data, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	qt.Assert(t, qt.Equals(resp.StatusCode, http.StatusOK))
+	qt.Assert(t, qt.Equals(string(data), "test ok"))
+	qt.Check(t, qt.DeepEquals(storageAuth, []string{""}))
+	storageURL, _ := url.Parse(storageSrv.URL)
+	qt.Check(t, qt.DeepEquals(lookups, []string{storageURL.Host}))
+
+	// The token isn't used for a request that
+	// needs a scope that it doesn't grant.
+	ctx = ContextWithRequestInfo(ctx, RequestInfo{
+		RequiredScope: ParseScope("repository:foo:push"),
+	})
+	req, err = http.NewRequestWithContext(ctx, "POST", ts.String()+"/test", strings.NewReader("test body"))
+	qt.Assert(t, qt.IsNil(err))
+	resp, err = client.Do(req)
+	qt.Assert(t, qt.IsNil(err))
+	resp.Body.Close()
+	qt.Check(t, qt.Equals(resp.StatusCode, http.StatusUnauthorized))
+	qt.Check(t, qt.DeepEquals(lookups, []string{storageURL.Host, ts.Host}))
+}
+
 func TestConfigErrorNilRequestBody(t *testing.T) {
 	// stdTransport used to panic when given a nil request body
 	// if something failed before it called the underlying transport,
@@ -485,6 +612,60 @@ func TestAuthServerRejectsRequestsWithTooMuchScope(t *testing.T) {
 	assertRequest(ctx, t, ts, "/test", client, Scope{})
 }
 
+func TestAuthServerRejectsTooMuchScopeRemembered(t *testing.T) {
+	// After the token server has rejected a request for more
+	// scope than required, only the required scope is requested.
+	userHasScope := ParseScope("repository:foo:pull repository:baz:pull")
+	var tokenRequests []string
+	authSrv := newAuthServer(t, func(req *http.Request) (any, *httpError) {
+		requestedScope := ParseScope(strings.Join(req.Form["scope"], " "))
+		tokenRequests = append(tokenRequests, requestedScope.String())
+		if !userHasScope.Contains(requestedScope) {
+			return nil, &httpError{
+				statusCode: http.StatusUnauthorized,
+			}
+		}
+		return &wireToken{
+			Token: token{requestedScope}.String(),
+		}, nil
+	})
+	ts := newTargetServer(t, func(req *http.Request) *httpError {
+		requiredScope := NewScope(ResourceScope{
+			ResourceType: TypeRepository,
+			Resource:     strings.TrimPrefix(req.URL.Path, "/test/"),
+			Action:       ActionPull,
+		})
+		if req.Header.Get("Authorization") == "" || !authScopeFromRequest(t, req).Contains(requiredScope) {
+			return &httpError{
+				statusCode: http.StatusUnauthorized,
+				header: http.Header{
+					"Www-Authenticate": []string{fmt.Sprintf("Bearer realm=%q,service=someService,scope=%q", authSrv, requiredScope)},
+				},
+			}
+		}
+		return nil
+	})
+	client := &http.Client{
+		Transport: NewStdTransport(StdTransportParams{
+			Config: configFunc(func(host string) (ConfigEntry, error) {
+				return ConfigEntry{}, nil
+			}),
+		}),
+	}
+	ctx := ContextWithScope(context.Background(), ParseScope("repository:bar:pull"))
+	assertRequest(ctx, t, ts, "/test/foo", client, ParseScope("repository:foo:pull"))
+	qt.Check(t, qt.DeepEquals(tokenRequests, []string{
+		"repository:bar:pull repository:foo:pull",
+		"repository:foo:pull",
+	}))
+
+	tokenRequests = nil
+	assertRequest(ctx, t, ts, "/test/baz", client, ParseScope("repository:baz:pull"))
+	qt.Check(t, qt.DeepEquals(tokenRequests, []string{
+		"repository:baz:pull",
+	}))
+}
+
 func TestAuthRequestUsesRefreshTokenFromConfig(t *testing.T) {
 	authCount := 0
 	authSrv := newAuthServer(t, func(req *http.Request) (any, *httpError) {
@@ -548,6 +729,57 @@ func TestAuthRequestUsesRefreshTokenFromConfig(t *testing.T) {
 	qt.Assert(t, qt.Equals(authCount, 2))
 }
 
+func TestAuthRequestUsesClientID(t *testing.T) {
+	for _, clientID := range []string{"", "my-tool"} {
+		t.Run(clientID, func(t *testing.T) {
+			wantClientID := clientID
+			if wantClientID == "" {
+				wantClientID = defaultOAuthClientID
+			}
+			authCount := 0
+			authSrv := newAuthServer(t, func(req *http.Request) (any, *httpError) {
+				authCount++
+				if !runNonFatal(t, func(t testing.TB) {
+					qt.Assert(t, qt.Equals(req.Form.Get("grant_type"), "refresh_token"))
+					qt.Assert(t, qt.Equals(req.Form.Get("client_id"), wantClientID))
+				}) {
+					return nil, &httpError{
+						statusCode: http.StatusInternalServerError,
+					}
+				}
+				requestedScope := ParseScope(strings.Join(req.Form["scope"], " "))
+				return &wireToken{
+					Token: token{requestedScope}.String(),
+				}, nil
+			})
+			requiredScope := ParseScope("repository:foo:pull")
+			ts := newTargetServer(t, func(req *http.Request) *httpError {
+				if req.Header.Get("Authorization") == "" {
+					return &httpError{
+						statusCode: http.StatusUnauthorized,
+						header: http.Header{
+							"Www-Authenticate": []string{fmt.Sprintf("Bearer realm=%q,service=someService,scope=%q", authSrv, requiredScope)},
+						},
+					}
+				}
+				return nil
+			})
+			client := &http.Client{
+				Transport: NewStdTransport(StdTransportParams{
+					Config: configFunc(func(host string) (ConfigEntry, error) {
+						return ConfigEntry{
+							RefreshToken: "someRefreshToken",
+						}, nil
+					}),
+					ClientID: clientID,
+				}),
+			}
+			assertRequest(context.Background(), t, ts, "/test", client, requiredScope)
+			qt.Assert(t, qt.Equals(authCount, 1))
+		})
+	}
+}
+
 func TestAuthRequestUsesRefreshTokenFromAuthServer(t *testing.T) {
 	authCount := 0
 	authSrv := newAuthServer(t, func(req *http.Request) (any, *httpError) {
@@ -618,6 +850,101 @@ func TestAuthRequestUsesRefreshTokenFromAuthServer(t *testing.T) {
 	qt.Assert(t, qt.Equals(authCount, numRequests))
 }
 
+func TestBackgroundTokenRefresh(t *testing.T) {
+	now := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	var clockMu sync.Mutex
+	qt.Patch(t, &timeNow, func() time.Time {
+		clockMu.Lock()
+		defer clockMu.Unlock()
+		return now
+	})
+	advance := func(d time.Duration) {
+		clockMu.Lock()
+		defer clockMu.Unlock()
+		now = now.Add(d)
+	}
+
+	testScope := ParseScope("repository:foo:pull")
+	var (
+		authMu    sync.Mutex
+		authCount int
+	)
+	unblockAuth := make(chan struct{})
+	authSrv := newAuthServer(t, func(req *http.Request) (any, *httpError) {
+		authMu.Lock()
+		authCount++
+		n := authCount
+		authMu.Unlock()
+		if n > 1 {
+			// Block the refresh until the test allows it to proceed.
+			<-unblockAuth
+		}
+		return &wireToken{
+			Token:     fmt.Sprintf("token%d", n),
+			ExpiresIn: 100,
+		}, nil
+	})
+	var (
+		targetMu   sync.Mutex
+		lastTarget string
+	)
+	ts := newTargetServer(t, func(req *http.Request) *httpError {
+		auth := req.Header.Get("Authorization")
+		if auth == "" {
+			return &httpError{
+				statusCode: http.StatusUnauthorized,
+				header: http.Header{
+					"Www-Authenticate": []string{fmt.Sprintf("Bearer realm=%q,service=someService,scope=%q", authSrv, testScope)},
+				},
+			}
+		}
+		targetMu.Lock()
+		defer targetMu.Unlock()
+		lastTarget = auth
+		return nil
+	})
+	lastAuth := func() string {
+		targetMu.Lock()
+		defer targetMu.Unlock()
+		return lastTarget
+	}
+	client := &http.Client{
+		Transport: NewStdTransport(StdTransportParams{
+			RefreshMargin: 30 * time.Second,
+		}),
+	}
+	ctx := ContextWithRequestInfo(context.Background(), RequestInfo{
+		RequiredScope: testScope,
+	})
+	assertRequest1(ctx, t, ts, "/test", client)
+	qt.Assert(t, qt.Equals(lastAuth(), "Bearer token1"))
+
+	// Move to within the refresh margin. The requests should
+	// complete using the existing token even though the token
+	// server is blocked, and only one refresh should be started.
+	advance(80 * time.Second)
+	assertRequest1(ctx, t, ts, "/test", client)
+	assertRequest1(ctx, t, ts, "/test", client)
+	qt.Assert(t, qt.Equals(lastAuth(), "Bearer token1"))
+
+	close(unblockAuth)
+	// Wait for the refreshed token to be used.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		assertRequest1(ctx, t, ts, "/test", client)
+		if lastAuth() == "Bearer token2" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("refreshed token never used")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	authMu.Lock()
+	defer authMu.Unlock()
+	qt.Assert(t, qt.Equals(authCount, 2))
+}
+
 func assertRequest(ctx context.Context, t testing.TB, tsURL *url.URL, path string, client *http.Client, needScope Scope) {
 	ctx = ContextWithRequestInfo(ctx, RequestInfo{
 		RequiredScope: needScope,
@@ -841,3 +1168,478 @@ func (t nonFatalT) Skipf(format string, args ...any) {
 	t.Logf(format, args...)
 	t.SkipNow()
 }
+
+func TestInspectTokenRecordsGrantedScope(t *testing.T) {
+	authCount := 0
+	authSrv := newAuthServer(t, func(req *http.Request) (any, *httpError) {
+		authCount++
+		requested := ParseScope(strings.Join(req.Form["scope"], " "))
+		if authCount > 1 {
+			return &wireToken{
+				Token: testJWT(t, requested),
+			}, nil
+		}
+		// The first time, silently grant only the first of
+		// the requested repositories.
+		var granted []ResourceScope
+		requested.Iter()(func(rs ResourceScope) bool {
+			granted = append(granted, rs)
+			return false
+		})
+		return &wireToken{
+			Token: testJWT(t, NewScope(granted...)),
+		}, nil
+	})
+	ts := newTargetServer(t, func(req *http.Request) *httpError {
+		resource := strings.TrimPrefix(req.URL.Path, "/test/")
+		requiredScope := NewScope(ResourceScope{
+			ResourceType: TypeRepository,
+			Resource:     resource,
+			Action:       ActionPull,
+		})
+		challenge := &httpError{
+			statusCode: http.StatusUnauthorized,
+			header: http.Header{
+				"Www-Authenticate": []string{fmt.Sprintf("Bearer realm=%q,service=someService,scope=%q", authSrv, requiredScope)},
+			},
+		}
+		tokStr, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			return challenge
+		}
+		granted, ok := JWTScope(tokStr)
+		if !ok || !granted.Contains(requiredScope) {
+			return challenge
+		}
+		return nil
+	})
+	client := &http.Client{
+		Transport: NewStdTransport(StdTransportParams{
+			Config: configFunc(func(host string) (ConfigEntry, error) {
+				return ConfigEntry{}, nil
+			}),
+			InspectToken: JWTScope,
+		}),
+	}
+	ctx := ContextWithScope(context.Background(), ParseScope("repository:foo1:pull repository:foo2:pull"))
+	assertRequest(ctx, t, ts, "/test/foo1", client, ParseScope("repository:foo1:pull"))
+	qt.Assert(t, qt.Equals(authCount, 1))
+	// The token acquired for foo1 doesn't cover foo2 even though
+	// foo2 was requested, so another token must be acquired.
+	assertRequest(ctx, t, ts, "/test/foo2", client, ParseScope("repository:foo2:pull"))
+	qt.Assert(t, qt.Equals(authCount, 2))
+}
+
+func TestJWTScope(t *testing.T) {
+	scope := ParseScope("repository:foo:pull,push repository:bar:pull registry:catalog:*")
+	got, ok := JWTScope(testJWT(t, scope))
+	qt.Assert(t, qt.IsTrue(ok))
+	qt.Check(t, qt.Equals(got.String(), scope.Canonical().String()))
+
+	for _, tok := range []string{
+		"opaque",
+		"a.b.c",
+		"e30.e30.sig", // Valid JWT without an access claim.
+	} {
+		_, ok := JWTScope(tok)
+		qt.Check(t, qt.IsFalse(ok), qt.Commentf("token %q", tok))
+	}
+}
+
+// testJWT returns an unsigned JWT whose access claim grants scope.
+func testJWT(t testing.TB, scope Scope) string {
+	type accessEntry struct {
+		Type    string   `json:"type"`
+		Name    string   `json:"name"`
+		Actions []string `json:"actions"`
+	}
+	access := []accessEntry{}
+	scope.Iter()(func(rs ResourceScope) bool {
+		if n := len(access); n > 0 && access[n-1].Type == rs.ResourceType && access[n-1].Name == rs.Resource {
+			access[n-1].Actions = append(access[n-1].Actions, rs.Action)
+		} else {
+			access = append(access, accessEntry{
+				Type:    rs.ResourceType,
+				Name:    rs.Resource,
+				Actions: []string{rs.Action},
+			})
+		}
+		return true
+	})
+	payload, err := json.Marshal(map[string]any{
+		"sub":    "someone",
+		"access": access,
+	})
+	qt.Assert(t, qt.IsNil(err))
+	enc := base64.RawURLEncoding.EncodeToString
+	return enc([]byte(`{"alg":"none"}`)) + "." + enc(payload) + ".sig"
+}
+
+func TestAccessTokensBounded(t *testing.T) {
+	authCount := 0
+	authSrv := newAuthServer(t, func(req *http.Request) (any, *httpError) {
+		authCount++
+		return &wireToken{
+			Token: token{ParseScope(strings.Join(req.Form["scope"], " "))}.String(),
+		}, nil
+	})
+	ts := newTargetServer(t, func(req *http.Request) *httpError {
+		resource := strings.TrimPrefix(req.URL.Path, "/test/")
+		requiredScope := NewScope(ResourceScope{
+			ResourceType: TypeRepository,
+			Resource:     resource,
+			Action:       ActionPull,
+		})
+		if req.Header.Get("Authorization") == "" {
+			return &httpError{
+				statusCode: http.StatusUnauthorized,
+				header: http.Header{
+					"Www-Authenticate": []string{fmt.Sprintf("Bearer realm=%q,service=someService,scope=%q", authSrv, requiredScope)},
+				},
+			}
+		}
+		runNonFatal(t, func(t testing.TB) {
+			qt.Assert(t, qt.IsTrue(authScopeFromRequest(t, req).Contains(requiredScope)))
+		})
+		return nil
+	})
+	transport := NewStdTransport(StdTransportParams{
+		Config: configFunc(func(host string) (ConfigEntry, error) {
+			return ConfigEntry{
+				RefreshToken: "someRefreshToken",
+			}, nil
+		}),
+		MaxAccessTokens: 3,
+	})
+	client := &http.Client{
+		Transport: transport,
+	}
+	repoScope := func(repo string) Scope {
+		return ParseScope("repository:" + repo + ":pull")
+	}
+	ctx := context.Background()
+	for i := range 20 {
+		repo := fmt.Sprintf("foo%d", i)
+		assertRequest(ctx, t, ts, "/test/"+repo, client, repoScope(repo))
+		// Keep using the first token so that it's never
+		// the least recently used.
+		assertRequest(ctx, t, ts, "/test/foo0", client, repoScope("foo0"))
+	}
+	qt.Assert(t, qt.Equals(authCount, 20))
+	reg := transport.(*stdTransport).registries[ts.Host]
+	qt.Assert(t, qt.HasLen(reg.accessTokens, 3))
+
+	// The most recently used tokens are retained; others
+	// need to be acquired again.
+	assertRequest(ctx, t, ts, "/test/foo19", client, repoScope("foo19"))
+	assertRequest(ctx, t, ts, "/test/foo0", client, repoScope("foo0"))
+	qt.Assert(t, qt.Equals(authCount, 20))
+	assertRequest(ctx, t, ts, "/test/foo1", client, repoScope("foo1"))
+	qt.Assert(t, qt.Equals(authCount, 21))
+	qt.Assert(t, qt.HasLen(reg.accessTokens, 3))
+}
+
+func TestTokenEndpointAuth(t *testing.T) {
+	testScope := ParseScope("repository:foo:push,pull")
+	authSrv := newAuthServer(t, func(req *http.Request) (any, *httpError) {
+		// The token server sits behind a gateway that
+		// requires its own key.
+		if req.Header.Get("X-Gateway-Key") != "gatewaysecret" {
+			return nil, &httpError{
+				statusCode: http.StatusForbidden,
+			}
+		}
+		username, password, ok := req.BasicAuth()
+		if !ok || username != "testuser" || password != "testpassword" {
+			return nil, &httpError{
+				statusCode: http.StatusUnauthorized,
+			}
+		}
+		return &wireToken{
+			Token: token{ParseScope(req.Form.Get("scope"))}.String(),
+		}, nil
+	})
+	ts := newTargetServer(t, func(req *http.Request) *httpError {
+		runNonFatal(t, func(t testing.TB) {
+			qt.Assert(t, qt.Equals(req.Header.Get("X-Gateway-Key"), ""))
+		})
+		if req.Header.Get("Authorization") == "" {
+			return &httpError{
+				statusCode: http.StatusUnauthorized,
+				header: http.Header{
+					"Www-Authenticate": []string{fmt.Sprintf("Bearer realm=%q,service=someService,scope=%q", authSrv, testScope)},
+				},
+			}
+		}
+		return nil
+	})
+	config := configFunc(func(host string) (ConfigEntry, error) {
+		return ConfigEntry{
+			Username: "testuser",
+			Password: "testpassword",
+		}, nil
+	})
+
+	// Without the extra authorization, the token request fails.
+	client := &http.Client{
+		Transport: NewStdTransport(StdTransportParams{
+			Config: config,
+		}),
+	}
+	req, err := http.NewRequest("POST", ts.String()+"/test", strings.NewReader("test body"))
+	qt.Assert(t, qt.IsNil(err))
+	_, err = client.Do(req)
+	qt.Assert(t, qt.ErrorMatches(err, `.*403 Forbidden.*`))
+
+	var tokenHosts []string
+	client = &http.Client{
+		Transport: NewStdTransport(StdTransportParams{
+			Config: config,
+			TokenEndpointAuth: func(req *http.Request) error {
+				tokenHosts = append(tokenHosts, req.URL.Host)
+				req.Header.Set("X-Gateway-Key", "gatewaysecret")
+				return nil
+			},
+		}),
+	}
+	assertRequest(context.Background(), t, ts, "/test", client, Scope{})
+	qt.Assert(t, qt.DeepEquals(tokenHosts, []string{authSrv.Host}))
+
+	// An error from the hook is returned.
+	client = &http.Client{
+		Transport: NewStdTransport(StdTransportParams{
+			Config: config,
+			TokenEndpointAuth: func(req *http.Request) error {
+				return fmt.Errorf("no key available")
+			},
+		}),
+	}
+	req, err = http.NewRequest("POST", ts.String()+"/test", strings.NewReader("test body"))
+	qt.Assert(t, qt.IsNil(err))
+	_, err = client.Do(req)
+	qt.Assert(t, qt.ErrorMatches(err, `.*cannot add token endpoint authorization: no key available`))
+}
+
+func TestSchemePriority(t *testing.T) {
+	tests := []struct {
+		testName       string
+		schemePriority []string
+		challenges     []string
+		wantScheme     string
+	}{{
+		testName:   "Default",
+		challenges: []string{"Bearer", "Basic"},
+		wantScheme: "Basic",
+	}, {
+		testName:       "PreferBearer",
+		schemePriority: []string{"bearer", "basic"},
+		challenges:     []string{"Basic", "Bearer"},
+		wantScheme:     "Bearer",
+	}, {
+		testName:       "CaseInsensitive",
+		schemePriority: []string{"BEARER", "Basic"},
+		challenges:     []string{"Basic", "Bearer"},
+		wantScheme:     "Bearer",
+	}, {
+		testName:       "FallBackToLowerPriority",
+		schemePriority: []string{"bearer", "basic"},
+		challenges:     []string{"Basic"},
+		wantScheme:     "Basic",
+	}, {
+		testName:       "BasicDisabled",
+		schemePriority: []string{"bearer"},
+		challenges:     []string{"Basic"},
+	}, {
+		testName:       "UnknownScheme",
+		schemePriority: []string{"negotiate", "basic"},
+		challenges:     []string{"Negotiate", "Basic"},
+		wantScheme:     "Basic",
+	}}
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			authSrv := newAuthServer(t, func(req *http.Request) (any, *httpError) {
+				username, password, ok := req.BasicAuth()
+				if !ok || username != "testuser" || password != "testpassword" {
+					return nil, &httpError{
+						statusCode: http.StatusUnauthorized,
+					}
+				}
+				return &wireToken{
+					Token: token{ParseScope(req.Form.Get("scope"))}.String(),
+				}, nil
+			})
+			var challenges []string
+			for _, scheme := range test.challenges {
+				if scheme == "Bearer" {
+					scheme = fmt.Sprintf("Bearer realm=%q,service=someService", authSrv)
+				}
+				challenges = append(challenges, scheme)
+			}
+			var gotSchemes []string
+			ts := newTargetServer(t, func(req *http.Request) *httpError {
+				if username, password, ok := req.BasicAuth(); ok && username == "testuser" && password == "testpassword" {
+					gotSchemes = append(gotSchemes, "Basic")
+					return nil
+				}
+				if strings.HasPrefix(req.Header.Get("Authorization"), "Bearer ") {
+					gotSchemes = append(gotSchemes, "Bearer")
+					return nil
+				}
+				return &httpError{
+					statusCode: http.StatusUnauthorized,
+					header: http.Header{
+						"Www-Authenticate": challenges,
+					},
+				}
+			})
+			client := &http.Client{
+				Transport: NewStdTransport(StdTransportParams{
+					Config: configFunc(func(host string) (ConfigEntry, error) {
+						return ConfigEntry{
+							Username: "testuser",
+							Password: "testpassword",
+						}, nil
+					}),
+					SchemePriority: test.schemePriority,
+				}),
+			}
+			req, err := http.NewRequest("POST", ts.String()+"/test", strings.NewReader("test body"))
+			qt.Assert(t, qt.IsNil(err))
+			resp, err := client.Do(req)
+			qt.Assert(t, qt.IsNil(err))
+			resp.Body.Close()
+			if test.wantScheme == "" {
+				qt.Check(t, qt.Equals(resp.StatusCode, http.StatusUnauthorized))
+				qt.Check(t, qt.HasLen(gotSchemes, 0))
+				return
+			}
+			qt.Check(t, qt.Equals(resp.StatusCode, http.StatusOK))
+			qt.Check(t, qt.DeepEquals(gotSchemes, []string{test.wantScheme}))
+		})
+	}
+}
+
+func TestContextCanceledDuringInit(t *testing.T) {
+	ts := newTargetServer(t, func(req *http.Request) *httpError {
+		username, password, _ := req.BasicAuth()
+		if username != "testuser" || password != "testpassword" {
+			return &httpError{
+				statusCode: http.StatusUnauthorized,
+				header: http.Header{
+					"Www-Authenticate": {"Basic"},
+				},
+			}
+		}
+		return nil
+	})
+	// The first lookup blocks until its context is done;
+	// later lookups succeed immediately.
+	var (
+		mu       sync.Mutex
+		lookups  int
+		canceled int
+	)
+	client := &http.Client{
+		Transport: NewStdTransport(StdTransportParams{
+			Config: contextConfigFunc(func(ctx context.Context, host string) (ConfigEntry, error) {
+				mu.Lock()
+				lookups++
+				n := lookups
+				mu.Unlock()
+				if n == 1 {
+					<-ctx.Done()
+					mu.Lock()
+					canceled++
+					mu.Unlock()
+					return ConfigEntry{}, ctx.Err()
+				}
+				return ConfigEntry{
+					Username: "testuser",
+					Password: "testpassword",
+				}, nil
+			}),
+		}),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", ts.String()+"/test", strings.NewReader("test body"))
+	qt.Assert(t, qt.IsNil(err))
+	_, err = client.Do(req)
+	qt.Assert(t, qt.ErrorIs(err, context.DeadlineExceeded))
+
+	// The canceled lookup isn't remembered, so a later
+	// request looks up the auth information again.
+	assertRequest(context.Background(), t, ts, "/test", client, Scope{})
+	mu.Lock()
+	defer mu.Unlock()
+	qt.Check(t, qt.Equals(lookups, 2))
+	qt.Check(t, qt.Equals(canceled, 1))
+}
+
+func TestContextCanceledDuringInitWithoutContextConfig(t *testing.T) {
+	ts := newTargetServer(t, func(req *http.Request) *httpError {
+		return nil
+	})
+	release := make(chan struct{})
+	defer close(release)
+	client := &http.Client{
+		Transport: NewStdTransport(StdTransportParams{
+			Config: configFunc(func(host string) (ConfigEntry, error) {
+				// This Config can't be canceled, but the
+				// request shouldn't wait for it.
+				<-release
+				return ConfigEntry{}, nil
+			}),
+		}),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", ts.String()+"/test", strings.NewReader("test body"))
+	qt.Assert(t, qt.IsNil(err))
+	_, err = client.Do(req)
+	qt.Assert(t, qt.ErrorIs(err, context.DeadlineExceeded))
+}
+
+func TestContextCanceledDuringTokenRequest(t *testing.T) {
+	testScope := ParseScope("repository:foo:pull")
+	authSrv := newAuthServer(t, func(req *http.Request) (any, *httpError) {
+		// Never respond; wait until the client gives up.
+		<-req.Context().Done()
+		return nil, &httpError{
+			statusCode: http.StatusServiceUnavailable,
+		}
+	})
+	ts := newTargetServer(t, func(req *http.Request) *httpError {
+		return &httpError{
+			statusCode: http.StatusUnauthorized,
+			header: http.Header{
+				"Www-Authenticate": []string{fmt.Sprintf("Bearer realm=%q,service=someService,scope=%q", authSrv, testScope)},
+			},
+		}
+	})
+	client := &http.Client{
+		Transport: NewStdTransport(StdTransportParams{
+			Config: configFunc(func(host string) (ConfigEntry, error) {
+				return ConfigEntry{}, nil
+			}),
+		}),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", ts.String()+"/test", strings.NewReader("test body"))
+	qt.Assert(t, qt.IsNil(err))
+	start := time.Now()
+	_, err = client.Do(req)
+	qt.Assert(t, qt.ErrorIs(err, context.DeadlineExceeded))
+	qt.Assert(t, qt.IsTrue(time.Since(start) < 30*time.Second))
+}
+
+type contextConfigFunc func(ctx context.Context, host string) (ConfigEntry, error)
+
+func (f contextConfigFunc) EntryForRegistry(host string) (ConfigEntry, error) {
+	return f(context.Background(), host)
+}
+
+func (f contextConfigFunc) EntryForRegistryContext(ctx context.Context, host string) (ConfigEntry, error) {
+	return f(ctx, host)
+}
@@ -2,6 +2,7 @@ package ociauth
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
@@ -12,6 +13,7 @@ import (
 	"runtime"
 	"slices"
 	"strings"
+	"time"
 )
 
 // AuthConfig represents access to system level (e.g. config-file or command-execution based)
@@ -25,6 +27,20 @@ type Config interface {
 	EntryForRegistry(host string) (ConfigEntry, error)
 }
 
+// ContextConfig is implemented by a [Config] whose lookups can be
+// canceled. When the Config used by the transport returned by
+// [NewStdTransport] implements ContextConfig, EntryForRegistryContext
+// is called instead of EntryForRegistry, with the context of the
+// request that needs the auth information.
+type ContextConfig interface {
+	Config
+
+	// EntryForRegistryContext is like EntryForRegistry except
+	// that it should abort promptly, returning ctx.Err(),
+	// if ctx is done before the information is available.
+	EntryForRegistryContext(ctx context.Context, host string) (ConfigEntry, error)
+}
+
 // ConfigEntry holds auth information for a registry.
 // It mirrors the information obtainable from the .docker/config.json
 // file and from the docker credential helper protocol
@@ -32,6 +48,8 @@ type ConfigEntry struct {
 	// RefreshToken holds a token that can be used to obtain an access token.
 	RefreshToken string
 	// AccessToken holds a bearer token to be sent to a registry.
+	// See [ContextWithBearerToken] for a way to supply a token
+	// for individual requests instead.
 	AccessToken string
 	// Username holds the username for use with basic auth.
 	Username string
@@ -40,10 +58,14 @@ type ConfigEntry struct {
 }
 
 // ConfigFile holds auth information for OCI registries as read from a configuration file.
-// It implements [Config].
+// It implements [Config] and [ContextConfig].
 type ConfigFile struct {
 	data   configData
-	runner HelperRunner
+	runner helperRunnerContext
+
+	// envAuths holds credentials read from environment variables,
+	// keyed by the result of envHostKey.
+	envAuths map[string]ConfigEntry
 }
 
 var ErrHelperNotFound = errors.New("helper not found")
@@ -58,6 +80,18 @@ var ErrHelperNotFound = errors.New("helper not found")
 // If the helper doesn't exist, it should return an [ErrHelperNotFound] error.
 type HelperRunner = func(helperName string, serverURL string) (ConfigEntry, error)
 
+// helperRunnerContext is like [HelperRunner] but also
+// takes the context of the lookup.
+type helperRunnerContext = func(ctx context.Context, helperName string, serverURL string) (ConfigEntry, error)
+
+// withoutContext returns a helperRunnerContext that calls runner,
+// ignoring the context.
+func withoutContext(runner HelperRunner) helperRunnerContext {
+	return func(_ context.Context, helperName string, serverURL string) (ConfigEntry, error) {
+		return runner(helperName, serverURL)
+	}
+}
+
 // configData holds the part of ~/.docker/config.json that pertains to auth.
 type configData struct {
 	Auths       map[string]authConfig `json:"auths"`
@@ -89,12 +123,19 @@ type authConfig struct {
 // returned by [os.Environ] instead of calling [os.Getenv]. If env
 // is nil, the current process's environment will be used.
 func LoadWithEnv(runner HelperRunner, env []string) (*ConfigFile, error) {
-	if runner == nil {
-		runner = ExecHelperWithEnv(env)
+	// The default runner kills a helper command when the
+	// context of the lookup is done.
+	runnerCtx := func(ctx context.Context, helperName string, serverURL string) (ConfigEntry, error) {
+		return execHelper(ctx, env, helperName, serverURL)
+	}
+	if runner != nil {
+		runnerCtx = withoutContext(runner)
 	}
 	getenv := os.Getenv
+	envAuths := envCredentials(os.Environ())
 	if env != nil {
 		getenv = getenvFunc(env)
+		envAuths = envCredentials(env)
 	}
 	for _, f := range configFileLocations {
 		filename := f(getenv)
@@ -113,12 +154,14 @@ func LoadWithEnv(runner HelperRunner, env []string) (*ConfigFile, error) {
 			return nil, fmt.Errorf("invalid config file %q: %v", filename, err)
 		}
 		return &ConfigFile{
-			data:   f,
-			runner: runner,
+			data:     f,
+			runner:   runnerCtx,
+			envAuths: envAuths,
 		}, nil
 	}
 	return &ConfigFile{
-		runner: runner,
+		runner:   runnerCtx,
+		envAuths: envAuths,
 	}, nil
 }
 
@@ -128,12 +171,62 @@ func LoadWithEnv(runner HelperRunner, env []string) (*ConfigFile, error) {
 //
 // In order it tries:
 // - $DOCKER_CONFIG/config.json
+// - $REGISTRY_AUTH_FILE
 // - ~/.docker/config.json
 // - $XDG_RUNTIME_DIR/containers/auth.json
+//
+// REGISTRY_AUTH_FILE is the variable used by Podman and other
+// tools based on containers/image to name an auth file explicitly,
+// so it takes precedence over the default locations.
+//
+// Credentials for individual registries can also be provided
+// with environment variables of the form REGISTRY_<HOST>_USERNAME
+// and REGISTRY_<HOST>_PASSWORD, where <HOST> is the registry host
+// name (including any port) converted to upper case, with each dot
+// replaced by an underscore, each dash by two underscores and the
+// colon before the port by three, so that no two hosts share the same
+// variables. For example, credentials for my-registry.example.com
+// can be provided in REGISTRY_MY__REGISTRY_EXAMPLE_COM_USERNAME and
+// REGISTRY_MY__REGISTRY_EXAMPLE_COM_PASSWORD, and those for
+// localhost:5000 in REGISTRY_LOCALHOST___5000_USERNAME and
+// REGISTRY_LOCALHOST___5000_PASSWORD. Credentials can't be provided
+// this way for hosts with any other characters in their names.
+// Such credentials take precedence over any found in the
+// configuration file, including those from helpers. When only one
+// of the two variables is set for a host, it overrides just that
+// field of the entry found in the configuration file, so that
+// the password or token found there is still used.
 func Load(runner HelperRunner) (*ConfigFile, error) {
 	return LoadWithEnv(runner, nil)
 }
 
+// LoadFromDockerConfigJSON returns a [Config] that reads auth
+// information from data, which holds content in the docker
+// config.json format. This is the same format used by the
+// .dockerconfigjson key of Kubernetes secrets, so this can be used
+// to supply credentials from a secret without consulting the
+// filesystem.
+//
+// Credential helpers are never executed: an explicit credHelpers
+// entry for a registry results in an error when that registry is looked
+// up, and a credsStore default is ignored.
+func LoadFromDockerConfigJSON(data []byte) (Config, error) {
+	f, err := decodeConfigFile(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid docker config JSON: %v", err)
+	}
+	return &ConfigFile{
+		data:   f,
+		runner: withoutContext(noHelperRunner),
+	}, nil
+}
+
+// noHelperRunner implements [HelperRunner] by reporting that
+// no helpers are available.
+func noHelperRunner(helperName string, serverURL string) (ConfigEntry, error) {
+	return ConfigEntry{}, fmt.Errorf("%w: cannot run %q helper when loading from docker config JSON", ErrHelperNotFound, helperName)
+}
+
 func getenvFunc(env []string) func(string) string {
 	return func(key string) string {
 		for i := len(env) - 1; i >= 0; i-- {
@@ -145,6 +238,87 @@ func getenvFunc(env []string) func(string) string {
 	}
 }
 
+// envCredentials returns the registry credentials held
+// in env as described in [Load].
+func envCredentials(env []string) map[string]ConfigEntry {
+	var auths map[string]ConfigEntry
+	for _, e := range env {
+		key, val, ok := strings.Cut(e, "=")
+		if !ok {
+			continue
+		}
+		host, ok := strings.CutPrefix(key, "REGISTRY_")
+		if !ok {
+			continue
+		}
+		var isPassword bool
+		if h, ok := strings.CutSuffix(host, "_USERNAME"); ok {
+			host = h
+		} else if h, ok := strings.CutSuffix(host, "_PASSWORD"); ok {
+			host, isPassword = h, true
+		} else {
+			continue
+		}
+		if host == "" {
+			continue
+		}
+		if auths == nil {
+			auths = make(map[string]ConfigEntry)
+		}
+		// Later entries take precedence, as with getenvFunc.
+		entry := auths[host]
+		if isPassword {
+			entry.Password = val
+		} else {
+			entry.Username = val
+		}
+		auths[host] = entry
+	}
+	return auths
+}
+
+// envHostKey returns the form of the given registry host
+// name used in credential environment variable names, or
+// the empty string if the host can't be represented there.
+//
+// In a valid host name, dots only appear between labels, which don't
+// start or end with a dash, and a colon can only appear between the
+// last label and the port, so a run of underscores in the result
+// always has a unique interpretation: one for a dot, three for
+// a colon and an even number for a sequence of dashes.
+func envHostKey(host string) string {
+	name, port, hasPort := strings.Cut(host, ":")
+	if hasPort && (port == "" || strings.Trim(port, "0123456789") != "") {
+		return ""
+	}
+	var buf strings.Builder
+	for i, label := range strings.Split(name, ".") {
+		if label == "" || label[0] == '-' || label[len(label)-1] == '-' {
+			return ""
+		}
+		if i > 0 {
+			buf.WriteString("_")
+		}
+		for _, r := range label {
+			switch {
+			case 'a' <= r && r <= 'z':
+				buf.WriteRune(r - 'a' + 'A')
+			case 'A' <= r && r <= 'Z', '0' <= r && r <= '9':
+				buf.WriteRune(r)
+			case r == '-':
+				buf.WriteString("__")
+			default:
+				return ""
+			}
+		}
+	}
+	if hasPort {
+		buf.WriteString("___")
+		buf.WriteString(port)
+	}
+	return buf.String()
+}
+
 var configFileLocations = []func(func(string) string) string{
 	func(getenv func(string) string) string {
 		if d := getenv("DOCKER_CONFIG"); d != "" {
@@ -152,6 +326,9 @@ var configFileLocations = []func(func(string) string) string{
 		}
 		return ""
 	},
+	func(getenv func(string) string) string {
+		return getenv("REGISTRY_AUTH_FILE")
+	},
 	func(getenv func(string) string) string {
 		if home := userHomeDir(getenv); home != "" {
 			return filepath.Join(home, ".docker", "config.json")
@@ -198,6 +375,43 @@ var userHomeDir = func(getenv func(string) string) string {
 // EntryForRegistry implements [Authorizer.InfoForRegistry].
 // If no registry is found, it returns the zero [ConfigEntry] and a nil error.
 func (c *ConfigFile) EntryForRegistry(registryHostname string) (ConfigEntry, error) {
+	return c.EntryForRegistryContext(context.Background(), registryHostname)
+}
+
+// EntryForRegistryContext implements [ContextConfig.EntryForRegistryContext].
+// When the configuration was loaded without an explicit [HelperRunner],
+// a helper command that is still running when ctx is done is killed.
+func (c *ConfigFile) EntryForRegistryContext(ctx context.Context, registryHostname string) (ConfigEntry, error) {
+	key := envHostKey(registryHostname)
+	envEntry, ok := c.envAuths[key]
+	if !ok || key == "" {
+		return c.configEntryForRegistry(ctx, registryHostname)
+	}
+	if envEntry.Username != "" && envEntry.Password != "" {
+		return envEntry, nil
+	}
+	// The environment only holds part of the credentials,
+	// so merge it with the entry from the configuration.
+	entry, err := c.configEntryForRegistry(ctx, registryHostname)
+	if err != nil {
+		return ConfigEntry{}, err
+	}
+	if envEntry.Username != "" {
+		entry.Username = envEntry.Username
+	}
+	if envEntry.Password != "" {
+		entry.Password = envEntry.Password
+	}
+	if entry.RefreshToken != "" && (entry.Username != "" || entry.Password != "") {
+		return ConfigEntry{}, fmt.Errorf("ambiguous auth credentials")
+	}
+	return entry, nil
+}
+
+// configEntryForRegistry returns the entry for the given
+// registry from the configuration file, ignoring any
+// credentials held in environment variables.
+func (c *ConfigFile) configEntryForRegistry(ctx context.Context, registryHostname string) (ConfigEntry, error) {
 	helper, ok := c.data.CredHelpers[registryHostname]
 	explicit := true
 	if !ok {
@@ -205,7 +419,7 @@ func (c *ConfigFile) EntryForRegistry(registryHostname string) (ConfigEntry, err
 		explicit = false
 	}
 	if helper != "" {
-		entry, err := c.runner(helper, registryHostname)
+		entry, err := c.runner(ctx, helper, registryHostname)
 		if err == nil || explicit || !errors.Is(err, ErrHelperNotFound) {
 			return entry, err
 		}
@@ -313,46 +527,60 @@ func ExecHelper(helperName string, serverURL string) (ConfigEntry, error) {
 // the current process's environment will be used.
 func ExecHelperWithEnv(env []string) HelperRunner {
 	return func(helperName string, serverURL string) (ConfigEntry, error) {
-		var out bytes.Buffer
-		cmd := exec.Command("docker-credential-"+helperName, "get")
-		// TODO this doesn't produce a decent error message for
-		// other helpers such as gcloud that print errors to stderr.
-		cmd.Stdin = strings.NewReader(serverURL)
-		cmd.Stdout = &out
-		cmd.Stderr = &out
-		cmd.Env = env
-		if err := cmd.Run(); err != nil {
-			if !errors.As(err, new(*exec.ExitError)) {
-				if errors.Is(err, exec.ErrNotFound) {
-					return ConfigEntry{}, fmt.Errorf("%w: %v", ErrHelperNotFound, err)
-				}
-				return ConfigEntry{}, fmt.Errorf("cannot run auth helper: %v", err)
-			}
-			t := strings.TrimSpace(out.String())
-			if t == "credentials not found in native keychain" {
-				return ConfigEntry{}, nil
-			}
-			return ConfigEntry{}, fmt.Errorf("error getting credentials: %s", t)
-		}
+		return execHelper(context.Background(), env, helperName, serverURL)
+	}
+}
 
-		// helperCredentials defines the JSON encoding of the data printed
-		// by credentials helper programs.
-		type helperCredentials struct {
-			Username string
-			Secret   string
+// helperWaitDelay holds how long to wait for a helper command's
+// output to be closed after the command has been killed.
+const helperWaitDelay = time.Second
+
+// execHelper implements [ExecHelperWithEnv]. The helper
+// command is killed if ctx is done before it completes.
+func execHelper(ctx context.Context, env []string, helperName string, serverURL string) (ConfigEntry, error) {
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, "docker-credential-"+helperName, "get")
+	// TODO this doesn't produce a decent error message for
+	// other helpers such as gcloud that print errors to stderr.
+	cmd.Stdin = strings.NewReader(serverURL)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	cmd.Env = env
+	cmd.WaitDelay = helperWaitDelay
+	if err := cmd.Run(); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ConfigEntry{}, fmt.Errorf("cannot run auth helper: %w", ctxErr)
 		}
-		var creds helperCredentials
-		if err := json.Unmarshal(out.Bytes(), &creds); err != nil {
-			return ConfigEntry{}, err
+		if !errors.As(err, new(*exec.ExitError)) {
+			if errors.Is(err, exec.ErrNotFound) {
+				return ConfigEntry{}, fmt.Errorf("%w: %v", ErrHelperNotFound, err)
+			}
+			return ConfigEntry{}, fmt.Errorf("cannot run auth helper: %v", err)
 		}
-		if creds.Username == "<token>" {
-			return ConfigEntry{
-				RefreshToken: creds.Secret,
-			}, nil
+		t := strings.TrimSpace(out.String())
+		if t == "credentials not found in native keychain" {
+			return ConfigEntry{}, nil
 		}
+		return ConfigEntry{}, fmt.Errorf("error getting credentials: %s", t)
+	}
+
+	// helperCredentials defines the JSON encoding of the data printed
+	// by credentials helper programs.
+	type helperCredentials struct {
+		Username string
+		Secret   string
+	}
+	var creds helperCredentials
+	if err := json.Unmarshal(out.Bytes(), &creds); err != nil {
+		return ConfigEntry{}, err
+	}
+	if creds.Username == "<token>" {
 		return ConfigEntry{
-			Password: creds.Secret,
-			Username: creds.Username,
+			RefreshToken: creds.Secret,
 		}, nil
 	}
+	return ConfigEntry{
+		Password: creds.Secret,
+		Username: creds.Username,
+	}, nil
 }
@@ -1,6 +1,7 @@
 package ociauth
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io"
@@ -8,6 +9,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/go-quicktest/qt"
 	"github.com/rogpeppe/go-internal/testscript"
@@ -28,6 +30,7 @@ func TestLoadWithNoConfig(t *testing.T) {
 	t.Setenv("HOME", "")
 	t.Setenv("DOCKER_CONFIG", "")
 	t.Setenv("XDG_RUNTIME_DIR", "")
+	t.Setenv("REGISTRY_AUTH_FILE", "")
 	c, err := Load(noRunner)
 	qt.Assert(t, qt.IsNil(err))
 	info, err := c.EntryForRegistry("some.org")
@@ -46,10 +49,18 @@ func TestLoad(t *testing.T) {
 		env  string
 		dir  string
 		file string
+		// envIsFile holds whether the environment variable
+		// names the file itself rather than its directory.
+		envIsFile bool
 	}{{
 		env:  "DOCKER_CONFIG",
 		dir:  "dockerconfig",
 		file: "config.json",
+	}, {
+		env:       "REGISTRY_AUTH_FILE",
+		dir:       "registryauthfile",
+		file:      "auth.json",
+		envIsFile: true,
 	}, {
 		env:  "HOME",
 		dir:  "home",
@@ -61,8 +72,12 @@ func TestLoad(t *testing.T) {
 	}}
 	for _, loc := range locations {
 		epath := filepath.Join(d, loc.dir)
-		t.Setenv(loc.env, epath)
 		cfgPath := filepath.Join(epath, filepath.FromSlash(loc.file))
+		if loc.envIsFile {
+			t.Setenv(loc.env, cfgPath)
+		} else {
+			t.Setenv(loc.env, epath)
+		}
 		err := os.MkdirAll(filepath.Dir(cfgPath), 0o777)
 		qt.Assert(t, qt.IsNil(err))
 		// Write the config file with a username that
@@ -393,6 +408,93 @@ func TestWithHelperAndExplicitEnv(t *testing.T) {
 	}))
 }
 
+func TestWithHelperContextCanceled(t *testing.T) {
+	// Note: "test" matches the executable installed using testscript in RunMain.
+	c, err := load(t, nil, `
+{
+	"credHelpers": {
+		"registry-with-slow-helper.com": "test"
+	}
+}
+`)
+	qt.Assert(t, qt.IsNil(err))
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = c.(ContextConfig).EntryForRegistryContext(ctx, "registry-with-slow-helper.com")
+	qt.Assert(t, qt.ErrorIs(err, context.DeadlineExceeded))
+	qt.Assert(t, qt.ErrorMatches(err, `cannot run auth helper: context deadline exceeded`))
+	// The helper should have been killed rather than
+	// waited for.
+	qt.Assert(t, qt.IsTrue(time.Since(start) < 30*time.Second))
+}
+
+func TestLoadFromDockerConfigJSON(t *testing.T) {
+	// This mirrors the decoded content of the .dockerconfigjson
+	// key in a Kubernetes secret of type kubernetes.io/dockerconfigjson.
+	c, err := LoadFromDockerConfigJSON([]byte(`{
+	"auths": {
+		"registry.example.com": {
+			"username": "testuser",
+			"password": "password",
+			"email": "testuser@example.com",
+			"auth": "dGVzdHVzZXI6cGFzc3dvcmQ="
+		},
+		"https://other.example.com/v1/": {
+			"auth": "b3RoZXJ1c2VyOm90aGVycGFzc3dvcmQ="
+		},
+		"token.example.com": {
+			"identitytoken": "sometoken"
+		}
+	},
+	"credsStore": "desktop"
+}`))
+	qt.Assert(t, qt.IsNil(err))
+
+	info, err := c.EntryForRegistry("registry.example.com")
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.Equals(info, ConfigEntry{
+		Username: "testuser",
+		Password: "password",
+	}))
+
+	info, err = c.EntryForRegistry("other.example.com")
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.Equals(info, ConfigEntry{
+		Username: "otheruser",
+		Password: "otherpassword",
+	}))
+
+	info, err = c.EntryForRegistry("token.example.com")
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.Equals(info, ConfigEntry{
+		RefreshToken: "sometoken",
+	}))
+
+	info, err = c.EntryForRegistry("unknown.example.com")
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.Equals(info, ConfigEntry{}))
+}
+
+func TestLoadFromDockerConfigJSONWithHelper(t *testing.T) {
+	c, err := LoadFromDockerConfigJSON([]byte(`{
+	"credHelpers": {
+		"registry.example.com": "ecr-login"
+	}
+}`))
+	qt.Assert(t, qt.IsNil(err))
+	_, err = c.EntryForRegistry("registry.example.com")
+	qt.Check(t, qt.ErrorIs(err, ErrHelperNotFound))
+}
+
+func TestLoadFromDockerConfigJSONMalformed(t *testing.T) {
+	_, err := LoadFromDockerConfigJSON([]byte(`{"auths": {"registry.example.com": {"auth": "!!!"}}}`))
+	qt.Check(t, qt.ErrorMatches(err, `invalid docker config JSON: cannot decode auth field for "registry.example.com": invalid base64-encoded string`))
+
+	_, err = LoadFromDockerConfigJSON([]byte(`not json`))
+	qt.Check(t, qt.ErrorMatches(err, `invalid docker config JSON: decode failed: .*`))
+}
+
 func load(t *testing.T, runner HelperRunner, cfgData string) (Config, error) {
 	d := t.TempDir()
 	t.Setenv("DOCKER_CONFIG", d)
@@ -438,9 +540,198 @@ func helperMain() int {
 	case "registry-with-error.com":
 		fmt.Fprintf(os.Stderr, "some error\n")
 		return 1
+	case "registry-with-slow-helper.com":
+		time.Sleep(time.Minute)
+		return 1
 	default:
 		fmt.Printf("credentials not found in native keychain\n")
 		return 1
 	}
 	return 0
 }
+
+func TestWithEnvCredentials(t *testing.T) {
+	d := t.TempDir()
+	err := os.WriteFile(filepath.Join(d, "config.json"), []byte(`
+{
+	"auths": {
+		"registry.example.com": {
+			"username": "fileuser",
+			"password": "filepassword"
+		},
+		"other.example.com": {
+			"username": "otheruser",
+			"password": "otherpassword"
+		}
+	}
+}
+`), 0o666)
+	qt.Assert(t, qt.IsNil(err))
+	c, err := LoadWithEnv(noRunner, []string{
+		"DOCKER_CONFIG=" + d,
+		"REGISTRY_REGISTRY_EXAMPLE_COM_USERNAME=envuser",
+		"REGISTRY_REGISTRY_EXAMPLE_COM_PASSWORD=envpassword",
+		"REGISTRY_LOCALHOST___5000_USERNAME=localuser",
+		"REGISTRY_LOCALHOST___5000_PASSWORD=wrong",
+		"REGISTRY_LOCALHOST___5000_PASSWORD=localpassword",
+		"REGISTRY__USERNAME=nobody",
+	})
+	qt.Assert(t, qt.IsNil(err))
+
+	// Environment variables take precedence over the config file.
+	info, err := c.EntryForRegistry("registry.example.com")
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.Equals(info, ConfigEntry{
+		Username: "envuser",
+		Password: "envpassword",
+	}))
+
+	// Later variables take precedence over earlier ones.
+	info, err = c.EntryForRegistry("localhost:5000")
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.Equals(info, ConfigEntry{
+		Username: "localuser",
+		Password: "localpassword",
+	}))
+
+	// Hosts without variables still use the config file.
+	info, err = c.EntryForRegistry("other.example.com")
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.Equals(info, ConfigEntry{
+		Username: "otheruser",
+		Password: "otherpassword",
+	}))
+}
+
+func TestWithEnvCredentialsPartial(t *testing.T) {
+	d := t.TempDir()
+	err := os.WriteFile(filepath.Join(d, "config.json"), []byte(`
+{
+	"auths": {
+		"registry.example.com": {
+			"username": "fileuser",
+			"password": "filepassword"
+		},
+		"token.example.com": {
+			"registrytoken": "filetoken"
+		},
+		"password.example.com": {
+			"username": "fileuser",
+			"password": "filepassword"
+		}
+	}
+}
+`), 0o666)
+	qt.Assert(t, qt.IsNil(err))
+	c, err := LoadWithEnv(noRunner, []string{
+		"DOCKER_CONFIG=" + d,
+		"REGISTRY_REGISTRY_EXAMPLE_COM_USERNAME=envuser",
+		"REGISTRY_TOKEN_EXAMPLE_COM_USERNAME=envuser",
+		"REGISTRY_PASSWORD_EXAMPLE_COM_PASSWORD=envpassword",
+		"REGISTRY_NOCONFIG_EXAMPLE_COM_USERNAME=envuser",
+	})
+	qt.Assert(t, qt.IsNil(err))
+
+	// A username on its own keeps the password from the config file.
+	info, err := c.EntryForRegistry("registry.example.com")
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.Equals(info, ConfigEntry{
+		Username: "envuser",
+		Password: "filepassword",
+	}))
+
+	// ... and any token.
+	info, err = c.EntryForRegistry("token.example.com")
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.Equals(info, ConfigEntry{
+		Username:    "envuser",
+		AccessToken: "filetoken",
+	}))
+
+	// A password on its own keeps the username.
+	info, err = c.EntryForRegistry("password.example.com")
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.Equals(info, ConfigEntry{
+		Username: "fileuser",
+		Password: "envpassword",
+	}))
+
+	// Without a config entry, the variable is used as is.
+	info, err = c.EntryForRegistry("noconfig.example.com")
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.Equals(info, ConfigEntry{
+		Username: "envuser",
+	}))
+}
+
+func TestWithEnvCredentialsNoConfig(t *testing.T) {
+	qt.Patch(t, &userHomeDir, func(getenv func(string) string) string {
+		return getenv("HOME")
+	})
+	t.Setenv("HOME", "")
+	t.Setenv("DOCKER_CONFIG", "")
+	t.Setenv("XDG_RUNTIME_DIR", "")
+	t.Setenv("REGISTRY_AUTH_FILE", "")
+	t.Setenv("REGISTRY_SOME_ORG_USERNAME", "someuser")
+	t.Setenv("REGISTRY_SOME_ORG_PASSWORD", "somepassword")
+	c, err := Load(noRunner)
+	qt.Assert(t, qt.IsNil(err))
+	info, err := c.EntryForRegistry("some.org")
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.Equals(info, ConfigEntry{
+		Username: "someuser",
+		Password: "somepassword",
+	}))
+}
+
+func TestWithEnvCredentialsAmbiguous(t *testing.T) {
+	d := t.TempDir()
+	err := os.WriteFile(filepath.Join(d, "config.json"), []byte(`
+{
+	"auths": {
+		"registry.example.com": {
+			"identitytoken": "filetoken"
+		}
+	}
+}
+`), 0o666)
+	qt.Assert(t, qt.IsNil(err))
+	c, err := LoadWithEnv(noRunner, []string{
+		"DOCKER_CONFIG=" + d,
+		"REGISTRY_REGISTRY_EXAMPLE_COM_USERNAME=envuser",
+	})
+	qt.Assert(t, qt.IsNil(err))
+
+	// A username can't be combined with an identity token
+	// any more than it can in the config file.
+	_, err = c.EntryForRegistry("registry.example.com")
+	qt.Assert(t, qt.ErrorMatches(err, `ambiguous auth credentials`))
+}
+
+func TestEnvHostKey(t *testing.T) {
+	for _, test := range []struct {
+		host string
+		want string
+	}{
+		{"registry.example.com", "REGISTRY_EXAMPLE_COM"},
+		{"Registry.Example.com", "REGISTRY_EXAMPLE_COM"},
+		{"my-reg.io", "MY__REG_IO"},
+		{"xn--bcher-kva.example", "XN____BCHER__KVA_EXAMPLE"},
+		{"localhost:5000", "LOCALHOST___5000"},
+		{"127.0.0.1:5000", "127_0_0_1___5000"},
+		{"my_reg.io", ""},
+		{"-reg.io", ""},
+		{"reg-.io", ""},
+		{"reg..io", ""},
+		{"localhost:", ""},
+		{"localhost:port", ""},
+		{"[::1]:5000", ""},
+		{"", ""},
+	} {
+		qt.Check(t, qt.Equals(envHostKey(test.host), test.want), qt.Commentf("host %q", test.host))
+	}
+
+	// Hosts that differ only in punctuation have different keys.
+	qt.Check(t, qt.Not(qt.Equals(envHostKey("my-reg.io"), envHostKey("my.reg.io"))))
+	qt.Check(t, qt.Not(qt.Equals(envHostKey("localhost:5000"), envHostKey("localhost.5000"))))
+}
@@ -2,6 +2,7 @@ package ociauth
 
 import (
 	"net/http"
+	"slices"
 	"strings"
 )
 
@@ -53,8 +54,12 @@ type authHeader struct {
 	params map[string]string
 }
 
-func challengeFromResponse(resp *http.Response) *authHeader {
+// challengeFromResponse returns the challenge in resp to respond to:
+// the one whose scheme comes first in schemePriority.
+// Challenges with schemes that aren't in schemePriority are ignored.
+func challengeFromResponse(resp *http.Response, schemePriority []string) *authHeader {
 	var h *authHeader
+	hPriority := len(schemePriority)
 	for _, chalStr := range resp.Header["Www-Authenticate"] {
 		h1 := parseWWWAuthenticate(chalStr)
 		if h1 == nil {
@@ -63,11 +68,8 @@ func challengeFromResponse(resp *http.Response) *authHeader {
 		if h1.scheme != "basic" && h1.scheme != "bearer" {
 			continue
 		}
-		if h == nil {
-			h = h1
-		} else if h1.scheme == "basic" && h.scheme == "bearer" {
-			// We prefer basic auth to bearer auth.
-			h = h1
+		if p := slices.Index(schemePriority, h1.scheme); p >= 0 && p < hPriority {
+			h, hPriority = h1, p
 		}
 	}
 	return h
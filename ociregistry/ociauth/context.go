@@ -2,6 +2,7 @@ package ociauth
 
 import (
 	"context"
+	"net/http"
 )
 
 type scopeKey struct{}
@@ -51,3 +52,109 @@ func RequestInfoFromContext(ctx context.Context) RequestInfo {
 	info, _ := ctx.Value(requestInfoKey{}).(RequestInfo)
 	return info
 }
+
+type secureAuthOnlyKey struct{}
+
+// ContextWithSecureAuthOnly returns ctx annotated so that the
+// ociauth transport will not add any authorization (bearer tokens or
+// basic credentials) to requests that are not made over https.
+// Such requests are sent as is, so that credentials are not exposed
+// over an unencrypted connection.
+//
+// The [ociclient] package adds this to requests unless
+// its AllowInsecureAuth option is set.
+func ContextWithSecureAuthOnly(ctx context.Context) context.Context {
+	return context.WithValue(ctx, secureAuthOnlyKey{}, true)
+}
+
+// SecureAuthOnlyFromContext reports whether ctx has been
+// annotated by [ContextWithSecureAuthOnly].
+func SecureAuthOnlyFromContext(ctx context.Context) bool {
+	b, _ := ctx.Value(secureAuthOnlyKey{}).(bool)
+	return b
+}
+
+type requestHookKey struct{}
+
+// ContextWithRequestHook returns ctx annotated with a function
+// that the ociauth transport calls with each request just before
+// passing it to the underlying transport, after any authorization
+// has been added. This includes requests that are sent again
+// with new authorization after an authorization challenge.
+// The function may modify the request.
+//
+// The [ociclient] package adds this to requests when its
+// OnRequest option is set.
+func ContextWithRequestHook(ctx context.Context, hook func(req *http.Request)) context.Context {
+	return context.WithValue(ctx, requestHookKey{}, hook)
+}
+
+// RequestHookFromContext returns the function added to ctx by
+// [ContextWithRequestHook], or nil if there is none.
+func RequestHookFromContext(ctx context.Context) func(req *http.Request) {
+	hook, _ := ctx.Value(requestHookKey{}).(func(req *http.Request))
+	return hook
+}
+
+type bearerTokenKey struct{}
+
+// BearerToken holds a bearer token that has already been acquired
+// by some other means, along with the registry and scope that
+// it was issued for. See [ContextWithBearerToken].
+type BearerToken struct {
+	// Host holds the host (and port, if any) of the registry
+	// that the token was issued for, as found in [net/url.URL.Host].
+	Host string
+
+	// Scope holds the scope that the token grants.
+	// Use [UnlimitedScope] for a token that can be
+	// used for any request to the registry.
+	Scope Scope
+
+	// Token holds the token itself.
+	Token string
+}
+
+// ContextWithBearerToken returns ctx annotated with a bearer token
+// that has already been acquired by some other means. When the
+// ociauth transport receives a request to tok.Host whose required
+// scope (see [ContextWithRequestInfo]) is held by tok.Scope, it sends
+// tok.Token in the Authorization header and bypasses its usual
+// logic entirely: the auth configuration isn't consulted, no token
+// server is contacted, and a 401 (Unauthorized) response is returned
+// to the caller as is rather than being treated as a challenge.
+//
+// Requests to any other host, such as the target of a redirect
+// to blob storage, don't get the token, and are treated as
+// if there were no token in the context.
+//
+// This differs from [ConfigEntry.AccessToken], which applies to all
+// requests to a registry and is used as the initial token for that
+// registry only: the usual challenge flow still applies when the
+// registry rejects it.
+//
+// The token is still subject to [ContextWithSecureAuthOnly].
+func ContextWithBearerToken(ctx context.Context, tok BearerToken) context.Context {
+	return context.WithValue(ctx, bearerTokenKey{}, tok)
+}
+
+// BearerTokenFromContext returns any bearer token associated with the
+// context by [ContextWithBearerToken]. It reports whether
+// a token was found.
+func BearerTokenFromContext(ctx context.Context) (BearerToken, bool) {
+	tok, ok := ctx.Value(bearerTokenKey{}).(BearerToken)
+	return tok, ok
+}
+
+// bearerTokenForRequest returns the token from [ContextWithBearerToken]
+// that applies to req, or the empty string if there is none.
+func bearerTokenForRequest(req *http.Request) string {
+	tok, ok := BearerTokenFromContext(req.Context())
+	if !ok || tok.Token == "" || tok.Host != req.URL.Host {
+		return ""
+	}
+	if !tok.Scope.Contains(RequestInfoFromContext(req.Context()).RequiredScope) {
+		return ""
+	}
+	return tok.Token
+}
@@ -0,0 +1,48 @@
+package ociauth
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+)
+
+// JWTScope returns the scope granted by token when it's a JWT
+// holding an "access" claim in the form described by the
+// [token spec]. It reports false if the token is not in that form.
+//
+// The token's signature is not verified: the result is only
+// useful as a hint as to which requests the token might authorize.
+// It is suitable for use as [StdTransportParams.InspectToken].
+//
+// [token spec]: https://distribution.github.io/distribution/spec/auth/jwt/
+func JWTScope(token string) (Scope, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Scope{}, false
+	}
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return Scope{}, false
+	}
+	var claims struct {
+		Access *[]struct {
+			Type    string   `json:"type"`
+			Name    string   `json:"name"`
+			Actions []string `json:"actions"`
+		} `json:"access"`
+	}
+	if err := json.Unmarshal(data, &claims); err != nil || claims.Access == nil {
+		return Scope{}, false
+	}
+	var rss []ResourceScope
+	for _, entry := range *claims.Access {
+		for _, action := range entry.Actions {
+			rss = append(rss, ResourceScope{
+				ResourceType: entry.Type,
+				Resource:     entry.Name,
+				Action:       action,
+			})
+		}
+	}
+	return NewScope(rss...), true
+}
@@ -0,0 +1,82 @@
+package ociauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"cuelabs.dev/go/oci/ociregistry"
+)
+
+// Validate checks whether the credentials used by transport (usually
+// a transport returned by [NewStdTransport]) are accepted by the
+// registry at the given host for the given scope. This is useful for
+// "login" commands that want to check credentials without pulling or
+// pushing anything.
+//
+// It goes through the usual challenge and token flow using a request
+// to the registry's /v2/ endpoint, which is cheap and available on all
+// registries, requiring the given scope to be authorized. The scope
+// may be empty, in which case only the ability to talk to the
+// registry at all is checked.
+//
+// Requests are made using HTTPS. To use plain HTTP, for example for a
+// local registry, prefix the host with "http://".
+//
+// It returns an error wrapping [ociregistry.ErrUnauthorized] or
+// [ociregistry.ErrDenied] when the registry or its token server
+// rejects the credentials.
+func Validate(ctx context.Context, transport http.RoundTripper, host string, scope Scope) error {
+	u := host
+	if !strings.HasPrefix(host, "http://") && !strings.HasPrefix(host, "https://") {
+		u = "https://" + host
+	}
+	u = strings.TrimSuffix(u, "/") + "/v2/"
+	ctx = ContextWithRequestInfo(ctx, RequestInfo{
+		RequiredScope: scope,
+	})
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{
+		Transport: transport,
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		// The token server might have rejected the credentials.
+		var herr ociregistry.HTTPError
+		if errors.As(err, &herr) {
+			if authErr := authErrorForStatus(herr.StatusCode()); authErr != nil {
+				return fmt.Errorf("%w: %v", authErr, err)
+			}
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	data, _ := io.ReadAll(resp.Body)
+	underlying := authErrorForStatus(resp.StatusCode)
+	if underlying == nil {
+		underlying = fmt.Errorf("unexpected response from %s", u)
+	}
+	return ociregistry.NewHTTPError(underlying, resp.StatusCode, resp, data)
+}
+
+// authErrorForStatus returns the error corresponding to an
+// authorization failure with the given HTTP status code,
+// or nil if the status doesn't indicate such a failure.
+func authErrorForStatus(code int) error {
+	switch code {
+	case http.StatusUnauthorized:
+		return ociregistry.ErrUnauthorized
+	case http.StatusForbidden:
+		return ociregistry.ErrDenied
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package ociauth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-quicktest/qt"
+
+	"cuelabs.dev/go/oci/ociregistry"
+)
+
+func TestValidate(t *testing.T) {
+	testScope := ParseScope("repository:foo:pull")
+	var tokenScopes []Scope
+	authSrv := newAuthServer(t, func(req *http.Request) (any, *httpError) {
+		username, password, ok := req.BasicAuth()
+		if !ok || username != "testuser" || password != "testpassword" {
+			return nil, &httpError{
+				statusCode: http.StatusUnauthorized,
+			}
+		}
+		scope := ParseScope(req.Form.Get("scope"))
+		tokenScopes = append(tokenScopes, scope)
+		return &wireToken{
+			Token: token{scope}.String(),
+		}, nil
+	})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/v2/" {
+			http.Error(w, "unexpected path", http.StatusNotFound)
+			return
+		}
+		if req.Header.Get("Authorization") == "" {
+			w.Header().Set("Www-Authenticate", fmt.Sprintf("Bearer realm=%q,service=someService", authSrv))
+			ociregistry.WriteError(w, ociregistry.ErrUnauthorized)
+			return
+		}
+	}))
+	defer srv.Close()
+	transport := func(username, password string) http.RoundTripper {
+		return NewStdTransport(StdTransportParams{
+			Config: configFunc(func(host string) (ConfigEntry, error) {
+				return ConfigEntry{
+					Username: username,
+					Password: password,
+				}, nil
+			}),
+		})
+	}
+	ctx := context.Background()
+
+	// Valid credentials acquire a token for the scope.
+	err := Validate(ctx, transport("testuser", "testpassword"), srv.URL, testScope)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.DeepEquals(tokenScopes, []Scope{testScope}))
+
+	// Invalid credentials are rejected by the token server.
+	err = Validate(ctx, transport("testuser", "wrong"), srv.URL, testScope)
+	qt.Assert(t, qt.ErrorIs(err, ociregistry.ErrUnauthorized))
+	qt.Assert(t, qt.ErrorMatches(err, `.*401 Unauthorized.*`))
+}
+
+func TestValidateBasicAuth(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		username, password, _ := req.BasicAuth()
+		if username != "testuser" || password != "testpassword" {
+			w.Header().Set("Www-Authenticate", "Basic")
+			ociregistry.WriteError(w, ociregistry.ErrUnauthorized)
+			return
+		}
+	}))
+	defer srv.Close()
+	transport := func(password string) http.RoundTripper {
+		return NewStdTransport(StdTransportParams{
+			Config: configFunc(func(host string) (ConfigEntry, error) {
+				return ConfigEntry{
+					Username: "testuser",
+					Password: password,
+				}, nil
+			}),
+		})
+	}
+	ctx := context.Background()
+
+	err := Validate(ctx, transport("testpassword"), srv.URL, Scope{})
+	qt.Assert(t, qt.IsNil(err))
+
+	err = Validate(ctx, transport("wrong"), srv.URL, Scope{})
+	qt.Assert(t, qt.ErrorIs(err, ociregistry.ErrUnauthorized))
+}
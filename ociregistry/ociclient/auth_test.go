@@ -123,12 +123,6 @@ func assertAuthScope(t *testing.T, host string, scope string, f func(ctx context
 	qt.Assert(t, qt.Equals(mapsKeys(requestedScopes)[0], scope))
 }
 
-type transportFunc func(req *http.Request) (*http.Response, error)
-
-func (f transportFunc) RoundTrip(req *http.Request) (*http.Response, error) {
-	return f(req)
-}
-
 // TODO: replace with maps.Keys once Go adds it
 func mapsKeys[M ~map[K]V, K comparable, V any](m M) []K {
 	r := make([]K, 0, len(m))
@@ -137,3 +131,45 @@ func mapsKeys[M ~map[K]V, K comparable, V any](m M) []K {
 	}
 	return r
 }
+
+func TestInsecureAuth(t *testing.T) {
+	var gotAuth []string
+	backend := ociserver.New(ocimem.New(), nil)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		auth := req.Header.Get("Authorization")
+		gotAuth = append(gotAuth, auth)
+		if user, pass, ok := req.BasicAuth(); !ok || user != "someuser" || pass != "somepassword" {
+			w.Header().Set("Www-Authenticate", `Basic realm="test"`)
+			ociregistry.WriteError(w, ociregistry.ErrUnauthorized)
+			return
+		}
+		backend.ServeHTTP(w, req)
+	}))
+	defer srv.Close()
+	srvURL, _ := url.Parse(srv.URL)
+
+	config, err := ociauth.LoadFromDockerConfigJSON([]byte(`{"auths":{"` + srvURL.Host + `":{"auth":"c29tZXVzZXI6c29tZXBhc3N3b3Jk"}}}`))
+	qt.Assert(t, qt.IsNil(err))
+	newClient := func(allowInsecureAuth bool) ociregistry.Interface {
+		r, err := New(srvURL.Host, &Options{
+			Insecure: true,
+			Transport: ociauth.NewStdTransport(ociauth.StdTransportParams{
+				Config: config,
+			}),
+			AllowInsecureAuth: allowInsecureAuth,
+		})
+		qt.Assert(t, qt.IsNil(err))
+		return r
+	}
+	ctx := context.Background()
+
+	// By default, credentials are withheld over plain HTTP.
+	_, err = ociregistry.All(newClient(false).Repositories(ctx, ""))
+	qt.Assert(t, qt.ErrorIs(err, ociregistry.ErrUnauthorized))
+	qt.Check(t, qt.DeepEquals(gotAuth, []string{""}))
+
+	gotAuth = nil
+	_, err = ociregistry.All(newClient(true).Repositories(ctx, ""))
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.DeepEquals(gotAuth, []string{"", "Basic c29tZXVzZXI6c29tZXBhc3N3b3Jk"}))
+}
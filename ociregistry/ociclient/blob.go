@@ -0,0 +1,86 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociclient
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"cuelabs.dev/go/oci/ociregistry"
+)
+
+// GetBlobInto reads the entire content of the blob with the given
+// digest from r into dst, returning the number of bytes read and the
+// blob's descriptor. It's intended for reading many small blobs
+// without allocating a new buffer for each one.
+//
+// As with [GetManifestContent], the content is checked against the
+// size and digest in the descriptor returned by r.
+//
+// If the blob is larger than dst, nothing is read and the returned
+// error wraps [io.ErrShortBuffer]. In that case the returned
+// descriptor is still valid, so the caller can allocate a larger
+// buffer and try again.
+//
+// If the size in the descriptor is unknown (-1), as with a registry
+// that reports no Content-Length, as much content as fits in dst is
+// read and checked against the digest, and the returned descriptor
+// holds the actual size. A blob that doesn't fit is reported as above,
+// except that some content may have been read into dst.
+func GetBlobInto(ctx context.Context, r ociregistry.Interface, repo string, dig ociregistry.Digest, dst []byte) (int, ociregistry.Descriptor, error) {
+	rd, err := r.GetBlob(ctx, repo, dig)
+	if err != nil {
+		return 0, ociregistry.Descriptor{}, err
+	}
+	defer rd.Close()
+	desc := rd.Descriptor()
+	if desc.Size < -1 {
+		return 0, ociregistry.Descriptor{}, fmt.Errorf("invalid blob size %d: %w", desc.Size, ociregistry.ErrSizeInvalid)
+	}
+	if desc.Size > int64(len(dst)) {
+		return 0, desc, fmt.Errorf("%w: blob of size %d does not fit in buffer of size %d", io.ErrShortBuffer, desc.Size, len(dst))
+	}
+	var data []byte
+	if desc.Size >= 0 {
+		data = dst[:desc.Size]
+		if _, err := io.ReadFull(rd, data); err != nil {
+			if err == io.ErrUnexpectedEOF || err == io.EOF {
+				return 0, ociregistry.Descriptor{}, fmt.Errorf("blob shorter than expected size %d: %w", desc.Size, ociregistry.ErrSizeInvalid)
+			}
+			return 0, ociregistry.Descriptor{}, fmt.Errorf("cannot read blob: %w", err)
+		}
+	} else {
+		// The size isn't known, so read as much as fits.
+		n, err := io.ReadFull(rd, dst)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return 0, ociregistry.Descriptor{}, fmt.Errorf("cannot read blob: %w", err)
+		}
+		data = dst[:n]
+	}
+	// Check that there's no more content.
+	var extra [1]byte
+	if n, _ := rd.Read(extra[:]); n > 0 {
+		if desc.Size < 0 {
+			return 0, desc, fmt.Errorf("%w: blob does not fit in buffer of size %d", io.ErrShortBuffer, len(dst))
+		}
+		return 0, ociregistry.Descriptor{}, fmt.Errorf("blob longer than expected size %d: %w", desc.Size, ociregistry.ErrSizeInvalid)
+	}
+	if !desc.Digest.Algorithm().Available() || desc.Digest.Algorithm().FromBytes(data) != desc.Digest {
+		return 0, ociregistry.Descriptor{}, fmt.Errorf("blob digest mismatch: %w", ociregistry.ErrDigestInvalid)
+	}
+	desc.Size = int64(len(data))
+	return len(data), desc, nil
+}
@@ -0,0 +1,167 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociclient
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/go-quicktest/qt"
+	"github.com/opencontainers/go-digest"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ocimem"
+	"cuelabs.dev/go/oci/ociregistry/ociserver"
+)
+
+func TestGetBlobInto(t *testing.T) {
+	ctx := context.Background()
+	content := "some blob content"
+	desc := ociregistry.Descriptor{
+		MediaType: "application/octet-stream",
+		Digest:    digest.FromString(content),
+		Size:      int64(len(content)),
+	}
+	backend := ocimem.New()
+	_, err := backend.PushBlob(ctx, "foo/bar", desc, strings.NewReader(content))
+	qt.Assert(t, qt.IsNil(err))
+	srv := httptest.NewServer(ociserver.New(backend, nil))
+	defer srv.Close()
+	srvURL, _ := url.Parse(srv.URL)
+	r, err := New(srvURL.Host, &Options{
+		Insecure: true,
+	})
+	qt.Assert(t, qt.IsNil(err))
+
+	// Exactly the right size.
+	buf := make([]byte, len(content))
+	n, gotDesc, err := GetBlobInto(ctx, r, "foo/bar", desc.Digest, buf)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.Equals(string(buf[:n]), content))
+	qt.Check(t, qt.Equals(gotDesc.Digest, desc.Digest))
+	qt.Check(t, qt.Equals(gotDesc.Size, desc.Size))
+
+	// A larger buffer can be reused.
+	buf = make([]byte, 100)
+	for range 2 {
+		n, _, err = GetBlobInto(ctx, r, "foo/bar", desc.Digest, buf)
+		qt.Assert(t, qt.IsNil(err))
+		qt.Check(t, qt.Equals(string(buf[:n]), content))
+	}
+
+	// Too small.
+	buf = make([]byte, len(content)-1)
+	n, gotDesc, err = GetBlobInto(ctx, r, "foo/bar", desc.Digest, buf)
+	qt.Check(t, qt.ErrorIs(err, io.ErrShortBuffer))
+	qt.Check(t, qt.Equals(n, 0))
+	qt.Check(t, qt.Equals(gotDesc.Size, desc.Size))
+
+	_, _, err = GetBlobInto(ctx, r, "foo/bar", digest.FromString("other"), buf)
+	qt.Check(t, qt.ErrorIs(err, ociregistry.ErrBlobUnknown))
+}
+
+func TestGetBlobIntoVerifies(t *testing.T) {
+	ctx := context.Background()
+	content := "some blob content"
+	tests := []struct {
+		testName string
+		desc     ociregistry.Descriptor
+		bufSize  int
+		wantErr  error
+	}{{
+		testName: "DigestMismatch",
+		desc: ociregistry.Descriptor{
+			Digest: digest.FromString("other"),
+			Size:   int64(len(content)),
+		},
+		wantErr: ociregistry.ErrDigestInvalid,
+	}, {
+		testName: "TooShort",
+		desc: ociregistry.Descriptor{
+			Digest: digest.FromString(content),
+			Size:   int64(len(content)) + 1,
+		},
+		wantErr: ociregistry.ErrSizeInvalid,
+	}, {
+		testName: "TooLong",
+		desc: ociregistry.Descriptor{
+			Digest: digest.FromString(content),
+			Size:   int64(len(content)) - 1,
+		},
+		wantErr: ociregistry.ErrSizeInvalid,
+	}, {
+		testName: "NegativeSize",
+		desc: ociregistry.Descriptor{
+			Digest: digest.FromString(content),
+			Size:   -5,
+		},
+		wantErr: ociregistry.ErrSizeInvalid,
+	}, {
+		testName: "LargerThanBuffer",
+		desc: ociregistry.Descriptor{
+			Digest: digest.FromString(content),
+			Size:   int64(len(content)),
+		},
+		bufSize: 5,
+		wantErr: io.ErrShortBuffer,
+	}, {
+		testName: "UnknownSize",
+		desc: ociregistry.Descriptor{
+			Digest: digest.FromString(content),
+			Size:   -1,
+		},
+	}, {
+		testName: "UnknownSizeDigestMismatch",
+		desc: ociregistry.Descriptor{
+			Digest: digest.FromString("other"),
+			Size:   -1,
+		},
+		wantErr: ociregistry.ErrDigestInvalid,
+	}, {
+		testName: "UnknownSizeLargerThanBuffer",
+		desc: ociregistry.Descriptor{
+			Digest: digest.FromString(content),
+			Size:   -1,
+		},
+		bufSize: 5,
+		wantErr: io.ErrShortBuffer,
+	}}
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			r := &ociregistry.Funcs{
+				GetBlob_: func(ctx context.Context, repo string, digest ociregistry.Digest) (ociregistry.BlobReader, error) {
+					return ocimem.NewBytesReader([]byte(content), test.desc), nil
+				},
+			}
+			bufSize := test.bufSize
+			if bufSize == 0 {
+				bufSize = 100
+			}
+			buf := make([]byte, bufSize)
+			n, desc, err := GetBlobInto(ctx, r, "foo/bar", test.desc.Digest, buf)
+			if test.wantErr != nil {
+				qt.Check(t, qt.ErrorIs(err, test.wantErr))
+				return
+			}
+			qt.Assert(t, qt.IsNil(err))
+			qt.Check(t, qt.Equals(string(buf[:n]), content))
+			qt.Check(t, qt.Equals(desc.Size, int64(len(content))))
+		})
+	}
+}
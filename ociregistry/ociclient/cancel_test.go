@@ -0,0 +1,174 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociclient
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-quicktest/qt"
+	"github.com/opencontainers/go-digest"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ocimem"
+	"cuelabs.dev/go/oci/ociregistry/ociserver"
+)
+
+func TestBlobWriterCancel(t *testing.T) {
+	ctx := context.Background()
+	const uploadPath = "/v2/foo/blobs/uploads/someid"
+	var (
+		mu       sync.Mutex
+		canceled bool
+		requests []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.Copy(io.Discard, req.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, req.Method+" "+req.URL.Path)
+		switch {
+		case req.Method == "POST" && req.URL.Path == "/v2/foo/blobs/uploads/":
+			w.Header().Set("Location", uploadPath)
+			w.WriteHeader(http.StatusAccepted)
+		case req.URL.Path != uploadPath:
+			http.NotFound(w, req)
+		case canceled:
+			ociregistry.WriteError(w, ociregistry.ErrBlobUploadUnknown)
+		case req.Method == "PATCH":
+			w.Header().Set("Location", uploadPath)
+			w.WriteHeader(http.StatusAccepted)
+		case req.Method == "DELETE":
+			canceled = true
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "unexpected request", http.StatusMethodNotAllowed)
+		}
+	}))
+	defer srv.Close()
+	srvURL, _ := url.Parse(srv.URL)
+	r, err := New(srvURL.Host, &Options{
+		Insecure: true,
+	})
+	qt.Assert(t, qt.IsNil(err))
+
+	w, err := r.PushBlobChunked(ctx, "foo", 5)
+	qt.Assert(t, qt.IsNil(err))
+	_, err = w.Write([]byte("hello world"))
+	qt.Assert(t, qt.IsNil(err))
+	id := w.ID()
+
+	err = w.Cancel()
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.DeepEquals(requests, []string{
+		"POST /v2/foo/blobs/uploads/",
+		"PATCH " + uploadPath,
+		"DELETE " + uploadPath,
+	}))
+
+	// The writer can't be used after it's been canceled.
+	_, err = w.Write([]byte("more"))
+	qt.Check(t, qt.ErrorMatches(err, `upload has been canceled`))
+	_, err = w.Commit("sha256:0000000000000000000000000000000000000000000000000000000000000000")
+	qt.Check(t, qt.ErrorMatches(err, `upload has been canceled`))
+	qt.Check(t, qt.IsNil(w.Close()))
+	qt.Check(t, qt.IsNil(w.Cancel()))
+	qt.Check(t, qt.HasLen(requests, 3))
+
+	// The upload session is no longer usable.
+	w, err = r.PushBlobChunkedResume(ctx, "foo", id, 11, 0)
+	qt.Assert(t, qt.IsNil(err))
+	_, err = w.Write([]byte("more"))
+	qt.Assert(t, qt.IsNil(err))
+	err = w.Close()
+	qt.Check(t, qt.ErrorIs(err, ociregistry.ErrBlobUploadUnknown))
+
+	// Canceling an upload that the server doesn't know about succeeds.
+	err = w.Cancel()
+	qt.Check(t, qt.IsNil(err))
+}
+
+func TestBlobWriterCancelAfterCommit(t *testing.T) {
+	ctx := context.Background()
+	handler := ociserver.New(ocimem.New(), nil)
+	var (
+		mu      sync.Mutex
+		deletes []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == "DELETE" {
+			mu.Lock()
+			deletes = append(deletes, req.URL.Path)
+			mu.Unlock()
+		}
+		handler.ServeHTTP(w, req)
+	}))
+	defer srv.Close()
+	srvURL, _ := url.Parse(srv.URL)
+	r, err := New(srvURL.Host, &Options{
+		Insecure: true,
+	})
+	qt.Assert(t, qt.IsNil(err))
+
+	content := []byte("hello world")
+	dig := digest.FromBytes(content)
+	w, err := r.PushBlobChunked(ctx, "foo", 0)
+	qt.Assert(t, qt.IsNil(err))
+	_, err = w.Write(content)
+	qt.Assert(t, qt.IsNil(err))
+	_, err = w.Commit(dig)
+	qt.Assert(t, qt.IsNil(err))
+
+	// A deferred Cancel after a successful Commit does nothing.
+	err = w.Cancel()
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.HasLen(deletes, 0))
+
+	rd, err := r.GetBlob(ctx, "foo", dig)
+	qt.Assert(t, qt.IsNil(err))
+	defer rd.Close()
+	data, err := io.ReadAll(rd)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.Equals(string(data), string(content)))
+}
+
+func TestBlobWriterCancelError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "POST":
+			w.Header().Set("Location", "/v2/foo/blobs/uploads/someid")
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			ociregistry.WriteError(w, ociregistry.ErrDenied)
+		}
+	}))
+	defer srv.Close()
+	srvURL, _ := url.Parse(srv.URL)
+	r, err := New(srvURL.Host, &Options{
+		Insecure: true,
+	})
+	qt.Assert(t, qt.IsNil(err))
+	w, err := r.PushBlobChunked(context.Background(), "foo", 0)
+	qt.Assert(t, qt.IsNil(err))
+	err = w.Cancel()
+	qt.Check(t, qt.ErrorIs(err, ociregistry.ErrDenied))
+	qt.Check(t, qt.IsTrue(strings.HasPrefix(err.Error(), "cannot cancel upload: ")))
+}
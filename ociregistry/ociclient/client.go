@@ -19,15 +19,19 @@ package ociclient
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"fmt"
 	"hash"
 	"io"
 	"log"
 	"net/http"
 	"net/url"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
@@ -50,17 +54,176 @@ type Options struct {
 	// to its RoundTrip method will have an appropriate
 	// [ociauth.RequestInfo] value added, suitable for consumption
 	// by the transport created by [ociauth.NewStdTransport]. If
-	// Transport is nil, [http.DefaultTransport] will be used.
+	// Transport is nil, [http.DefaultTransport] will be used,
+	// or a transport created from TransportConfig if that's set.
 	Transport http.RoundTripper
 
+	// TransportConfig, if non-nil and Transport is nil, is used to
+	// create a dedicated [http.Transport] for the client, so that
+	// connection pooling and timeouts can be tuned without
+	// constructing a transport by hand. It's ignored when
+	// Transport is set.
+	TransportConfig *TransportConfig
+
 	// Insecure specifies whether an http scheme will be used to
 	// address the host instead of https.
 	Insecure bool
 
+	// InsecureSkipTLSVerify causes the client to accept any TLS
+	// certificate presented by the registry, including self-signed
+	// and expired certificates and those issued for other hosts.
+	//
+	// WARNING: this removes all protection against
+	// man-in-the-middle attacks, including the exposure of any
+	// credentials sent to the registry. It is intended only for
+	// testing against local registries and must not be used in
+	// production. A warning is logged the first time a client is
+	// created with this option for each host.
+	//
+	// When it is set, Transport must be nil or an [*http.Transport],
+	// which will be cloned rather than modified in place.
+	// This is unrelated to Insecure, which uses plain HTTP.
+	InsecureSkipTLSVerify bool
+
+	// TLSServerName, if non-empty, overrides the server name used
+	// in the TLS handshake, both to select a certificate with
+	// SNI and to verify the certificate that's presented, while
+	// connections are still made to the host passed to [New].
+	// This is useful when a registry is reached through an IP address
+	// or gateway whose name doesn't match the registry's certificate.
+	//
+	// When it is set, Transport must be nil or an [*http.Transport],
+	// which will be cloned rather than modified in place.
+	TLSServerName string
+
 	// ListPageSize configures the maximum number of results
 	// requested when making list requests. If it's <= zero, it
 	// defaults to DefaultListPageSize.
 	ListPageSize int
+
+	// ConvertSchema1 causes GetManifest and GetTag to convert
+	// legacy Docker schema1 manifests to OCI image manifests.
+	// This involves fetching every layer of the image to
+	// calculate its uncompressed digest, so can be slow.
+	//
+	// Note that the converted manifest has a different digest
+	// from the original, as does the image config generated for it.
+	// The generated config is not present in the registry, so the
+	// client retains it and GetBlob and ResolveBlob will return it.
+	// Only the configs from the 100 most recent conversions are
+	// retained: after that, an older config is unknown until its
+	// manifest is fetched and converted again. ResolveManifest and
+	// ResolveTag are unaffected and continue to describe the
+	// original manifest.
+	//
+	// The original manifest is verified against the requested
+	// digest, or the digest reported by the registry, before it's
+	// converted. For a signed manifest, the digest may be that of
+	// its payload without signatures.
+	ConvertSchema1 bool
+
+	// DisableExpectContinue stops the client from sending an
+	// "Expect: 100-continue" header on requests with a body.
+	// Some proxies mishandle that header and stall the request
+	// until the transport's ExpectContinueTimeout elapses (or
+	// indefinitely if there is no timeout).
+	//
+	// Without the header, the body is sent before the server has
+	// responded, so it's consumed even if the server rejects the
+	// request. In particular, when the server responds with an
+	// authorization challenge, the transport created by
+	// [ociauth.NewStdTransport] cannot retry requests whose body
+	// cannot be rewound, such as blob uploads from an [io.Reader].
+	DisableExpectContinue bool
+
+	// RewriteUploadLocation, if non-nil, is applied to the
+	// (absolute) Location URL returned by the registry in response
+	// to upload requests, and the result is used in its place.
+	// This is a workaround for registries that return upload
+	// locations on internal host names that aren't reachable by
+	// the client: the rewrite can map them to reachable ones.
+	RewriteUploadLocation func(*url.URL) *url.URL
+
+	// AllowInsecureAuth allows authorization to be sent to the
+	// registry over plain HTTP. By default, when Insecure is set,
+	// the transport created by [ociauth.NewStdTransport] will not
+	// add credentials or tokens to requests, so that they're not
+	// leaked if the host turns out not to be local.
+	//
+	// Note that this relies on the transport honoring
+	// [ociauth.ContextWithSecureAuthOnly]; other transports
+	// are not affected.
+	AllowInsecureAuth bool
+
+	// VerifyContentDigestHeader causes GetBlob, GetManifest and
+	// GetTag to check that the Docker-Content-Digest header in the
+	// response, when present, matches the digest of the content
+	// that's actually read, in addition to the requested digest.
+	// Reading the content fails if it does not.
+	//
+	// Without this, when content is requested by digest and the
+	// header holds a different digest, the content is checked
+	// against the header only. Ranged reads with GetBlobRange
+	// are never verified.
+	VerifyContentDigestHeader bool
+
+	// BlobReadRetries, if > 0, causes readers returned by GetBlob
+	// to recover from errors partway through reading the content,
+	// such as a dropped connection, by requesting the rest of
+	// the content with a Range request. At most BlobReadRetries
+	// such requests are made for each reader. The content is
+	// still verified against the blob's digest as a whole.
+	BlobReadRetries int
+
+	// OnRequest, if non-nil, is called with each HTTP request made
+	// by the client, after the URL and all the headers set by the
+	// client have been filled in. It's called for every attempt,
+	// including retries (see Retry). It may modify the request, for
+	// example to add tracing headers or to adjust the URL, or just
+	// log it.
+	//
+	// When Transport was created by [ociauth.NewStdTransport],
+	// OnRequest is called by the transport after authorization
+	// has been added, so it sees any Authorization header, and it's
+	// called again when a request is resent after an authorization
+	// challenge. Otherwise it's called just before the request is
+	// passed to Transport. Modifying authorization headers here
+	// is discouraged.
+	OnRequest func(req *http.Request)
+
+	// IdempotentDelete causes DeleteBlob, DeleteManifest and
+	// DeleteTag to succeed when the item to be deleted
+	// doesn't exist, which makes cleanup code simpler. That is, a
+	// 404 response, or an error that wraps [ociregistry.ErrBlobUnknown]
+	// or [ociregistry.ErrManifestUnknown], is treated as success.
+	IdempotentDelete bool
+
+	// ReferrersCache, if non-nil, is used to cache the
+	// results of Referrers calls. See [ReferrersCache]
+	// for details.
+	ReferrersCache *ReferrersCache
+
+	// ProbeManifestMediaTypes causes the client to find out which
+	// Accept header the registry accepts before making its first
+	// manifest request, rather than always sending the full list
+	// of known manifest media types followed by the */* wildcard.
+	// Some registries reject requests that include the wildcard.
+	//
+	// The probe is a HEAD request for a manifest that doesn't exist,
+	// first with the full list and then, if that's rejected, without
+	// the wildcard. The result is retained for the lifetime of the
+	// client. If the probe is inconclusive, the full list is used,
+	// and the registry isn't probed again for a minute.
+	ProbeManifestMediaTypes bool
+
+	// Retry, if non-nil, causes requests that fail with a
+	// transient error to be retried. See [RetryOptions] for
+	// details. Only idempotent requests (GET, HEAD, PUT and DELETE)
+	// whose body can be sent again (see [http.Request.GetBody])
+	// are retried. Requests that start, continue or complete a blob
+	// upload are never retried, because a failed attempt might have
+	// been partly applied by the server.
+	Retry *RetryOptions
 }
 
 // See https://github.com/google/go-containerregistry/issues/1091
@@ -74,12 +237,37 @@ const DefaultListPageSize = 1000
 
 var debugID int32
 
+// insecureSkipTLSVerifyWarned holds an entry for each host for
+// which the warning about InsecureSkipTLSVerify has been logged,
+// so that it's logged once for each host rather than for every
+// client.
+var insecureSkipTLSVerifyWarned sync.Map
+
 // New returns a registry implementation that uses the OCI
 // HTTP API. A nil opts parameter is equivalent to a pointer
 // to zero Options.
 //
 // The host specifies the host name to talk to; it may
 // optionally be a host:port pair.
+//
+// # Errors
+//
+// Errors resulting from non-OK responses implement
+// [ociregistry.HTTPError]. When the response body holds
+// errors in the format defined by the OCI spec, the error
+// also wraps each of those errors, so [errors.As] with
+// a target of type [ociregistry.Error] will retrieve the
+// first of them, and its Code method returns the
+// spec error code (for example "MANIFEST_UNKNOWN").
+// This is suitable for use as a low-cardinality label
+// when logging or recording metrics.
+//
+// # Uploads
+//
+// Blob uploads are started with a POST to /v2/<name>/blobs/uploads/,
+// with a trailing slash, as in the spec. If the registry responds
+// to that with 404 (Not Found), the client tries again without the
+// trailing slash and, if that works, uses that form from then on.
 func New(host string, opts0 *Options) (ociregistry.Interface, error) {
 	var opts Options
 	if opts0 != nil {
@@ -89,7 +277,11 @@ func New(host string, opts0 *Options) (ociregistry.Interface, error) {
 		opts.DebugID = fmt.Sprintf("id%d", atomic.AddInt32(&debugID, 1))
 	}
 	if opts.Transport == nil {
-		opts.Transport = http.DefaultTransport
+		if opts.TransportConfig != nil {
+			opts.Transport = opts.TransportConfig.newTransport()
+		} else {
+			opts.Transport = http.DefaultTransport
+		}
 	}
 	// Check that it's a valid host by forming a URL from it and checking that it matches.
 	u, err := url.Parse("https://" + host + "/path")
@@ -102,20 +294,96 @@ func New(host string, opts0 *Options) (ociregistry.Interface, error) {
 	if opts.Insecure {
 		u.Scheme = "http"
 	}
+	if opts.InsecureSkipTLSVerify {
+		t, err := cloneTLSTransport(opts.Transport, "InsecureSkipTLSVerify")
+		if err != nil {
+			return nil, err
+		}
+		t.TLSClientConfig.InsecureSkipVerify = true
+		opts.Transport = t
+		if _, warned := insecureSkipTLSVerifyWarned.LoadOrStore(host, true); !warned {
+			log.Printf("ociclient %s: WARNING: TLS certificate verification disabled for %s; do not use this in production", opts.DebugID, host)
+		}
+	}
+	if opts.TLSServerName != "" {
+		t, err := cloneTLSTransport(opts.Transport, "TLSServerName")
+		if err != nil {
+			return nil, err
+		}
+		t.TLSClientConfig.ServerName = opts.TLSServerName
+		opts.Transport = t
+	}
 	if opts.ListPageSize == 0 {
 		opts.ListPageSize = DefaultListPageSize
 	}
+	if opts.Retry != nil {
+		retry := *opts.Retry
+		opts.Retry = &retry
+	}
 	return &client{
 		httpHost:   host,
 		httpScheme: u.Scheme,
 		httpClient: &http.Client{
-			Transport: opts.Transport,
+			Transport: onRequestTransport(opts.Transport, opts.OnRequest),
 		},
-		debugID:      opts.DebugID,
-		listPageSize: opts.ListPageSize,
+		debugID:          opts.DebugID,
+		listPageSize:     opts.ListPageSize,
+		convertSchema1:   opts.ConvertSchema1,
+		expectContinue:   !opts.DisableExpectContinue,
+		rewriteLocation:  opts.RewriteUploadLocation,
+		secureAuthOnly:   !opts.AllowInsecureAuth,
+		verifyHeader:     opts.VerifyContentDigestHeader,
+		referrersCache:   opts.ReferrersCache,
+		blobReadRetries:  opts.BlobReadRetries,
+		idempotentDelete: opts.IdempotentDelete,
+		probeMediaTypes:  opts.ProbeManifestMediaTypes,
+		retry:            opts.Retry,
+		schema1Configs:   make(map[digest.Digest][]byte),
 	}, nil
 }
 
+// onRequestTransport returns a transport that calls hook with each
+// request sent with t. When t calls the hook itself after adding
+// authorization (see [ociauth.CallsRequestHook]), the hook is
+// passed to it in the request context.
+func onRequestTransport(t http.RoundTripper, hook func(*http.Request)) http.RoundTripper {
+	if hook == nil {
+		return t
+	}
+	if ociauth.CallsRequestHook(t) {
+		return transportFunc(func(req *http.Request) (*http.Response, error) {
+			return t.RoundTrip(req.WithContext(ociauth.ContextWithRequestHook(req.Context(), hook)))
+		})
+	}
+	return transportFunc(func(req *http.Request) (*http.Response, error) {
+		// A RoundTripper must not modify the request it's given.
+		req = req.Clone(req.Context())
+		hook(req)
+		return t.RoundTrip(req)
+	})
+}
+
+type transportFunc func(req *http.Request) (*http.Response, error)
+
+func (f transportFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// cloneTLSTransport returns a clone of t, which must be an [*http.Transport],
+// with a non-nil TLS configuration that can be modified. The option
+// argument names the option that requires it, for use in the error.
+func cloneTLSTransport(t http.RoundTripper, option string) (*http.Transport, error) {
+	ht, ok := t.(*http.Transport)
+	if !ok {
+		return nil, fmt.Errorf("%s requires Transport to be nil or *http.Transport, not %T", option, t)
+	}
+	ht = ht.Clone()
+	if ht.TLSClientConfig == nil {
+		ht.TLSClientConfig = &tls.Config{}
+	}
+	return ht, nil
+}
+
 type client struct {
 	*ociregistry.Funcs
 	httpScheme   string
@@ -123,6 +391,41 @@ type client struct {
 	httpClient   *http.Client
 	debugID      string
 	listPageSize int
+
+	convertSchema1   bool
+	expectContinue   bool
+	rewriteLocation  func(*url.URL) *url.URL
+	secureAuthOnly   bool
+	verifyHeader     bool
+	referrersCache   *ReferrersCache
+	blobReadRetries  int
+	idempotentDelete bool
+	probeMediaTypes  bool
+	retry            *RetryOptions
+
+	// acceptMu guards the fields below it, which record the
+	// state of probing the registry for the manifest media types
+	// that it accepts. acceptTypes holds the result, or nil if
+	// the registry hasn't been probed successfully yet.
+	// acceptProbing is non-nil while a probe is in progress
+	// and is closed when it completes. acceptRetryTime holds
+	// the earliest time to probe again after an inconclusive probe.
+	acceptMu        sync.Mutex
+	acceptTypes     []string
+	acceptProbing   chan struct{}
+	acceptRetryTime time.Time
+
+	// uploadNoSlash records that the registry only accepts
+	// upload start requests without a trailing slash.
+	uploadNoSlash atomic.Bool
+
+	// schema1Mu guards schema1Configs, which holds the image
+	// configs created by schema1 conversion, keyed by digest,
+	// and schema1Order, which holds their digests in the order
+	// they were added so that the oldest can be evicted.
+	schema1Mu      sync.Mutex
+	schema1Configs map[digest.Digest][]byte
+	schema1Order   []digest.Digest
 }
 
 type descriptorRequired byte
@@ -145,17 +448,9 @@ func descriptorFromResponse(resp *http.Response, knownDigest digest.Digest, requ
 	size := int64(0)
 	if (require & requireSize) != 0 {
 		if resp.StatusCode == http.StatusPartialContent {
-			contentRange := resp.Header.Get("Content-Range")
-			if contentRange == "" {
-				return ociregistry.Descriptor{}, fmt.Errorf("no Content-Range in partial content response")
-			}
-			i := strings.LastIndex(contentRange, "/")
-			if i == -1 {
-				return ociregistry.Descriptor{}, fmt.Errorf("malformed Content-Range %q", contentRange)
-			}
-			contentSize, err := strconv.ParseInt(contentRange[i+1:], 10, 64)
+			contentSize, err := sizeFromContentRange(resp.Header.Get("Content-Range"))
 			if err != nil {
-				return ociregistry.Descriptor{}, fmt.Errorf("malformed Content-Range %q", contentRange)
+				return ociregistry.Descriptor{}, err
 			}
 			size = contentSize
 		} else {
@@ -183,6 +478,24 @@ func descriptorFromResponse(resp *http.Response, knownDigest digest.Digest, requ
 	}, nil
 }
 
+// sizeFromContentRange returns the complete length of the content
+// from a Content-Range header value such as "bytes 0-0/1234"
+// or "bytes */1234".
+func sizeFromContentRange(contentRange string) (int64, error) {
+	if contentRange == "" {
+		return 0, fmt.Errorf("no Content-Range in partial content response")
+	}
+	i := strings.LastIndex(contentRange, "/")
+	if i == -1 {
+		return 0, fmt.Errorf("malformed Content-Range %q", contentRange)
+	}
+	size, err := strconv.ParseInt(contentRange[i+1:], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("malformed Content-Range %q", contentRange)
+	}
+	return size, nil
+}
+
 func newBlobReader(r io.ReadCloser, desc ociregistry.Descriptor) *blobReader {
 	return &blobReader{
 		r:        r,
@@ -204,6 +517,26 @@ type blobReader struct {
 	digester hash.Hash
 	desc     ociregistry.Descriptor
 	verify   bool
+
+	// headerDigest, if non-empty, holds a digest from the
+	// Docker-Content-Digest header that's checked in addition to
+	// desc.Digest. headerDigester is used to calculate it when its
+	// algorithm differs from that of desc.Digest.
+	headerDigest   digest.Digest
+	headerDigester hash.Hash
+}
+
+// verifyHeaderDigest arranges for the content to be checked
+// against the digest d as well as the descriptor's digest.
+func (r *blobReader) verifyHeaderDigest(d digest.Digest) error {
+	if d.Algorithm() != r.desc.Digest.Algorithm() {
+		if !d.Algorithm().Available() {
+			return fmt.Errorf("unsupported digest algorithm in Docker-Content-Digest header %q", d)
+		}
+		r.headerDigester = d.Algorithm().Hash()
+	}
+	r.headerDigest = d
+	return nil
 }
 
 func (r *blobReader) Descriptor() ociregistry.Descriptor {
@@ -214,8 +547,11 @@ func (r *blobReader) Read(buf []byte) (int, error) {
 	n, err := r.r.Read(buf)
 	r.n += int64(n)
 	r.digester.Write(buf[:n])
+	if r.headerDigester != nil {
+		r.headerDigester.Write(buf[:n])
+	}
 	if err == nil {
-		if r.n > r.desc.Size {
+		if r.desc.Size >= 0 && r.n > r.desc.Size {
 			// Fail early when the blob is too big; we can do that even
 			// when we're not verifying for other use cases.
 			return n, fmt.Errorf("blob size exceeds content length %d: %w", r.desc.Size, ociregistry.ErrSizeInvalid)
@@ -228,13 +564,26 @@ func (r *blobReader) Read(buf []byte) (int, error) {
 	if !r.verify {
 		return n, io.EOF
 	}
-	if r.n != r.desc.Size {
+	if r.desc.Size >= 0 && r.n != r.desc.Size {
 		return n, fmt.Errorf("blob size mismatch (%d/%d): %w", r.n, r.desc.Size, ociregistry.ErrSizeInvalid)
 	}
 	gotDigest := digest.NewDigest(r.desc.Digest.Algorithm(), r.digester)
 	if gotDigest != r.desc.Digest {
 		return n, fmt.Errorf("digest mismatch when reading blob")
 	}
+	if r.desc.Size < 0 {
+		// The size wasn't known in advance, but now
+		// that the content has been verified, it is.
+		r.desc.Size = r.n
+	}
+	if r.headerDigest != "" {
+		if r.headerDigester != nil {
+			gotDigest = digest.NewDigest(r.headerDigest.Algorithm(), r.headerDigester)
+		}
+		if gotDigest != r.headerDigest {
+			return n, fmt.Errorf("Docker-Content-Digest header %s does not match content digest %s", r.headerDigest, gotDigest)
+		}
+	}
 	return n, io.EOF
 }
 
@@ -243,16 +592,27 @@ func (r *blobReader) Close() error {
 }
 
 // TODO make this list configurable.
-var knownManifestMediaTypes = []string{
+var knownManifestMediaTypes = append(slices.Clone(explicitManifestMediaTypes),
+	// Technically this wildcard should be sufficient, but it isn't
+	// recognized by some registries, and some reject it
+	// (see Options.ProbeManifestMediaTypes).
+	"*/*",
+)
+
+const (
+	mediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+)
+
+// explicitManifestMediaTypes holds all the manifest
+// media types that we know about.
+var explicitManifestMediaTypes = []string{
 	ocispec.MediaTypeImageManifest,
 	ocispec.MediaTypeImageIndex,
 	"application/vnd.oci.artifact.manifest.v1+json", // deprecated.
-	"application/vnd.docker.distribution.manifest.v1+json",
-	"application/vnd.docker.distribution.manifest.v2+json",
-	"application/vnd.docker.distribution.manifest.list.v2+json",
-	// Technically this wildcard should be sufficient, but it isn't
-	// recognized by some registries.
-	"*/*",
+	mediaTypeDockerSchema1,
+	mediaTypeDockerManifest,
+	mediaTypeDockerManifestList,
 }
 
 // doRequest performs the given OCI request, sending it with the given body (which may be nil).
@@ -265,7 +625,7 @@ func (c *client) doRequest(ctx context.Context, rreq *ocirequest.Request, okStat
 		// When getting manifests, some servers won't return
 		// the content unless there's an Accept header, so
 		// add all the manifest kinds that we know about.
-		req.Header["Accept"] = knownManifestMediaTypes
+		req.Header["Accept"] = c.manifestMediaTypes(ctx, rreq.Repo)
 	}
 	resp, err := c.do(req, okStatuses...)
 	if err != nil {
@@ -285,7 +645,10 @@ func (c *client) do(req *http.Request, okStatuses ...int) (*http.Response, error
 	if req.URL.Host == "" {
 		req.URL.Host = c.httpHost
 	}
-	if req.Body != nil {
+	if c.secureAuthOnly {
+		req = req.WithContext(ociauth.ContextWithSecureAuthOnly(req.Context()))
+	}
+	if req.Body != nil && c.expectContinue {
 		// Ensure that the body isn't consumed until the
 		// server has responded that it will receive it.
 		// This means that we can retry requests even when we've
@@ -302,7 +665,7 @@ func (c *client) do(req *http.Request, okStatuses ...int) (*http.Response, error
 		}
 		c.logf("%s", buf.Bytes())
 	}
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.sendWithRetry(req)
 	if err != nil {
 		return nil, fmt.Errorf("cannot do HTTP request: %w", err)
 	}
@@ -340,7 +703,7 @@ func (c *client) logf(f string, a ...any) {
 	log.Printf("ociclient %s: %s", c.debugID, fmt.Sprintf(f, a...))
 }
 
-func locationFromResponse(resp *http.Response) (*url.URL, error) {
+func (c *client) locationFromResponse(resp *http.Response) (*url.URL, error) {
 	location := resp.Header.Get("Location")
 	if location == "" {
 		return nil, fmt.Errorf("no Location found in response")
@@ -349,7 +712,11 @@ func locationFromResponse(resp *http.Response) (*url.URL, error) {
 	if err != nil {
 		return nil, fmt.Errorf("invalid Location URL found in response")
 	}
-	return resp.Request.URL.ResolveReference(u), nil
+	u = resp.Request.URL.ResolveReference(u)
+	if c.rewriteLocation != nil {
+		u = c.rewriteLocation(u)
+	}
+	return u, nil
 }
 
 func isOKStatus(code int) bool {
@@ -366,58 +733,13 @@ func unexpectedStatusError(code int) error {
 	return fmt.Errorf("unexpected HTTP response code %d", code)
 }
 
-func scopeForRequest(r *ocirequest.Request) ociauth.Scope {
-	switch r.Kind {
-	case ocirequest.ReqPing:
-		return ociauth.Scope{}
-	case ocirequest.ReqBlobGet,
-		ocirequest.ReqBlobHead,
-		ocirequest.ReqManifestGet,
-		ocirequest.ReqManifestHead,
-		ocirequest.ReqTagsList,
-		ocirequest.ReqReferrersList:
-		return ociauth.NewScope(ociauth.ResourceScope{
-			ResourceType: ociauth.TypeRepository,
-			Resource:     r.Repo,
-			Action:       ociauth.ActionPull,
-		})
-	case ocirequest.ReqBlobDelete,
-		ocirequest.ReqBlobStartUpload,
-		ocirequest.ReqBlobUploadBlob,
-		ocirequest.ReqBlobUploadInfo,
-		ocirequest.ReqBlobUploadChunk,
-		ocirequest.ReqBlobCompleteUpload,
-		ocirequest.ReqManifestPut,
-		ocirequest.ReqManifestDelete:
-		return ociauth.NewScope(ociauth.ResourceScope{
-			ResourceType: ociauth.TypeRepository,
-			Resource:     r.Repo,
-			Action:       ociauth.ActionPush,
-		})
-	case ocirequest.ReqBlobMount:
-		return ociauth.NewScope(ociauth.ResourceScope{
-			ResourceType: ociauth.TypeRepository,
-			Resource:     r.Repo,
-			Action:       ociauth.ActionPush,
-		}, ociauth.ResourceScope{
-			ResourceType: ociauth.TypeRepository,
-			Resource:     r.FromRepo,
-			Action:       ociauth.ActionPull,
-		})
-	case ocirequest.ReqCatalogList:
-		return ociauth.NewScope(ociauth.CatalogScope)
-	default:
-		panic(fmt.Errorf("unexpected request kind %v", r.Kind))
-	}
-}
-
 func newRequest(ctx context.Context, rreq *ocirequest.Request, body io.Reader) (*http.Request, error) {
 	method, u, err := rreq.Construct()
 	if err != nil {
 		return nil, err
 	}
 	ctx = ociauth.ContextWithRequestInfo(ctx, ociauth.RequestInfo{
-		RequiredScope: scopeForRequest(rreq),
+		RequiredScope: rreq.RequiredScope(),
 	})
 	return http.NewRequestWithContext(ctx, method, u, body)
 }
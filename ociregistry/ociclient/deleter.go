@@ -16,12 +16,62 @@ package ociclient
 
 import (
 	"context"
+	"fmt"
 	"net/http"
 
 	"cuelabs.dev/go/oci/ociregistry"
 	"cuelabs.dev/go/oci/ociregistry/internal/ocirequest"
+	"cuelabs.dev/go/oci/ociregistry/ociref"
 )
 
+// DeleteTarget specifies what [DeleteReference] deletes.
+type DeleteTarget int
+
+const (
+	// DeleteTagOnly deletes the tag named by the reference,
+	// leaving the manifest it refers to in place.
+	DeleteTagOnly DeleteTarget = iota
+
+	// DeleteManifest deletes the manifest that the reference
+	// refers to. When the reference holds only a tag, the tag is first
+	// resolved to find the manifest's digest.
+	DeleteManifest
+)
+
+// DeleteReference deletes the tag or manifest referred to by ref
+// from r, as determined by target. The Host field of ref is ignored.
+//
+// When ref holds both a tag and a digest, the tag is checked to
+// refer to that digest before anything is deleted, as described in
+// the documentation for [ociref.Reference]. It is an error to use
+// DeleteTagOnly with a reference that holds no tag.
+func DeleteReference(ctx context.Context, r ociregistry.Interface, ref ociref.Reference, target DeleteTarget) error {
+	dig := ref.Digest
+	if ref.Tag != "" && (dig != "" || target == DeleteManifest) {
+		desc, err := r.ResolveTag(ctx, ref.Repository, ref.Tag)
+		if err != nil {
+			return err
+		}
+		if dig != "" && desc.Digest != dig {
+			return fmt.Errorf("tag %q refers to %s not %s: %w", ref.Tag, desc.Digest, dig, ociregistry.ErrManifestUnknown)
+		}
+		dig = desc.Digest
+	}
+	switch target {
+	case DeleteTagOnly:
+		if ref.Tag == "" {
+			return fmt.Errorf("cannot delete tag of reference %q with no tag", ref)
+		}
+		return r.DeleteTag(ctx, ref.Repository, ref.Tag)
+	case DeleteManifest:
+		if dig == "" {
+			return fmt.Errorf("reference %q has no tag or digest", ref)
+		}
+		return r.DeleteManifest(ctx, ref.Repository, dig)
+	}
+	return fmt.Errorf("unknown delete target %d", target)
+}
+
 func (c *client) DeleteBlob(ctx context.Context, repoName string, digest ociregistry.Digest) error {
 	return c.delete(ctx, &ocirequest.Request{
 		Kind:   ocirequest.ReqBlobDelete,
@@ -49,6 +99,9 @@ func (c *client) DeleteTag(ctx context.Context, repoName string, tagName string)
 func (c *client) delete(ctx context.Context, rreq *ocirequest.Request) error {
 	resp, err := c.doRequest(ctx, rreq, http.StatusAccepted)
 	if err != nil {
+		if c.idempotentDelete && isNotFound(err) {
+			return nil
+		}
 		return err
 	}
 	resp.Body.Close()
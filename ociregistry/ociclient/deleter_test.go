@@ -0,0 +1,151 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociclient
+
+import (
+	"context"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/go-quicktest/qt"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ocimem"
+	"cuelabs.dev/go/oci/ociregistry/ociref"
+	"cuelabs.dev/go/oci/ociregistry/ociserver"
+)
+
+var deleteReferenceTests = []struct {
+	testName string
+	// ref is called with the digest of the tagged manifest.
+	ref              func(dig ociregistry.Digest) ociref.Reference
+	target           DeleteTarget
+	wantError        string
+	wantTagGone      bool
+	wantManifestGone bool
+}{{
+	testName: "TagOnly",
+	ref: func(dig ociregistry.Digest) ociref.Reference {
+		return ociref.Reference{Repository: "foo/bar", Tag: "latest"}
+	},
+	target:      DeleteTagOnly,
+	wantTagGone: true,
+}, {
+	testName: "ManifestByTag",
+	ref: func(dig ociregistry.Digest) ociref.Reference {
+		return ociref.Reference{Repository: "foo/bar", Tag: "latest"}
+	},
+	target:           DeleteManifest,
+	wantManifestGone: true,
+}, {
+	testName: "ManifestByDigest",
+	ref: func(dig ociregistry.Digest) ociref.Reference {
+		return ociref.Reference{Repository: "foo/bar", Digest: dig}
+	},
+	target:           DeleteManifest,
+	wantManifestGone: true,
+}, {
+	testName: "ManifestByTagAndDigest",
+	ref: func(dig ociregistry.Digest) ociref.Reference {
+		return ociref.Reference{Repository: "foo/bar", Tag: "latest", Digest: dig}
+	},
+	target:           DeleteManifest,
+	wantManifestGone: true,
+}, {
+	testName: "TagAndMismatchedDigest",
+	ref: func(dig ociregistry.Digest) ociref.Reference {
+		return ociref.Reference{Repository: "foo/bar", Tag: "latest", Digest: digest.FromString("other")}
+	},
+	target:    DeleteTagOnly,
+	wantError: `tag "latest" refers to sha256:[0-9a-f]+ not sha256:[0-9a-f]+: manifest unknown: manifest unknown to registry`,
+}, {
+	testName: "TagOnlyWithDigestOnly",
+	ref: func(dig ociregistry.Digest) ociref.Reference {
+		return ociref.Reference{Repository: "foo/bar", Digest: dig}
+	},
+	target:    DeleteTagOnly,
+	wantError: `cannot delete tag of reference "foo/bar@sha256:[0-9a-f]+" with no tag`,
+}}
+
+func TestDeleteReference(t *testing.T) {
+	ctx := context.Background()
+	for _, test := range deleteReferenceTests {
+		t.Run(test.testName, func(t *testing.T) {
+			backend := ocimem.New()
+			manifest := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[]}`)
+			desc, err := backend.PushManifest(ctx, "foo/bar", "latest", manifest, ocispec.MediaTypeImageIndex)
+			qt.Assert(t, qt.IsNil(err))
+
+			srv := httptest.NewServer(ociserver.New(backend, nil))
+			defer srv.Close()
+			srvURL, _ := url.Parse(srv.URL)
+			r, err := New(srvURL.Host, &Options{
+				Insecure: true,
+			})
+			qt.Assert(t, qt.IsNil(err))
+
+			err = DeleteReference(ctx, r, test.ref(desc.Digest), test.target)
+			if test.wantError != "" {
+				qt.Assert(t, qt.ErrorMatches(err, test.wantError))
+			} else {
+				qt.Assert(t, qt.IsNil(err))
+			}
+			_, err = backend.ResolveTag(ctx, "foo/bar", "latest")
+			qt.Check(t, qt.Equals(err != nil, test.wantTagGone))
+			_, err = backend.ResolveManifest(ctx, "foo/bar", desc.Digest)
+			qt.Check(t, qt.Equals(err != nil, test.wantManifestGone))
+		})
+	}
+}
+
+func TestIdempotentDelete(t *testing.T) {
+	ctx := context.Background()
+	backend := ocimem.New()
+	// Create the repository so that the deletions fail because
+	// of the missing items rather than the missing repository.
+	_, err := backend.PushBlob(ctx, "foo/bar", ociregistry.Descriptor{
+		MediaType: "application/octet-stream",
+		Digest:    digest.FromString("x"),
+		Size:      1,
+	}, strings.NewReader("x"))
+	qt.Assert(t, qt.IsNil(err))
+	srv := httptest.NewServer(ociserver.New(backend, nil))
+	defer srv.Close()
+	srvURL, _ := url.Parse(srv.URL)
+	missing := digest.FromString("missing")
+
+	for _, idempotent := range []bool{false, true} {
+		r, err := New(srvURL.Host, &Options{
+			Insecure:         true,
+			IdempotentDelete: idempotent,
+		})
+		qt.Assert(t, qt.IsNil(err))
+		check := func(err error, wantErr error) {
+			if idempotent {
+				qt.Check(t, qt.IsNil(err))
+			} else {
+				qt.Check(t, qt.ErrorIs(err, wantErr))
+			}
+		}
+		check(r.DeleteManifest(ctx, "foo/bar", missing), ociregistry.ErrManifestUnknown)
+		check(r.DeleteTag(ctx, "foo/bar", "missing"), ociregistry.ErrManifestUnknown)
+		check(r.DeleteBlob(ctx, "foo/bar", missing), ociregistry.ErrBlobUnknown)
+		check(r.DeleteManifest(ctx, "other", missing), ociregistry.ErrNameUnknown)
+	}
+}
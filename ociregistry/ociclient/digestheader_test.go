@@ -0,0 +1,354 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociclient
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/go-quicktest/qt"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestVerifyContentDigestHeader(t *testing.T) {
+	wanted := "wanted content"
+	other := "other content"
+	wantedDigest := digest.FromString(wanted)
+	otherDigest := digest.FromString(other)
+	tests := []struct {
+		testName string
+		// content and header are served for any request.
+		content string
+		header  digest.Digest
+		// verify holds the value of VerifyContentDigestHeader.
+		verify    bool
+		wantError string
+	}{{
+		testName: "CorrectHeader",
+		content:  wanted,
+		header:   wantedDigest,
+		verify:   true,
+	}, {
+		testName: "NoHeader",
+		content:  wanted,
+		verify:   true,
+	}, {
+		testName: "SHA512Header",
+		content:  wanted,
+		header:   digest.SHA512.FromString(wanted),
+		verify:   true,
+	}, {
+		testName:  "MismatchedSHA512Header",
+		content:   wanted,
+		header:    digest.SHA512.FromString(other),
+		verify:    true,
+		wantError: `Docker-Content-Digest header sha512:.* does not match content digest sha512:.*`,
+	}, {
+		// Without verification, content that matches the
+		// header is accepted even though it's not what was asked for.
+		testName: "OtherContentNotVerified",
+		content:  other,
+		header:   otherDigest,
+	}, {
+		testName:  "OtherContent",
+		content:   other,
+		header:    otherDigest,
+		verify:    true,
+		wantError: `digest mismatch when reading blob`,
+	}, {
+		testName:  "MismatchedHeader",
+		content:   wanted,
+		header:    otherDigest,
+		verify:    true,
+		wantError: `Docker-Content-Digest header sha256:.* does not match content digest sha256:.*`,
+	}}
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				w.Header().Set("Content-Type", "application/octet-stream")
+				w.Header().Set("Content-Length", strconv.Itoa(len(test.content)))
+				if test.header != "" {
+					w.Header().Set("Docker-Content-Digest", string(test.header))
+				}
+				io.WriteString(w, test.content)
+			}))
+			defer srv.Close()
+			srvURL, _ := url.Parse(srv.URL)
+			r, err := New(srvURL.Host, &Options{
+				Insecure:                  true,
+				VerifyContentDigestHeader: test.verify,
+			})
+			qt.Assert(t, qt.IsNil(err))
+			ctx := context.Background()
+			for _, get := range []func() (io.ReadCloser, error){
+				func() (io.ReadCloser, error) {
+					return r.GetBlob(ctx, "foo", wantedDigest)
+				},
+				func() (io.ReadCloser, error) {
+					return r.GetManifest(ctx, "foo", wantedDigest)
+				},
+			} {
+				rd, err := get()
+				qt.Assert(t, qt.IsNil(err))
+				data, err := io.ReadAll(rd)
+				rd.Close()
+				if test.wantError != "" {
+					qt.Assert(t, qt.ErrorMatches(err, test.wantError))
+					continue
+				}
+				qt.Assert(t, qt.IsNil(err))
+				qt.Assert(t, qt.Equals(string(data), test.content))
+			}
+		})
+	}
+}
+
+func TestGetBlobWithoutHeaders(t *testing.T) {
+	small := "small content"
+	large := strings.Repeat("x", inMemThreshold+100)
+	tests := []struct {
+		testName string
+		content  string
+		// served holds the content actually served,
+		// if different from content.
+		served string
+		// headSize holds the Content-Length returned
+		// from HEAD requests, if any.
+		headSize int
+		// unknownSize reports that the size isn't
+		// known until the content has been read.
+		unknownSize bool
+		wantError   string
+	}{{
+		testName: "Small",
+		content:  small,
+	}, {
+		testName:  "SmallCorrupted",
+		content:   small,
+		served:    "other content",
+		wantError: `digest mismatch when reading blob`,
+	}, {
+		testName: "LargeWithHEAD",
+		content:  large,
+		headSize: len(large),
+	}, {
+		testName:  "LargeTruncated",
+		content:   large,
+		served:    large[:len(large)-1],
+		headSize:  len(large),
+		wantError: `blob size mismatch .*`,
+	}, {
+		testName:    "LargeWithoutHEAD",
+		content:     large,
+		unknownSize: true,
+	}, {
+		testName:    "LargeWithoutHEADCorrupted",
+		content:     large,
+		served:      large[:len(large)-1] + "y",
+		unknownSize: true,
+		wantError:   `digest mismatch when reading blob`,
+	}, {
+		testName:    "LargeWithoutHEADTruncated",
+		content:     large,
+		served:      large[:len(large)-1],
+		unknownSize: true,
+		wantError:   `digest mismatch when reading blob`,
+	}}
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			served := test.content
+			if test.served != "" {
+				served = test.served
+			}
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				w.Header().Set("Content-Type", "application/octet-stream")
+				if req.Method == "HEAD" {
+					if test.headSize > 0 {
+						w.Header().Set("Content-Length", strconv.Itoa(test.headSize))
+					}
+					return
+				}
+				// Flush before writing the body so that the server
+				// doesn't add a Content-Length header.
+				w.WriteHeader(http.StatusOK)
+				w.(http.Flusher).Flush()
+				io.WriteString(w, served)
+			}))
+			defer srv.Close()
+			srvURL, _ := url.Parse(srv.URL)
+			r, err := New(srvURL.Host, &Options{
+				Insecure: true,
+			})
+			qt.Assert(t, qt.IsNil(err))
+			dig := digest.FromString(test.content)
+			rd, err := r.GetBlob(context.Background(), "foo", dig)
+			if err != nil {
+				qt.Assert(t, qt.ErrorMatches(err, test.wantError))
+				return
+			}
+			defer rd.Close()
+			qt.Assert(t, qt.Equals(rd.Descriptor().Digest, dig))
+			if test.unknownSize {
+				qt.Assert(t, qt.Equals(rd.Descriptor().Size, int64(-1)))
+			} else {
+				qt.Assert(t, qt.Equals(rd.Descriptor().Size, int64(len(test.content))))
+			}
+			data, err := io.ReadAll(rd)
+			if test.wantError != "" {
+				qt.Assert(t, qt.ErrorMatches(err, test.wantError))
+				return
+			}
+			qt.Assert(t, qt.IsNil(err))
+			qt.Assert(t, qt.Equals(string(data), test.content))
+			// The size is known once the content has been verified.
+			qt.Assert(t, qt.Equals(rd.Descriptor().Size, int64(len(test.content))))
+		})
+	}
+}
+
+func TestResolveBlobWithoutContentLength(t *testing.T) {
+	content := "some content"
+	tests := []struct {
+		testName string
+		content  string
+		// handleGet handles GET requests for the blob.
+		handleGet func(w http.ResponseWriter, req *http.Request)
+		wantSize  int64
+		wantError string
+	}{{
+		testName: "RangeSupported",
+		content:  content,
+		handleGet: func(w http.ResponseWriter, req *http.Request) {
+			if req.Header.Get("Range") != "bytes=0-0" {
+				http.Error(w, "unexpected range", http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Content-Range", "bytes 0-0/"+strconv.Itoa(len(content)))
+			w.WriteHeader(http.StatusPartialContent)
+			io.WriteString(w, content[:1])
+		},
+		wantSize: int64(len(content)),
+	}, {
+		testName: "RangeIgnored",
+		content:  content,
+		handleGet: func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			io.WriteString(w, content)
+		},
+		wantSize: int64(len(content)),
+	}, {
+		testName: "Empty",
+		content:  "",
+		handleGet: func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Content-Range", "bytes */0")
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		},
+		wantSize: 0,
+	}, {
+		testName: "NoSize",
+		content:  content,
+		handleGet: func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			io.WriteString(w, content)
+		},
+		wantError: `invalid descriptor in response: unknown content length`,
+	}}
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			var methods []string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				methods = append(methods, req.Method)
+				w.Header().Set("Content-Type", "application/octet-stream")
+				if req.Method == "HEAD" {
+					// Don't send Content-Length.
+					w.WriteHeader(http.StatusOK)
+					return
+				}
+				test.handleGet(w, req)
+			}))
+			defer srv.Close()
+			srvURL, _ := url.Parse(srv.URL)
+			r, err := New(srvURL.Host, &Options{
+				Insecure: true,
+			})
+			qt.Assert(t, qt.IsNil(err))
+			dig := digest.FromString(test.content)
+			desc, err := r.ResolveBlob(context.Background(), "foo", dig)
+			qt.Check(t, qt.DeepEquals(methods, []string{"HEAD", "GET"}))
+			if test.wantError != "" {
+				qt.Assert(t, qt.ErrorMatches(err, test.wantError))
+				return
+			}
+			qt.Assert(t, qt.IsNil(err))
+			qt.Assert(t, qt.Equals(desc.Digest, dig))
+			qt.Assert(t, qt.Equals(desc.Size, test.wantSize))
+		})
+	}
+}
+
+func TestPushManifestDigestHeader(t *testing.T) {
+	manifest := `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[]}`
+	tests := []struct {
+		testName  string
+		header    digest.Digest
+		wantError string
+	}{{
+		testName: "NoHeader",
+	}, {
+		testName: "CorrectHeader",
+		header:   digest.FromString(manifest),
+	}, {
+		testName: "CorrectSHA512Header",
+		header:   digest.SHA512.FromString(manifest),
+	}, {
+		testName: "UnknownAlgorithm",
+		header:   "other:1234",
+	}, {
+		testName:  "MismatchedHeader",
+		header:    digest.FromString("something else"),
+		wantError: `Docker-Content-Digest header sha256:[0-9a-f]+ in manifest push response does not match pushed digest ` + string(digest.FromString(manifest)),
+	}}
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				io.Copy(io.Discard, req.Body)
+				if test.header != "" {
+					w.Header().Set("Docker-Content-Digest", string(test.header))
+				}
+				w.WriteHeader(http.StatusCreated)
+			}))
+			defer srv.Close()
+			srvURL, _ := url.Parse(srv.URL)
+			r, err := New(srvURL.Host, &Options{
+				Insecure: true,
+			})
+			qt.Assert(t, qt.IsNil(err))
+			desc, err := r.PushManifest(context.Background(), "foo", "latest", []byte(manifest), "application/vnd.oci.image.index.v1+json")
+			if test.wantError != "" {
+				qt.Assert(t, qt.ErrorMatches(err, test.wantError))
+				return
+			}
+			qt.Assert(t, qt.IsNil(err))
+			qt.Assert(t, qt.Equals(desc.Digest, digest.FromString(manifest)))
+		})
+	}
+}
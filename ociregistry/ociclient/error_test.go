@@ -160,3 +160,30 @@ func TestNonJSONErrorResponse(t *testing.T) {
 		return err
 	})
 }
+
+func TestErrorCodeFromMultiErrorBody(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"errors":[{"code":"MANIFEST_UNKNOWN","message":"no such manifest"},{"code":"NAME_UNKNOWN","message":"no such repo"}]}`))
+	}))
+	defer srv.Close()
+
+	srvURL, _ := url.Parse(srv.URL)
+	r, err := New(srvURL.Host, &Options{
+		Insecure: true,
+	})
+	qt.Assert(t, qt.IsNil(err))
+	_, err = r.GetTag(context.Background(), "foo", "sometag")
+	qt.Assert(t, qt.IsNotNil(err))
+
+	var rerr ociregistry.Error
+	qt.Assert(t, qt.IsTrue(errors.As(err, &rerr)))
+	qt.Check(t, qt.Equals(rerr.Code(), "MANIFEST_UNKNOWN"))
+	qt.Check(t, qt.ErrorIs(err, ociregistry.ErrManifestUnknown))
+	qt.Check(t, qt.ErrorIs(err, ociregistry.ErrNameUnknown))
+
+	var herr ociregistry.HTTPError
+	qt.Assert(t, qt.IsTrue(errors.As(err, &herr)))
+	qt.Check(t, qt.Equals(herr.StatusCode(), http.StatusNotFound))
+}
@@ -0,0 +1,118 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociclient
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-quicktest/qt"
+)
+
+func TestExpectContinue(t *testing.T) {
+	host, expectHeaders := newNoContinueServer(t)
+	// Use a transport that waits as long as necessary for the
+	// 100 Continue response, so that the request stalls,
+	// mimicking a misbehaving proxy.
+	transport := &http.Transport{
+		ExpectContinueTimeout: time.Hour,
+	}
+	defer transport.CloseIdleConnections()
+
+	r, err := New(host, &Options{
+		Insecure:  true,
+		Transport: transport,
+	})
+	qt.Assert(t, qt.IsNil(err))
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, err = r.PushManifest(ctx, "foo", "sometag", []byte("{}"), "application/json")
+	qt.Assert(t, qt.ErrorIs(err, context.DeadlineExceeded))
+
+	r, err = New(host, &Options{
+		Insecure:              true,
+		Transport:             transport,
+		DisableExpectContinue: true,
+	})
+	qt.Assert(t, qt.IsNil(err))
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = r.PushManifest(ctx, "foo", "sometag", []byte("{}"), "application/json")
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.DeepEquals(expectHeaders(), []string{""}))
+}
+
+// newNoContinueServer starts a server that never sends a
+// "100 Continue" response, and always responds with "201 Created"
+// after reading the request body. It returns the server's host and a
+// function that returns the Expect headers of all the requests
+// that have been completely read.
+func newNoContinueServer(t *testing.T) (string, func() []string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	qt.Assert(t, qt.IsNil(err))
+	var (
+		mu      sync.Mutex
+		conns   []net.Conn
+		expects []string
+	)
+	t.Cleanup(func() {
+		ln.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	})
+	serve := func(conn net.Conn) {
+		defer conn.Close()
+		br := bufio.NewReader(conn)
+		for {
+			req, err := http.ReadRequest(br)
+			if err != nil {
+				return
+			}
+			if _, err := io.Copy(io.Discard, req.Body); err != nil {
+				return
+			}
+			mu.Lock()
+			expects = append(expects, req.Header.Get("Expect"))
+			mu.Unlock()
+			io.WriteString(conn, "HTTP/1.1 201 Created\r\nContent-Length: 0\r\n\r\n")
+		}
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+			go serve(conn)
+		}
+	}()
+	return ln.Addr().String(), func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), expects...)
+	}
+}
@@ -0,0 +1,427 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ociref"
+)
+
+// PullToLayout writes the manifest referred to by ref, and all the
+// manifests and blobs that it refers to, from r into dir as an
+// [OCI image layout]. The host in ref is ignored: all content is
+// fetched from r. Image indexes are followed recursively.
+//
+// The directory is created if needed. Blobs that are already present
+// in the layout are not fetched again, so content shared between
+// images is only written once. The content of every blob is checked
+// against its digest as it's written.
+//
+// An entry describing the pulled manifest, annotated with the tag
+// from ref if there is one, is added to index.json, so several
+// images can be pulled into the same layout. The entry replaces any
+// existing entry with the same tag, and any untagged entry for the
+// same manifest. When ref has no tag and the manifest is already
+// in the index, the index is left unchanged. PullToLayout returns
+// the entry.
+//
+// [OCI image layout]: https://github.com/opencontainers/image-spec/blob/v1.1.0/image-layout.md
+func PullToLayout(ctx context.Context, r ociregistry.Interface, ref ociref.Reference, dir string) (ociregistry.Descriptor, error) {
+	return PullToLayoutParallel(ctx, r, ref, dir, 1)
+}
+
+// PullToLayoutParallel is like [PullToLayout] except that it pulls
+// the manifests in an image index concurrently, with up to
+// concurrency manifests and blobs being fetched at once.
+//
+// Content that's referred to from more than one place, such as a
+// layer shared between the images for different platforms, is
+// fetched only once: a concurrent pull of the same digest waits for
+// the one already in flight rather than fetching it again.
+//
+// If concurrency is less than 2, content is fetched sequentially.
+func PullToLayoutParallel(ctx context.Context, r ociregistry.Interface, ref ociref.Reference, dir string, concurrency int) (ociregistry.Descriptor, error) {
+	var (
+		rd  ociregistry.BlobReader
+		err error
+	)
+	if ref.Digest != "" {
+		rd, err = r.GetManifest(ctx, ref.Repository, ref.Digest)
+	} else if ref.Tag != "" {
+		rd, err = r.GetTag(ctx, ref.Repository, ref.Tag)
+	} else {
+		return ociregistry.Descriptor{}, fmt.Errorf("reference %q has no tag or digest", ref)
+	}
+	if err != nil {
+		return ociregistry.Descriptor{}, err
+	}
+	data, desc, err := readManifestContent(rd)
+	if err != nil {
+		return ociregistry.Descriptor{}, err
+	}
+	if ref.Digest != "" && desc.Digest != ref.Digest {
+		return ociregistry.Descriptor{}, fmt.Errorf("manifest for %s has unexpected digest %s", ref, desc.Digest)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "blobs"), 0o777); err != nil {
+		return ociregistry.Descriptor{}, err
+	}
+	p := &layoutPuller{
+		r:        r,
+		repo:     ref.Repository,
+		dir:      dir,
+		inflight: make(map[ociregistry.Digest]*layoutFetch),
+	}
+	if concurrency > 1 {
+		p.sem = make(chan struct{}, concurrency)
+	}
+	if err := p.writeManifest(ctx, desc, data); err != nil {
+		return ociregistry.Descriptor{}, err
+	}
+	if ref.Tag != "" {
+		desc.Annotations = map[string]string{
+			ocispec.AnnotationRefName: ref.Tag,
+		}
+	}
+	if err := writeJSONFile(filepath.Join(dir, ocispec.ImageLayoutFile), ocispec.ImageLayout{
+		Version: ocispec.ImageLayoutVersion,
+	}); err != nil {
+		return ociregistry.Descriptor{}, err
+	}
+	indexPath := filepath.Join(dir, ocispec.ImageIndexFile)
+	index, err := readLayoutIndex(indexPath)
+	if err != nil {
+		return ociregistry.Descriptor{}, err
+	}
+	index.Manifests = addIndexEntry(index.Manifests, desc)
+	if err := writeJSONFile(indexPath, index); err != nil {
+		return ociregistry.Descriptor{}, err
+	}
+	return desc, nil
+}
+
+// readLayoutIndex reads the index.json file of a layout,
+// returning an empty index if it doesn't exist.
+func readLayoutIndex(path string) (ocispec.Index, error) {
+	index := ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageIndex,
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return index, nil
+		}
+		return ocispec.Index{}, err
+	}
+	if err := json.Unmarshal(data, &index); err != nil {
+		return ocispec.Index{}, fmt.Errorf("cannot parse existing %s: %v", path, err)
+	}
+	return index, nil
+}
+
+// addIndexEntry returns manifests with desc added, replacing any
+// entry with the same tag and any untagged entry for the same digest.
+// If desc has no tag and its digest is already present, manifests
+// is returned unchanged.
+func addIndexEntry(manifests []ociregistry.Descriptor, desc ociregistry.Descriptor) []ociregistry.Descriptor {
+	tag := desc.Annotations[ocispec.AnnotationRefName]
+	if tag == "" && slices.ContainsFunc(manifests, func(m ociregistry.Descriptor) bool {
+		return m.Digest == desc.Digest
+	}) {
+		return manifests
+	}
+	manifests = slices.DeleteFunc(manifests, func(m ociregistry.Descriptor) bool {
+		mtag := m.Annotations[ocispec.AnnotationRefName]
+		return (mtag == "" && m.Digest == desc.Digest) || (tag != "" && mtag == tag)
+	})
+	return append(manifests, desc)
+}
+
+type layoutPuller struct {
+	r    ociregistry.Interface
+	repo string
+	dir  string
+
+	// sem limits the number of concurrent fetches.
+	// It's nil when fetching sequentially.
+	sem chan struct{}
+
+	// mu guards inflight, which holds an entry for each
+	// manifest or blob that has been fetched or is being fetched.
+	mu       sync.Mutex
+	inflight map[ociregistry.Digest]*layoutFetch
+}
+
+// layoutFetch represents the fetching of a single manifest or blob.
+// done is closed when the fetch has completed, after which err
+// holds its result.
+type layoutFetch struct {
+	done chan struct{}
+	err  error
+}
+
+// writeManifest writes the manifest with the given descriptor
+// and content to the layout, followed by everything it refers to.
+func (p *layoutPuller) writeManifest(ctx context.Context, desc ociregistry.Descriptor, data []byte) error {
+	var (
+		manifests []ociregistry.Descriptor
+		blobs     []ociregistry.Descriptor
+	)
+	switch desc.MediaType {
+	case ocispec.MediaTypeImageIndex, mediaTypeDockerManifestList:
+		var index ocispec.Index
+		if err := json.Unmarshal(data, &index); err != nil {
+			return fmt.Errorf("cannot unmarshal index %s: %v", desc.Digest, err)
+		}
+		manifests = index.Manifests
+	case ocispec.MediaTypeImageManifest, mediaTypeDockerManifest:
+		var m ocispec.Manifest
+		if err := json.Unmarshal(data, &m); err != nil {
+			return fmt.Errorf("cannot unmarshal manifest %s: %v", desc.Digest, err)
+		}
+		blobs = append(blobs, m.Config)
+		blobs = append(blobs, m.Layers...)
+	}
+	tasks := make([]func(ctx context.Context) error, 0, len(blobs)+len(manifests))
+	for _, blob := range blobs {
+		tasks = append(tasks, func(ctx context.Context) error {
+			return p.writeBlob(ctx, blob)
+		})
+	}
+	for _, m := range manifests {
+		tasks = append(tasks, func(ctx context.Context) error {
+			return p.pullManifest(ctx, m)
+		})
+	}
+	if err := p.run(ctx, tasks); err != nil {
+		return err
+	}
+	// Write the manifest itself last, so that its presence
+	// implies that everything it refers to is present too.
+	return p.writeFile(desc, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// pullManifest fetches the manifest with the given descriptor
+// and writes it to the layout, along with everything it refers to,
+// if it's not already there.
+func (p *layoutPuller) pullManifest(ctx context.Context, desc ociregistry.Descriptor) error {
+	return p.once(ctx, desc.Digest, func() error {
+		if p.exists(desc) {
+			return nil
+		}
+		var data []byte
+		err := p.fetch(ctx, func() error {
+			rd, err := p.r.GetManifest(ctx, p.repo, desc.Digest)
+			if err != nil {
+				return fmt.Errorf("cannot get manifest %s: %w", desc.Digest, err)
+			}
+			data, err = readLayoutManifest(rd, desc)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		return p.writeManifest(ctx, desc, data)
+	})
+}
+
+// writeBlob fetches the blob with the given descriptor
+// and writes it to the layout if it's not already there.
+func (p *layoutPuller) writeBlob(ctx context.Context, desc ociregistry.Descriptor) error {
+	return p.once(ctx, desc.Digest, func() error {
+		if p.exists(desc) {
+			return nil
+		}
+		if !desc.Digest.Algorithm().Available() {
+			return fmt.Errorf("unsupported digest algorithm in %q", desc.Digest)
+		}
+		return p.fetch(ctx, func() error {
+			return p.writeFile(desc, func(w io.Writer) error {
+				rd, err := p.r.GetBlob(ctx, p.repo, desc.Digest)
+				if err != nil {
+					return fmt.Errorf("cannot get blob %s: %w", desc.Digest, err)
+				}
+				defer rd.Close()
+				// Check the content against the descriptor that
+				// refers to it, not the one provided by the registry.
+				if _, err := io.Copy(w, newBlobReader(rd, desc)); err != nil {
+					return fmt.Errorf("cannot read blob %s: %w", desc.Digest, err)
+				}
+				return nil
+			})
+		})
+	})
+}
+
+// once calls f to fetch the content with the given digest unless
+// it has already been fetched or is being fetched, in which case
+// it waits for that to complete and returns its result.
+func (p *layoutPuller) once(ctx context.Context, dig ociregistry.Digest, f func() error) error {
+	p.mu.Lock()
+	if fetch, ok := p.inflight[dig]; ok {
+		p.mu.Unlock()
+		select {
+		case <-fetch.done:
+			return fetch.err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	fetch := &layoutFetch{
+		done: make(chan struct{}),
+	}
+	p.inflight[dig] = fetch
+	p.mu.Unlock()
+
+	fetch.err = f()
+	close(fetch.done)
+	return fetch.err
+}
+
+// fetch calls f, waiting first until there are fewer than
+// the maximum number of concurrent fetches in progress.
+// The wait is only done around requests to the registry, never
+// while waiting for other content, so that the pull can't deadlock.
+func (p *layoutPuller) fetch(ctx context.Context, f func() error) error {
+	if p.sem == nil {
+		return f()
+	}
+	select {
+	case p.sem <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() {
+		<-p.sem
+	}()
+	return f()
+}
+
+// run calls all the given functions, concurrently when
+// fetching in parallel, and returns the first error encountered.
+// When one function fails, the context passed to the others
+// is canceled.
+func (p *layoutPuller) run(ctx context.Context, tasks []func(ctx context.Context) error) error {
+	if p.sem == nil || len(tasks) < 2 {
+		for _, task := range tasks {
+			if err := task(ctx); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	for _, task := range tasks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := task(ctx); err != nil {
+				errOnce.Do(func() {
+					firstErr = err
+					cancel()
+				})
+			}
+		}()
+	}
+	wg.Wait()
+	return firstErr
+}
+
+func (p *layoutPuller) path(desc ociregistry.Descriptor) string {
+	return filepath.Join(p.dir, "blobs", string(desc.Digest.Algorithm()), desc.Digest.Encoded())
+}
+
+func (p *layoutPuller) exists(desc ociregistry.Descriptor) bool {
+	info, err := os.Stat(p.path(desc))
+	return err == nil && info.Mode().IsRegular() && info.Size() == desc.Size
+}
+
+// writeFile writes the blob with the given descriptor by calling
+// write. The content is written to a temporary file first so that
+// an incomplete or invalid blob is never left in the layout.
+func (p *layoutPuller) writeFile(desc ociregistry.Descriptor, write func(w io.Writer) error) (_err error) {
+	if err := desc.Digest.Validate(); err != nil {
+		return fmt.Errorf("invalid digest %q: %v", desc.Digest, err)
+	}
+	path := p.path(desc)
+	if err := os.MkdirAll(filepath.Dir(path), 0o777); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if _err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	if err := write(f); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// readLayoutManifest reads the content of the manifest with
+// the given descriptor from rd, checking it against the descriptor.
+// It closes rd.
+func readLayoutManifest(rd ociregistry.BlobReader, desc ociregistry.Descriptor) ([]byte, error) {
+	data, got, err := readManifestContent(rd)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read manifest %s: %w", desc.Digest, err)
+	}
+	if got.Digest != desc.Digest {
+		return nil, fmt.Errorf("manifest %s has unexpected digest %s: %w", desc.Digest, got.Digest, ociregistry.ErrDigestInvalid)
+	}
+	if got.Size != desc.Size {
+		return nil, fmt.Errorf("manifest %s has unexpected size %d: %w", desc.Digest, got.Size, ociregistry.ErrSizeInvalid)
+	}
+	return data, nil
+}
+
+func writeJSONFile(path string, x any) error {
+	data, err := json.Marshal(x)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o666)
+}
@@ -0,0 +1,400 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-quicktest/qt"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ocimem"
+	"cuelabs.dev/go/oci/ociregistry/ociref"
+	"cuelabs.dev/go/oci/ociregistry/ociserver"
+)
+
+func TestPullToLayout(t *testing.T) {
+	ctx := context.Background()
+	backend := ocimem.New()
+	pushBlob := func(mediaType, content string) ociregistry.Descriptor {
+		desc := ociregistry.Descriptor{
+			MediaType: mediaType,
+			Digest:    digest.FromString(content),
+			Size:      int64(len(content)),
+		}
+		desc, err := backend.PushBlob(ctx, "foo", desc, strings.NewReader(content))
+		qt.Assert(t, qt.IsNil(err))
+		return desc
+	}
+	pushManifest := func(mediaType, tag string, m any) ociregistry.Descriptor {
+		data, err := json.Marshal(m)
+		qt.Assert(t, qt.IsNil(err))
+		desc, err := backend.PushManifest(ctx, "foo", tag, data, mediaType)
+		qt.Assert(t, qt.IsNil(err))
+		return desc
+	}
+	// Two platform images that share a base layer.
+	baseLayer := pushBlob(ocispec.MediaTypeImageLayer, "base layer")
+	var images []ociregistry.Descriptor
+	for _, arch := range []string{"amd64", "arm64"} {
+		desc := pushManifest(ocispec.MediaTypeImageManifest, "", ocispec.Manifest{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			MediaType: ocispec.MediaTypeImageManifest,
+			Config:    pushBlob(ocispec.MediaTypeImageConfig, `{"architecture":"`+arch+`"}`),
+			Layers: []ociregistry.Descriptor{
+				baseLayer,
+				pushBlob(ocispec.MediaTypeImageLayer, arch+" layer"),
+			},
+		})
+		desc.Platform = &ocispec.Platform{
+			Architecture: arch,
+			OS:           "linux",
+		}
+		images = append(images, desc)
+	}
+	indexDesc := pushManifest(ocispec.MediaTypeImageIndex, "latest", ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: images,
+	})
+
+	srv := httptest.NewServer(ociserver.New(backend, nil))
+	defer srv.Close()
+	srvURL, _ := url.Parse(srv.URL)
+	r, err := New(srvURL.Host, &Options{
+		Insecure: true,
+	})
+	qt.Assert(t, qt.IsNil(err))
+
+	dir := t.TempDir()
+	ref, err := ociref.Parse(srvURL.Host + "/foo:latest")
+	qt.Assert(t, qt.IsNil(err))
+	desc, err := PullToLayout(ctx, r, ref, dir)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.Equals(desc.Digest, indexDesc.Digest))
+	qt.Check(t, qt.Equals(desc.Annotations[ocispec.AnnotationRefName], "latest"))
+
+	data, err := os.ReadFile(filepath.Join(dir, ocispec.ImageLayoutFile))
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.JSONEquals(data, ocispec.ImageLayout{
+		Version: ocispec.ImageLayoutVersion,
+	}))
+
+	data, err = os.ReadFile(filepath.Join(dir, ocispec.ImageIndexFile))
+	qt.Assert(t, qt.IsNil(err))
+	var index ocispec.Index
+	qt.Assert(t, qt.IsNil(json.Unmarshal(data, &index)))
+	qt.Assert(t, qt.HasLen(index.Manifests, 1))
+	qt.Check(t, qt.DeepEquals(index.Manifests[0], desc))
+
+	// Every blob should be present under its digest, with the
+	// shared base layer written once: an index, two manifests,
+	// two configs and three layers.
+	var blobs []string
+	err = filepath.WalkDir(filepath.Join(dir, "blobs"), func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		qt.Assert(t, qt.IsNil(err))
+		dig := digest.NewDigestFromEncoded(digest.Algorithm(filepath.Base(filepath.Dir(path))), filepath.Base(path))
+		qt.Check(t, qt.Equals(digest.FromBytes(data), dig))
+		blobs = append(blobs, string(dig))
+		return nil
+	})
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.HasLen(blobs, 8))
+
+	// Pulling by digest gives the same result without a tag annotation.
+	ref.Tag, ref.Digest = "", indexDesc.Digest
+	desc, err = PullToLayout(ctx, r, ref, dir)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.Equals(desc.Digest, indexDesc.Digest))
+	qt.Check(t, qt.IsNil(desc.Annotations))
+}
+
+func TestPullToLayoutMultiple(t *testing.T) {
+	ctx := context.Background()
+	backend := ocimem.New()
+	pushImage := func(tag, content string) ociregistry.Descriptor {
+		config := ociregistry.Descriptor{
+			MediaType: ocispec.MediaTypeImageConfig,
+			Digest:    digest.FromString(content),
+			Size:      int64(len(content)),
+		}
+		config, err := backend.PushBlob(ctx, "foo", config, strings.NewReader(content))
+		qt.Assert(t, qt.IsNil(err))
+		data, err := json.Marshal(ocispec.Manifest{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			MediaType: ocispec.MediaTypeImageManifest,
+			Config:    config,
+			Layers:    []ociregistry.Descriptor{},
+		})
+		qt.Assert(t, qt.IsNil(err))
+		desc, err := backend.PushManifest(ctx, "foo", tag, data, ocispec.MediaTypeImageManifest)
+		qt.Assert(t, qt.IsNil(err))
+		return desc
+	}
+	imageA := pushImage("a", `{"image":"a"}`)
+	imageB := pushImage("b", `{"image":"b"}`)
+
+	dir := t.TempDir()
+	pull := func(ref ociref.Reference) {
+		t.Helper()
+		_, err := PullToLayout(ctx, backend, ref, dir)
+		qt.Assert(t, qt.IsNil(err))
+	}
+	checkIndex := func(want ...string) {
+		t.Helper()
+		data, err := os.ReadFile(filepath.Join(dir, ocispec.ImageIndexFile))
+		qt.Assert(t, qt.IsNil(err))
+		var index ocispec.Index
+		qt.Assert(t, qt.IsNil(json.Unmarshal(data, &index)))
+		var got []string
+		for _, m := range index.Manifests {
+			got = append(got, m.Annotations[ocispec.AnnotationRefName]+"="+string(m.Digest))
+		}
+		qt.Check(t, qt.DeepEquals(got, want))
+	}
+
+	// Each pull adds an entry to the index.
+	pull(ociref.Reference{Repository: "foo", Tag: "a"})
+	pull(ociref.Reference{Repository: "foo", Tag: "b"})
+	checkIndex("a="+string(imageA.Digest), "b="+string(imageB.Digest))
+
+	// Pulling a manifest that's already present by
+	// digest doesn't add another entry.
+	pull(ociref.Reference{Repository: "foo", Digest: imageA.Digest})
+	checkIndex("a="+string(imageA.Digest), "b="+string(imageB.Digest))
+
+	// An entry for a tag that now refers to a different
+	// manifest is replaced.
+	imageC := pushImage("a", `{"image":"c"}`)
+	pull(ociref.Reference{Repository: "foo", Tag: "a"})
+	checkIndex("b="+string(imageB.Digest), "a="+string(imageC.Digest))
+
+	// An untagged entry is replaced when the
+	// same manifest is pulled with a tag.
+	dir = t.TempDir()
+	pull(ociref.Reference{Repository: "foo", Digest: imageB.Digest})
+	checkIndex("=" + string(imageB.Digest))
+	pull(ociref.Reference{Repository: "foo", Tag: "b"})
+	checkIndex("b=" + string(imageB.Digest))
+}
+
+func TestPullToLayoutBadBlob(t *testing.T) {
+	ctx := context.Background()
+	backend := ocimem.New()
+	layer := []byte("layer")
+	layerDesc, err := backend.PushBlob(ctx, "foo", ociregistry.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayer,
+		Digest:    digest.FromBytes(layer),
+		Size:      int64(len(layer)),
+	}, bytes.NewReader(layer))
+	qt.Assert(t, qt.IsNil(err))
+	data, err := json.Marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    layerDesc,
+		Layers:    []ociregistry.Descriptor{layerDesc},
+	})
+	qt.Assert(t, qt.IsNil(err))
+	_, err = backend.PushManifest(ctx, "foo", "latest", data, ocispec.MediaTypeImageManifest)
+	qt.Assert(t, qt.IsNil(err))
+
+	// Serve corrupted content for the layer.
+	r := &ociregistry.Funcs{
+		GetTag_: backend.GetTag,
+		GetBlob_: func(ctx context.Context, repo string, dig ociregistry.Digest) (ociregistry.BlobReader, error) {
+			rd, err := backend.GetBlob(ctx, repo, dig)
+			if err != nil {
+				return nil, err
+			}
+			rd.Close()
+			return newBlobReaderUnverified(io.NopCloser(strings.NewReader("LAYER")), rd.Descriptor()), nil
+		},
+	}
+	dir := t.TempDir()
+	_, err = PullToLayout(ctx, r, ociref.Reference{Repository: "foo", Tag: "latest"}, dir)
+	qt.Assert(t, qt.ErrorMatches(err, `cannot read blob .*: digest mismatch when reading blob`))
+	_, err = os.Stat(filepath.Join(dir, "blobs", "sha256", layerDesc.Digest.Encoded()))
+	qt.Check(t, qt.ErrorIs(err, fs.ErrNotExist))
+}
+
+func TestPullToLayoutUnknownManifestSize(t *testing.T) {
+	ctx := context.Background()
+	backend := ocimem.New()
+	layer := []byte("layer")
+	layerDesc, err := backend.PushBlob(ctx, "foo", ociregistry.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayer,
+		Digest:    digest.FromBytes(layer),
+		Size:      int64(len(layer)),
+	}, bytes.NewReader(layer))
+	qt.Assert(t, qt.IsNil(err))
+	data, err := json.Marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    layerDesc,
+		Layers:    []ociregistry.Descriptor{layerDesc},
+	})
+	qt.Assert(t, qt.IsNil(err))
+	_, err = backend.PushManifest(ctx, "foo", "latest", data, ocispec.MediaTypeImageManifest)
+	qt.Assert(t, qt.IsNil(err))
+
+	getTag := func(content io.Reader) func(ctx context.Context, repo string, tag string) (ociregistry.BlobReader, error) {
+		return func(ctx context.Context, repo string, tag string) (ociregistry.BlobReader, error) {
+			rd, err := backend.GetTag(ctx, repo, tag)
+			if err != nil {
+				return nil, err
+			}
+			rd.Close()
+			desc := rd.Descriptor()
+			desc.Size = -1
+			return newBlobReaderUnverified(io.NopCloser(content), desc), nil
+		}
+	}
+
+	// The size recorded in the layout is taken from the content.
+	r := &ociregistry.Funcs{
+		GetTag_:  getTag(bytes.NewReader(data)),
+		GetBlob_: backend.GetBlob,
+	}
+	desc, err := PullToLayout(ctx, r, ociref.Reference{Repository: "foo", Tag: "latest"}, t.TempDir())
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.Equals(desc.Size, int64(len(data))))
+
+	// Endless content isn't read without bound.
+	r.GetTag_ = getTag(infiniteReader{})
+	_, err = PullToLayout(ctx, r, ociref.Reference{Repository: "foo", Tag: "latest"}, t.TempDir())
+	qt.Assert(t, qt.ErrorMatches(err, `manifest too large \(more than \d+ bytes\)`))
+}
+
+// infiniteReader is an [io.Reader] that never reaches EOF.
+type infiniteReader struct{}
+
+func (infiniteReader) Read(buf []byte) (int, error) {
+	for i := range buf {
+		buf[i] = ' '
+	}
+	return len(buf), nil
+}
+
+func TestPullToLayoutParallel(t *testing.T) {
+	ctx := context.Background()
+	backend := ocimem.New()
+	pushBlob := func(mediaType, content string) ociregistry.Descriptor {
+		desc := ociregistry.Descriptor{
+			MediaType: mediaType,
+			Digest:    digest.FromString(content),
+			Size:      int64(len(content)),
+		}
+		desc, err := backend.PushBlob(ctx, "foo", desc, strings.NewReader(content))
+		qt.Assert(t, qt.IsNil(err))
+		return desc
+	}
+	pushManifest := func(mediaType, tag string, m any) ociregistry.Descriptor {
+		data, err := json.Marshal(m)
+		qt.Assert(t, qt.IsNil(err))
+		desc, err := backend.PushManifest(ctx, "foo", tag, data, mediaType)
+		qt.Assert(t, qt.IsNil(err))
+		return desc
+	}
+	// Several platform images that share a base layer.
+	baseLayer := pushBlob(ocispec.MediaTypeImageLayer, "base layer")
+	archs := []string{"amd64", "arm64", "ppc64le", "s390x"}
+	var images []ociregistry.Descriptor
+	for _, arch := range archs {
+		images = append(images, pushManifest(ocispec.MediaTypeImageManifest, "", ocispec.Manifest{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			MediaType: ocispec.MediaTypeImageManifest,
+			Config:    pushBlob(ocispec.MediaTypeImageConfig, `{"architecture":"`+arch+`"}`),
+			Layers: []ociregistry.Descriptor{
+				baseLayer,
+				pushBlob(ocispec.MediaTypeImageLayer, arch+" layer"),
+			},
+		}))
+	}
+	pushManifest(ocispec.MediaTypeImageIndex, "latest", ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: images,
+	})
+
+	var (
+		mu         sync.Mutex
+		blobCalls  = make(map[ociregistry.Digest]int)
+		requested  = make(chan struct{}, len(archs))
+		allStarted = make(chan struct{})
+	)
+	go func() {
+		for range archs {
+			<-requested
+		}
+		close(allStarted)
+	}()
+	r := &ociregistry.Funcs{
+		GetTag_: backend.GetTag,
+		GetManifest_: func(ctx context.Context, repo string, dig ociregistry.Digest) (ociregistry.BlobReader, error) {
+			// Don't return any of the child manifests until they've
+			// all been requested, so that the pulls of their
+			// content overlap.
+			requested <- struct{}{}
+			select {
+			case <-allStarted:
+			case <-time.After(5 * time.Second):
+				return nil, fmt.Errorf("manifests not fetched concurrently")
+			}
+			return backend.GetManifest(ctx, repo, dig)
+		},
+		GetBlob_: func(ctx context.Context, repo string, dig ociregistry.Digest) (ociregistry.BlobReader, error) {
+			mu.Lock()
+			blobCalls[dig]++
+			mu.Unlock()
+			return backend.GetBlob(ctx, repo, dig)
+		},
+	}
+	dir := t.TempDir()
+	_, err := PullToLayoutParallel(ctx, r, ociref.Reference{Repository: "foo", Tag: "latest"}, dir, len(archs))
+	qt.Assert(t, qt.IsNil(err))
+
+	// Each blob, including the shared base layer,
+	// was fetched exactly once.
+	qt.Check(t, qt.HasLen(blobCalls, 1+2*len(archs)))
+	for dig, n := range blobCalls {
+		qt.Check(t, qt.Equals(n, 1), qt.Commentf("blob %s", dig))
+	}
+	_, err = os.Stat(filepath.Join(dir, "blobs", "sha256", baseLayer.Digest.Encoded()))
+	qt.Check(t, qt.IsNil(err))
+	for _, image := range images {
+		_, err = os.Stat(filepath.Join(dir, "blobs", "sha256", image.Digest.Encoded()))
+		qt.Check(t, qt.IsNil(err))
+	}
+}
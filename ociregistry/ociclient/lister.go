@@ -71,27 +71,109 @@ func (c *client) Tags(ctx context.Context, repoName, startAfter string) ociregis
 }
 
 func (c *client) Referrers(ctx context.Context, repoName string, digest ociregistry.Digest, artifactType string) ociregistry.Seq[ociregistry.Descriptor] {
-	// TODO paging
-	resp, err := c.doRequest(ctx, &ocirequest.Request{
-		Kind:   ocirequest.ReqReferrersList,
-		Repo:   repoName,
-		Digest: string(digest),
-		ListN:  c.listPageSize,
-	})
-	if err != nil {
-		return ociregistry.ErrorSeq[ociregistry.Descriptor](err)
+	if c.referrersCache == nil {
+		return c.referrers(ctx, repoName, digest, artifactType)
+	}
+	key := referrersKey{
+		repo:         repoName,
+		digest:       digest,
+		artifactType: artifactType,
+	}
+	return func(yield func(ociregistry.Descriptor, error) bool) {
+		if descs, ok := c.referrersCache.get(key); ok {
+			for _, desc := range descs {
+				if !yield(desc, nil) {
+					return
+				}
+			}
+			return
+		}
+		descs := []ociregistry.Descriptor{}
+		complete := true
+		c.referrers(ctx, repoName, digest, artifactType)(func(desc ociregistry.Descriptor, err error) bool {
+			if err != nil {
+				complete = false
+				yield(desc, err)
+				return false
+			}
+			descs = append(descs, desc)
+			if !yield(desc, nil) {
+				complete = false
+				return false
+			}
+			return true
+		})
+		if complete {
+			c.referrersCache.put(key, descs)
+		}
 	}
+}
 
-	data, err := io.ReadAll(resp.Body)
-	resp.Body.Close()
-	if err != nil {
-		return ociregistry.ErrorSeq[ociregistry.Descriptor](err)
+func (c *client) referrers(ctx context.Context, repoName string, digest ociregistry.Digest, artifactType string) ociregistry.Seq[ociregistry.Descriptor] {
+	return func(yield func(ociregistry.Descriptor, error) bool) {
+		req, err := newRequest(ctx, &ocirequest.Request{
+			Kind:         ocirequest.ReqReferrersList,
+			Repo:         repoName,
+			Digest:       string(digest),
+			ListN:        c.listPageSize,
+			ArtifactType: artifactType,
+		}, nil)
+		if err != nil {
+			yield(ociregistry.Descriptor{}, err)
+			return
+		}
+		for {
+			resp, err := c.do(req)
+			if err != nil {
+				yield(ociregistry.Descriptor{}, err)
+				return
+			}
+			data, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				yield(ociregistry.Descriptor{}, err)
+				return
+			}
+			var referrersResponse ocispec.Index
+			if err := json.Unmarshal(data, &referrersResponse); err != nil {
+				yield(ociregistry.Descriptor{}, fmt.Errorf("cannot unmarshal referrers response: %v", err))
+				return
+			}
+			// The registry might not support filtering, in which
+			// case it won't say that it's applied the filter and
+			// we need to do it ourselves.
+			filter := artifactType != "" && !filterApplied(resp, "artifactType")
+			for _, desc := range referrersResponse.Manifests {
+				if filter && desc.ArtifactType != artifactType {
+					continue
+				}
+				if !yield(desc, nil) {
+					return
+				}
+			}
+			if resp.Header.Get("Link") == "" {
+				return
+			}
+			req, err = nextLink(ctx, resp, nil, "")
+			if err != nil {
+				yield(ociregistry.Descriptor{}, fmt.Errorf("invalid Link header in response: %v", err))
+				return
+			}
+		}
 	}
-	var referrersResponse ocispec.Index
-	if err := json.Unmarshal(data, &referrersResponse); err != nil {
-		return ociregistry.ErrorSeq[ociregistry.Descriptor](fmt.Errorf("cannot unmarshal referrers response: %v", err))
+}
+
+// filterApplied reports whether the OCI-Filters-Applied header
+// in resp includes the given filter.
+func filterApplied(resp *http.Response, filter string) bool {
+	for _, h := range resp.Header.Values("OCI-Filters-Applied") {
+		for _, f := range strings.Split(h, ",") {
+			if strings.TrimSpace(f) == filter {
+				return true
+			}
+		}
 	}
-	return ociregistry.SliceSeq(referrersResponse.Manifests)
+	return false
 }
 
 // pager returns an iterator for a list entry point. It starts by sending the given
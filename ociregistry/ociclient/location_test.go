@@ -0,0 +1,107 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociclient
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/go-quicktest/qt"
+	"github.com/opencontainers/go-digest"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ocimem"
+	"cuelabs.dev/go/oci/ociregistry/ociserver"
+)
+
+// internalHost is a host name that the client can't reach.
+const internalHost = "registry.internal.invalid"
+
+func TestRewriteUploadLocation(t *testing.T) {
+	srv := httptest.NewServer(internalUploadLocations(ociserver.New(ocimem.New(), nil)))
+	defer srv.Close()
+	srvURL, _ := url.Parse(srv.URL)
+
+	content := []byte("some content")
+	desc := ociregistry.Descriptor{
+		MediaType: "application/octet-stream",
+		Digest:    digest.FromBytes(content),
+		Size:      int64(len(content)),
+	}
+	ctx := context.Background()
+
+	// Without the rewrite, the client tries to use the
+	// unreachable host.
+	r, err := New(srvURL.Host, &Options{
+		Insecure: true,
+	})
+	qt.Assert(t, qt.IsNil(err))
+	_, err = r.PushBlob(ctx, "foo", desc, bytes.NewReader(content))
+	qt.Assert(t, qt.ErrorMatches(err, `.*`+internalHost+`.*`))
+
+	var rewritten []string
+	r, err = New(srvURL.Host, &Options{
+		Insecure: true,
+		RewriteUploadLocation: func(u *url.URL) *url.URL {
+			rewritten = append(rewritten, u.Host)
+			if u.Host == internalHost {
+				u1 := *u
+				u1.Host = srvURL.Host
+				return &u1
+			}
+			return u
+		},
+	})
+	qt.Assert(t, qt.IsNil(err))
+	gotDesc, err := r.PushBlob(ctx, "foo", desc, bytes.NewReader(content))
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.Equals(gotDesc.Digest, desc.Digest))
+	qt.Check(t, qt.Not(qt.HasLen(rewritten, 0)))
+	qt.Check(t, qt.Equals(rewritten[0], internalHost))
+
+	rd, err := r.GetBlob(ctx, "foo", desc.Digest)
+	qt.Assert(t, qt.IsNil(err))
+	rd.Close()
+}
+
+// internalUploadLocations returns a handler that defers to h but
+// returns upload locations on an internal host name, as some
+// misconfigured registries do.
+func internalUploadLocations(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		h.ServeHTTP(&locationRewriter{ResponseWriter: w}, req)
+	})
+}
+
+type locationRewriter struct {
+	http.ResponseWriter
+}
+
+func (w *locationRewriter) WriteHeader(code int) {
+	if loc := w.Header().Get("Location"); strings.Contains(loc, "/blobs/uploads/") {
+		u, err := url.Parse(loc)
+		if err == nil {
+			u.Scheme = "http"
+			u.Host = internalHost
+			w.Header().Set("Location", u.String())
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
@@ -0,0 +1,137 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"cuelabs.dev/go/oci/ociregistry"
+)
+
+// maxManifestSize holds the maximum size of manifest that we're
+// prepared to read into memory. The distribution spec suggests
+// that registries should accept manifests of at least 4MiB.
+const maxManifestSize = 4 * 1024 * 1024
+
+// GetManifestContent returns the entire content of the manifest
+// with the given digest from r, along with its descriptor.
+//
+// The content is checked against the size and digest in
+// the descriptor returned by r, so the caller does not need to
+// verify it again. Manifests larger than 4MiB are rejected.
+//
+// Note that when r has been created by [New] with
+// [Options.ConvertSchema1] set, the returned descriptor may refer
+// to a converted manifest with a different digest from dig.
+func GetManifestContent(ctx context.Context, r ociregistry.Interface, repo string, dig ociregistry.Digest) ([]byte, ociregistry.Descriptor, error) {
+	rd, err := r.GetManifest(ctx, repo, dig)
+	if err != nil {
+		return nil, ociregistry.Descriptor{}, err
+	}
+	return readManifestContent(rd)
+}
+
+// GetTagContent is like [GetManifestContent] but fetches the manifest
+// with the given tag. The returned descriptor holds the digest of the
+// manifest, so it can be used to pin the tag without a separate
+// ResolveTag call.
+//
+// When r has been created by [New], the digest is taken from the
+// Docker-Content-Digest response header or, when there's no such
+// header, computed from the content. Either way, it's checked
+// against the content returned.
+func GetTagContent(ctx context.Context, r ociregistry.Interface, repo string, tag string) ([]byte, ociregistry.Descriptor, error) {
+	rd, err := r.GetTag(ctx, repo, tag)
+	if err != nil {
+		return nil, ociregistry.Descriptor{}, err
+	}
+	return readManifestContent(rd)
+}
+
+// PushManifestIfChanged is like calling r.PushManifest except that
+// it first resolves the tag and, if it already refers to a manifest
+// with the same digest as contents, it does not push the
+// manifest, returning the existing descriptor instead.
+// This avoids needless churn when the same content is
+// pushed repeatedly. It reports whether the manifest
+// was pushed.
+//
+// If the tag does not exist, the manifest is pushed as usual.
+func PushManifestIfChanged(ctx context.Context, r ociregistry.Interface, repo string, tag string, contents []byte, mediaType string) (_ ociregistry.Descriptor, pushed bool, _ error) {
+	existing, err := r.ResolveTag(ctx, repo, tag)
+	switch {
+	case err == nil:
+		alg := existing.Digest.Algorithm()
+		if alg.Available() && alg.FromBytes(contents) == existing.Digest {
+			return existing, false, nil
+		}
+	case !isNotFound(err):
+		return ociregistry.Descriptor{}, false, err
+	}
+	desc, err := r.PushManifest(ctx, repo, tag, contents, mediaType)
+	if err != nil {
+		return ociregistry.Descriptor{}, false, err
+	}
+	return desc, true, nil
+}
+
+// isNotFound reports whether err indicates that the
+// requested manifest, blob or repository does not exist.
+func isNotFound(err error) bool {
+	if errors.Is(err, ociregistry.ErrManifestUnknown) ||
+		errors.Is(err, ociregistry.ErrBlobUnknown) ||
+		errors.Is(err, ociregistry.ErrNameUnknown) {
+		return true
+	}
+	var herr ociregistry.HTTPError
+	return errors.As(err, &herr) && herr.StatusCode() == http.StatusNotFound
+}
+
+// readManifestContent reads all the content from rd, checking
+// it against the size and digest in rd's descriptor,
+// and closes it. If the size in the descriptor is unknown (-1),
+// it's filled in from the content.
+func readManifestContent(rd ociregistry.BlobReader) ([]byte, ociregistry.Descriptor, error) {
+	defer rd.Close()
+	desc := rd.Descriptor()
+	if desc.Size > maxManifestSize {
+		return nil, ociregistry.Descriptor{}, fmt.Errorf("manifest too large (%d bytes)", desc.Size)
+	}
+	limit := desc.Size
+	if limit < 0 {
+		limit = maxManifestSize
+	}
+	data, err := io.ReadAll(io.LimitReader(rd, limit+1))
+	if err != nil {
+		return nil, ociregistry.Descriptor{}, fmt.Errorf("cannot read manifest: %w", err)
+	}
+	if desc.Size < 0 {
+		if int64(len(data)) > maxManifestSize {
+			return nil, ociregistry.Descriptor{}, fmt.Errorf("manifest too large (more than %d bytes)", maxManifestSize)
+		}
+		desc.Size = int64(len(data))
+	}
+	if int64(len(data)) != desc.Size {
+		return nil, ociregistry.Descriptor{}, fmt.Errorf("manifest size mismatch (%d/%d): %w", len(data), desc.Size, ociregistry.ErrSizeInvalid)
+	}
+	if !desc.Digest.Algorithm().Available() || desc.Digest.Algorithm().FromBytes(data) != desc.Digest {
+		return nil, ociregistry.Descriptor{}, fmt.Errorf("manifest digest mismatch: %w", ociregistry.ErrDigestInvalid)
+	}
+	return data, desc, nil
+}
@@ -0,0 +1,211 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociclient
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/go-quicktest/qt"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ocimem"
+	"cuelabs.dev/go/oci/ociregistry/ociserver"
+)
+
+func TestGetManifestContent(t *testing.T) {
+	ctx := context.Background()
+	backend := ocimem.New()
+	manifest := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[]}`)
+	pushed, err := backend.PushManifest(ctx, "foo/bar", "", manifest, ocispec.MediaTypeImageIndex)
+	qt.Assert(t, qt.IsNil(err))
+
+	srv := httptest.NewServer(ociserver.New(backend, nil))
+	defer srv.Close()
+	srvURL, _ := url.Parse(srv.URL)
+	r, err := New(srvURL.Host, &Options{
+		Insecure: true,
+	})
+	qt.Assert(t, qt.IsNil(err))
+
+	data, desc, err := GetManifestContent(ctx, r, "foo/bar", pushed.Digest)
+	qt.Assert(t, qt.IsNil(err))
+
+	rd, err := r.GetManifest(ctx, "foo/bar", pushed.Digest)
+	qt.Assert(t, qt.IsNil(err))
+	defer rd.Close()
+	wantData, err := io.ReadAll(rd)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.DeepEquals(data, wantData))
+	qt.Check(t, qt.DeepEquals(desc, rd.Descriptor()))
+	qt.Check(t, qt.Equals(desc.Digest, pushed.Digest))
+	qt.Check(t, qt.Equals(desc.MediaType, ocispec.MediaTypeImageIndex))
+
+	_, _, err = GetManifestContent(ctx, r, "foo/bar", digest.FromString("other"))
+	qt.Check(t, qt.ErrorIs(err, ociregistry.ErrManifestUnknown))
+}
+
+func TestGetManifestContentVerifies(t *testing.T) {
+	ctx := context.Background()
+	content := []byte("some content")
+	tests := []struct {
+		testName string
+		desc     ociregistry.Descriptor
+		wantErr  error
+	}{{
+		testName: "DigestMismatch",
+		desc: ociregistry.Descriptor{
+			Digest: digest.FromString("something else"),
+			Size:   int64(len(content)),
+		},
+		wantErr: ociregistry.ErrDigestInvalid,
+	}, {
+		testName: "SizeMismatch",
+		desc: ociregistry.Descriptor{
+			Digest: digest.FromBytes(content),
+			Size:   int64(len(content)) + 1,
+		},
+		wantErr: ociregistry.ErrSizeInvalid,
+	}}
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			r := &ociregistry.Funcs{
+				GetManifest_: func(ctx context.Context, repo string, dig ociregistry.Digest) (ociregistry.BlobReader, error) {
+					return ocimem.NewBytesReader(content, test.desc), nil
+				},
+			}
+			_, _, err := GetManifestContent(ctx, r, "foo/bar", test.desc.Digest)
+			qt.Check(t, qt.ErrorIs(err, test.wantErr))
+		})
+	}
+}
+
+func TestGetTagContent(t *testing.T) {
+	ctx := context.Background()
+	backend := ocimem.New()
+	manifest := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[]}`)
+	pushed, err := backend.PushManifest(ctx, "foo/bar", "latest", manifest, ocispec.MediaTypeImageIndex)
+	qt.Assert(t, qt.IsNil(err))
+
+	for _, omitDigest := range []bool{false, true} {
+		srv := ociserver.New(backend, &ociserver.Options{
+			OmitDigestFromTagGetResponse: omitDigest,
+		})
+		var requests []string
+		httpSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			requests = append(requests, req.Method+" "+req.URL.Path)
+			srv.ServeHTTP(w, req)
+		}))
+		defer httpSrv.Close()
+		srvURL, _ := url.Parse(httpSrv.URL)
+		r, err := New(srvURL.Host, &Options{
+			Insecure: true,
+		})
+		qt.Assert(t, qt.IsNil(err))
+
+		data, desc, err := GetTagContent(ctx, r, "foo/bar", "latest")
+		qt.Assert(t, qt.IsNil(err))
+		qt.Check(t, qt.DeepEquals(data, manifest))
+		qt.Check(t, qt.Equals(desc.Digest, pushed.Digest))
+		qt.Check(t, qt.Equals(desc.Digest, digest.FromBytes(data)))
+		qt.Check(t, qt.Equals(desc.Size, int64(len(manifest))))
+		qt.Check(t, qt.Equals(desc.MediaType, ocispec.MediaTypeImageIndex))
+		// The digest is found with a single request.
+		qt.Check(t, qt.DeepEquals(requests, []string{"GET /v2/foo/bar/manifests/latest"}))
+
+		_, _, err = GetTagContent(ctx, r, "foo/bar", "other")
+		qt.Check(t, qt.ErrorIs(err, ociregistry.ErrManifestUnknown))
+	}
+}
+
+func TestGetTagContentVerifies(t *testing.T) {
+	// The server returns a digest header that doesn't match the content.
+	manifest := `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[]}`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", ocispec.MediaTypeImageIndex)
+		w.Header().Set("Docker-Content-Digest", string(digest.FromString("other")))
+		io.WriteString(w, manifest)
+	}))
+	defer srv.Close()
+	srvURL, _ := url.Parse(srv.URL)
+	r, err := New(srvURL.Host, &Options{
+		Insecure: true,
+	})
+	qt.Assert(t, qt.IsNil(err))
+	_, _, err = GetTagContent(context.Background(), r, "foo/bar", "latest")
+	qt.Check(t, qt.ErrorMatches(err, `cannot read manifest: digest mismatch when reading blob`))
+}
+
+func TestPushManifestIfChanged(t *testing.T) {
+	ctx := context.Background()
+	backend := ocimem.New()
+	var requests []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/v2/" {
+			requests = append(requests, req.Method+" "+req.URL.Path)
+		}
+		ociserver.New(backend, nil).ServeHTTP(w, req)
+	}))
+	defer srv.Close()
+	srvURL, _ := url.Parse(srv.URL)
+	r, err := New(srvURL.Host, &Options{
+		Insecure: true,
+	})
+	qt.Assert(t, qt.IsNil(err))
+
+	manifest1 := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[]}`)
+	manifest2 := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[],"annotations":{"x":"y"}}`)
+
+	// The tag is absent, so the manifest is pushed.
+	desc, pushed, err := PushManifestIfChanged(ctx, r, "foo/bar", "latest", manifest1, ocispec.MediaTypeImageIndex)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.IsTrue(pushed))
+	qt.Check(t, qt.Equals(desc.Digest, digest.FromBytes(manifest1)))
+	qt.Check(t, qt.DeepEquals(requests, []string{
+		"HEAD /v2/foo/bar/manifests/latest",
+		"PUT /v2/foo/bar/manifests/latest",
+	}))
+
+	// The tag is unchanged, so the push is skipped.
+	requests = nil
+	desc, pushed, err = PushManifestIfChanged(ctx, r, "foo/bar", "latest", manifest1, ocispec.MediaTypeImageIndex)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.IsFalse(pushed))
+	qt.Check(t, qt.Equals(desc.Digest, digest.FromBytes(manifest1)))
+	qt.Check(t, qt.Equals(desc.Size, int64(len(manifest1))))
+	qt.Check(t, qt.DeepEquals(requests, []string{
+		"HEAD /v2/foo/bar/manifests/latest",
+	}))
+
+	// The content has changed, so the manifest is pushed.
+	requests = nil
+	desc, pushed, err = PushManifestIfChanged(ctx, r, "foo/bar", "latest", manifest2, ocispec.MediaTypeImageIndex)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.IsTrue(pushed))
+	qt.Check(t, qt.Equals(desc.Digest, digest.FromBytes(manifest2)))
+	qt.Check(t, qt.DeepEquals(requests, []string{
+		"HEAD /v2/foo/bar/manifests/latest",
+		"PUT /v2/foo/bar/manifests/latest",
+	}))
+	got, err := backend.ResolveTag(ctx, "foo/bar", "latest")
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.Equals(got.Digest, digest.FromBytes(manifest2)))
+}
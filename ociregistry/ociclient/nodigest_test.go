@@ -0,0 +1,97 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociclient
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/go-quicktest/qt"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ocimem"
+	"cuelabs.dev/go/oci/ociregistry/ociserver"
+)
+
+func TestNoContentDigestHeader(t *testing.T) {
+	ctx := context.Background()
+	srv := ociserver.New(ocimem.New(), &ociserver.Options{
+		OmitContentDigestHeader: true,
+	})
+	httpSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		srv.ServeHTTP(w, req)
+		qt.Check(t, qt.Equals(w.Header().Get("Docker-Content-Digest"), ""), qt.Commentf("%s %s", req.Method, req.URL))
+	}))
+	defer httpSrv.Close()
+	srvURL, _ := url.Parse(httpSrv.URL)
+	r, err := New(srvURL.Host, &Options{
+		Insecure: true,
+	})
+	qt.Assert(t, qt.IsNil(err))
+
+	blob := "some blob content"
+	blobDesc := ociregistry.Descriptor{
+		MediaType: "application/octet-stream",
+		Digest:    digest.FromString(blob),
+		Size:      int64(len(blob)),
+	}
+	_, err = r.PushBlob(ctx, "foo", blobDesc, strings.NewReader(blob))
+	qt.Assert(t, qt.IsNil(err))
+	manifest := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[]}`)
+	manifestDesc, err := r.PushManifest(ctx, "foo", "latest", manifest, ocispec.MediaTypeImageIndex)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.Equals(manifestDesc.Digest, digest.FromBytes(manifest)))
+
+	// Requests by digest use the digest from the request.
+	desc, err := r.ResolveBlob(ctx, "foo", blobDesc.Digest)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.Equals(desc.Digest, blobDesc.Digest))
+	qt.Check(t, qt.Equals(desc.Size, blobDesc.Size))
+
+	rd, err := r.GetBlob(ctx, "foo", blobDesc.Digest)
+	qt.Assert(t, qt.IsNil(err))
+	data, err := io.ReadAll(rd)
+	rd.Close()
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.Equals(string(data), blob))
+	qt.Check(t, qt.Equals(rd.Descriptor().Digest, blobDesc.Digest))
+
+	desc, err = r.ResolveManifest(ctx, "foo", manifestDesc.Digest)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.Equals(desc.Digest, manifestDesc.Digest))
+
+	data, desc, err = GetManifestContent(ctx, r, "foo", manifestDesc.Digest)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.DeepEquals(data, manifest))
+	qt.Check(t, qt.Equals(desc.Digest, manifestDesc.Digest))
+
+	// Getting a manifest by tag computes the digest from the content.
+	data, desc, err = GetTagContent(ctx, r, "foo", "latest")
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.DeepEquals(data, manifest))
+	qt.Check(t, qt.Equals(desc.Digest, manifestDesc.Digest))
+	qt.Check(t, qt.Equals(desc.MediaType, ocispec.MediaTypeImageIndex))
+
+	// A HEAD request for a tag has no way of finding the digest.
+	_, err = r.ResolveTag(ctx, "foo", "latest")
+	qt.Check(t, qt.ErrorMatches(err, `invalid descriptor in response: no digest found in response`))
+}
@@ -0,0 +1,132 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociclient
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/go-quicktest/qt"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ociauth"
+	"cuelabs.dev/go/oci/ociregistry/ocimem"
+	"cuelabs.dev/go/oci/ociregistry/ociserver"
+)
+
+func TestOnRequest(t *testing.T) {
+	backend := ociserver.New(ocimem.New(), nil)
+	var serverTraceIDs []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		serverTraceIDs = append(serverTraceIDs, req.Header.Get("X-Trace-Id"))
+		backend.ServeHTTP(w, req)
+	}))
+	defer srv.Close()
+	srvURL, _ := url.Parse(srv.URL)
+
+	var seen []*http.Request
+	r, err := New(srvURL.Host, &Options{
+		Insecure: true,
+		OnRequest: func(req *http.Request) {
+			seen = append(seen, req)
+			req.Header.Set("X-Trace-Id", "trace-1")
+		},
+	})
+	qt.Assert(t, qt.IsNil(err))
+	_, err = r.ResolveTag(context.Background(), "foo", "latest")
+	qt.Assert(t, qt.ErrorMatches(err, `404 Not Found: .*`))
+
+	qt.Assert(t, qt.HasLen(seen, 1))
+	req := seen[0]
+	qt.Check(t, qt.Equals(req.Method, "HEAD"))
+	qt.Check(t, qt.Equals(req.URL.String(), srv.URL+"/v2/foo/manifests/latest"))
+	qt.Check(t, qt.StringContains(req.Header.Get("Accept"), "application/vnd.oci.image.manifest.v1+json"))
+
+	// The header added by the hook was sent to the server.
+	qt.Check(t, qt.DeepEquals(serverTraceIDs, []string{"trace-1"}))
+}
+
+func TestOnRequestSeesAuthorization(t *testing.T) {
+	backend := ociserver.New(ocimem.New(), nil)
+	var serverAuth []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		serverAuth = append(serverAuth, req.Header.Get("Authorization"))
+		if user, pass, ok := req.BasicAuth(); !ok || user != "someuser" || pass != "somepassword" {
+			w.Header().Set("Www-Authenticate", `Basic realm="test"`)
+			ociregistry.WriteError(w, ociregistry.ErrUnauthorized)
+			return
+		}
+		backend.ServeHTTP(w, req)
+	}))
+	defer srv.Close()
+	srvURL, _ := url.Parse(srv.URL)
+
+	config, err := ociauth.LoadFromDockerConfigJSON([]byte(`{"auths":{"` + srvURL.Host + `":{"auth":"c29tZXVzZXI6c29tZXBhc3N3b3Jk"}}}`))
+	qt.Assert(t, qt.IsNil(err))
+	var hookAuth []string
+	r, err := New(srvURL.Host, &Options{
+		Insecure: true,
+		Transport: ociauth.NewStdTransport(ociauth.StdTransportParams{
+			Config: config,
+		}),
+		AllowInsecureAuth: true,
+		OnRequest: func(req *http.Request) {
+			hookAuth = append(hookAuth, req.Header.Get("Authorization"))
+		},
+	})
+	qt.Assert(t, qt.IsNil(err))
+	_, err = ociregistry.All(r.Repositories(context.Background(), ""))
+	qt.Assert(t, qt.IsNil(err))
+
+	// The hook is called for the request resent after the
+	// challenge, and it sees the authorization that's sent.
+	qt.Check(t, qt.DeepEquals(serverAuth, []string{"", "Basic c29tZXVzZXI6c29tZXBhc3N3b3Jk"}))
+	qt.Check(t, qt.DeepEquals(hookAuth, serverAuth))
+}
+
+func TestOnRequestCalledForEachAttempt(t *testing.T) {
+	backend := ociserver.New(ocimem.New(), nil)
+	var serverTraceIDs []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		serverTraceIDs = append(serverTraceIDs, req.Header.Get("X-Trace-Id"))
+		if len(serverTraceIDs) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		backend.ServeHTTP(w, req)
+	}))
+	defer srv.Close()
+	srvURL, _ := url.Parse(srv.URL)
+
+	n := 0
+	r, err := New(srvURL.Host, &Options{
+		Insecure: true,
+		Retry: &RetryOptions{
+			MaxAttempts: 2,
+		},
+		OnRequest: func(req *http.Request) {
+			n++
+			req.Header.Set("X-Trace-Id", fmt.Sprintf("attempt-%d", n))
+		},
+	})
+	qt.Assert(t, qt.IsNil(err))
+	_, err = r.ResolveTag(context.Background(), "foo", "latest")
+	qt.Assert(t, qt.ErrorMatches(err, `404 Not Found: .*`))
+	qt.Check(t, qt.DeepEquals(serverTraceIDs, []string{"attempt-1", "attempt-2"}))
+}
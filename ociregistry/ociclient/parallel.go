@@ -0,0 +1,218 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/internal/ocirequest"
+	"cuelabs.dev/go/oci/ociregistry/ociauth"
+)
+
+// PushBlobParallel is like [ociregistry.Writer.PushBlob] except that
+// it reads the content from ra and, when r has been created by [New],
+// it may upload the content as several chunks with up to concurrency
+// PATCH requests in flight at once.
+//
+// The OCI spec requires chunks to be uploaded in order, so parallel
+// upload is only attempted when the registry keeps the same upload
+// location from one chunk to the next and accepts an out-of-order
+// chunk. When it does not (it returns a new location, or responds
+// with "416 Range Not Satisfiable"), the content is uploaded
+// sequentially instead.
+//
+// If r was not created by [New] or concurrency is less than 2,
+// the content is pushed with r.PushBlob.
+func PushBlobParallel(ctx context.Context, r ociregistry.Interface, repo string, desc ociregistry.Descriptor, ra io.ReaderAt, concurrency int) (ociregistry.Descriptor, error) {
+	c, ok := r.(*client)
+	if !ok || concurrency < 2 {
+		return r.PushBlob(ctx, repo, desc, io.NewSectionReader(ra, 0, desc.Size))
+	}
+	return c.pushBlobParallel(ctx, repo, desc, ra, concurrency)
+}
+
+func (c *client) pushBlobParallel(ctx context.Context, repo string, desc ociregistry.Descriptor, ra io.ReaderAt, concurrency int) (ociregistry.Descriptor, error) {
+	rreq := &ocirequest.Request{
+		Kind: ocirequest.ReqBlobStartUpload,
+		Repo: repo,
+	}
+	resp, err := c.startUpload(ctx, rreq)
+	if err != nil {
+		return ociregistry.Descriptor{}, err
+	}
+	resp.Body.Close()
+	location, err := c.locationFromResponse(resp)
+	if err != nil {
+		return ociregistry.Descriptor{}, err
+	}
+	ctx = ociauth.ContextWithRequestInfo(ctx, ociauth.RequestInfo{
+		RequiredScope: rreq.RequiredScope(),
+	})
+	// Divide the content evenly between the workers, but
+	// avoid very small chunks.
+	chunkSize := (desc.Size + int64(concurrency) - 1) / int64(concurrency)
+	chunkSize = int64(chunkSizeFromResponse(resp, int(max(chunkSize, defaultChunkSize))))
+	if desc.Size <= chunkSize {
+		// There's only one chunk, so upload it all in one go.
+		if _, err := c.uploadChunk(ctx, location, ra, 0, desc.Size, desc.Digest); err != nil {
+			return ociregistry.Descriptor{}, err
+		}
+		return desc, nil
+	}
+
+	// Send the first chunk in order. This is always valid and
+	// shows whether the registry keeps the same upload location
+	// throughout the upload: if it hands out a new location for
+	// each chunk, concurrent requests can't share one, so upload
+	// the rest sequentially.
+	firstLocation, err := c.uploadChunk(ctx, location, ra, 0, chunkSize, "")
+	if err != nil {
+		return ociregistry.Descriptor{}, err
+	}
+	if firstLocation.String() != location.String() || desc.Size <= 2*chunkSize {
+		return c.pushBlobSequential(ctx, firstLocation, desc, ra, chunkSize, chunkSize)
+	}
+
+	// Find out whether the registry accepts out-of-order
+	// chunks by sending the third chunk before the second.
+	if _, err := c.uploadChunk(ctx, location, ra, 2*chunkSize, min(chunkSize, desc.Size-2*chunkSize), ""); err != nil {
+		var herr ociregistry.HTTPError
+		if !errors.As(err, &herr) || herr.StatusCode() != http.StatusRequestedRangeNotSatisfiable {
+			return ociregistry.Descriptor{}, err
+		}
+		// The registry requires chunks to be sent in order.
+		// Fall back to uploading sequentially.
+		return c.pushBlobSequential(ctx, location, desc, ra, chunkSize, chunkSize)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	sem := make(chan struct{}, concurrency)
+	for off := int64(0); off < desc.Size; off += chunkSize {
+		if off == 0 || off == 2*chunkSize {
+			// Already sent above.
+			continue
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func(off int64) {
+			defer wg.Done()
+			defer func() {
+				<-sem
+			}()
+			if _, err := c.uploadChunk(ctx, location, ra, off, min(chunkSize, desc.Size-off), ""); err != nil {
+				errOnce.Do(func() {
+					firstErr = err
+					cancel()
+				})
+			}
+		}(off)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return ociregistry.Descriptor{}, firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return ociregistry.Descriptor{}, err
+	}
+	// All the content has been sent; commit it.
+	if _, err := c.uploadChunk(ctx, location, ra, 0, 0, desc.Digest); err != nil {
+		return ociregistry.Descriptor{}, err
+	}
+	return desc, nil
+}
+
+// pushBlobSequential uploads the content of ra from offset off
+// onwards in chunks of the given size, in order, to the given upload
+// location, and commits the upload.
+func (c *client) pushBlobSequential(ctx context.Context, location *url.URL, desc ociregistry.Descriptor, ra io.ReaderAt, off, chunkSize int64) (ociregistry.Descriptor, error) {
+	w := &blobWriter{
+		ctx:       ctx,
+		client:    c,
+		chunkSize: int(chunkSize),
+		location:  location,
+		size:      off,
+		flushed:   off,
+	}
+	if _, err := io.Copy(w, io.NewSectionReader(ra, off, desc.Size-off)); err != nil {
+		return ociregistry.Descriptor{}, err
+	}
+	if _, err := w.Commit(desc.Digest); err != nil {
+		return ociregistry.Descriptor{}, err
+	}
+	return desc, nil
+}
+
+// uploadChunk sends n bytes of content from ra starting at offset off to the
+// given upload location. If commitDigest is non-empty, the
+// upload is completed with a PUT request; otherwise a PATCH request is used
+// and uploadChunk returns the location to use for subsequent requests.
+func (c *client) uploadChunk(ctx context.Context, location *url.URL, ra io.ReaderAt, off, n int64, commitDigest ociregistry.Digest) (*url.URL, error) {
+	method := "PATCH"
+	expect := http.StatusAccepted
+	reqURL := location
+	if commitDigest != "" {
+		method = "PUT"
+		expect = http.StatusCreated
+		reqURL = urlWithDigest(location, string(commitDigest))
+	}
+	var body io.Reader
+	if n > 0 {
+		body = io.NewSectionReader(ra, off, n)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, "", body)
+	if err != nil {
+		return nil, fmt.Errorf("cannot make %s request: %v", method, err)
+	}
+	req.URL = reqURL
+	req.ContentLength = n
+	if n > 0 {
+		req.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(io.NewSectionReader(ra, off, n)), nil
+		}
+		req.Header.Set("Content-Range", ocirequest.RangeString(off, off+n))
+	}
+	resp, err := c.do(req, expect)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if commitDigest != "" {
+		return nil, nil
+	}
+	newLocation, err := c.locationFromResponse(resp)
+	if err != nil {
+		return nil, fmt.Errorf("bad Location in response: %v", err)
+	}
+	return newLocation, nil
+}
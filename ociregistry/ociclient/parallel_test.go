@@ -0,0 +1,199 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociclient
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-quicktest/qt"
+	"github.com/opencontainers/go-digest"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/internal/ocirequest"
+	"cuelabs.dev/go/oci/ociregistry/ocimem"
+	"cuelabs.dev/go/oci/ociregistry/ociserver"
+)
+
+func TestPushBlobParallel(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), 4*defaultChunkSize/16)
+	desc := ociregistry.Descriptor{
+		Digest: digest.FromBytes(content),
+		Size:   int64(len(content)),
+	}
+
+	// permissiveServer accepts chunks in any order.
+	var (
+		mu          sync.Mutex
+		buf         = make([]byte, len(content))
+		inFlight    int
+		maxInFlight int
+		patches     int
+		committed   bool
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "POST":
+			w.Header().Set("Location", "/upload")
+			w.WriteHeader(http.StatusAccepted)
+		case "PATCH":
+			mu.Lock()
+			patches++
+			inFlight++
+			maxInFlight = max(maxInFlight, inFlight)
+			mu.Unlock()
+			// Give other requests a chance to arrive.
+			time.Sleep(20 * time.Millisecond)
+			data, _ := io.ReadAll(req.Body)
+			start, end, ok := ocirequest.ParseRange(req.Header.Get("Content-Range"))
+			mu.Lock()
+			inFlight--
+			if ok && end == start+int64(len(data)) {
+				copy(buf[start:], data)
+			}
+			mu.Unlock()
+			if !ok {
+				http.Error(w, "bad range", http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Location", "/upload")
+			w.WriteHeader(http.StatusAccepted)
+		case "PUT":
+			mu.Lock()
+			defer mu.Unlock()
+			if req.URL.Query().Get("digest") != string(digest.FromBytes(buf)) {
+				http.Error(w, "digest mismatch", http.StatusBadRequest)
+				return
+			}
+			committed = true
+			w.Header().Set("Location", "/blob")
+			w.WriteHeader(http.StatusCreated)
+		default:
+			http.Error(w, "unexpected method", http.StatusMethodNotAllowed)
+		}
+	}))
+	defer srv.Close()
+	srvURL, _ := url.Parse(srv.URL)
+	r, err := New(srvURL.Host, &Options{
+		Insecure: true,
+	})
+	qt.Assert(t, qt.IsNil(err))
+	gotDesc, err := PushBlobParallel(context.Background(), r, "foo", desc, bytes.NewReader(content), 4)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.DeepEquals(gotDesc, desc))
+	qt.Check(t, qt.IsTrue(committed))
+	qt.Check(t, qt.Equals(patches, 4))
+	qt.Check(t, qt.IsTrue(maxInFlight > 1), qt.Commentf("max in flight %d", maxInFlight))
+}
+
+func TestPushBlobParallelFallsBackToSequential(t *testing.T) {
+	// ociserver requires chunks to be uploaded in order.
+	content := bytes.Repeat([]byte("0123456789abcdef"), 4*defaultChunkSize/16)
+	desc := ociregistry.Descriptor{
+		Digest: digest.FromBytes(content),
+		Size:   int64(len(content)),
+	}
+	backend := ocimem.New()
+	srv := httptest.NewServer(ociserver.New(backend, nil))
+	defer srv.Close()
+	srvURL, _ := url.Parse(srv.URL)
+	r, err := New(srvURL.Host, &Options{
+		Insecure: true,
+	})
+	qt.Assert(t, qt.IsNil(err))
+	_, err = PushBlobParallel(context.Background(), r, "foo", desc, bytes.NewReader(content), 4)
+	qt.Assert(t, qt.IsNil(err))
+
+	rd, err := backend.GetBlob(context.Background(), "foo", desc.Digest)
+	qt.Assert(t, qt.IsNil(err))
+	defer rd.Close()
+	data, err := io.ReadAll(rd)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.IsTrue(bytes.Equal(data, content)))
+}
+
+func TestPushBlobParallelChangingLocation(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), 4*defaultChunkSize/16)
+	desc := ociregistry.Descriptor{
+		Digest: digest.FromBytes(content),
+		Size:   int64(len(content)),
+	}
+
+	// statefulServer accepts chunks in any order but returns
+	// a new location for each one, and requires the most
+	// recent location to be used.
+	var (
+		mu        sync.Mutex
+		buf       = make([]byte, len(content))
+		state     int
+		committed bool
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if req.Method != "POST" && req.URL.Query().Get("state") != fmt.Sprint(state) {
+			http.Error(w, "stale upload location", http.StatusBadRequest)
+			return
+		}
+		switch req.Method {
+		case "POST":
+			w.Header().Set("Location", fmt.Sprintf("/upload?state=%d", state))
+			w.WriteHeader(http.StatusAccepted)
+		case "PATCH":
+			data, _ := io.ReadAll(req.Body)
+			start, end, ok := ocirequest.ParseRange(req.Header.Get("Content-Range"))
+			if !ok || end != start+int64(len(data)) {
+				http.Error(w, "bad range", http.StatusBadRequest)
+				return
+			}
+			copy(buf[start:], data)
+			state++
+			w.Header().Set("Location", fmt.Sprintf("/upload?state=%d", state))
+			w.WriteHeader(http.StatusAccepted)
+		case "PUT":
+			data, _ := io.ReadAll(req.Body)
+			start, _, ok := ocirequest.ParseRange(req.Header.Get("Content-Range"))
+			if ok {
+				copy(buf[start:], data)
+			}
+			if req.URL.Query().Get("digest") != string(digest.FromBytes(buf)) {
+				http.Error(w, "digest mismatch", http.StatusBadRequest)
+				return
+			}
+			committed = true
+			w.Header().Set("Location", "/blob")
+			w.WriteHeader(http.StatusCreated)
+		default:
+			http.Error(w, "unexpected method", http.StatusMethodNotAllowed)
+		}
+	}))
+	defer srv.Close()
+	srvURL, _ := url.Parse(srv.URL)
+	r, err := New(srvURL.Host, &Options{
+		Insecure: true,
+	})
+	qt.Assert(t, qt.IsNil(err))
+	_, err = PushBlobParallel(context.Background(), r, "foo", desc, bytes.NewReader(content), 4)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.IsTrue(committed))
+}
@@ -0,0 +1,156 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ociref"
+)
+
+// PeekedManifest holds information gleaned from the start
+// of a manifest by [PeekManifest].
+type PeekedManifest struct {
+	// Descriptor holds the descriptor of the manifest
+	// as reported by the registry.
+	Descriptor ociregistry.Descriptor
+
+	// MediaType holds the media type of the manifest. This is taken
+	// from the mediaType field when it's found; otherwise it's
+	// inferred from the fields that are present, falling back to
+	// the media type in Descriptor.
+	MediaType string
+
+	// SchemaVersion holds the value of the schemaVersion field,
+	// or zero if it wasn't found.
+	SchemaVersion int
+}
+
+// PeekManifest reads up to maxBytes from the start of the manifest
+// in repo with the given tag or digest, and returns information
+// about the manifest taken from that prefix. This can be used to
+// classify a manifest, for example to tell an image index from an
+// image manifest, without reading all of a potentially large index.
+//
+// The result is not verified: the content read is not checked
+// against the manifest's digest, so it should be used only for
+// routing decisions, not trusted as a statement about the content.
+// Use [GetManifestContent] to fetch and verify the whole manifest.
+func PeekManifest(ctx context.Context, r ociregistry.Interface, repo string, tagOrDigest string, maxBytes int64) (PeekedManifest, error) {
+	var (
+		rd  ociregistry.BlobReader
+		err error
+	)
+	if ociref.IsValidDigest(tagOrDigest) {
+		rd, err = r.GetManifest(ctx, repo, ociregistry.Digest(tagOrDigest))
+	} else {
+		rd, err = r.GetTag(ctx, repo, tagOrDigest)
+	}
+	if err != nil {
+		return PeekedManifest{}, err
+	}
+	// Note: closing the reader before reaching the end
+	// avoids reading the rest of the body.
+	defer rd.Close()
+	info := PeekedManifest{
+		Descriptor: rd.Descriptor(),
+	}
+	var fields map[string]bool
+	info.MediaType, info.SchemaVersion, fields, err = peekManifestFields(io.LimitReader(rd, maxBytes))
+	if err != nil {
+		return PeekedManifest{}, fmt.Errorf("cannot parse manifest prefix: %v", err)
+	}
+	if info.MediaType == "" {
+		switch {
+		case fields["manifests"]:
+			info.MediaType = ocispec.MediaTypeImageIndex
+		case fields["config"], fields["layers"]:
+			info.MediaType = ocispec.MediaTypeImageManifest
+		default:
+			info.MediaType = info.Descriptor.MediaType
+		}
+	}
+	return info, nil
+}
+
+// peekManifestFields scans the top level of the JSON object read from r,
+// returning the values of the mediaType and schemaVersion fields
+// and the set of all the field names encountered. The content may
+// be truncated: scanning stops without error when r is exhausted.
+func peekManifestFields(r io.Reader) (mediaType string, schemaVersion int, fields map[string]bool, _ error) {
+	dec := json.NewDecoder(r)
+	tok, err := dec.Token()
+	if err != nil {
+		return "", 0, nil, err
+	}
+	if tok != json.Delim('{') {
+		return "", 0, nil, fmt.Errorf("manifest is not a JSON object")
+	}
+	fields = make(map[string]bool)
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			break
+		}
+		key, _ := tok.(string)
+		fields[key] = true
+		switch key {
+		case "mediaType":
+			err = dec.Decode(&mediaType)
+		case "schemaVersion":
+			err = dec.Decode(&schemaVersion)
+		default:
+			err = skipJSONValue(dec)
+		}
+		if err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				// The prefix ends within the value.
+				break
+			}
+			return "", 0, nil, fmt.Errorf("invalid %s field: %v", key, err)
+		}
+		if mediaType != "" && schemaVersion != 0 {
+			break
+		}
+	}
+	return mediaType, schemaVersion, fields, nil
+}
+
+// skipJSONValue skips over the next value in dec
+// without requiring it to be complete in memory.
+func skipJSONValue(dec *json.Decoder) error {
+	depth := 0
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch tok {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociclient
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/go-quicktest/qt"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ocimem"
+	"cuelabs.dev/go/oci/ociregistry/ociserver"
+)
+
+func TestPeekManifest(t *testing.T) {
+	ctx := context.Background()
+	backend := ocimem.New()
+	// A large index, so that a prefix doesn't hold all of it.
+	var entries []string
+	for i := range 100 {
+		entries = append(entries, fmt.Sprintf(`"annotation%d":"value"`, i))
+	}
+	index := `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[],"annotations":{` + strings.Join(entries, ",") + `}}`
+	indexDesc, err := backend.PushManifest(ctx, "foo", "index", []byte(index), ocispec.MediaTypeImageIndex)
+	qt.Assert(t, qt.IsNil(err))
+
+	srv := httptest.NewServer(ociserver.New(backend, nil))
+	defer srv.Close()
+	srvURL, _ := url.Parse(srv.URL)
+	r, err := New(srvURL.Host, &Options{
+		Insecure: true,
+	})
+	qt.Assert(t, qt.IsNil(err))
+
+	for _, ref := range []string{"index", string(indexDesc.Digest)} {
+		info, err := PeekManifest(ctx, r, "foo", ref, 100)
+		qt.Assert(t, qt.IsNil(err))
+		qt.Check(t, qt.Equals(info.MediaType, ocispec.MediaTypeImageIndex))
+		qt.Check(t, qt.Equals(info.SchemaVersion, 2))
+		qt.Check(t, qt.Equals(info.Descriptor.Digest, indexDesc.Digest))
+	}
+}
+
+func TestPeekManifestInfersMediaType(t *testing.T) {
+	tests := []struct {
+		testName      string
+		content       string
+		maxBytes      int64
+		wantMediaType string
+		wantVersion   int
+		wantError     string
+	}{{
+		testName:      "IndexWithoutMediaType",
+		content:       `{"schemaVersion":2,"manifests":[{"mediaType":"application/vnd.oci.image.manifest.v1+json","digest":"sha256:`,
+		maxBytes:      1000,
+		wantMediaType: ocispec.MediaTypeImageIndex,
+		wantVersion:   2,
+	}, {
+		testName:      "ImageManifestWithoutMediaType",
+		content:       `{"schemaVersion":2,"config":{"mediaType":"application/vnd.oci.image.config.v1+json"},"layers":[]}`,
+		maxBytes:      1000,
+		wantMediaType: ocispec.MediaTypeImageManifest,
+		wantVersion:   2,
+	}, {
+		testName:      "MediaTypeFieldTakesPrecedence",
+		content:       `{"mediaType":"application/vnd.docker.distribution.manifest.list.v2+json","schemaVersion":2,"manifests":[]}`,
+		maxBytes:      1000,
+		wantMediaType: "application/vnd.docker.distribution.manifest.list.v2+json",
+		wantVersion:   2,
+	}, {
+		testName:      "TruncatedBeforeClassification",
+		content:       `{"schemaVersion":2,"annotations":{"a":"very long value"}}`,
+		maxBytes:      30,
+		wantMediaType: "application/octet-stream",
+		wantVersion:   2,
+	}, {
+		testName:  "NotAnObject",
+		content:   `[]`,
+		maxBytes:  1000,
+		wantError: `cannot parse manifest prefix: manifest is not a JSON object`,
+	}}
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			r := &ociregistry.Funcs{
+				GetTag_: func(ctx context.Context, repo string, tag string) (ociregistry.BlobReader, error) {
+					// Note: the content is deliberately not verified.
+					return newBlobReaderUnverified(io.NopCloser(strings.NewReader(test.content)), ociregistry.Descriptor{
+						MediaType: "application/octet-stream",
+						Digest:    digest.FromString("something else"),
+						Size:      1 << 20,
+					}), nil
+				},
+			}
+			info, err := PeekManifest(context.Background(), r, "foo", "latest", test.maxBytes)
+			if test.wantError != "" {
+				qt.Assert(t, qt.ErrorMatches(err, test.wantError))
+				return
+			}
+			qt.Assert(t, qt.IsNil(err))
+			qt.Check(t, qt.Equals(info.MediaType, test.wantMediaType))
+			qt.Check(t, qt.Equals(info.SchemaVersion, test.wantVersion))
+		})
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociclient
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/internal/ocirequest"
+)
+
+// probeDigest is the digest of a manifest that's known not to exist:
+// empty content is never a valid manifest.
+var probeDigest = digest.FromBytes(nil)
+
+// probeRetryInterval holds how long to wait after an
+// inconclusive probe before probing the registry again.
+const probeRetryInterval = time.Minute
+
+// manifestMediaTypes returns the media types to send in the Accept
+// header of manifest requests. When Options.ProbeManifestMediaTypes
+// is set, the first call probes the registry to find out which
+// list it accepts, using repo for the probe request, and the result
+// is used from then on. Concurrent calls wait for the probe in
+// progress rather than starting their own.
+func (c *client) manifestMediaTypes(ctx context.Context, repo string) []string {
+	if !c.probeMediaTypes {
+		return knownManifestMediaTypes
+	}
+	c.acceptMu.Lock()
+	for c.acceptProbing != nil {
+		probing := c.acceptProbing
+		c.acceptMu.Unlock()
+		select {
+		case <-probing:
+		case <-ctx.Done():
+			return knownManifestMediaTypes
+		}
+		c.acceptMu.Lock()
+	}
+	if c.acceptTypes != nil || time.Now().Before(c.acceptRetryTime) {
+		defer c.acceptMu.Unlock()
+		if c.acceptTypes != nil {
+			return c.acceptTypes
+		}
+		return knownManifestMediaTypes
+	}
+	probing := make(chan struct{})
+	c.acceptProbing = probing
+	c.acceptMu.Unlock()
+
+	types, err := c.probeManifestMediaTypes(ctx, repo)
+
+	c.acceptMu.Lock()
+	defer c.acceptMu.Unlock()
+	c.acceptProbing = nil
+	close(probing)
+	if err != nil {
+		// The probe didn't tell us anything, so use the full
+		// list for now and try again later.
+		c.acceptRetryTime = time.Now().Add(probeRetryInterval)
+		return knownManifestMediaTypes
+	}
+	c.acceptTypes = types
+	return types
+}
+
+// probeManifestMediaTypes returns the first of the candidate Accept
+// lists that the registry accepts, falling back to the full list
+// when it accepts none of them.
+func (c *client) probeManifestMediaTypes(ctx context.Context, repo string) ([]string, error) {
+	for _, types := range [][]string{knownManifestMediaTypes, explicitManifestMediaTypes} {
+		ok, err := c.probeAccept(ctx, repo, types)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return types, nil
+		}
+	}
+	return knownManifestMediaTypes, nil
+}
+
+// probeAccept reports whether the registry accepts manifest requests
+// with the given media types in the Accept header. It makes a cheap
+// HEAD request for a manifest that doesn't exist: a "404 Not Found"
+// response shows that the request itself was acceptable, while a
+// "400 Bad Request", "406 Not Acceptable" or "415 Unsupported Media
+// Type" response shows that it was not. Any other outcome results
+// in an error.
+func (c *client) probeAccept(ctx context.Context, repo string, types []string) (bool, error) {
+	req, err := newRequest(ctx, &ocirequest.Request{
+		Kind:   ocirequest.ReqManifestHead,
+		Repo:   repo,
+		Digest: string(probeDigest),
+	}, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header["Accept"] = types
+	resp, err := c.do(req, http.StatusNotFound, http.StatusOK)
+	if err == nil {
+		resp.Body.Close()
+		return true, nil
+	}
+	var herr ociregistry.HTTPError
+	if errors.As(err, &herr) {
+		switch herr.StatusCode() {
+		case http.StatusBadRequest, http.StatusNotAcceptable, http.StatusUnsupportedMediaType:
+			return false, nil
+		}
+	}
+	return false, err
+}
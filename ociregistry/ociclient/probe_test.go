@@ -0,0 +1,202 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociclient
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/go-quicktest/qt"
+
+	"cuelabs.dev/go/oci/ociregistry/ocimem"
+	"cuelabs.dev/go/oci/ociregistry/ociserver"
+)
+
+func TestProbeManifestMediaTypes(t *testing.T) {
+	ctx := context.Background()
+	manifest := `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[]}`
+	backend := ocimem.New()
+	_, err := backend.PushManifest(ctx, "foo", "latest", []byte(manifest), "application/vnd.oci.image.index.v1+json")
+	qt.Assert(t, qt.IsNil(err))
+
+	for _, rejectWildcard := range []bool{false, true} {
+		var (
+			mu      sync.Mutex
+			probes  int
+			accepts [][]string
+		)
+		handler := ociserver.New(backend, nil)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if strings.Contains(req.URL.Path, "/manifests/") {
+				mu.Lock()
+				if strings.HasSuffix(req.URL.Path, "/"+string(probeDigest)) {
+					probes++
+				} else {
+					accepts = append(accepts, req.Header["Accept"])
+				}
+				mu.Unlock()
+				if rejectWildcard && slices.Contains(req.Header["Accept"], "*/*") {
+					http.Error(w, "unsupported media type in Accept header", http.StatusNotAcceptable)
+					return
+				}
+			}
+			handler.ServeHTTP(w, req)
+		}))
+		defer srv.Close()
+		srvURL, _ := url.Parse(srv.URL)
+
+		if rejectWildcard {
+			// Without probing, the request fails.
+			r, err := New(srvURL.Host, &Options{
+				Insecure: true,
+			})
+			qt.Assert(t, qt.IsNil(err))
+			_, err = r.GetTag(ctx, "foo", "latest")
+			qt.Assert(t, qt.ErrorMatches(err, `406 Not Acceptable: .*`))
+			accepts = nil
+		}
+
+		r, err := New(srvURL.Host, &Options{
+			Insecure:                true,
+			ProbeManifestMediaTypes: true,
+		})
+		qt.Assert(t, qt.IsNil(err))
+		rd, err := r.GetTag(ctx, "foo", "latest")
+		qt.Assert(t, qt.IsNil(err), qt.Commentf("rejectWildcard %v", rejectWildcard))
+		rd.Close()
+		_, err = r.ResolveTag(ctx, "foo", "latest")
+		qt.Assert(t, qt.IsNil(err))
+		rd, err = r.GetManifest(ctx, "foo", rd.Descriptor().Digest)
+		qt.Assert(t, qt.IsNil(err))
+		rd.Close()
+
+		// The registry is only probed before the first request.
+		// The probe takes a second request when the wildcard
+		// is rejected.
+		wantProbes := 1
+		if rejectWildcard {
+			wantProbes = 2
+		}
+		qt.Check(t, qt.Equals(probes, wantProbes))
+		qt.Assert(t, qt.HasLen(accepts, 3))
+		for _, accept := range accepts {
+			qt.Check(t, qt.Equals(slices.Contains(accept, "*/*"), !rejectWildcard))
+			qt.Check(t, qt.IsTrue(slices.Contains(accept, "application/vnd.oci.image.index.v1+json")))
+		}
+	}
+}
+
+func TestProbeManifestMediaTypesInconclusive(t *testing.T) {
+	ctx := context.Background()
+	manifest := `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[]}`
+	backend := ocimem.New()
+	_, err := backend.PushManifest(ctx, "foo", "latest", []byte(manifest), "application/vnd.oci.image.index.v1+json")
+	qt.Assert(t, qt.IsNil(err))
+	handler := ociserver.New(backend, nil)
+	var probes atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if strings.HasSuffix(req.URL.Path, "/"+string(probeDigest)) {
+			probes.Add(1)
+			http.Error(w, "no access", http.StatusForbidden)
+			return
+		}
+		handler.ServeHTTP(w, req)
+	}))
+	defer srv.Close()
+	srvURL, _ := url.Parse(srv.URL)
+	r, err := New(srvURL.Host, &Options{
+		Insecure:                true,
+		ProbeManifestMediaTypes: true,
+	})
+	qt.Assert(t, qt.IsNil(err))
+	for range 3 {
+		rd, err := r.GetTag(ctx, "foo", "latest")
+		qt.Assert(t, qt.IsNil(err))
+		rd.Close()
+	}
+	// The inconclusive result is remembered, so
+	// the registry isn't probed for every request.
+	qt.Check(t, qt.Equals(probes.Load(), int32(1)))
+}
+
+func TestProbeManifestMediaTypesConcurrent(t *testing.T) {
+	ctx := context.Background()
+	manifest := `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[]}`
+	backend := ocimem.New()
+	_, err := backend.PushManifest(ctx, "foo", "latest", []byte(manifest), "application/vnd.oci.image.index.v1+json")
+	qt.Assert(t, qt.IsNil(err))
+	handler := ociserver.New(backend, nil)
+	var probes atomic.Int32
+	probeStarted := make(chan struct{})
+	releaseProbe := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if strings.HasSuffix(req.URL.Path, "/"+string(probeDigest)) && probes.Add(1) == 1 {
+			close(probeStarted)
+			<-releaseProbe
+		}
+		handler.ServeHTTP(w, req)
+	}))
+	defer srv.Close()
+	srvURL, _ := url.Parse(srv.URL)
+	r, err := New(srvURL.Host, &Options{
+		Insecure:                true,
+		ProbeManifestMediaTypes: true,
+	})
+	qt.Assert(t, qt.IsNil(err))
+
+	// A caller whose context is done doesn't wait for
+	// another caller's probe to complete.
+	errc := make(chan error, 1)
+	go func() {
+		rd, err := r.GetTag(ctx, "foo", "latest")
+		if err == nil {
+			rd.Close()
+		}
+		errc <- err
+	}()
+	<-probeStarted
+	canceledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = r.GetTag(canceledCtx, "foo", "latest")
+	qt.Assert(t, qt.ErrorIs(err, context.Canceled))
+
+	var wg sync.WaitGroup
+	errs := make([]error, 5)
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rd, err := r.GetTag(ctx, "foo", "latest")
+			if err == nil {
+				rd.Close()
+			}
+			errs[i] = err
+		}()
+	}
+	close(releaseProbe)
+	wg.Wait()
+	qt.Assert(t, qt.IsNil(<-errc))
+	for _, err := range errs {
+		qt.Check(t, qt.IsNil(err))
+	}
+	qt.Check(t, qt.Equals(probes.Load(), int32(1)))
+}
@@ -27,6 +27,9 @@ import (
 )
 
 func (c *client) GetBlob(ctx context.Context, repo string, digest ociregistry.Digest) (ociregistry.BlobReader, error) {
+	if data, ok := c.schema1Config(digest); ok {
+		return newBlobReader(io.NopCloser(bytes.NewReader(data)), schema1ConfigDescriptor(data)), nil
+	}
 	return c.read(ctx, &ocirequest.Request{
 		Kind:   ocirequest.ReqBlobGet,
 		Repo:   repo,
@@ -38,6 +41,15 @@ func (c *client) GetBlobRange(ctx context.Context, repo string, digest ociregist
 	if o0 == 0 && o1 < 0 {
 		return c.GetBlob(ctx, repo, digest)
 	}
+	if data, ok := c.schema1Config(digest); ok {
+		if o1 < 0 || o1 > int64(len(data)) {
+			o1 = int64(len(data))
+		}
+		if o0 < 0 || o0 > o1 {
+			return nil, fmt.Errorf("invalid range [%d, %d]; have [%d, %d]: %w", o0, o1, 0, len(data), ociregistry.ErrRangeInvalid)
+		}
+		return newBlobReaderUnverified(io.NopCloser(bytes.NewReader(data[o0:o1])), schema1ConfigDescriptor(data)), nil
+	}
 	rreq := &ocirequest.Request{
 		Kind:   ocirequest.ReqBlobGet,
 		Repo:   repo,
@@ -68,11 +80,72 @@ func (c *client) GetBlobRange(ctx context.Context, repo string, digest ociregist
 }
 
 func (c *client) ResolveBlob(ctx context.Context, repo string, digest ociregistry.Digest) (ociregistry.Descriptor, error) {
-	return c.resolve(ctx, &ocirequest.Request{
+	if data, ok := c.schema1Config(digest); ok {
+		return schema1ConfigDescriptor(data), nil
+	}
+	rreq := &ocirequest.Request{
 		Kind:   ocirequest.ReqBlobHead,
 		Repo:   repo,
 		Digest: string(digest),
-	})
+	}
+	resp, err := c.doRequest(ctx, rreq)
+	if err != nil {
+		return ociregistry.Descriptor{}, err
+	}
+	resp.Body.Close()
+	if resp.ContentLength < 0 {
+		// Some registries don't send Content-Length in response
+		// to HEAD requests, so find out the size another way.
+		return c.probeBlob(ctx, repo, digest)
+	}
+	desc, err := descriptorFromResponse(resp, digest, requireSize|requireDigest)
+	if err != nil {
+		return ociregistry.Descriptor{}, fmt.Errorf("invalid descriptor in response: %v", err)
+	}
+	return desc, nil
+}
+
+// probeBlob returns the descriptor for a blob by asking for
+// its first byte only and obtaining the size from the
+// Content-Range header in the response.
+func (c *client) probeBlob(ctx context.Context, repo string, digest ociregistry.Digest) (ociregistry.Descriptor, error) {
+	req, err := newRequest(ctx, &ocirequest.Request{
+		Kind:   ocirequest.ReqBlobGet,
+		Repo:   repo,
+		Digest: string(digest),
+	}, nil)
+	if err != nil {
+		return ociregistry.Descriptor{}, err
+	}
+	req.Header.Set("Range", "bytes=0-0")
+	// An empty blob has no first byte, so the
+	// server may reject the range as unsatisfiable.
+	resp, err := c.do(req, http.StatusOK, http.StatusPartialContent, http.StatusRequestedRangeNotSatisfiable)
+	if err != nil {
+		return ociregistry.Descriptor{}, err
+	}
+	// Note: when the server ignores the range and returns the whole
+	// blob, closing the body without reading it avoids downloading
+	// any more of it than necessary.
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		size, err := sizeFromContentRange(resp.Header.Get("Content-Range"))
+		if err != nil {
+			return ociregistry.Descriptor{}, fmt.Errorf("invalid descriptor in response: %v", err)
+		}
+		if size != 0 {
+			return ociregistry.Descriptor{}, fmt.Errorf("unexpected unsatisfiable range for blob of size %d", size)
+		}
+		return ociregistry.Descriptor{
+			MediaType: "application/octet-stream",
+			Digest:    digest,
+		}, nil
+	}
+	desc, err := descriptorFromResponse(resp, digest, requireSize|requireDigest)
+	if err != nil {
+		return ociregistry.Descriptor{}, fmt.Errorf("invalid descriptor in response: %v", err)
+	}
+	return desc, nil
 }
 
 func (c *client) ResolveManifest(ctx context.Context, repo string, digest ociregistry.Digest) (ociregistry.Descriptor, error) {
@@ -138,10 +211,39 @@ func (c *client) read(ctx context.Context, rreq *ocirequest.Request) (_ ociregis
 		return nil, err
 	}
 	defer closeOnError(&_err, resp.Body)
-	desc, err := descriptorFromResponse(resp, ociregistry.Digest(rreq.Digest), requireSize)
+	require := requireSize
+	if rreq.Digest != "" && resp.ContentLength < 0 {
+		// Content-Length is only recommended by the spec, and
+		// when we know the digest, we can verify the size
+		// from the content itself.
+		require = 0
+	}
+	desc, err := descriptorFromResponse(resp, ociregistry.Digest(rreq.Digest), require)
 	if err != nil {
 		return nil, fmt.Errorf("invalid descriptor in response: %v", err)
 	}
+	if require&requireSize == 0 {
+		desc.Size, err = c.sizeFromContent(ctx, rreq, resp)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if c.convertSchema1 && rreq.Kind == ocirequest.ReqManifestGet && isSchema1(desc.MediaType) {
+		defer resp.Body.Close()
+		if rreq.Digest != "" {
+			// Verify against the requested digest rather than
+			// any digest returned by the registry.
+			desc.Digest = ociregistry.Digest(rreq.Digest)
+		}
+		return c.readSchema1(ctx, rreq.Repo, resp.Body, desc)
+	}
+	var headerDigest ociregistry.Digest
+	if c.verifyHeader && rreq.Digest != "" && desc.Digest != ociregistry.Digest(rreq.Digest) {
+		// The descriptor holds the digest from the header, so check
+		// the content against the requested digest as well.
+		headerDigest = desc.Digest
+		desc.Digest = ociregistry.Digest(rreq.Digest)
+	}
 	if desc.Digest == "" {
 		// Returning a digest isn't mandatory according to the spec, and
 		// at least one registry (AWS's ECR) fails to return a digest
@@ -182,5 +284,68 @@ func (c *client) read(ctx context.Context, rreq *ocirequest.Request) (_ ociregis
 			}
 		}
 	}
-	return newBlobReader(resp.Body, desc), nil
+	if rreq.Kind == ocirequest.ReqBlobGet && c.blobReadRetries > 0 {
+		resp.Body = &resumingBody{
+			c:       c,
+			ctx:     ctx,
+			rreq:    rreq,
+			body:    resp.Body,
+			size:    desc.Size,
+			retries: c.blobReadRetries,
+		}
+	}
+	br := newBlobReader(resp.Body, desc)
+	if headerDigest != "" {
+		if err := br.verifyHeaderDigest(headerDigest); err != nil {
+			return nil, err
+		}
+	}
+	return br, nil
+}
+
+// sizeFromContent determines the size of the content in the body
+// of resp, a response to rreq that has no Content-Length.
+// If the content is small, it's read into memory and resp.Body
+// is replaced so that it can be read again; otherwise a HEAD
+// request is used to find the size. If the HEAD response has
+// no Content-Length either, the size is reported as -1 (unknown):
+// the request has a digest, so the content is still
+// verified against that when it's read.
+//
+// When the size is known, it's checked when the content is read,
+// along with the digest.
+func (c *client) sizeFromContent(ctx context.Context, rreq *ocirequest.Request, resp *http.Response) (int64, error) {
+	data, err := io.ReadAll(io.LimitReader(resp.Body, inMemThreshold+1))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read body to determine size: %v", err)
+	}
+	if len(data) <= inMemThreshold {
+		resp.Body.Close()
+		resp.Body = io.NopCloser(bytes.NewReader(data))
+		return int64(len(data)), nil
+	}
+	rreq1 := *rreq
+	if rreq.Kind == ocirequest.ReqBlobGet {
+		rreq1.Kind = ocirequest.ReqBlobHead
+	} else {
+		rreq1.Kind = ocirequest.ReqManifestHead
+	}
+	resp1, err := c.doRequest(ctx, &rreq1)
+	if err != nil {
+		return 0, err
+	}
+	resp1.Body.Close()
+	size := int64(-1)
+	if resp1.ContentLength >= 0 {
+		desc, err := descriptorFromResponse(resp1, ociregistry.Digest(rreq.Digest), requireSize)
+		if err != nil {
+			return 0, fmt.Errorf("cannot determine size of content: %v", err)
+		}
+		size = desc.Size
+	}
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(data), resp.Body), resp.Body}
+	return size, nil
 }
@@ -0,0 +1,108 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociclient
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"cuelabs.dev/go/oci/ociregistry/internal/ocirequest"
+)
+
+// resumingBody reads the body of a blob GET response, re-requesting
+// the remaining content with a range request when reading fails
+// partway through. See [Options.BlobReadRetries].
+//
+// It doesn't check the content itself: that's done
+// by the blobReader that wraps it.
+type resumingBody struct {
+	c       *client
+	ctx     context.Context
+	rreq    *ocirequest.Request
+	body    io.ReadCloser
+	n       int64
+	size    int64
+	retries int
+}
+
+func (b *resumingBody) Read(buf []byte) (int, error) {
+	for {
+		n, err := b.body.Read(buf)
+		b.n += int64(n)
+		if err == nil || err == io.EOF || b.retries <= 0 || (b.size >= 0 && b.n >= b.size) || b.ctx.Err() != nil {
+			return n, err
+		}
+		b.retries--
+		if rerr := b.resume(); rerr != nil {
+			return n, fmt.Errorf("cannot resume read after error %v: %w", err, rerr)
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// resume replaces b.body with the body of a response
+// holding the content from offset b.n onwards.
+func (b *resumingBody) resume() error {
+	b.body.Close()
+	b.body = http.NoBody
+	req, err := newRequest(b.ctx, b.rreq, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", b.n))
+	resp, err := b.c.do(req, http.StatusPartialContent)
+	if err != nil {
+		return err
+	}
+	start, err := startFromContentRange(resp.Header.Get("Content-Range"))
+	if err != nil {
+		resp.Body.Close()
+		return err
+	}
+	if start != b.n {
+		resp.Body.Close()
+		return fmt.Errorf("range response starts at %d not %d", start, b.n)
+	}
+	b.body = resp.Body
+	return nil
+}
+
+func (b *resumingBody) Close() error {
+	return b.body.Close()
+}
+
+// startFromContentRange returns the start offset
+// from a Content-Range header value such as "bytes 100-199/200".
+func startFromContentRange(contentRange string) (int64, error) {
+	s, ok := strings.CutPrefix(contentRange, "bytes ")
+	if !ok {
+		return 0, fmt.Errorf("malformed Content-Range %q", contentRange)
+	}
+	s, _, ok = strings.Cut(s, "-")
+	if !ok {
+		return 0, fmt.Errorf("malformed Content-Range %q", contentRange)
+	}
+	start, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("malformed Content-Range %q", contentRange)
+	}
+	return start, nil
+}
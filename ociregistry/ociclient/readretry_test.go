@@ -0,0 +1,131 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociclient
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-quicktest/qt"
+	"github.com/opencontainers/go-digest"
+)
+
+// flakyBlobServer returns a server that serves content as the blob
+// foo@dig, dropping the connection after sending dropAfter bytes of
+// each of the first drops responses.
+func flakyBlobServer(t *testing.T, content []byte, dropAfter int, drops int) (*httptest.Server, *[]string) {
+	dig := digest.FromBytes(content)
+	var mu sync.Mutex
+	var ranges []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/v2/foo/blobs/"+string(dig) {
+			http.NotFound(w, req)
+			return
+		}
+		mu.Lock()
+		ranges = append(ranges, req.Header.Get("Range"))
+		drop := drops > 0
+		drops--
+		mu.Unlock()
+		w.Header().Set("Docker-Content-Digest", string(dig))
+		w.Header().Set("Content-Type", "application/octet-stream")
+		if !drop {
+			http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(content))
+			return
+		}
+		start := 0
+		if rng := req.Header.Get("Range"); rng != "" {
+			// Serve the first part of the requested range properly
+			// so that the client can tell where it starts.
+			var err error
+			start, err = strconv.Atoi(rng[len("bytes=") : len(rng)-1])
+			qt.Check(t, qt.IsNil(err))
+			w.Header().Set("Content-Range", "bytes "+strconv.Itoa(start)+"-"+strconv.Itoa(len(content)-1)+"/"+strconv.Itoa(len(content)))
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)-start))
+			w.WriteHeader(http.StatusPartialContent)
+		} else {
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			w.WriteHeader(http.StatusOK)
+		}
+		w.Write(content[start : start+dropAfter])
+		w.(http.Flusher).Flush()
+		conn, _, err := w.(http.Hijacker).Hijack()
+		qt.Check(t, qt.IsNil(err))
+		conn.Close()
+	}))
+	return srv, &ranges
+}
+
+func TestGetBlobResumesAfterDroppedConnection(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	srv, ranges := flakyBlobServer(t, content, 3000, 2)
+	defer srv.Close()
+	srvURL, _ := url.Parse(srv.URL)
+	r, err := New(srvURL.Host, &Options{
+		Insecure:        true,
+		BlobReadRetries: 2,
+	})
+	qt.Assert(t, qt.IsNil(err))
+	rd, err := r.GetBlob(context.Background(), "foo", digest.FromBytes(content))
+	qt.Assert(t, qt.IsNil(err))
+	defer rd.Close()
+	data, err := io.ReadAll(rd)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.IsTrue(bytes.Equal(data, content)))
+	qt.Assert(t, qt.DeepEquals(*ranges, []string{"", "bytes=3000-", "bytes=6000-"}))
+}
+
+func TestGetBlobResumeBudgetExhausted(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	srv, ranges := flakyBlobServer(t, content, 3000, 2)
+	defer srv.Close()
+	srvURL, _ := url.Parse(srv.URL)
+	r, err := New(srvURL.Host, &Options{
+		Insecure:        true,
+		BlobReadRetries: 1,
+	})
+	qt.Assert(t, qt.IsNil(err))
+	rd, err := r.GetBlob(context.Background(), "foo", digest.FromBytes(content))
+	qt.Assert(t, qt.IsNil(err))
+	defer rd.Close()
+	_, err = io.ReadAll(rd)
+	qt.Assert(t, qt.ErrorIs(err, io.ErrUnexpectedEOF))
+	qt.Assert(t, qt.DeepEquals(*ranges, []string{"", "bytes=3000-"}))
+}
+
+func TestGetBlobNoResumeByDefault(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	srv, ranges := flakyBlobServer(t, content, 3000, 1)
+	defer srv.Close()
+	srvURL, _ := url.Parse(srv.URL)
+	r, err := New(srvURL.Host, &Options{
+		Insecure: true,
+	})
+	qt.Assert(t, qt.IsNil(err))
+	rd, err := r.GetBlob(context.Background(), "foo", digest.FromBytes(content))
+	qt.Assert(t, qt.IsNil(err))
+	defer rd.Close()
+	_, err = io.ReadAll(rd)
+	qt.Assert(t, qt.ErrorIs(err, io.ErrUnexpectedEOF))
+	qt.Assert(t, qt.DeepEquals(*ranges, []string{""}))
+}
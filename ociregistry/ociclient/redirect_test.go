@@ -0,0 +1,175 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociclient
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-quicktest/qt"
+	"github.com/opencontainers/go-digest"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ociauth"
+	"cuelabs.dev/go/oci/ociregistry/ocimem"
+	"cuelabs.dev/go/oci/ociregistry/ociserver"
+)
+
+// redirectUploads returns a handler that redirects PATCH and PUT upload
+// requests with a 308 status to the same path on target, or under
+// /redirected if target is empty. Requests under /redirected are
+// served by h. The method of each redirected request is appended to
+// *redirected.
+func redirectUploads(h http.Handler, target string, redirected *[]string) http.Handler {
+	var mu sync.Mutex
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if p, ok := strings.CutPrefix(req.URL.Path, "/redirected"); ok {
+			req.URL.Path = p
+			req.URL.RawPath = ""
+			h.ServeHTTP(w, req)
+			return
+		}
+		if (req.Method == "PATCH" || req.Method == "PUT") && strings.Contains(req.URL.Path, "/blobs/uploads/") {
+			mu.Lock()
+			*redirected = append(*redirected, req.Method)
+			mu.Unlock()
+			if target == "" {
+				target = "/redirected"
+			}
+			w.Header().Set("Location", target+req.URL.RequestURI())
+			w.WriteHeader(http.StatusPermanentRedirect)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+func TestUploadRedirects(t *testing.T) {
+	backend := ocimem.New()
+	var redirected []string
+	srv := httptest.NewServer(redirectUploads(ociserver.New(backend, nil), "", &redirected))
+	defer srv.Close()
+	srvURL, _ := url.Parse(srv.URL)
+	r, err := New(srvURL.Host, &Options{
+		Insecure: true,
+	})
+	qt.Assert(t, qt.IsNil(err))
+	ctx := context.Background()
+
+	checkBlob := func(content string) {
+		t.Helper()
+		rd, err := backend.GetBlob(ctx, "foo", digest.FromString(content))
+		qt.Assert(t, qt.IsNil(err))
+		defer rd.Close()
+		data, err := io.ReadAll(rd)
+		qt.Assert(t, qt.IsNil(err))
+		qt.Assert(t, qt.Equals(string(data), content))
+	}
+
+	// A chunked upload sends each chunk again to the redirected location.
+	// The content is larger than the default chunk size so that
+	// the second write flushes it along with the first.
+	content := "hello, " + strings.Repeat("world", 14000)
+	w, err := r.PushBlobChunked(ctx, "foo", 0)
+	qt.Assert(t, qt.IsNil(err))
+	_, err = w.Write([]byte(content[:7]))
+	qt.Assert(t, qt.IsNil(err))
+	_, err = w.Write([]byte(content[7:]))
+	qt.Assert(t, qt.IsNil(err))
+	_, err = w.Commit(digest.FromString(content))
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.DeepEquals(redirected, []string{"PATCH", "PUT"}))
+	checkBlob(content)
+
+	pushBlob := func(content string, body io.Reader) error {
+		_, err := r.PushBlob(ctx, "foo", ociregistry.Descriptor{
+			MediaType: "application/octet-stream",
+			Digest:    digest.FromString(content),
+			Size:      int64(len(content)),
+		}, body)
+		return err
+	}
+
+	// A monolithic upload can be redirected when the body can be
+	// rewound: either it's a type known to net/http or it
+	// implements io.Seeker.
+	redirected = nil
+	err = pushBlob("content 1", strings.NewReader("content 1"))
+	qt.Assert(t, qt.IsNil(err))
+	checkBlob("content 1")
+
+	err = pushBlob("content 2", io.NewSectionReader(strings.NewReader("xxcontent 2"), 2, 9))
+	qt.Assert(t, qt.IsNil(err))
+	checkBlob("content 2")
+	qt.Check(t, qt.DeepEquals(redirected, []string{"PUT", "PUT"}))
+
+	// Otherwise the redirect can't be followed.
+	err = pushBlob("content 3", struct{ io.Reader }{strings.NewReader("content 3")})
+	qt.Assert(t, qt.ErrorMatches(err, `.*308 Permanent Redirect.*`))
+}
+
+func TestUploadRedirectToOtherHostOmitsAuthorization(t *testing.T) {
+	backend := ociserver.New(ocimem.New(), nil)
+
+	var mu sync.Mutex
+	var otherAuth []string
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		otherAuth = append(otherAuth, req.Header.Get("Authorization"))
+		mu.Unlock()
+		backend.ServeHTTP(w, req)
+	}))
+	defer other.Close()
+
+	var redirected []string
+	redirector := redirectUploads(backend, other.URL, &redirected)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if user, pass, ok := req.BasicAuth(); !ok || user != "someuser" || pass != "somepassword" {
+			w.Header().Set("Www-Authenticate", `Basic realm="test"`)
+			ociregistry.WriteError(w, ociregistry.ErrUnauthorized)
+			return
+		}
+		redirector.ServeHTTP(w, req)
+	}))
+	defer srv.Close()
+	srvURL, _ := url.Parse(srv.URL)
+
+	config, err := ociauth.LoadFromDockerConfigJSON([]byte(`{"auths":{"` + srvURL.Host + `":{"auth":"c29tZXVzZXI6c29tZXBhc3N3b3Jk"}}}`))
+	qt.Assert(t, qt.IsNil(err))
+	r, err := New(srvURL.Host, &Options{
+		Insecure: true,
+		Transport: ociauth.NewStdTransport(ociauth.StdTransportParams{
+			Config: config,
+		}),
+		AllowInsecureAuth: true,
+	})
+	qt.Assert(t, qt.IsNil(err))
+
+	content := "some content"
+	_, err = r.PushBlob(context.Background(), "foo", ociregistry.Descriptor{
+		MediaType: "application/octet-stream",
+		Digest:    digest.FromString(content),
+		Size:      int64(len(content)),
+	}, strings.NewReader(content))
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.DeepEquals(redirected, []string{"PUT"}))
+	qt.Check(t, qt.DeepEquals(otherAuth, []string{""}))
+}
@@ -0,0 +1,223 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/go-quicktest/qt"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ocimem"
+	"cuelabs.dev/go/oci/ociregistry/ociserver"
+)
+
+const (
+	sbomType      = "application/vnd.example.sbom"
+	signatureType = "application/vnd.example.signature"
+)
+
+var testReferrers = [][]ociregistry.Descriptor{{
+	referrer("sbom1", sbomType),
+	referrer("sig1", signatureType),
+}, {
+	referrer("sbom2", sbomType),
+	referrer("sig2", signatureType),
+}}
+
+func TestReferrers(t *testing.T) {
+	for _, serverFilters := range []bool{false, true} {
+		t.Run(map[bool]string{false: "clientFilter", true: "serverFilter"}[serverFilters], func(t *testing.T) {
+			var gotArtifactTypes []string
+			srv := httptest.NewServer(referrersHandler(serverFilters, &gotArtifactTypes))
+			defer srv.Close()
+			srvURL, _ := url.Parse(srv.URL)
+			r, err := New(srvURL.Host, &Options{
+				Insecure: true,
+			})
+			qt.Assert(t, qt.IsNil(err))
+			ctx := context.Background()
+			subject := digest.FromString("subject")
+
+			all, err := ociregistry.All(r.Referrers(ctx, "foo", subject, ""))
+			qt.Assert(t, qt.IsNil(err))
+			qt.Check(t, qt.DeepEquals(all, append(testReferrers[0], testReferrers[1]...)))
+
+			sboms, err := ociregistry.All(r.Referrers(ctx, "foo", subject, sbomType))
+			qt.Assert(t, qt.IsNil(err))
+			qt.Check(t, qt.DeepEquals(sboms, []ociregistry.Descriptor{
+				testReferrers[0][0],
+				testReferrers[1][0],
+			}))
+			qt.Check(t, qt.DeepEquals(gotArtifactTypes, []string{"", "", sbomType, sbomType}))
+		})
+	}
+}
+
+// referrersHandler returns a handler that serves testReferrers,
+// one page at a time. If filter is true, it honors the artifactType
+// query parameter. The artifactType parameter of each request is
+// appended to *artifactTypes.
+func referrersHandler(filter bool, artifactTypes *[]string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		artifactType := req.URL.Query().Get("artifactType")
+		*artifactTypes = append(*artifactTypes, artifactType)
+		page := 0
+		if req.URL.Query().Get("page") == "1" {
+			page = 1
+		}
+		var manifests []ociregistry.Descriptor
+		for _, desc := range testReferrers[page] {
+			if filter && artifactType != "" && desc.ArtifactType != artifactType {
+				continue
+			}
+			manifests = append(manifests, desc)
+		}
+		if filter && artifactType != "" {
+			w.Header().Set("OCI-Filters-Applied", "artifactType")
+		}
+		if page == 0 {
+			q := req.URL.Query()
+			q.Set("page", "1")
+			w.Header().Set("Link", `<`+req.URL.Path+"?"+q.Encode()+`>; rel="next"`)
+		}
+		data, _ := json.Marshal(ocispec.Index{
+			MediaType: ocispec.MediaTypeImageIndex,
+			Manifests: manifests,
+		})
+		w.Header().Set("Content-Type", ocispec.MediaTypeImageIndex)
+		w.Write(data)
+	})
+}
+
+func referrer(content, artifactType string) ociregistry.Descriptor {
+	return ociregistry.Descriptor{
+		MediaType:    ocispec.MediaTypeImageManifest,
+		Digest:       digest.FromString(content),
+		Size:         int64(len(content)),
+		ArtifactType: artifactType,
+	}
+}
+
+func TestReferrersCache(t *testing.T) {
+	var gotArtifactTypes []string
+	srv := httptest.NewServer(referrersHandler(false, &gotArtifactTypes))
+	defer srv.Close()
+	srvURL, _ := url.Parse(srv.URL)
+	cache := NewReferrersCache(time.Minute)
+	now := time.Now()
+	cache.now = func() time.Time {
+		return now
+	}
+	r, err := New(srvURL.Host, &Options{
+		Insecure:       true,
+		ReferrersCache: cache,
+	})
+	qt.Assert(t, qt.IsNil(err))
+	ctx := context.Background()
+	subject := digest.FromString("subject")
+	allReferrers := append(testReferrers[0], testReferrers[1]...)
+
+	checkReferrers := func(artifactType string, want []ociregistry.Descriptor, wantRequests int) {
+		t.Helper()
+		gotArtifactTypes = nil
+		got, err := ociregistry.All(r.Referrers(ctx, "foo", subject, artifactType))
+		qt.Assert(t, qt.IsNil(err))
+		qt.Check(t, qt.DeepEquals(got, want))
+		qt.Check(t, qt.HasLen(gotArtifactTypes, wantRequests))
+	}
+
+	// The first call fetches both pages.
+	checkReferrers("", allReferrers, 2)
+	// A second call within the TTL makes no requests.
+	checkReferrers("", allReferrers, 0)
+	// Results are cached separately for each artifact type.
+	sboms := []ociregistry.Descriptor{testReferrers[0][0], testReferrers[1][0]}
+	checkReferrers(sbomType, sboms, 2)
+	checkReferrers(sbomType, sboms, 0)
+
+	// An incomplete iteration doesn't populate the cache.
+	r.Referrers(ctx, "foo", subject, signatureType)(func(ociregistry.Descriptor, error) bool {
+		return false
+	})
+	checkReferrers(signatureType, []ociregistry.Descriptor{testReferrers[0][1], testReferrers[1][1]}, 2)
+
+	// Invalidating the subject removes all its entries.
+	cache.Invalidate("foo", subject)
+	checkReferrers("", allReferrers, 2)
+	checkReferrers(sbomType, sboms, 2)
+
+	// Entries expire after the TTL.
+	now = now.Add(time.Minute)
+	checkReferrers("", allReferrers, 2)
+	checkReferrers("", allReferrers, 0)
+}
+
+func TestReferrersCacheInvalidatedByPush(t *testing.T) {
+	srv := httptest.NewServer(ociserver.New(ocimem.New(), nil))
+	defer srv.Close()
+	srvURL, _ := url.Parse(srv.URL)
+	r, err := New(srvURL.Host, &Options{
+		Insecure:       true,
+		ReferrersCache: NewReferrersCache(time.Hour),
+	})
+	qt.Assert(t, qt.IsNil(err))
+	ctx := context.Background()
+
+	pushManifest := func(m ocispec.Manifest) ociregistry.Descriptor {
+		data, err := json.Marshal(m)
+		qt.Assert(t, qt.IsNil(err))
+		desc, err := r.PushManifest(ctx, "foo", "", data, ocispec.MediaTypeImageManifest)
+		qt.Assert(t, qt.IsNil(err))
+		return desc
+	}
+	config := []byte("{}")
+	configDesc, err := r.PushBlob(ctx, "foo", ociregistry.Descriptor{
+		MediaType: ocispec.MediaTypeImageConfig,
+		Digest:    digest.FromBytes(config),
+		Size:      int64(len(config)),
+	}, bytes.NewReader(config))
+	qt.Assert(t, qt.IsNil(err))
+	manifest := ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    configDesc,
+		Layers:    []ociregistry.Descriptor{},
+	}
+	subject := pushManifest(manifest)
+
+	all, err := ociregistry.All(r.Referrers(ctx, "foo", subject.Digest, ""))
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.HasLen(all, 0))
+
+	manifest.ArtifactType = sbomType
+	manifest.Subject = &subject
+	referrerDesc := pushManifest(manifest)
+
+	all, err = ociregistry.All(r.Referrers(ctx, "foo", subject.Digest, ""))
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.HasLen(all, 1))
+	qt.Assert(t, qt.Equals(all[0].Digest, referrerDesc.Digest))
+}
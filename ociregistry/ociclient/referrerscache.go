@@ -0,0 +1,124 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociclient
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"cuelabs.dev/go/oci/ociregistry"
+)
+
+// ReferrersCache caches the results of Referrers calls, keyed by
+// repository, subject digest and artifact type. Use it by setting
+// [Options.ReferrersCache].
+//
+// The referrers of a given subject only change when referrers are
+// pushed or deleted, so tools that repeatedly discover signatures or
+// SBOMs for the same subjects can avoid most of their requests.
+// Pushing a manifest with a subject through a client that uses the
+// cache invalidates the entries for that subject; other changes are
+// only seen when an entry expires or is invalidated explicitly
+// with [ReferrersCache.Invalidate].
+//
+// Only complete results are cached: if the caller stops iterating
+// early or there's an error, nothing is stored.
+//
+// A ReferrersCache may be shared by several clients as long as they
+// all talk to the same registry. It's OK to use it concurrently.
+type ReferrersCache struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[referrersKey]referrersEntry
+}
+
+type referrersKey struct {
+	repo         string
+	digest       ociregistry.Digest
+	artifactType string
+}
+
+type referrersEntry struct {
+	descs   []ociregistry.Descriptor
+	expires time.Time
+}
+
+// NewReferrersCache returns a cache that holds
+// Referrers results for the given duration.
+func NewReferrersCache(ttl time.Duration) *ReferrersCache {
+	return &ReferrersCache{
+		ttl:     ttl,
+		now:     time.Now,
+		entries: make(map[referrersKey]referrersEntry),
+	}
+}
+
+// Invalidate removes any cached referrers of the subject
+// with the given digest in the given repository.
+func (c *ReferrersCache) Invalidate(repo string, digest ociregistry.Digest) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key := range c.entries {
+		if key.repo == repo && key.digest == digest {
+			delete(c.entries, key)
+		}
+	}
+}
+
+func (c *ReferrersCache) get(key referrersKey) ([]ociregistry.Descriptor, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if !c.now().Before(e.expires) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return e.descs, true
+}
+
+func (c *ReferrersCache) put(key referrersKey, descs []ociregistry.Descriptor) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	// Remove expired entries so that the cache
+	// doesn't grow without bound.
+	for k, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = referrersEntry{
+		descs:   descs,
+		expires: now.Add(c.ttl),
+	}
+}
+
+// invalidateSubject invalidates the cache entries for the subject
+// of the given manifest contents, if any.
+func (c *ReferrersCache) invalidateSubject(repo string, contents []byte) {
+	var m struct {
+		Subject *ociregistry.Descriptor `json:"subject"`
+	}
+	if err := json.Unmarshal(contents, &m); err != nil || m.Subject == nil {
+		return
+	}
+	c.Invalidate(repo, m.Subject.Digest)
+}
@@ -0,0 +1,84 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociclient
+
+import (
+	"context"
+
+	"cuelabs.dev/go/oci/ociregistry"
+)
+
+// Referrer describes a manifest found by [ListReferrersRecursive].
+type Referrer struct {
+	// Descriptor holds the descriptor of the referring manifest
+	// as returned by [ociregistry.Lister.Referrers].
+	Descriptor ociregistry.Descriptor
+
+	// Parent holds the referrer that this manifest refers to,
+	// or nil if it refers directly to the original subject.
+	Parent *Referrer
+
+	// Depth holds the distance from the original subject:
+	// 1 for direct referrers, 2 for their referrers, and so on.
+	Depth int
+}
+
+// ListReferrersRecursive returns all the manifests in repo that refer
+// to subject, either directly or through a chain of other
+// referrers, such as a signature of an attestation of an image.
+// If maxDepth is > 0, referrers more than maxDepth steps away
+// from subject are not included.
+//
+// The result is in breadth-first order, so each referrer appears
+// after its parent. Each manifest is included at most once, at its
+// first (shallowest) position, which also prevents loops if the
+// registry reports a cycle.
+func ListReferrersRecursive(ctx context.Context, r ociregistry.Interface, repo string, subject ociregistry.Digest, maxDepth int) ([]*Referrer, error) {
+	seen := map[ociregistry.Digest]bool{
+		subject: true,
+	}
+	var all []*Referrer
+	// level holds the referrers found at the previous depth,
+	// with nil standing for subject itself.
+	level := []*Referrer{nil}
+	for depth := 1; len(level) > 0 && (maxDepth <= 0 || depth <= maxDepth); depth++ {
+		var next []*Referrer
+		for _, parent := range level {
+			dig := subject
+			if parent != nil {
+				dig = parent.Descriptor.Digest
+			}
+			descs, err := ociregistry.All(r.Referrers(ctx, repo, dig, ""))
+			if err != nil {
+				return nil, err
+			}
+			for _, desc := range descs {
+				if seen[desc.Digest] {
+					continue
+				}
+				seen[desc.Digest] = true
+				ref := &Referrer{
+					Descriptor: desc,
+					Parent:     parent,
+					Depth:      depth,
+				}
+				all = append(all, ref)
+				next = append(next, ref)
+			}
+		}
+		level = next
+	}
+	return all, nil
+}
@@ -0,0 +1,151 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociclient
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/go-quicktest/qt"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ocimem"
+	"cuelabs.dev/go/oci/ociregistry/ociserver"
+)
+
+func TestListReferrersRecursive(t *testing.T) {
+	ctx := context.Background()
+	backend := ocimem.New()
+	srv := httptest.NewServer(ociserver.New(backend, nil))
+	defer srv.Close()
+	srvURL, _ := url.Parse(srv.URL)
+	r, err := New(srvURL.Host, &Options{
+		Insecure: true,
+	})
+	qt.Assert(t, qt.IsNil(err))
+
+	// This mirrors the nested referrers in the conformance tests:
+	// referrer0 and referrer1 refer to the manifest and
+	// referrer2 refers to referrer1.
+	configData := []byte("{}")
+	configDesc := ociregistry.Descriptor{
+		MediaType: "application/json",
+		Digest:    digest.FromBytes(configData),
+		Size:      int64(len(configData)),
+	}
+	_, err = r.PushBlob(ctx, "foo", configDesc, strings.NewReader(string(configData)))
+	qt.Assert(t, qt.IsNil(err))
+	pushManifest := func(artifactType string, subject *ociregistry.Descriptor) ociregistry.Descriptor {
+		config := configDesc
+		config.MediaType = artifactType
+		data, err := json.Marshal(ociregistry.Manifest{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			MediaType: ocispec.MediaTypeImageManifest,
+			Config:    config,
+			Layers:    []ociregistry.Descriptor{},
+			Subject:   subject,
+		})
+		qt.Assert(t, qt.IsNil(err))
+		desc, err := r.PushManifest(ctx, "foo", "", data, ocispec.MediaTypeImageManifest)
+		qt.Assert(t, qt.IsNil(err))
+		return desc
+	}
+	manifest := pushManifest("artifact1", nil)
+	referrer0 := pushManifest("referrer0", &manifest)
+	referrer1 := pushManifest("referrer1", &manifest)
+	referrer2 := pushManifest("referrer2", &referrer1)
+	names := map[ociregistry.Digest]string{
+		referrer0.Digest: "referrer0",
+		referrer1.Digest: "referrer1",
+		referrer2.Digest: "referrer2",
+	}
+
+	type result struct {
+		Name   string
+		Parent string
+		Depth  int
+	}
+	summarize := func(refs []*Referrer) map[ociregistry.Digest]result {
+		m := make(map[ociregistry.Digest]result)
+		for _, ref := range refs {
+			res := result{
+				Name:  names[ref.Descriptor.Digest],
+				Depth: ref.Depth,
+			}
+			if ref.Parent != nil {
+				res.Parent = names[ref.Parent.Descriptor.Digest]
+			}
+			m[ref.Descriptor.Digest] = res
+		}
+		return m
+	}
+
+	refs, err := ListReferrersRecursive(ctx, r, "foo", manifest.Digest, 0)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.HasLen(refs, 3))
+	qt.Check(t, qt.DeepEquals(summarize(refs), map[ociregistry.Digest]result{
+		referrer0.Digest: {"referrer0", "", 1},
+		referrer1.Digest: {"referrer1", "", 1},
+		referrer2.Digest: {"referrer2", "referrer1", 2},
+	}))
+	// Breadth-first order means the nested referrer comes last.
+	qt.Check(t, qt.Equals(refs[2].Descriptor.Digest, referrer2.Digest))
+
+	// The depth can be limited.
+	refs, err = ListReferrersRecursive(ctx, r, "foo", manifest.Digest, 1)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.DeepEquals(summarize(refs), map[ociregistry.Digest]result{
+		referrer0.Digest: {"referrer0", "", 1},
+		referrer1.Digest: {"referrer1", "", 1},
+	}))
+
+	// Starting from a referrer gives just its subtree.
+	refs, err = ListReferrersRecursive(ctx, r, "foo", referrer1.Digest, 0)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.DeepEquals(summarize(refs), map[ociregistry.Digest]result{
+		referrer2.Digest: {"referrer2", "", 1},
+	}))
+}
+
+func TestListReferrersRecursiveCycle(t *testing.T) {
+	// A misbehaving registry reports a cycle: a refers to
+	// the subject, b refers to a, and the subject refers to b.
+	subject := digest.FromString("subject")
+	a := ociregistry.Descriptor{Digest: digest.FromString("a"), ArtifactType: "a"}
+	b := ociregistry.Descriptor{Digest: digest.FromString("b"), ArtifactType: "b"}
+	referrers := map[ociregistry.Digest][]ociregistry.Descriptor{
+		subject:  {a},
+		a.Digest: {b},
+		b.Digest: {{Digest: subject}, a},
+	}
+	r := &ociregistry.Funcs{
+		Referrers_: func(ctx context.Context, repo string, digest ociregistry.Digest, artifactType string) ociregistry.Seq[ociregistry.Descriptor] {
+			return ociregistry.SliceSeq(referrers[digest])
+		},
+	}
+	refs, err := ListReferrersRecursive(context.Background(), r, "foo", subject, 0)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.HasLen(refs, 2))
+	qt.Check(t, qt.Equals(refs[0].Descriptor.Digest, a.Digest))
+	qt.Check(t, qt.Equals(refs[1].Descriptor.Digest, b.Digest))
+	qt.Check(t, qt.Equals(refs[1].Parent, refs[0]))
+}
@@ -0,0 +1,80 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociclient
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/go-quicktest/qt"
+)
+
+func TestPushBlobChunkedResumeRange(t *testing.T) {
+	tests := []struct {
+		testName  string
+		rangeHdr  string
+		wantSize  int64
+		wantError string
+	}{{
+		testName: "Empty",
+		rangeHdr: "0-0",
+		wantSize: 0,
+	}, {
+		testName: "NonEmpty",
+		rangeHdr: "0-99",
+		wantSize: 100,
+	}, {
+		testName: "WithBytesPrefix",
+		rangeHdr: "bytes=0-99",
+		wantSize: 100,
+	}, {
+		testName:  "NonZeroStart",
+		rangeHdr:  "10-99",
+		wantError: `range "10-99" does not start with 0`,
+	}, {
+		testName:  "Invalid",
+		rangeHdr:  "0--1",
+		wantError: `invalid range "0--1" in response`,
+	}}
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if req.Method != "GET" {
+					http.Error(w, "unexpected request", http.StatusMethodNotAllowed)
+					return
+				}
+				w.Header().Set("Location", req.URL.Path)
+				w.Header().Set("Range", test.rangeHdr)
+				w.WriteHeader(http.StatusNoContent)
+			}))
+			defer srv.Close()
+			srvURL, _ := url.Parse(srv.URL)
+			r, err := New(srvURL.Host, &Options{
+				Insecure: true,
+			})
+			qt.Assert(t, qt.IsNil(err))
+			w, err := r.PushBlobChunkedResume(context.Background(), "foo", srv.URL+"/v2/foo/blobs/uploads/someid", -1, 0)
+			if test.wantError != "" {
+				qt.Assert(t, qt.ErrorMatches(err, test.wantError))
+				return
+			}
+			qt.Assert(t, qt.IsNil(err))
+			qt.Assert(t, qt.Equals(w.Size(), test.wantSize))
+		})
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociclient
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryOptions configures the retrying of requests that fail with
+// a transient error. See [Options.Retry].
+type RetryOptions struct {
+	// MaxAttempts holds the maximum number of times that a
+	// request is sent, including the first time. If it's less
+	// than 2, requests are not retried.
+	MaxAttempts int
+
+	// Delay holds the time to wait before retrying a request
+	// for the first time. It doubles for each subsequent retry.
+	// If it's zero, 100ms is used. A Retry-After header in a
+	// "429 Too Many Requests" or "503 Service Unavailable"
+	// response takes precedence.
+	Delay time.Duration
+
+	// MaxDelay holds the maximum time to wait before retrying
+	// a request, including any time requested by a Retry-After
+	// header, so that a server can't stall the client
+	// indefinitely. If it's zero, one minute is used.
+	MaxDelay time.Duration
+
+	// IsRetryable reports whether a request that received
+	// the given non-2xx response should be retried. It
+	// may read the response body; the body will be available
+	// again in full afterwards. If it's nil, [DefaultIsRetryable]
+	// is used.
+	//
+	// This can be used for registries that report
+	// transient conditions with non-standard statuses.
+	IsRetryable func(resp *http.Response) bool
+}
+
+const (
+	// defaultRetryDelay holds the default value of RetryOptions.Delay.
+	defaultRetryDelay = 100 * time.Millisecond
+
+	// defaultRetryMaxDelay holds the default value of RetryOptions.MaxDelay.
+	defaultRetryMaxDelay = time.Minute
+)
+
+// DefaultIsRetryable is the default value of [RetryOptions.IsRetryable].
+// It reports whether resp has a status that indicates a transient
+// condition: 429 (Too Many Requests), 500 (Internal Server Error),
+// 502 (Bad Gateway), 503 (Service Unavailable) or 504 (Gateway Timeout).
+func DefaultIsRetryable(resp *http.Response) bool {
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// isIdempotent reports whether req can safely be sent more than
+// once. In particular, starting an upload (POST), sending a chunk
+// (PATCH) and completing an upload (a PUT with a digest query
+// parameter) are not, because a failed attempt might have been
+// partly applied by the server, or might have ended the upload
+// session.
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case "GET", "HEAD", "DELETE":
+		return true
+	case "PUT":
+		return !req.URL.Query().Has("digest")
+	}
+	return false
+}
+
+// retryAfter returns the delay requested by the Retry-After
+// header in resp, if any.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return 0, false
+	}
+	h := resp.Header.Get("Retry-After")
+	if h == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(h); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	t, err := http.ParseTime(h)
+	if err != nil {
+		return 0, false
+	}
+	return max(time.Until(t), 0), true
+}
+
+// sendWithRetry sends req, retrying it according to c.retry
+// when the response is classified as retryable. A request is only
+// retried when its method is idempotent and its body can be rewound
+// with req.GetBody.
+func (c *client) sendWithRetry(req *http.Request) (*http.Response, error) {
+	if c.retry == nil || c.retry.MaxAttempts < 2 || !isIdempotent(req) {
+		return c.httpClient.Do(req)
+	}
+	isRetryable := c.retry.IsRetryable
+	if isRetryable == nil {
+		isRetryable = DefaultIsRetryable
+	}
+	delay := c.retry.Delay
+	if delay <= 0 {
+		delay = defaultRetryDelay
+	}
+	maxDelay := c.retry.MaxDelay
+	if maxDelay <= 0 {
+		maxDelay = defaultRetryMaxDelay
+	}
+	for attempt := 1; ; attempt++ {
+		resp, err := c.httpClient.Do(req)
+		if err != nil || isOKStatus(resp.StatusCode) {
+			return resp, err
+		}
+		if attempt >= c.retry.MaxAttempts || (req.Body != nil && req.GetBody == nil) {
+			return resp, nil
+		}
+		// Buffer the body so that it can be read by
+		// the classifier and then again by our caller.
+		data, err := io.ReadAll(io.LimitReader(resp.Body, errorBodySizeLimit+1))
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(data))
+		retry := isRetryable(resp)
+		resp.Body = io.NopCloser(bytes.NewReader(data))
+		if !retry {
+			return resp, nil
+		}
+		if debug {
+			c.logf("retrying %s %s after %s (attempt %d)", req.Method, req.URL, resp.Status, attempt)
+		}
+		wait := delay
+		if d, ok := retryAfter(resp); ok {
+			wait = d
+		}
+		wait = min(wait, maxDelay)
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-req.Context().Done():
+			t.Stop()
+			return resp, nil
+		}
+		delay *= 2
+		if req.GetBody != nil {
+			req.Body, err = req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+}
@@ -0,0 +1,305 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociclient
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-quicktest/qt"
+	"github.com/opencontainers/go-digest"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ocimem"
+	"cuelabs.dev/go/oci/ociregistry/ociserver"
+)
+
+func TestRetryIsRetryable(t *testing.T) {
+	const lockedBody = `{"errors":[{"code":"DENIED","message":"repository temporarily locked"}]}`
+	isLocked := func(resp *http.Response) bool {
+		if resp.StatusCode != http.StatusForbidden {
+			return DefaultIsRetryable(resp)
+		}
+		data, _ := io.ReadAll(resp.Body)
+		return strings.Contains(string(data), "temporarily locked")
+	}
+	tests := []struct {
+		testName   string
+		retry      *RetryOptions
+		status     int
+		retryAfter string
+		body       string
+		failures   int32
+		wantErr    string
+		wantCalls  int32
+	}{{
+		testName:  "NoRetry",
+		status:    http.StatusServiceUnavailable,
+		failures:  1,
+		wantErr:   `503 Service Unavailable: .*`,
+		wantCalls: 1,
+	}, {
+		testName: "DefaultServerError",
+		retry: &RetryOptions{
+			MaxAttempts: 3,
+		},
+		status:    http.StatusServiceUnavailable,
+		failures:  2,
+		wantCalls: 3,
+	}, {
+		testName: "DefaultTooManyAttempts",
+		retry: &RetryOptions{
+			MaxAttempts: 3,
+		},
+		status:    http.StatusTooManyRequests,
+		failures:  3,
+		wantErr:   `429 Too Many Requests: .*`,
+		wantCalls: 3,
+	}, {
+		testName: "DefaultNotImplemented",
+		retry: &RetryOptions{
+			MaxAttempts: 3,
+		},
+		status:    http.StatusNotImplemented,
+		failures:  1,
+		wantErr:   `501 Not Implemented: .*`,
+		wantCalls: 1,
+	}, {
+		testName: "RetryAfter",
+		retry: &RetryOptions{
+			MaxAttempts: 2,
+			// The Retry-After header takes precedence
+			// over this, so the test doesn't time out.
+			Delay: time.Hour,
+		},
+		status:     http.StatusServiceUnavailable,
+		retryAfter: "0",
+		failures:   1,
+		wantCalls:  2,
+	}, {
+		testName: "RetryAfterCapped",
+		retry: &RetryOptions{
+			MaxAttempts: 2,
+			// The delay requested by the server is
+			// capped, so the test doesn't time out.
+			MaxDelay: time.Millisecond,
+		},
+		status:     http.StatusTooManyRequests,
+		retryAfter: "3600",
+		failures:   1,
+		wantCalls:  2,
+	}, {
+		testName: "DefaultForbidden",
+		retry: &RetryOptions{
+			MaxAttempts: 3,
+		},
+		status:    http.StatusForbidden,
+		body:      lockedBody,
+		failures:  1,
+		wantErr:   `403 Forbidden: denied: repository temporarily locked`,
+		wantCalls: 1,
+	}, {
+		testName: "CustomForbidden",
+		retry: &RetryOptions{
+			MaxAttempts: 3,
+			IsRetryable: isLocked,
+		},
+		status:    http.StatusForbidden,
+		body:      lockedBody,
+		failures:  2,
+		wantCalls: 3,
+	}, {
+		testName: "CustomForbiddenNotRetryable",
+		retry: &RetryOptions{
+			MaxAttempts: 3,
+			IsRetryable: isLocked,
+		},
+		status:   http.StatusForbidden,
+		body:     `{"errors":[{"code":"DENIED","message":"access denied"}]}`,
+		failures: 1,
+		// The body that the classifier read is
+		// still available to make the error.
+		wantErr:   `403 Forbidden: denied: access denied`,
+		wantCalls: 1,
+	}}
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			ctx := context.Background()
+			backend := ocimem.New()
+			_, err := backend.PushManifest(ctx, "foo", "latest", []byte(`{}`), "application/json")
+			qt.Assert(t, qt.IsNil(err))
+			handler := ociserver.New(backend, nil)
+			var calls atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if n := calls.Add(1); n <= test.failures {
+					w.Header().Set("Content-Type", "application/json")
+					if test.retryAfter != "" {
+						w.Header().Set("Retry-After", test.retryAfter)
+					}
+					w.WriteHeader(test.status)
+					w.Write([]byte(test.body))
+					return
+				}
+				handler.ServeHTTP(w, req)
+			}))
+			defer srv.Close()
+			srvURL, _ := url.Parse(srv.URL)
+			if test.retry != nil && test.retry.Delay == 0 {
+				test.retry.Delay = time.Millisecond
+			}
+			r, err := New(srvURL.Host, &Options{
+				Insecure: true,
+				Retry:    test.retry,
+			})
+			qt.Assert(t, qt.IsNil(err))
+			rd, err := r.GetTag(ctx, "foo", "latest")
+			if test.wantErr != "" {
+				qt.Assert(t, qt.ErrorMatches(err, test.wantErr))
+			} else {
+				qt.Assert(t, qt.IsNil(err))
+				data, err := io.ReadAll(rd)
+				rd.Close()
+				qt.Assert(t, qt.IsNil(err))
+				qt.Check(t, qt.Equals(string(data), `{}`))
+			}
+			qt.Check(t, qt.Equals(calls.Load(), test.wantCalls))
+		})
+	}
+}
+
+func TestRetryRewindsBody(t *testing.T) {
+	ctx := context.Background()
+	handler := ociserver.New(ocimem.New(), nil)
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == "PUT" && calls.Add(1) == 1 {
+			// Consume the body before failing, as a proxy might.
+			io.Copy(io.Discard, req.Body)
+			http.Error(w, "try again", http.StatusBadGateway)
+			return
+		}
+		handler.ServeHTTP(w, req)
+	}))
+	defer srv.Close()
+	srvURL, _ := url.Parse(srv.URL)
+	r, err := New(srvURL.Host, &Options{
+		Insecure: true,
+		Retry: &RetryOptions{
+			MaxAttempts: 2,
+			Delay:       time.Millisecond,
+		},
+	})
+	qt.Assert(t, qt.IsNil(err))
+	manifest := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[]}`)
+	_, err = r.PushManifest(ctx, "foo", "latest", manifest, "application/vnd.oci.image.index.v1+json")
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.Equals(calls.Load(), int32(2)))
+
+	rd, err := r.GetTag(ctx, "foo", "latest")
+	qt.Assert(t, qt.IsNil(err))
+	defer rd.Close()
+	data, err := io.ReadAll(rd)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.Equals(string(data), string(manifest)))
+}
+
+func TestRetryNotIdempotent(t *testing.T) {
+	ctx := context.Background()
+	handler := ociserver.New(ocimem.New(), nil)
+	var posts, patches atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "POST":
+			if posts.Add(1) == 1 {
+				http.Error(w, "try again", http.StatusBadGateway)
+				return
+			}
+		case "PATCH":
+			if patches.Add(1) == 1 {
+				// The server might have applied some of the
+				// chunk before failing, so it can't be retried.
+				io.Copy(io.Discard, req.Body)
+				http.Error(w, "try again", http.StatusBadGateway)
+				return
+			}
+		}
+		handler.ServeHTTP(w, req)
+	}))
+	defer srv.Close()
+	srvURL, _ := url.Parse(srv.URL)
+	r, err := New(srvURL.Host, &Options{
+		Insecure: true,
+		Retry: &RetryOptions{
+			MaxAttempts: 3,
+			Delay:       time.Millisecond,
+		},
+	})
+	qt.Assert(t, qt.IsNil(err))
+
+	_, err = r.PushBlobChunked(ctx, "foo", 0)
+	qt.Assert(t, qt.ErrorMatches(err, `.*502 Bad Gateway.*`))
+	qt.Check(t, qt.Equals(posts.Load(), int32(1)))
+
+	w, err := r.PushBlobChunked(ctx, "foo", 5)
+	qt.Assert(t, qt.IsNil(err))
+	_, err = w.Write([]byte("hello world"))
+	qt.Assert(t, qt.IsNil(err))
+	err = w.Close()
+	qt.Check(t, qt.ErrorMatches(err, `.*502 Bad Gateway.*`))
+	qt.Check(t, qt.Equals(patches.Load(), int32(1)))
+}
+
+func TestRetryNotUploadCompletion(t *testing.T) {
+	ctx := context.Background()
+	handler := ociserver.New(ocimem.New(), nil)
+	var puts atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == "PUT" && puts.Add(1) == 1 {
+			// The server might have completed the upload
+			// before failing, so it can't be retried.
+			io.Copy(io.Discard, req.Body)
+			http.Error(w, "try again", http.StatusBadGateway)
+			return
+		}
+		handler.ServeHTTP(w, req)
+	}))
+	defer srv.Close()
+	srvURL, _ := url.Parse(srv.URL)
+	r, err := New(srvURL.Host, &Options{
+		Insecure: true,
+		Retry: &RetryOptions{
+			MaxAttempts: 3,
+			Delay:       time.Millisecond,
+		},
+	})
+	qt.Assert(t, qt.IsNil(err))
+
+	content := []byte("hello world")
+	_, err = r.PushBlob(ctx, "foo", ociregistry.Descriptor{
+		MediaType: "application/octet-stream",
+		Digest:    digest.FromBytes(content),
+		Size:      int64(len(content)),
+	}, bytes.NewReader(content))
+	qt.Assert(t, qt.ErrorMatches(err, `.*502 Bad Gateway.*`))
+	qt.Check(t, qt.Equals(puts.Load(), int32(1)))
+}
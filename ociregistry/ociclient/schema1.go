@@ -0,0 +1,334 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociclient
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"cuelabs.dev/go/oci/ociregistry"
+)
+
+const (
+	mediaTypeDockerSchema1       = "application/vnd.docker.distribution.manifest.v1+json"
+	mediaTypeDockerSchema1Signed = "application/vnd.docker.distribution.manifest.v1+prettyjws"
+)
+
+func isSchema1(mediaType string) bool {
+	return mediaType == mediaTypeDockerSchema1 || mediaType == mediaTypeDockerSchema1Signed
+}
+
+// schema1Manifest holds the parts of a Docker schema1 manifest
+// that are needed for conversion. See
+// https://github.com/distribution/distribution/blob/v2.8.3/docs/spec/manifest-v2-1.md
+type schema1Manifest struct {
+	SchemaVersion int `json:"schemaVersion"`
+	FSLayers      []struct {
+		BlobSum digest.Digest `json:"blobSum"`
+	} `json:"fsLayers"`
+	History []struct {
+		V1Compatibility string `json:"v1Compatibility"`
+	} `json:"history"`
+}
+
+// schema1V1Compat holds the fields of a v1Compatibility
+// history entry that contribute to the converted image history.
+type schema1V1Compat struct {
+	Created         *time.Time `json:"created,omitempty"`
+	Author          string     `json:"author,omitempty"`
+	Comment         string     `json:"comment,omitempty"`
+	ThrowAway       bool       `json:"throwaway,omitempty"`
+	ContainerConfig struct {
+		Cmd []string `json:"Cmd,omitempty"`
+	} `json:"container_config,omitempty"`
+}
+
+// readSchema1 reads a schema1 manifest from r and converts it to an
+// OCI image manifest, returning a reader for the converted
+// manifest. If desc has a digest, the original manifest is
+// verified against it before conversion.
+func (c *client) readSchema1(ctx context.Context, repo string, r io.Reader, desc ociregistry.Descriptor) (ociregistry.BlobReader, error) {
+	if desc.Size > maxManifestSize {
+		return nil, fmt.Errorf("schema1 manifest too large to convert (%d bytes)", desc.Size)
+	}
+	limit := desc.Size
+	if limit < 0 {
+		// The size isn't known.
+		limit = maxManifestSize
+	}
+	data, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read schema1 manifest: %v", err)
+	}
+	if desc.Size < 0 && int64(len(data)) <= maxManifestSize {
+		desc.Size = int64(len(data))
+	}
+	if int64(len(data)) != desc.Size {
+		return nil, fmt.Errorf("body size mismatch")
+	}
+	if desc.Digest != "" {
+		if err := checkSchema1Digest(data, desc.Digest); err != nil {
+			return nil, err
+		}
+	}
+	mdata, config, err := c.schema1ToOCI(ctx, repo, data)
+	if err != nil {
+		return nil, fmt.Errorf("cannot convert schema1 manifest: %w", err)
+	}
+	c.addSchema1Config(config)
+	return newBlobReader(io.NopCloser(bytes.NewReader(mdata)), ociregistry.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    digest.FromBytes(mdata),
+		Size:      int64(len(mdata)),
+	}), nil
+}
+
+// checkSchema1Digest checks that the schema1 manifest in data has
+// the digest dig. The digest of a signed manifest is calculated over
+// its payload, which is the manifest without its signatures, so
+// either that or the content as a whole may match.
+func checkSchema1Digest(data []byte, dig digest.Digest) error {
+	if !dig.Algorithm().Available() {
+		return fmt.Errorf("cannot verify schema1 manifest with digest %q: %w", dig, ociregistry.ErrDigestInvalid)
+	}
+	if dig.Algorithm().FromBytes(data) == dig {
+		return nil
+	}
+	payload, err := schema1Payload(data)
+	if err == nil && dig.Algorithm().FromBytes(payload) == dig {
+		return nil
+	}
+	return fmt.Errorf("schema1 manifest does not match digest %s: %w", dig, ociregistry.ErrDigestInvalid)
+}
+
+// schema1Payload returns the payload of a signed schema1 manifest,
+// as described by the "formatLength" and "formatTail" fields of
+// the protected header of its first signature.
+func schema1Payload(data []byte) ([]byte, error) {
+	var m struct {
+		Signatures []struct {
+			Protected string `json:"protected"`
+		} `json:"signatures"`
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	if len(m.Signatures) == 0 {
+		return nil, fmt.Errorf("manifest is not signed")
+	}
+	protected, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(m.Signatures[0].Protected, "="))
+	if err != nil {
+		return nil, fmt.Errorf("invalid protected header: %v", err)
+	}
+	var header struct {
+		FormatLength int    `json:"formatLength"`
+		FormatTail   string `json:"formatTail"`
+	}
+	if err := json.Unmarshal(protected, &header); err != nil {
+		return nil, fmt.Errorf("invalid protected header: %v", err)
+	}
+	tail, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(header.FormatTail, "="))
+	if err != nil {
+		return nil, fmt.Errorf("invalid format tail: %v", err)
+	}
+	if header.FormatLength < 0 || header.FormatLength > len(data) {
+		return nil, fmt.Errorf("invalid format length %d", header.FormatLength)
+	}
+	return append(data[:header.FormatLength:header.FormatLength], tail...), nil
+}
+
+// schema1ToOCI converts the schema1 manifest in data to an OCI
+// image manifest, returning the encoded manifest and the image
+// config that it refers to.
+//
+// Schema1 manifests don't record the uncompressed digests of their
+// layers, so each layer is fetched from repo to calculate them.
+func (c *client) schema1ToOCI(ctx context.Context, repo string, data []byte) (manifest, config []byte, _ error) {
+	var m schema1Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, nil, err
+	}
+	if m.SchemaVersion != 1 {
+		return nil, nil, fmt.Errorf("unexpected schema version %d", m.SchemaVersion)
+	}
+	if len(m.FSLayers) == 0 || len(m.FSLayers) != len(m.History) {
+		return nil, nil, fmt.Errorf("mismatched or empty fsLayers and history (%d vs %d)", len(m.FSLayers), len(m.History))
+	}
+	// The most recent history entry holds the image configuration,
+	// mixed in with some v1-specific fields that have no
+	// place in an OCI config.
+	var cfg map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(m.History[0].V1Compatibility), &cfg); err != nil {
+		return nil, nil, fmt.Errorf("invalid v1Compatibility: %v", err)
+	}
+	for _, field := range []string{"id", "parent", "parent_id", "layer_id", "Size", "throwaway"} {
+		delete(cfg, field)
+	}
+
+	type layerInfo struct {
+		desc   ocispec.Descriptor
+		diffID digest.Digest
+	}
+	var (
+		layers  []ocispec.Descriptor
+		diffIDs []digest.Digest
+		history []ocispec.History
+		// known holds layers that have already been fetched:
+		// the same layer can appear more than once.
+		known = make(map[digest.Digest]layerInfo)
+	)
+	// Schema1 lists layers and history most recent first;
+	// OCI wants them the other way around.
+	for i := len(m.FSLayers) - 1; i >= 0; i-- {
+		var v1 schema1V1Compat
+		if err := json.Unmarshal([]byte(m.History[i].V1Compatibility), &v1); err != nil {
+			return nil, nil, fmt.Errorf("invalid v1Compatibility: %v", err)
+		}
+		history = append(history, ocispec.History{
+			Created:    v1.Created,
+			Author:     v1.Author,
+			CreatedBy:  strings.Join(v1.ContainerConfig.Cmd, " "),
+			Comment:    v1.Comment,
+			EmptyLayer: v1.ThrowAway,
+		})
+		if v1.ThrowAway {
+			continue
+		}
+		blobSum := m.FSLayers[i].BlobSum
+		layer, ok := known[blobSum]
+		if !ok {
+			size, diffID, err := c.schema1DiffID(ctx, repo, blobSum)
+			if err != nil {
+				return nil, nil, err
+			}
+			layer = layerInfo{
+				desc: ocispec.Descriptor{
+					MediaType: ocispec.MediaTypeImageLayerGzip,
+					Digest:    blobSum,
+					Size:      size,
+				},
+				diffID: diffID,
+			}
+			known[blobSum] = layer
+		}
+		layers = append(layers, layer.desc)
+		diffIDs = append(diffIDs, layer.diffID)
+	}
+	var err error
+	if cfg["rootfs"], err = json.Marshal(ocispec.RootFS{
+		Type:    "layers",
+		DiffIDs: diffIDs,
+	}); err != nil {
+		return nil, nil, err
+	}
+	if cfg["history"], err = json.Marshal(history); err != nil {
+		return nil, nil, err
+	}
+	config, err = json.Marshal(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	manifest, err = json.Marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config: ocispec.Descriptor{
+			MediaType: ocispec.MediaTypeImageConfig,
+			Digest:    digest.FromBytes(config),
+			Size:      int64(len(config)),
+		},
+		Layers: layers,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return manifest, config, nil
+}
+
+// schema1DiffID fetches the gzipped layer with the given digest and
+// returns its size and the digest of its uncompressed content.
+func (c *client) schema1DiffID(ctx context.Context, repo string, dig digest.Digest) (int64, digest.Digest, error) {
+	r, err := c.GetBlob(ctx, repo, dig)
+	if err != nil {
+		return 0, "", fmt.Errorf("cannot fetch layer %s: %w", dig, err)
+	}
+	defer r.Close()
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return 0, "", fmt.Errorf("cannot decompress layer %s: %v", dig, err)
+	}
+	digester := digest.Canonical.Digester()
+	if _, err := io.Copy(digester.Hash(), zr); err != nil {
+		return 0, "", fmt.Errorf("cannot decompress layer %s: %v", dig, err)
+	}
+	// Read any trailing data so that the blob reader
+	// gets the chance to verify the layer digest.
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return 0, "", fmt.Errorf("cannot read layer %s: %v", dig, err)
+	}
+	return r.Descriptor().Size, digester.Digest(), nil
+}
+
+// maxSchema1Configs holds the maximum number of converted
+// schema1 configs that are kept by a client.
+const maxSchema1Configs = 100
+
+// addSchema1Config records the content of a config blob created
+// by a schema1 conversion, evicting the oldest one if there are
+// more than maxSchema1Configs.
+func (c *client) addSchema1Config(config []byte) {
+	dig := digest.FromBytes(config)
+	c.schema1Mu.Lock()
+	defer c.schema1Mu.Unlock()
+	if _, ok := c.schema1Configs[dig]; ok {
+		return
+	}
+	if len(c.schema1Order) >= maxSchema1Configs {
+		delete(c.schema1Configs, c.schema1Order[0])
+		c.schema1Order = c.schema1Order[1:]
+	}
+	c.schema1Configs[dig] = config
+	c.schema1Order = append(c.schema1Order, dig)
+}
+
+// schema1Config returns the content of a config blob
+// created by a previous schema1 conversion, if any.
+func (c *client) schema1Config(dig digest.Digest) ([]byte, bool) {
+	if !c.convertSchema1 {
+		return nil, false
+	}
+	c.schema1Mu.Lock()
+	defer c.schema1Mu.Unlock()
+	data, ok := c.schema1Configs[dig]
+	return data, ok
+}
+
+func schema1ConfigDescriptor(data []byte) ociregistry.Descriptor {
+	return ociregistry.Descriptor{
+		MediaType: ocispec.MediaTypeImageConfig,
+		Digest:    digest.FromBytes(data),
+		Size:      int64(len(data)),
+	}
+}
@@ -0,0 +1,324 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociclient
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/go-quicktest/qt"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ocimem"
+	"cuelabs.dev/go/oci/ociregistry/ociserver"
+)
+
+// schema1Fixture holds a schema1 manifest in the form
+// returned by legacy registries. The %[1]s and %[2]s verbs are
+// filled in with the digests of the base layer and the
+// top layer respectively.
+const schema1Fixture = `{
+   "schemaVersion": 1,
+   "name": "foo/bar",
+   "tag": "latest",
+   "architecture": "amd64",
+   "fsLayers": [
+      {"blobSum": "%[2]s"},
+      {"blobSum": "%[1]s"},
+      {"blobSum": "%[1]s"}
+   ],
+   "history": [
+      {"v1Compatibility": "{\"architecture\":\"amd64\",\"config\":{\"Cmd\":[\"/bin/sh\"],\"Env\":[\"PATH=/bin\"]},\"container_config\":{\"Cmd\":[\"/bin/sh\",\"-c\",\"#(nop) ADD file:top in /\"]},\"created\":\"2016-01-02T00:00:00Z\",\"id\":\"c\",\"os\":\"linux\",\"parent\":\"b\"}"},
+      {"v1Compatibility": "{\"container_config\":{\"Cmd\":[\"/bin/sh\",\"-c\",\"#(nop) CMD [\\\"/bin/sh\\\"]\"]},\"created\":\"2016-01-01T12:00:00Z\",\"id\":\"b\",\"parent\":\"a\",\"throwaway\":true}"},
+      {"v1Compatibility": "{\"container_config\":{\"Cmd\":[\"/bin/sh\",\"-c\",\"#(nop) ADD file:base in /\"]},\"created\":\"2016-01-01T00:00:00Z\",\"id\":\"a\"}"}
+   ]
+}`
+
+func TestConvertSchema1(t *testing.T) {
+	ctx := context.Background()
+	backend := ocimem.New()
+	baseContent, baseDesc := pushGzipLayer(t, backend, "foo/bar", "base layer")
+	topContent, topDesc := pushGzipLayer(t, backend, "foo/bar", "top layer")
+	manifest := []byte(fmt.Sprintf(schema1Fixture, baseDesc.Digest, topDesc.Digest))
+
+	srv := httptest.NewServer(schema1Handler(manifest, mediaTypeDockerSchema1, digest.FromBytes(manifest), ociserver.New(backend, nil)))
+	defer srv.Close()
+	srvURL, _ := url.Parse(srv.URL)
+
+	// Without ConvertSchema1, the manifest is returned as is.
+	r, err := New(srvURL.Host, &Options{
+		Insecure: true,
+	})
+	qt.Assert(t, qt.IsNil(err))
+	rd, err := r.GetTag(ctx, "foo/bar", "latest")
+	qt.Assert(t, qt.IsNil(err))
+	data, err := io.ReadAll(rd)
+	rd.Close()
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.Equals(rd.Descriptor().MediaType, mediaTypeDockerSchema1))
+	qt.Check(t, qt.DeepEquals(data, manifest))
+
+	r, err = New(srvURL.Host, &Options{
+		Insecure:       true,
+		ConvertSchema1: true,
+	})
+	qt.Assert(t, qt.IsNil(err))
+	rd, err = r.GetTag(ctx, "foo/bar", "latest")
+	qt.Assert(t, qt.IsNil(err))
+	data, err = io.ReadAll(rd)
+	rd.Close()
+	qt.Assert(t, qt.IsNil(err))
+	desc := rd.Descriptor()
+	qt.Check(t, qt.Equals(desc.MediaType, ocispec.MediaTypeImageManifest))
+	qt.Check(t, qt.Equals(desc.Digest, digest.FromBytes(data)))
+	qt.Check(t, qt.Equals(desc.Size, int64(len(data))))
+
+	var m ocispec.Manifest
+	qt.Assert(t, qt.IsNil(json.Unmarshal(data, &m)))
+	qt.Check(t, qt.Equals(m.SchemaVersion, 2))
+	qt.Check(t, qt.Equals(m.MediaType, ocispec.MediaTypeImageManifest))
+	qt.Check(t, qt.DeepEquals(m.Layers, []ocispec.Descriptor{{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    baseDesc.Digest,
+		Size:      baseDesc.Size,
+	}, {
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    topDesc.Digest,
+		Size:      topDesc.Size,
+	}}))
+	qt.Check(t, qt.Equals(m.Config.MediaType, ocispec.MediaTypeImageConfig))
+
+	// The generated config isn't in the registry but
+	// can still be fetched through the client.
+	configDesc, err := r.ResolveBlob(ctx, "foo/bar", m.Config.Digest)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.DeepEquals(configDesc, m.Config))
+	rd, err = r.GetBlob(ctx, "foo/bar", m.Config.Digest)
+	qt.Assert(t, qt.IsNil(err))
+	configData, err := io.ReadAll(rd)
+	rd.Close()
+	qt.Assert(t, qt.IsNil(err))
+
+	var config ocispec.Image
+	qt.Assert(t, qt.IsNil(json.Unmarshal(configData, &config)))
+	qt.Check(t, qt.Equals(config.Architecture, "amd64"))
+	qt.Check(t, qt.Equals(config.OS, "linux"))
+	qt.Check(t, qt.DeepEquals(config.Config.Cmd, []string{"/bin/sh"}))
+	qt.Check(t, qt.DeepEquals(config.RootFS, ocispec.RootFS{
+		Type: "layers",
+		DiffIDs: []digest.Digest{
+			digest.FromBytes(baseContent),
+			digest.FromBytes(topContent),
+		},
+	}))
+	qt.Assert(t, qt.HasLen(config.History, 3))
+	qt.Check(t, qt.Equals(config.History[0].CreatedBy, "/bin/sh -c #(nop) ADD file:base in /"))
+	qt.Check(t, qt.IsFalse(config.History[0].EmptyLayer))
+	qt.Check(t, qt.IsTrue(config.History[1].EmptyLayer))
+	qt.Check(t, qt.Equals(config.History[2].CreatedBy, "/bin/sh -c #(nop) ADD file:top in /"))
+}
+
+func TestConvertSchema1VerifiesDigest(t *testing.T) {
+	ctx := context.Background()
+	backend := ocimem.New()
+	_, baseDesc := pushGzipLayer(t, backend, "foo/bar", "base layer")
+	_, topDesc := pushGzipLayer(t, backend, "foo/bar", "top layer")
+	manifest := []byte(fmt.Sprintf(schema1Fixture, baseDesc.Digest, topDesc.Digest))
+
+	// Sign the manifest as Docker does: the signatures are
+	// inserted before the closing brace, and the protected
+	// header records how to recover the payload.
+	payloadDigest := digest.FromBytes(manifest)
+	formatLength := bytes.LastIndexByte(manifest, '}')
+	protected, err := json.Marshal(map[string]any{
+		"formatLength": formatLength,
+		"formatTail":   base64.RawURLEncoding.EncodeToString(manifest[formatLength:]),
+	})
+	qt.Assert(t, qt.IsNil(err))
+	signed := slices.Concat(
+		manifest[:formatLength],
+		[]byte(`,"signatures":[{"protected":"`+base64.RawURLEncoding.EncodeToString(protected)+`","signature":"xxx"}]`),
+		manifest[formatLength:],
+	)
+
+	tests := []struct {
+		testName  string
+		manifest  []byte
+		mediaType string
+		headerDig digest.Digest
+		getDig    digest.Digest
+		wantErr   string
+	}{{
+		testName:  "Unsigned",
+		manifest:  manifest,
+		mediaType: mediaTypeDockerSchema1,
+		headerDig: payloadDigest,
+		getDig:    payloadDigest,
+	}, {
+		testName:  "UnsignedMismatch",
+		manifest:  manifest,
+		mediaType: mediaTypeDockerSchema1,
+		headerDig: digest.FromString("other"),
+		getDig:    digest.FromString("other"),
+		wantErr:   `schema1 manifest does not match digest .*: digest invalid: .*`,
+	}, {
+		// The registry reports a digest that matches the content,
+		// but it's not the one that was asked for.
+		testName:  "HeaderDigestIgnored",
+		manifest:  manifest,
+		mediaType: mediaTypeDockerSchema1,
+		headerDig: payloadDigest,
+		getDig:    digest.FromString("other"),
+		wantErr:   `schema1 manifest does not match digest .*: digest invalid: .*`,
+	}, {
+		testName:  "SignedPayload",
+		manifest:  signed,
+		mediaType: mediaTypeDockerSchema1Signed,
+		headerDig: payloadDigest,
+		getDig:    payloadDigest,
+	}, {
+		testName:  "SignedWhole",
+		manifest:  signed,
+		mediaType: mediaTypeDockerSchema1Signed,
+		headerDig: digest.FromBytes(signed),
+		getDig:    digest.FromBytes(signed),
+	}, {
+		testName:  "SignedMismatch",
+		manifest:  signed,
+		mediaType: mediaTypeDockerSchema1Signed,
+		headerDig: digest.FromString("other"),
+		getDig:    digest.FromString("other"),
+		wantErr:   `schema1 manifest does not match digest .*: digest invalid: .*`,
+	}}
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			srv := httptest.NewServer(schema1Handler(test.manifest, test.mediaType, test.headerDig, ociserver.New(backend, nil)))
+			defer srv.Close()
+			srvURL, _ := url.Parse(srv.URL)
+			r, err := New(srvURL.Host, &Options{
+				Insecure:       true,
+				ConvertSchema1: true,
+			})
+			qt.Assert(t, qt.IsNil(err))
+			rd, err := r.GetManifest(ctx, "foo/bar", test.getDig)
+			if test.wantErr != "" {
+				qt.Assert(t, qt.ErrorMatches(err, test.wantErr))
+				return
+			}
+			qt.Assert(t, qt.IsNil(err))
+			defer rd.Close()
+			qt.Check(t, qt.Equals(rd.Descriptor().MediaType, ocispec.MediaTypeImageManifest))
+		})
+	}
+}
+
+func TestSchema1ConfigsBounded(t *testing.T) {
+	r, err := New("localhost:5000", &Options{
+		ConvertSchema1: true,
+	})
+	qt.Assert(t, qt.IsNil(err))
+	c := r.(*client)
+	config := func(i int) []byte {
+		return []byte(fmt.Sprintf(`{"id":%d}`, i))
+	}
+	for i := range maxSchema1Configs + 10 {
+		c.addSchema1Config(config(i))
+		// Adding the same config again has no effect.
+		c.addSchema1Config(config(i))
+	}
+	qt.Assert(t, qt.HasLen(c.schema1Configs, maxSchema1Configs))
+	qt.Assert(t, qt.HasLen(c.schema1Order, maxSchema1Configs))
+	for i := range maxSchema1Configs + 10 {
+		data, ok := c.schema1Config(digest.FromBytes(config(i)))
+		if i < 10 {
+			qt.Check(t, qt.IsFalse(ok), qt.Commentf("config %d", i))
+			continue
+		}
+		qt.Check(t, qt.IsTrue(ok), qt.Commentf("config %d", i))
+		qt.Check(t, qt.DeepEquals(data, config(i)))
+	}
+}
+
+func TestConvertSchema1MissingLayer(t *testing.T) {
+	missing := digest.FromString("missing")
+	manifest := []byte(fmt.Sprintf(schema1Fixture, missing, missing))
+	backend := ocimem.New()
+	pushGzipLayer(t, backend, "foo/bar", "other layer")
+	srv := httptest.NewServer(schema1Handler(manifest, mediaTypeDockerSchema1, digest.FromBytes(manifest), ociserver.New(backend, nil)))
+	defer srv.Close()
+	srvURL, _ := url.Parse(srv.URL)
+
+	r, err := New(srvURL.Host, &Options{
+		Insecure:       true,
+		ConvertSchema1: true,
+	})
+	qt.Assert(t, qt.IsNil(err))
+	_, err = r.GetTag(context.Background(), "foo/bar", "latest")
+	qt.Check(t, qt.ErrorMatches(err, `cannot convert schema1 manifest: cannot fetch layer .*`))
+	qt.Check(t, qt.ErrorIs(err, ociregistry.ErrBlobUnknown))
+}
+
+// schema1Handler returns a handler that serves manifest as the
+// foo/bar:latest schema1 manifest, and defers to h for everything else.
+// schema1Handler returns a handler that serves manifest with the
+// given media type and digest for the tag foo/bar:latest and for
+// any manifest requested by digest from foo/bar, and defers to h
+// otherwise.
+func schema1Handler(manifest []byte, mediaType string, dig digest.Digest, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ref, ok := strings.CutPrefix(req.URL.Path, "/v2/foo/bar/manifests/")
+		if !ok || (ref != "latest" && !strings.HasPrefix(ref, "sha256:")) {
+			h.ServeHTTP(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", mediaType)
+		w.Header().Set("Content-Length", fmt.Sprint(len(manifest)))
+		w.Header().Set("Docker-Content-Digest", string(dig))
+		if req.Method == "GET" {
+			w.Write(manifest)
+		}
+	})
+}
+
+// pushGzipLayer pushes a gzipped layer holding content to
+// the given repository, returning the uncompressed content
+// and the descriptor of the pushed layer.
+func pushGzipLayer(t *testing.T, r ociregistry.Interface, repo string, content string) ([]byte, ociregistry.Descriptor) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(content))
+	qt.Assert(t, qt.IsNil(zw.Close()))
+	desc := ociregistry.Descriptor{
+		MediaType: "application/octet-stream",
+		Digest:    digest.FromBytes(buf.Bytes()),
+		Size:      int64(buf.Len()),
+	}
+	desc, err := r.PushBlob(context.Background(), repo, desc, &buf)
+	qt.Assert(t, qt.IsNil(err))
+	return []byte(content), desc
+}
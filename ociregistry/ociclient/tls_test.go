@@ -0,0 +1,132 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociclient
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/go-quicktest/qt"
+
+	"cuelabs.dev/go/oci/ociregistry/ocimem"
+	"cuelabs.dev/go/oci/ociregistry/ociserver"
+)
+
+func TestInsecureSkipTLSVerify(t *testing.T) {
+	ctx := context.Background()
+	srv := httptest.NewTLSServer(ociserver.New(ocimem.New(), nil))
+	defer srv.Close()
+	srvURL, _ := url.Parse(srv.URL)
+
+	var logBuf bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&logBuf)
+	// Make sure that the warning hasn't already been
+	// logged by another test.
+	const otherHost = "other.example.com"
+	insecureSkipTLSVerifyWarned.Delete(srvURL.Host)
+	insecureSkipTLSVerifyWarned.Delete(otherHost)
+
+	// The test server's certificate is self-signed, so
+	// the request fails by default.
+	r, err := New(srvURL.Host, nil)
+	qt.Assert(t, qt.IsNil(err))
+	_, err = r.ResolveTag(ctx, "foo", "latest")
+	qt.Assert(t, qt.ErrorMatches(err, `.*certificate.*`))
+	qt.Check(t, qt.Equals(logBuf.String(), ""))
+
+	r, err = New(srvURL.Host, &Options{
+		DebugID:               "tlstest",
+		InsecureSkipTLSVerify: true,
+	})
+	qt.Assert(t, qt.IsNil(err))
+	_, err = r.ResolveTag(ctx, "foo", "latest")
+	// The request reached the server.
+	qt.Assert(t, qt.ErrorMatches(err, `404 Not Found: .*`))
+	qt.Check(t, qt.Matches(logBuf.String(), `(?s).*ociclient tlstest: WARNING: TLS certificate verification disabled for `+srvURL.Host+`.*`))
+
+	// The warning is only logged once for each host.
+	_, err = New(srvURL.Host, &Options{
+		DebugID:               "tlstest2",
+		InsecureSkipTLSVerify: true,
+	})
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.Equals(strings.Count(logBuf.String(), "WARNING"), 1))
+	_, err = New(otherHost, &Options{
+		DebugID:               "tlstest3",
+		InsecureSkipTLSVerify: true,
+	})
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.Equals(strings.Count(logBuf.String(), "WARNING"), 2))
+	qt.Check(t, qt.StringContains(logBuf.String(), "ociclient tlstest3: WARNING: TLS certificate verification disabled for "+otherHost))
+
+	// The default transport must not have been changed.
+	if cfg := http.DefaultTransport.(*http.Transport).TLSClientConfig; cfg != nil {
+		qt.Check(t, qt.IsFalse(cfg.InsecureSkipVerify))
+	}
+}
+
+func TestInsecureSkipTLSVerifyWithCustomTransport(t *testing.T) {
+	_, err := New("localhost:5000", &Options{
+		InsecureSkipTLSVerify: true,
+		Transport:             transportFunc(http.DefaultTransport.RoundTrip),
+	})
+	qt.Assert(t, qt.ErrorMatches(err, `InsecureSkipTLSVerify requires Transport to be nil or \*http.Transport, not ociclient.transportFunc`))
+}
+
+func TestTLSServerName(t *testing.T) {
+	ctx := context.Background()
+	srv := httptest.NewTLSServer(ociserver.New(ocimem.New(), nil))
+	defer srv.Close()
+	srvURL, _ := url.Parse(srv.URL)
+	// The test server's certificate is valid for example.com
+	// and 127.0.0.1 but not localhost, which is what we dial.
+	host := "localhost:" + srvURL.Port()
+	// The test server's client trusts its certificate.
+	transport := srv.Client().Transport
+
+	r, err := New(host, &Options{
+		Transport: transport,
+	})
+	qt.Assert(t, qt.IsNil(err))
+	_, err = r.ResolveTag(ctx, "foo", "latest")
+	qt.Assert(t, qt.ErrorMatches(err, `.*certificate is (valid for .*, )?not .*localhost.*`))
+
+	r, err = New(host, &Options{
+		Transport:     transport,
+		TLSServerName: "example.com",
+	})
+	qt.Assert(t, qt.IsNil(err))
+	_, err = r.ResolveTag(ctx, "foo", "latest")
+	// The request reached the server.
+	qt.Assert(t, qt.ErrorMatches(err, `404 Not Found: .*`))
+
+	// The original transport must not have been changed.
+	qt.Check(t, qt.Equals(transport.(*http.Transport).TLSClientConfig.ServerName, ""))
+}
+
+func TestTLSServerNameWithCustomTransport(t *testing.T) {
+	_, err := New("localhost:5000", &Options{
+		TLSServerName: "example.com",
+		Transport:     transportFunc(http.DefaultTransport.RoundTrip),
+	})
+	qt.Assert(t, qt.ErrorMatches(err, `TLSServerName requires Transport to be nil or \*http.Transport, not ociclient.transportFunc`))
+}
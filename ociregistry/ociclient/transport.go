@@ -0,0 +1,108 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociclient
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+// TransportConfig holds connection settings used to create a
+// dedicated [http.Transport] for a client. See [Options.TransportConfig].
+//
+// Zero fields leave the corresponding setting of
+// [http.DefaultTransport] unchanged.
+type TransportConfig struct {
+	// MaxIdleConns limits the total number of idle connections
+	// kept open across all hosts.
+	MaxIdleConns int
+
+	// MaxIdleConnsPerHost limits the number of idle connections
+	// kept open to each host. The [http.Transport] default of 2
+	// is usually too low when pushing or pulling many blobs
+	// concurrently.
+	MaxIdleConnsPerHost int
+
+	// MaxConnsPerHost limits the total number of connections
+	// to each host, including those in use.
+	MaxConnsPerHost int
+
+	// IdleConnTimeout is how long an idle connection is kept
+	// open before it's closed.
+	IdleConnTimeout time.Duration
+
+	// DialTimeout limits the time taken to establish a connection.
+	DialTimeout time.Duration
+
+	// TLSHandshakeTimeout limits the time taken by the TLS handshake.
+	TLSHandshakeTimeout time.Duration
+
+	// ResponseHeaderTimeout, if non-zero, limits the time spent
+	// waiting for the response headers after the request
+	// has been written.
+	ResponseHeaderTimeout time.Duration
+
+	// KeepAlive sets the interval between TCP keep-alive probes
+	// on open connections. If it's negative, keep-alive probes
+	// are disabled.
+	KeepAlive time.Duration
+
+	// DisableKeepAlives disables HTTP keep-alives, so that
+	// each connection is used for a single request only.
+	DisableKeepAlives bool
+}
+
+// defaultDialer mirrors the dialer settings used by [http.DefaultTransport].
+var defaultDialer = net.Dialer{
+	Timeout:   30 * time.Second,
+	KeepAlive: 30 * time.Second,
+}
+
+// newTransport returns a new transport based on [http.DefaultTransport]
+// with the settings in cfg applied.
+func (cfg *TransportConfig) newTransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.MaxIdleConns != 0 {
+		t.MaxIdleConns = cfg.MaxIdleConns
+	}
+	if cfg.MaxIdleConnsPerHost != 0 {
+		t.MaxIdleConnsPerHost = cfg.MaxIdleConnsPerHost
+	}
+	if cfg.MaxConnsPerHost != 0 {
+		t.MaxConnsPerHost = cfg.MaxConnsPerHost
+	}
+	if cfg.IdleConnTimeout != 0 {
+		t.IdleConnTimeout = cfg.IdleConnTimeout
+	}
+	if cfg.TLSHandshakeTimeout != 0 {
+		t.TLSHandshakeTimeout = cfg.TLSHandshakeTimeout
+	}
+	if cfg.ResponseHeaderTimeout != 0 {
+		t.ResponseHeaderTimeout = cfg.ResponseHeaderTimeout
+	}
+	t.DisableKeepAlives = cfg.DisableKeepAlives
+	if cfg.DialTimeout != 0 || cfg.KeepAlive != 0 {
+		d := defaultDialer
+		if cfg.DialTimeout != 0 {
+			d.Timeout = cfg.DialTimeout
+		}
+		if cfg.KeepAlive != 0 {
+			d.KeepAlive = cfg.KeepAlive
+		}
+		t.DialContext = d.DialContext
+	}
+	return t
+}
@@ -0,0 +1,100 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociclient
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/go-quicktest/qt"
+
+	"cuelabs.dev/go/oci/ociregistry/ocimem"
+	"cuelabs.dev/go/oci/ociregistry/ociserver"
+)
+
+func TestTransportConfig(t *testing.T) {
+	r, err := New("localhost:5000", &Options{
+		TransportConfig: &TransportConfig{
+			MaxIdleConns:          50,
+			MaxIdleConnsPerHost:   20,
+			MaxConnsPerHost:       30,
+			IdleConnTimeout:       time.Minute,
+			TLSHandshakeTimeout:   5 * time.Second,
+			ResponseHeaderTimeout: 15 * time.Second,
+			DisableKeepAlives:     true,
+		},
+	})
+	qt.Assert(t, qt.IsNil(err))
+	tr, ok := r.(*client).httpClient.Transport.(*http.Transport)
+	qt.Assert(t, qt.IsTrue(ok))
+	qt.Check(t, qt.Not(qt.Equals(tr, http.DefaultTransport.(*http.Transport))))
+	qt.Check(t, qt.Equals(tr.MaxIdleConns, 50))
+	qt.Check(t, qt.Equals(tr.MaxIdleConnsPerHost, 20))
+	qt.Check(t, qt.Equals(tr.MaxConnsPerHost, 30))
+	qt.Check(t, qt.Equals(tr.IdleConnTimeout, time.Minute))
+	qt.Check(t, qt.Equals(tr.TLSHandshakeTimeout, 5*time.Second))
+	qt.Check(t, qt.Equals(tr.ResponseHeaderTimeout, 15*time.Second))
+	qt.Check(t, qt.IsTrue(tr.DisableKeepAlives))
+
+	// Settings that aren't specified are inherited from the default transport.
+	r, err = New("localhost:5000", &Options{
+		TransportConfig: &TransportConfig{
+			MaxIdleConnsPerHost: 20,
+		},
+	})
+	qt.Assert(t, qt.IsNil(err))
+	tr = r.(*client).httpClient.Transport.(*http.Transport)
+	def := http.DefaultTransport.(*http.Transport)
+	qt.Check(t, qt.Equals(tr.MaxIdleConnsPerHost, 20))
+	qt.Check(t, qt.Equals(tr.MaxIdleConns, def.MaxIdleConns))
+	qt.Check(t, qt.Equals(tr.IdleConnTimeout, def.IdleConnTimeout))
+	qt.Check(t, qt.Equals(tr.TLSHandshakeTimeout, def.TLSHandshakeTimeout))
+	qt.Check(t, qt.IsFalse(tr.DisableKeepAlives))
+	qt.Check(t, qt.Equals(def.MaxIdleConnsPerHost, 0))
+
+	// An explicit transport takes precedence.
+	custom := transportFunc(http.DefaultTransport.RoundTrip)
+	r, err = New("localhost:5000", &Options{
+		Transport: custom,
+		TransportConfig: &TransportConfig{
+			MaxIdleConnsPerHost: 20,
+		},
+	})
+	qt.Assert(t, qt.IsNil(err))
+	_, ok = r.(*client).httpClient.Transport.(transportFunc)
+	qt.Check(t, qt.IsTrue(ok))
+}
+
+func TestTransportConfigRequests(t *testing.T) {
+	srv := httptest.NewServer(ociserver.New(ocimem.New(), nil))
+	defer srv.Close()
+	srvURL, _ := url.Parse(srv.URL)
+	r, err := New(srvURL.Host, &Options{
+		Insecure: true,
+		TransportConfig: &TransportConfig{
+			MaxIdleConnsPerHost: 10,
+			DialTimeout:         5 * time.Second,
+			KeepAlive:           -1,
+		},
+	})
+	qt.Assert(t, qt.IsNil(err))
+	_, err = r.ResolveTag(context.Background(), "foo", "latest")
+	// The request reached the server.
+	qt.Assert(t, qt.ErrorMatches(err, `404 Not Found: .*`))
+}
@@ -0,0 +1,142 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociclient
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-quicktest/qt"
+	"github.com/opencontainers/go-digest"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ocimem"
+	"cuelabs.dev/go/oci/ociregistry/ociserver"
+)
+
+func TestUploadStartPath(t *testing.T) {
+	for _, slash := range []bool{true, false} {
+		name := "WithSlash"
+		if !slash {
+			name = "WithoutSlash"
+		}
+		t.Run(name, func(t *testing.T) {
+			backend := ocimem.New()
+			h := ociserver.New(backend, nil)
+			var mu sync.Mutex
+			var posts []string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if req.Method == "POST" {
+					mu.Lock()
+					posts = append(posts, req.URL.Path)
+					mu.Unlock()
+					// Accept only one form of the upload start path.
+					if strings.HasSuffix(req.URL.Path, "/") != slash {
+						http.NotFound(w, req)
+						return
+					}
+				}
+				h.ServeHTTP(w, req)
+			}))
+			defer srv.Close()
+			srvURL, _ := url.Parse(srv.URL)
+			r, err := New(srvURL.Host, &Options{
+				Insecure: true,
+			})
+			qt.Assert(t, qt.IsNil(err))
+			ctx := context.Background()
+
+			checkBlob := func(content string) {
+				t.Helper()
+				rd, err := backend.GetBlob(ctx, "foo", digest.FromString(content))
+				qt.Assert(t, qt.IsNil(err))
+				defer rd.Close()
+				data, err := io.ReadAll(rd)
+				qt.Assert(t, qt.IsNil(err))
+				qt.Assert(t, qt.Equals(string(data), content))
+			}
+
+			content := "content 1"
+			_, err = r.PushBlob(ctx, "foo", ociregistry.Descriptor{
+				MediaType: "application/octet-stream",
+				Digest:    digest.FromString(content),
+				Size:      int64(len(content)),
+			}, strings.NewReader(content))
+			qt.Assert(t, qt.IsNil(err))
+			checkBlob(content)
+
+			content = "content 2"
+			w, err := r.PushBlobChunked(ctx, "foo", 0)
+			qt.Assert(t, qt.IsNil(err))
+			_, err = w.Write([]byte(content))
+			qt.Assert(t, qt.IsNil(err))
+			_, err = w.Commit(digest.FromString(content))
+			qt.Assert(t, qt.IsNil(err))
+			checkBlob(content)
+
+			// The trailing slash is tried first and, when that
+			// fails, the form that works is remembered.
+			want := []string{"/v2/foo/blobs/uploads/", "/v2/foo/blobs/uploads/"}
+			if !slash {
+				want = []string{"/v2/foo/blobs/uploads/", "/v2/foo/blobs/uploads", "/v2/foo/blobs/uploads"}
+			}
+			qt.Assert(t, qt.DeepEquals(posts, want))
+		})
+	}
+}
+
+func TestUploadStartNotFound(t *testing.T) {
+	var posts int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		posts++
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		io.WriteString(w, `{"errors":[{"code":"NAME_UNKNOWN","message":"no such repository"}]}`)
+	}))
+	defer srv.Close()
+	srvURL, _ := url.Parse(srv.URL)
+	r, err := New(srvURL.Host, &Options{
+		Insecure: true,
+	})
+	qt.Assert(t, qt.IsNil(err))
+	_, err = r.PushBlobChunked(context.Background(), "foo", 0)
+	qt.Assert(t, qt.ErrorIs(err, ociregistry.ErrNameUnknown))
+	// The error code shows that the path was recognized,
+	// so the other form isn't tried.
+	qt.Assert(t, qt.Equals(posts, 1))
+}
+
+func TestUploadStartBareNotFound(t *testing.T) {
+	var posts int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		posts++
+		http.NotFound(w, req)
+	}))
+	defer srv.Close()
+	srvURL, _ := url.Parse(srv.URL)
+	r, err := New(srvURL.Host, &Options{
+		Insecure: true,
+	})
+	qt.Assert(t, qt.IsNil(err))
+	_, err = r.PushBlobChunked(context.Background(), "foo", 0)
+	qt.Assert(t, qt.ErrorMatches(err, `404 Not Found: .*`))
+	qt.Assert(t, qt.Equals(posts, 2))
+}
@@ -17,6 +17,7 @@ package ociclient
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -61,9 +62,31 @@ func (c *client) PushManifest(ctx context.Context, repo string, tag string, cont
 		return ociregistry.Descriptor{}, err
 	}
 	resp.Body.Close()
+	if err := checkPushedManifestDigest(resp, contents); err != nil {
+		return ociregistry.Descriptor{}, err
+	}
+	if c.referrersCache != nil {
+		c.referrersCache.invalidateSubject(repo, contents)
+	}
 	return desc, nil
 }
 
+// checkPushedManifestDigest checks that the Docker-Content-Digest
+// header in the response to a manifest push, if present, matches the
+// digest of the contents that were sent, which catches registries that
+// have stored something other than what was pushed. A digest that uses
+// an unknown algorithm can't be checked and is ignored.
+func checkPushedManifestDigest(resp *http.Response, contents []byte) error {
+	d := digest.Digest(resp.Header.Get("Docker-Content-Digest"))
+	if d == "" || !d.Algorithm().Available() {
+		return nil
+	}
+	if want := d.Algorithm().FromBytes(contents); d != want {
+		return fmt.Errorf("Docker-Content-Digest header %s in manifest push response does not match pushed digest %s", d, want)
+	}
+	return nil
+}
+
 func (c *client) MountBlob(ctx context.Context, fromRepo, toRepo string, dig ociregistry.Digest) (ociregistry.Descriptor, error) {
 	rreq := &ocirequest.Request{
 		Kind:     ocirequest.ReqBlobMount,
@@ -95,16 +118,12 @@ func (c *client) PushBlob(ctx context.Context, repo string, desc ociregistry.Des
 		Kind: ocirequest.ReqBlobStartUpload,
 		Repo: repo,
 	}
-	req, err := newRequest(ctx, rreq, nil)
-	if err != nil {
-		return ociregistry.Descriptor{}, err
-	}
-	resp, err := c.do(req, http.StatusAccepted)
+	resp, err := c.startUpload(ctx, rreq)
 	if err != nil {
 		return ociregistry.Descriptor{}, err
 	}
 	resp.Body.Close()
-	location, err := locationFromResponse(resp)
+	location, err := c.locationFromResponse(resp)
 	if err != nil {
 		return ociregistry.Descriptor{}, err
 	}
@@ -112,14 +131,15 @@ func (c *client) PushBlob(ctx context.Context, repo string, desc ociregistry.Des
 	// We've got the upload location. Now PUT the content.
 
 	ctx = ociauth.ContextWithRequestInfo(ctx, ociauth.RequestInfo{
-		RequiredScope: scopeForRequest(rreq),
+		RequiredScope: rreq.RequiredScope(),
 	})
 	// Note: we can't use ocirequest.Request here because that's
 	// specific to the ociserver implementation in this case.
-	req, err = http.NewRequestWithContext(ctx, "PUT", "", r)
+	req, err := http.NewRequestWithContext(ctx, "PUT", "", r)
 	if err != nil {
 		return ociregistry.Descriptor{}, err
 	}
+	setGetBody(req, r)
 	req.URL = urlWithDigest(location, string(desc.Digest))
 	req.ContentLength = desc.Size
 	req.Header.Set("Content-Type", "application/octet-stream")
@@ -143,15 +163,15 @@ func (c *client) PushBlobChunked(ctx context.Context, repo string, chunkSize int
 	if chunkSize <= 0 {
 		chunkSize = defaultChunkSize
 	}
-	resp, err := c.doRequest(ctx, &ocirequest.Request{
+	resp, err := c.startUpload(ctx, &ocirequest.Request{
 		Kind: ocirequest.ReqBlobStartUpload,
 		Repo: repo,
-	}, http.StatusAccepted)
+	})
 	if err != nil {
 		return nil, err
 	}
 	resp.Body.Close()
-	location, err := locationFromResponse(resp)
+	location, err := c.locationFromResponse(resp)
 	if err != nil {
 		return nil, err
 	}
@@ -203,7 +223,7 @@ func (c *client) PushBlobChunkedResume(ctx context.Context, repo string, id stri
 		if err != nil {
 			return nil, fmt.Errorf("cannot recover chunk offset: %v", err)
 		}
-		location, err = locationFromResponse(resp)
+		location, err = c.locationFromResponse(resp)
 		if err != nil {
 			return nil, fmt.Errorf("cannot get location from response: %v", err)
 		}
@@ -270,11 +290,22 @@ type blobWriter struct {
 	// Each successfully flushed chunk increases this.
 	flushed  int64
 	location *url.URL
+
+	// canceled records that Cancel has been called.
+	canceled bool
+
+	// committed records that Commit has succeeded.
+	committed bool
 }
 
+var errUploadCanceled = errors.New("upload has been canceled")
+
 func (w *blobWriter) Write(buf []byte) (int, error) {
 	w.mu.Lock()
 	defer w.mu.Unlock()
+	if w.canceled {
+		return 0, errUploadCanceled
+	}
 
 	// We use > rather than >= here so that using a chunk size of 100
 	// and writing 100 bytes does not actually flush, which would result in a PATCH
@@ -316,6 +347,14 @@ func (w *blobWriter) flush(buf []byte, commitDigest ociregistry.Digest) error {
 	if err != nil {
 		return fmt.Errorf("cannot make PATCH request: %v", err)
 	}
+	if req.Body != nil {
+		// Allow the body to be sent again if the request is
+		// redirected (with a 307 or 308 status) or retried.
+		chunk := w.chunk
+		req.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(concatBody(chunk, buf)), nil
+		}
+	}
 	req.URL = reqURL
 	req.ContentLength = int64(len(w.chunk) + len(buf))
 	// TODO: per the spec, the content-range header here is unnecessary
@@ -326,7 +365,7 @@ func (w *blobWriter) flush(buf []byte, commitDigest ociregistry.Digest) error {
 		return err
 	}
 	resp.Body.Close()
-	location, err := locationFromResponse(resp)
+	location, err := w.client.locationFromResponse(resp)
 	if err != nil {
 		return fmt.Errorf("bad Location in response: %v", err)
 	}
@@ -337,6 +376,31 @@ func (w *blobWriter) flush(buf []byte, commitDigest ociregistry.Digest) error {
 	return nil
 }
 
+// setGetBody sets req.GetBody, if it's not already set, so that
+// the body r can be sent again when the request is redirected
+// (with a 307 or 308 status) or retried. That's only possible
+// when r implements [io.Seeker]; other readers can be read only
+// once, so such requests fail with the redirect response instead.
+func setGetBody(req *http.Request, r io.Reader) {
+	if req.GetBody != nil {
+		return
+	}
+	rs, ok := r.(io.ReadSeeker)
+	if !ok {
+		return
+	}
+	start, err := rs.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return
+	}
+	req.GetBody = func() (io.ReadCloser, error) {
+		if _, err := rs.Seek(start, io.SeekStart); err != nil {
+			return nil, err
+		}
+		return io.NopCloser(rs), nil
+	}
+}
+
 func concatBody(b1, b2 []byte) io.Reader {
 	if len(b1)+len(b2) == 0 {
 		return nil // note that net/http treats a nil request body differently
@@ -356,6 +420,9 @@ func concatBody(b1, b2 []byte) io.Reader {
 func (w *blobWriter) Close() error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
+	if w.canceled {
+		return nil
+	}
 	if w.closed {
 		return w.closeErr
 	}
@@ -387,9 +454,13 @@ func (w *blobWriter) Commit(digest ociregistry.Digest) (ociregistry.Descriptor,
 	}
 	w.mu.Lock()
 	defer w.mu.Unlock()
+	if w.canceled {
+		return ociregistry.Descriptor{}, errUploadCanceled
+	}
 	if err := w.flush(nil, digest); err != nil {
 		return ociregistry.Descriptor{}, fmt.Errorf("cannot flush data before commit: %w", err)
 	}
+	w.committed = true
 	return ociregistry.Descriptor{
 		MediaType: "application/octet-stream",
 		Size:      w.size,
@@ -397,7 +468,31 @@ func (w *blobWriter) Commit(digest ociregistry.Digest) (ociregistry.Descriptor,
 	}, nil
 }
 
+// Cancel cancels the upload by sending a DELETE request to the
+// upload location, as described in the distribution spec, so that
+// the registry can reclaim the resources associated with it. A 404
+// response is ignored, as there's then nothing to clean up. Any data
+// that hasn't been flushed is discarded, and the writer can't be
+// used afterwards. Cancel is a no-op after a successful Commit,
+// so it can be used in a defer statement.
 func (w *blobWriter) Cancel() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.canceled || w.committed {
+		return nil
+	}
+	w.canceled = true
+	w.chunk = nil
+	req, err := http.NewRequestWithContext(w.ctx, "DELETE", "", nil)
+	if err != nil {
+		return fmt.Errorf("cannot make DELETE request: %v", err)
+	}
+	req.URL = w.location
+	resp, err := w.client.do(req, http.StatusNoContent, http.StatusNotFound)
+	if err != nil {
+		return fmt.Errorf("cannot cancel upload: %w", err)
+	}
+	resp.Body.Close()
 	return nil
 }
 
@@ -431,3 +526,52 @@ func chunkSizeFromResponse(resp *http.Response, chunkSize int) int {
 	}
 	return chunkSize
 }
+
+// startUpload starts a blob upload as specified by rreq, which must be
+// a ReqBlobStartUpload request, and returns the 202 (Accepted) response.
+//
+// The request is sent to /v2/<name>/blobs/uploads/ with a trailing
+// slash, as in the spec. Some registries only accept the form without
+// the slash, so if that gets a 404 (Not Found) response without an
+// OCI error code, the request is tried again with the other form.
+// The form that worked is remembered and tried first for later
+// uploads.
+func (c *client) startUpload(ctx context.Context, rreq *ocirequest.Request) (*http.Response, error) {
+	noSlash := c.uploadNoSlash.Load()
+	resp, err := c.startUpload1(ctx, rreq, noSlash)
+	if err == nil || !isBareNotFound(err) {
+		return resp, err
+	}
+	resp, err1 := c.startUpload1(ctx, rreq, !noSlash)
+	if err1 != nil {
+		// Return the original error, which is more likely
+		// to be meaningful.
+		return nil, err
+	}
+	c.uploadNoSlash.Store(!noSlash)
+	return resp, nil
+}
+
+// isBareNotFound reports whether err is a 404 response without
+// an OCI error code, suggesting that the server doesn't recognize
+// the path at all, rather than that something like the repository
+// doesn't exist.
+func isBareNotFound(err error) bool {
+	var herr ociregistry.HTTPError
+	if !errors.As(err, &herr) || herr.StatusCode() != http.StatusNotFound {
+		return false
+	}
+	var oerr ociregistry.Error
+	return !errors.As(err, &oerr) || oerr.Code() == ""
+}
+
+func (c *client) startUpload1(ctx context.Context, rreq *ocirequest.Request, noSlash bool) (*http.Response, error) {
+	req, err := newRequest(ctx, rreq, nil)
+	if err != nil {
+		return nil, err
+	}
+	if noSlash {
+		req.URL.Path = strings.TrimSuffix(req.URL.Path, "/")
+	}
+	return c.do(req, http.StatusAccepted)
+}
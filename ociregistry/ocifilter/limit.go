@@ -0,0 +1,128 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocifilter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+
+	"cuelabs.dev/go/oci/ociregistry"
+)
+
+// ImageLimits holds the limits enforced by [LimitImage].
+// A zero value for any field means that there's no limit.
+type ImageLimits struct {
+	// MaxLayers holds the maximum number of layers in an image.
+	MaxLayers int
+
+	// MaxSize holds the maximum total size in bytes
+	// of all the layers in an image.
+	MaxSize int64
+}
+
+// LimitImage returns a registry that wraps r and rejects pushes of
+// image manifests that have more layers than limits.MaxLayers or
+// whose layers add up to more than limits.MaxSize bytes.
+// Such pushes fail with a MANIFEST_INVALID error.
+//
+// Layer sizes are taken from the manifest's layer descriptors; when
+// a descriptor doesn't record a size, the size of the blob in r is
+// used instead. Other kinds of manifest, such as indexes, are passed
+// through unchanged.
+func LimitImage(r ociregistry.Interface, limits ImageLimits) ociregistry.Interface {
+	return &limitImage{
+		Interface: r,
+		limits:    limits,
+	}
+}
+
+type limitImage struct {
+	ociregistry.Interface
+	limits ImageLimits
+}
+
+func (r *limitImage) PushManifest(ctx context.Context, repo string, tag string, contents []byte, mediaType string) (ociregistry.Descriptor, error) {
+	if err := r.checkLimits(ctx, repo, contents); err != nil {
+		return ociregistry.Descriptor{}, err
+	}
+	return r.Interface.PushManifest(ctx, repo, tag, contents, mediaType)
+}
+
+func (r *limitImage) checkLimits(ctx context.Context, repo string, contents []byte) error {
+	var m struct {
+		Layers []ociregistry.Descriptor `json:"layers"`
+	}
+	if err := json.Unmarshal(contents, &m); err != nil {
+		// Leave it to the underlying registry to reject
+		// invalid manifests.
+		return nil
+	}
+	if r.limits.MaxLayers > 0 && len(m.Layers) > r.limits.MaxLayers {
+		return limitError(fmt.Sprintf("image has %d layers, more than the maximum of %d", len(m.Layers), r.limits.MaxLayers), limitDetail{
+			Layers:    len(m.Layers),
+			MaxLayers: r.limits.MaxLayers,
+		})
+	}
+	if r.limits.MaxSize <= 0 {
+		return nil
+	}
+	var size int64
+	for _, desc := range m.Layers {
+		if desc.Size == 0 {
+			// The size wasn't recorded in the manifest.
+			bdesc, err := r.Interface.ResolveBlob(ctx, repo, desc.Digest)
+			if err != nil {
+				return fmt.Errorf("cannot determine size of layer %v: %w", desc.Digest, err)
+			}
+			desc.Size = bdesc.Size
+		}
+		if desc.Size < 0 {
+			return ociregistry.NewError(fmt.Sprintf("layer %v has invalid size %d", desc.Digest, desc.Size), ociregistry.ErrManifestInvalid.Code(), nil)
+		}
+		// Saturate rather than overflow, so that huge sizes
+		// can't wrap around to within the limit.
+		if desc.Size > math.MaxInt64-size {
+			size = math.MaxInt64
+		} else {
+			size += desc.Size
+		}
+	}
+	if size > r.limits.MaxSize {
+		return limitError(fmt.Sprintf("image layers total %d bytes, more than the maximum of %d", size, r.limits.MaxSize), limitDetail{
+			Size:    size,
+			MaxSize: r.limits.MaxSize,
+		})
+	}
+	return nil
+}
+
+// limitDetail holds the detail of an error returned
+// when an image exceeds its limits.
+type limitDetail struct {
+	Layers    int   `json:"layers,omitempty"`
+	MaxLayers int   `json:"maxLayers,omitempty"`
+	Size      int64 `json:"size,omitempty"`
+	MaxSize   int64 `json:"maxSize,omitempty"`
+}
+
+func limitError(msg string, detail limitDetail) error {
+	data, err := json.Marshal(detail)
+	if err != nil {
+		panic(err)
+	}
+	return ociregistry.NewError(msg, ociregistry.ErrManifestInvalid.Code(), data)
+}
@@ -0,0 +1,113 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocifilter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/go-quicktest/qt"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ocimem"
+	"cuelabs.dev/go/oci/ociregistry/ocitest"
+)
+
+func TestLimitImage(t *testing.T) {
+	ctx := context.Background()
+	base := ocitest.NewRegistry(t, ocimem.New())
+	content := base.MustPushContent(ocitest.RegistryContent{
+		"foo": {
+			Blobs: map[string]string{
+				"b1":      "hello",
+				"b2":      "other",
+				"b3":      "more content",
+				"scratch": "{}",
+			},
+		},
+	})["foo"]
+	r := LimitImage(base.R, ImageLimits{
+		MaxLayers: 2,
+		MaxSize:   12,
+	})
+
+	manifest := func(layers ...string) []byte {
+		m := ociregistry.Manifest{
+			MediaType: ocispec.MediaTypeImageManifest,
+			Config:    content.Blobs["scratch"],
+		}
+		m.SchemaVersion = 2
+		for _, layer := range layers {
+			m.Layers = append(m.Layers, content.Blobs[layer])
+		}
+		data, err := json.Marshal(m)
+		qt.Assert(t, qt.IsNil(err))
+		return data
+	}
+	push := func(data []byte) error {
+		_, err := r.PushManifest(ctx, "foo", "", data, ocispec.MediaTypeImageManifest)
+		return err
+	}
+
+	// Within the limits.
+	err := push(manifest("b1", "b2"))
+	qt.Assert(t, qt.IsNil(err))
+
+	// Too many layers.
+	data := manifest("b1", "b2", "b1")
+	err = push(data)
+	qt.Assert(t, qt.ErrorIs(err, ociregistry.ErrManifestInvalid))
+	qt.Assert(t, qt.ErrorMatches(err, `manifest invalid: image has 3 layers, more than the maximum of 2`))
+	var ociErr ociregistry.Error
+	qt.Assert(t, qt.IsTrue(errors.As(err, &ociErr)))
+	qt.Assert(t, qt.JSONEquals([]byte(ociErr.Detail()), map[string]any{
+		"layers":    3,
+		"maxLayers": 2,
+	}))
+	_, err = base.R.ResolveManifest(ctx, "foo", digest.FromBytes(data))
+	qt.Assert(t, qt.ErrorIs(err, ociregistry.ErrManifestUnknown))
+
+	// Too large.
+	err = push(manifest("b1", "b3"))
+	qt.Assert(t, qt.ErrorIs(err, ociregistry.ErrManifestInvalid))
+	qt.Assert(t, qt.ErrorMatches(err, `manifest invalid: image layers total 17 bytes, more than the maximum of 12`))
+	qt.Assert(t, qt.IsTrue(errors.As(err, &ociErr)))
+	qt.Assert(t, qt.JSONEquals([]byte(ociErr.Detail()), map[string]any{
+		"size":    17,
+		"maxSize": 12,
+	}))
+
+	// The sizes of layers without a recorded size
+	// are found from the underlying registry.
+	data = []byte(`{"schemaVersion":2,"layers":[{"digest":"` + string(content.Blobs["b3"].Digest) + `"},{"digest":"` + string(content.Blobs["b2"].Digest) + `"}]}`)
+	err = push(data)
+	qt.Assert(t, qt.ErrorMatches(err, `manifest invalid: image layers total 17 bytes, more than the maximum of 12`))
+
+	// Negative sizes are rejected.
+	data = []byte(`{"schemaVersion":2,"layers":[{"digest":"` + string(content.Blobs["b1"].Digest) + `","size":-100}]}`)
+	err = push(data)
+	qt.Assert(t, qt.ErrorIs(err, ociregistry.ErrManifestInvalid))
+	qt.Assert(t, qt.ErrorMatches(err, `manifest invalid: layer sha256:[0-9a-f]+ has invalid size -100`))
+
+	// Sizes that would overflow when added are still
+	// reported as too large.
+	data = []byte(`{"schemaVersion":2,"layers":[{"digest":"` + string(content.Blobs["b1"].Digest) + `","size":5},{"digest":"` + string(content.Blobs["b2"].Digest) + `","size":9223372036854775807}]}`)
+	err = push(data)
+	qt.Assert(t, qt.ErrorMatches(err, `manifest invalid: image layers total 9223372036854775807 bytes, more than the maximum of 12`))
+}
@@ -0,0 +1,399 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocifilter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"cuelabs.dev/go/oci/ociregistry"
+)
+
+// ReadThroughOptions holds options for [ReadThrough].
+type ReadThroughOptions struct {
+	// WriteUpstream causes pushes and deletes to be applied
+	// to the upstream registry as well as to the primary
+	// registry. By default they're applied to the primary
+	// registry only.
+	WriteUpstream bool
+}
+
+// ReadThrough returns a registry that acts as a read-through cache
+// in front of upstream, using primary as the cache.
+//
+// Reads are first directed to primary. If the content isn't found
+// there, it's fetched from upstream, stored in primary and then
+// returned from primary. When a manifest is cached, any blobs
+// and manifests it refers to are cached too, so that primary
+// remains consistent.
+//
+// Resolve requests that miss in primary are answered by upstream
+// without caching anything. List requests are answered by primary
+// unless it reports that the repository doesn't exist, in which
+// case they're answered by upstream.
+//
+// Note that tags are cached like any other content: once a tag
+// is present in primary, later changes to it in upstream
+// will not be seen.
+//
+// A nil opts parameter is equivalent to a pointer to zero
+// ReadThroughOptions.
+func ReadThrough(primary, upstream ociregistry.Interface, opts *ReadThroughOptions) ociregistry.Interface {
+	if opts == nil {
+		opts = new(ReadThroughOptions)
+	}
+	return &readThrough{
+		primary:  primary,
+		upstream: upstream,
+		opts:     *opts,
+	}
+}
+
+type readThrough struct {
+	*ociregistry.Funcs
+	primary  ociregistry.Interface
+	upstream ociregistry.Interface
+	opts     ReadThroughOptions
+}
+
+func (r *readThrough) GetBlob(ctx context.Context, repo string, digest ociregistry.Digest) (ociregistry.BlobReader, error) {
+	rd, err := r.primary.GetBlob(ctx, repo, digest)
+	if !isMiss(err) {
+		return rd, err
+	}
+	if err := r.cacheBlob(ctx, repo, digest); err != nil {
+		return nil, err
+	}
+	return r.primary.GetBlob(ctx, repo, digest)
+}
+
+func (r *readThrough) GetBlobRange(ctx context.Context, repo string, digest ociregistry.Digest, offset0, offset1 int64) (ociregistry.BlobReader, error) {
+	rd, err := r.primary.GetBlobRange(ctx, repo, digest, offset0, offset1)
+	if !isMiss(err) {
+		return rd, err
+	}
+	if err := r.cacheBlob(ctx, repo, digest); err != nil {
+		return nil, err
+	}
+	return r.primary.GetBlobRange(ctx, repo, digest, offset0, offset1)
+}
+
+func (r *readThrough) GetManifest(ctx context.Context, repo string, digest ociregistry.Digest) (ociregistry.BlobReader, error) {
+	rd, err := r.primary.GetManifest(ctx, repo, digest)
+	if !isMiss(err) {
+		return rd, err
+	}
+	rd, err = r.upstream.GetManifest(ctx, repo, digest)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.cacheManifest(ctx, repo, "", rd); err != nil {
+		return nil, err
+	}
+	return r.primary.GetManifest(ctx, repo, digest)
+}
+
+func (r *readThrough) GetTag(ctx context.Context, repo string, tagName string) (ociregistry.BlobReader, error) {
+	rd, err := r.primary.GetTag(ctx, repo, tagName)
+	if !isMiss(err) {
+		return rd, err
+	}
+	rd, err = r.upstream.GetTag(ctx, repo, tagName)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.cacheManifest(ctx, repo, tagName, rd); err != nil {
+		return nil, err
+	}
+	return r.primary.GetTag(ctx, repo, tagName)
+}
+
+func (r *readThrough) ResolveBlob(ctx context.Context, repo string, digest ociregistry.Digest) (ociregistry.Descriptor, error) {
+	desc, err := r.primary.ResolveBlob(ctx, repo, digest)
+	if !isMiss(err) {
+		return desc, err
+	}
+	return r.upstream.ResolveBlob(ctx, repo, digest)
+}
+
+func (r *readThrough) ResolveManifest(ctx context.Context, repo string, digest ociregistry.Digest) (ociregistry.Descriptor, error) {
+	desc, err := r.primary.ResolveManifest(ctx, repo, digest)
+	if !isMiss(err) {
+		return desc, err
+	}
+	return r.upstream.ResolveManifest(ctx, repo, digest)
+}
+
+func (r *readThrough) ResolveTag(ctx context.Context, repo string, tagName string) (ociregistry.Descriptor, error) {
+	desc, err := r.primary.ResolveTag(ctx, repo, tagName)
+	if !isMiss(err) {
+		return desc, err
+	}
+	return r.upstream.ResolveTag(ctx, repo, tagName)
+}
+
+func (r *readThrough) PushBlob(ctx context.Context, repo string, desc ociregistry.Descriptor, rd io.Reader) (ociregistry.Descriptor, error) {
+	desc, err := r.primary.PushBlob(ctx, repo, desc, rd)
+	if err != nil || !r.opts.WriteUpstream {
+		return desc, err
+	}
+	if err := r.pushBlobUpstream(ctx, repo, desc); err != nil {
+		return ociregistry.Descriptor{}, err
+	}
+	return desc, nil
+}
+
+func (r *readThrough) PushBlobChunked(ctx context.Context, repo string, chunkSize int) (ociregistry.BlobWriter, error) {
+	w, err := r.primary.PushBlobChunked(ctx, repo, chunkSize)
+	if err != nil || !r.opts.WriteUpstream {
+		return w, err
+	}
+	return &readThroughBlobWriter{
+		BlobWriter: w,
+		ctx:        ctx,
+		r:          r,
+		repo:       repo,
+	}, nil
+}
+
+func (r *readThrough) PushBlobChunkedResume(ctx context.Context, repo, id string, offset int64, chunkSize int) (ociregistry.BlobWriter, error) {
+	w, err := r.primary.PushBlobChunkedResume(ctx, repo, id, offset, chunkSize)
+	if err != nil || !r.opts.WriteUpstream {
+		return w, err
+	}
+	return &readThroughBlobWriter{
+		BlobWriter: w,
+		ctx:        ctx,
+		r:          r,
+		repo:       repo,
+	}, nil
+}
+
+func (r *readThrough) MountBlob(ctx context.Context, fromRepo, toRepo string, digest ociregistry.Digest) (ociregistry.Descriptor, error) {
+	desc, err := r.primary.MountBlob(ctx, fromRepo, toRepo, digest)
+	if err != nil || !r.opts.WriteUpstream {
+		return desc, err
+	}
+	if _, err := r.upstream.MountBlob(ctx, fromRepo, toRepo, digest); err != nil {
+		return ociregistry.Descriptor{}, err
+	}
+	return desc, nil
+}
+
+func (r *readThrough) PushManifest(ctx context.Context, repo string, tag string, contents []byte, mediaType string) (ociregistry.Descriptor, error) {
+	desc, err := r.primary.PushManifest(ctx, repo, tag, contents, mediaType)
+	if err != nil || !r.opts.WriteUpstream {
+		return desc, err
+	}
+	if _, err := r.upstream.PushManifest(ctx, repo, tag, contents, mediaType); err != nil {
+		return ociregistry.Descriptor{}, err
+	}
+	return desc, nil
+}
+
+func (r *readThrough) DeleteBlob(ctx context.Context, repo string, digest ociregistry.Digest) error {
+	return r.delete(func(reg ociregistry.Interface) error {
+		return reg.DeleteBlob(ctx, repo, digest)
+	})
+}
+
+func (r *readThrough) DeleteManifest(ctx context.Context, repo string, digest ociregistry.Digest) error {
+	return r.delete(func(reg ociregistry.Interface) error {
+		return reg.DeleteManifest(ctx, repo, digest)
+	})
+}
+
+func (r *readThrough) DeleteTag(ctx context.Context, repo string, name string) error {
+	return r.delete(func(reg ociregistry.Interface) error {
+		return reg.DeleteTag(ctx, repo, name)
+	})
+}
+
+// delete calls del on the primary registry and, if configured,
+// the upstream registry. Content that's missing from the primary
+// registry is not considered an error when it will also be deleted
+// from upstream.
+func (r *readThrough) delete(del func(reg ociregistry.Interface) error) error {
+	err := del(r.primary)
+	if !r.opts.WriteUpstream || (err != nil && !isMiss(err)) {
+		return err
+	}
+	return del(r.upstream)
+}
+
+func (r *readThrough) Repositories(ctx context.Context, startAfter string) ociregistry.Seq[string] {
+	return seqWithFallback(r.primary.Repositories(ctx, startAfter), func() ociregistry.Seq[string] {
+		return r.upstream.Repositories(ctx, startAfter)
+	})
+}
+
+func (r *readThrough) Tags(ctx context.Context, repo string, startAfter string) ociregistry.Seq[string] {
+	return seqWithFallback(r.primary.Tags(ctx, repo, startAfter), func() ociregistry.Seq[string] {
+		return r.upstream.Tags(ctx, repo, startAfter)
+	})
+}
+
+func (r *readThrough) Referrers(ctx context.Context, repo string, digest ociregistry.Digest, artifactType string) ociregistry.Seq[ociregistry.Descriptor] {
+	return seqWithFallback(r.primary.Referrers(ctx, repo, digest, artifactType), func() ociregistry.Seq[ociregistry.Descriptor] {
+		return r.upstream.Referrers(ctx, repo, digest, artifactType)
+	})
+}
+
+// seqWithFallback returns an iterator that produces the items from
+// primary unless primary immediately fails because the repository
+// isn't known, in which case it produces the items from fallback.
+func seqWithFallback[T any](primary ociregistry.Seq[T], fallback func() ociregistry.Seq[T]) ociregistry.Seq[T] {
+	return func(yield func(T, error) bool) {
+		started := false
+		useFallback := false
+		primary(func(x T, err error) bool {
+			if !started && errors.Is(err, ociregistry.ErrNameUnknown) {
+				useFallback = true
+				return false
+			}
+			started = true
+			return yield(x, err)
+		})
+		if useFallback {
+			fallback()(yield)
+		}
+	}
+}
+
+// cacheBlob copies the blob with the given digest from
+// the upstream registry to the primary registry.
+func (r *readThrough) cacheBlob(ctx context.Context, repo string, digest ociregistry.Digest) error {
+	rd, err := r.upstream.GetBlob(ctx, repo, digest)
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+	if _, err := r.primary.PushBlob(ctx, repo, rd.Descriptor(), rd); err != nil {
+		return fmt.Errorf("cannot cache blob %s: %w", digest, err)
+	}
+	return nil
+}
+
+// cacheManifest stores the manifest read from rd in the primary
+// registry, tagging it with the given tag if that's non-empty.
+// Any content referred to by the manifest that's not already present
+// in the primary registry is copied from the upstream registry first.
+// It closes rd.
+func (r *readThrough) cacheManifest(ctx context.Context, repo string, tag string, rd ociregistry.BlobReader) error {
+	defer rd.Close()
+	desc := rd.Descriptor()
+	data, err := io.ReadAll(rd)
+	if err != nil {
+		return err
+	}
+	if err := r.cacheManifestReferences(ctx, repo, data); err != nil {
+		return err
+	}
+	if _, err := r.primary.PushManifest(ctx, repo, tag, data, desc.MediaType); err != nil {
+		return fmt.Errorf("cannot cache manifest %s: %w", desc.Digest, err)
+	}
+	return nil
+}
+
+// manifestReferences holds the fields from the various
+// manifest and index formats that refer to other content.
+type manifestReferences struct {
+	Config    *ociregistry.Descriptor  `json:"config"`
+	Layers    []ociregistry.Descriptor `json:"layers"`
+	Blobs     []ociregistry.Descriptor `json:"blobs"`
+	Manifests []ociregistry.Descriptor `json:"manifests"`
+}
+
+func (r *readThrough) cacheManifestReferences(ctx context.Context, repo string, data []byte) error {
+	var refs manifestReferences
+	if err := json.Unmarshal(data, &refs); err != nil {
+		// It's not a manifest format that we know about, so
+		// we can't know what it refers to.
+		return nil
+	}
+	blobs := append(refs.Layers, refs.Blobs...)
+	if refs.Config != nil {
+		blobs = append(blobs, *refs.Config)
+	}
+	for _, desc := range blobs {
+		if desc.Digest == "" {
+			continue
+		}
+		_, err := r.primary.ResolveBlob(ctx, repo, desc.Digest)
+		if !isMiss(err) {
+			continue
+		}
+		if err := r.cacheBlob(ctx, repo, desc.Digest); err != nil {
+			return err
+		}
+	}
+	for _, desc := range refs.Manifests {
+		_, err := r.primary.ResolveManifest(ctx, repo, desc.Digest)
+		if !isMiss(err) {
+			continue
+		}
+		rd, err := r.upstream.GetManifest(ctx, repo, desc.Digest)
+		if err != nil {
+			return err
+		}
+		if err := r.cacheManifest(ctx, repo, "", rd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *readThrough) pushBlobUpstream(ctx context.Context, repo string, desc ociregistry.Descriptor) error {
+	rd, err := r.primary.GetBlob(ctx, repo, desc.Digest)
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+	if _, err := r.upstream.PushBlob(ctx, repo, desc, rd); err != nil {
+		return fmt.Errorf("cannot push blob upstream: %w", err)
+	}
+	return nil
+}
+
+// readThroughBlobWriter copies the blob to the upstream registry
+// when it's committed to the primary registry.
+type readThroughBlobWriter struct {
+	ociregistry.BlobWriter
+	ctx  context.Context
+	r    *readThrough
+	repo string
+}
+
+func (w *readThroughBlobWriter) Commit(digest ociregistry.Digest) (ociregistry.Descriptor, error) {
+	desc, err := w.BlobWriter.Commit(digest)
+	if err != nil {
+		return desc, err
+	}
+	if err := w.r.pushBlobUpstream(w.ctx, w.repo, desc); err != nil {
+		return ociregistry.Descriptor{}, err
+	}
+	return desc, nil
+}
+
+// isMiss reports whether err indicates that content
+// was not found.
+func isMiss(err error) bool {
+	return errors.Is(err, ociregistry.ErrBlobUnknown) ||
+		errors.Is(err, ociregistry.ErrManifestUnknown) ||
+		errors.Is(err, ociregistry.ErrNameUnknown)
+}
@@ -0,0 +1,166 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocifilter
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/go-quicktest/qt"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ocimem"
+	"cuelabs.dev/go/oci/ociregistry/ocitest"
+)
+
+func TestReadThrough(t *testing.T) {
+	ctx := context.Background()
+	upstream := ocitest.NewRegistry(t, ocimem.New())
+	content := upstream.MustPushContent(ocitest.RegistryContent{
+		"foo/bar": {
+			Blobs: map[string]string{
+				"b1":      "hello",
+				"b2":      "other",
+				"scratch": "{}",
+			},
+			Manifests: map[string]ociregistry.Manifest{
+				"m1": {
+					MediaType: ocispec.MediaTypeImageManifest,
+					Config: ociregistry.Descriptor{
+						Digest: "scratch",
+					},
+					Layers: []ociregistry.Descriptor{{
+						Digest: "b1",
+					}},
+				},
+			},
+			Tags: map[string]string{
+				"t1": "m1",
+			},
+		},
+	})["foo/bar"]
+	counter := &readCounter{Interface: upstream.R}
+	primary := ocimem.New()
+	r := ReadThrough(primary, counter, nil)
+
+	// A tag read misses in primary, so it's fetched from upstream
+	// along with everything the manifest refers to.
+	rd, err := r.GetTag(ctx, "foo/bar", "t1")
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, ocitest.HasContent(rd, content.ManifestData["m1"], ocispec.MediaTypeImageManifest))
+	rd.Close()
+	qt.Assert(t, qt.Equals(counter.n, 3))
+
+	// The content is now present in primary.
+	_, err = primary.ResolveTag(ctx, "foo/bar", "t1")
+	qt.Assert(t, qt.IsNil(err))
+	_, err = primary.ResolveBlob(ctx, "foo/bar", content.Blobs["b1"].Digest)
+	qt.Assert(t, qt.IsNil(err))
+
+	// Subsequent reads are served without touching upstream.
+	rd, err = r.GetTag(ctx, "foo/bar", "t1")
+	qt.Assert(t, qt.IsNil(err))
+	rd.Close()
+	rd, err = r.GetManifest(ctx, "foo/bar", content.Manifests["m1"].Digest)
+	qt.Assert(t, qt.IsNil(err))
+	rd.Close()
+	rd, err = r.GetBlob(ctx, "foo/bar", content.Blobs["b1"].Digest)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, ocitest.HasContent(rd, []byte("hello"), "application/binary"))
+	rd.Close()
+	qt.Assert(t, qt.Equals(counter.n, 3))
+
+	// A blob that's not referred to by any manifest is
+	// fetched on demand, once only.
+	rd, err = r.GetBlobRange(ctx, "foo/bar", content.Blobs["b2"].Digest, 1, 3)
+	qt.Assert(t, qt.IsNil(err))
+	data, err := io.ReadAll(rd)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.Equals(string(data), "th"))
+	rd.Close()
+	qt.Assert(t, qt.Equals(counter.n, 4))
+	rd, err = r.GetBlob(ctx, "foo/bar", content.Blobs["b2"].Digest)
+	qt.Assert(t, qt.IsNil(err))
+	rd.Close()
+	qt.Assert(t, qt.Equals(counter.n, 4))
+
+	// Content missing from both is reported as such.
+	_, err = r.GetTag(ctx, "foo/bar", "nope")
+	qt.Assert(t, qt.ErrorIs(err, ociregistry.ErrManifestUnknown))
+}
+
+func TestReadThroughWrites(t *testing.T) {
+	ctx := context.Background()
+	upstream := ocimem.New()
+	primary := ocimem.New()
+
+	r := ReadThrough(primary, upstream, nil)
+	ocitest.NewRegistry(t, r).MustPushBlob("foo", []byte("hello"))
+	_, err := upstream.ResolveBlob(ctx, "foo", "sha256:2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824")
+	qt.Assert(t, qt.ErrorIs(err, ociregistry.ErrNameUnknown))
+
+	r = ReadThrough(primary, upstream, &ReadThroughOptions{
+		WriteUpstream: true,
+	})
+	desc := ocitest.NewRegistry(t, r).MustPushBlob("foo", []byte("hello"))
+	_, err = upstream.ResolveBlob(ctx, "foo", desc.Digest)
+	qt.Assert(t, qt.IsNil(err))
+	_, err = primary.ResolveBlob(ctx, "foo", desc.Digest)
+	qt.Assert(t, qt.IsNil(err))
+}
+
+func TestReadThroughCacheErrorIsWrapped(t *testing.T) {
+	ctx := context.Background()
+	upstream := ocimem.New()
+	desc := ocitest.NewRegistry(t, upstream).MustPushBlob("foo", []byte("hello"))
+
+	// The primary registry doesn't hold the blob
+	// and refuses to store it.
+	primary := &ociregistry.Funcs{
+		GetBlob_: func(ctx context.Context, repo string, digest ociregistry.Digest) (ociregistry.BlobReader, error) {
+			return nil, ociregistry.ErrBlobUnknown
+		},
+		PushBlob_: func(ctx context.Context, repo string, desc ociregistry.Descriptor, r io.Reader) (ociregistry.Descriptor, error) {
+			return ociregistry.Descriptor{}, ociregistry.ErrDenied
+		},
+	}
+	r := ReadThrough(primary, upstream, nil)
+	_, err := r.GetBlob(ctx, "foo", desc.Digest)
+	qt.Assert(t, qt.ErrorMatches(err, `cannot cache blob .*: denied: .*`))
+	qt.Assert(t, qt.ErrorIs(err, ociregistry.ErrDenied))
+}
+
+// readCounter counts the number of content reads made.
+type readCounter struct {
+	ociregistry.Interface
+	n int
+}
+
+func (r *readCounter) GetBlob(ctx context.Context, repo string, digest ociregistry.Digest) (ociregistry.BlobReader, error) {
+	r.n++
+	return r.Interface.GetBlob(ctx, repo, digest)
+}
+
+func (r *readCounter) GetManifest(ctx context.Context, repo string, digest ociregistry.Digest) (ociregistry.BlobReader, error) {
+	r.n++
+	return r.Interface.GetManifest(ctx, repo, digest)
+}
+
+func (r *readCounter) GetTag(ctx context.Context, repo string, tagName string) (ociregistry.BlobReader, error) {
+	r.n++
+	return r.Interface.GetTag(ctx, repo, tagName)
+}
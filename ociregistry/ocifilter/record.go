@@ -0,0 +1,358 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocifilter
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"cuelabs.dev/go/oci/ociregistry"
+)
+
+// Record returns a registry that wraps r and records the operations
+// made on it in the returned [Recorder]. It's intended for tests that
+// need to check the exact sequence of operations performed by some code.
+func Record(r ociregistry.Interface) (ociregistry.Interface, *Recorder) {
+	rec := &Recorder{}
+	return &recordRegistry{
+		r:   r,
+		rec: rec,
+	}, rec
+}
+
+// Recorder holds the operations recorded by a registry
+// returned from [Record]. It's OK to use it concurrently.
+type Recorder struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+// Event describes an operation recorded by a [Recorder].
+//
+// Operations that involve streaming content or iterating over
+// results are recorded twice: once when they start and again,
+// with Done set, when they complete. The completion of a read is
+// recorded when the returned reader is closed, the completion of
+// a chunked upload when it's committed or cancelled, and the
+// completion of an iteration when it finishes.
+type Event struct {
+	// Op holds the name of the [ociregistry.Interface]
+	// method that was called.
+	Op string
+
+	// Done reports whether the event records the completion
+	// of the operation rather than its start.
+	Done bool
+
+	Repo string
+
+	// FromRepo holds the source repository for MountBlob.
+	FromRepo string
+
+	Digest ociregistry.Digest
+	Tag    string
+
+	// Offset holds the start offset for GetBlobRange
+	// and PushBlobChunkedResume.
+	Offset int64
+
+	// Size holds the size of the content involved in the operation,
+	// if known. For GetBlobRange, it's the size of the requested range,
+	// or -1 for the rest of the blob. When a read completes, it's the
+	// number of bytes read; when an iteration completes, it's the number
+	// of items produced.
+	Size int64
+
+	// Err holds the text of the error returned by the operation,
+	// if any. A cancelled chunked upload is recorded as completing
+	// with the error "canceled".
+	Err string
+}
+
+// String returns the event in a form suitable
+// for comparison against golden files.
+func (e Event) String() string {
+	var buf strings.Builder
+	buf.WriteString(e.Op)
+	if e.Done {
+		buf.WriteString(" done")
+	}
+	if e.Repo != "" {
+		fmt.Fprintf(&buf, " repo=%s", e.Repo)
+	}
+	if e.FromRepo != "" {
+		fmt.Fprintf(&buf, " from=%s", e.FromRepo)
+	}
+	if e.Digest != "" {
+		fmt.Fprintf(&buf, " digest=%s", e.Digest)
+	}
+	if e.Tag != "" {
+		fmt.Fprintf(&buf, " tag=%s", e.Tag)
+	}
+	if e.Offset != 0 {
+		fmt.Fprintf(&buf, " offset=%d", e.Offset)
+	}
+	if e.Size != 0 {
+		fmt.Fprintf(&buf, " size=%d", e.Size)
+	}
+	if e.Err != "" {
+		fmt.Fprintf(&buf, " error=%q", e.Err)
+	}
+	return buf.String()
+}
+
+// Events returns a copy of the events recorded so far, in order.
+func (rec *Recorder) Events() []Event {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return append([]Event(nil), rec.events...)
+}
+
+// String returns all the events recorded so far,
+// one per line, as formatted by [Event.String].
+func (rec *Recorder) String() string {
+	var buf strings.Builder
+	for _, e := range rec.Events() {
+		buf.WriteString(e.String())
+		buf.WriteByte('\n')
+	}
+	return buf.String()
+}
+
+// Reset discards all the events recorded so far.
+func (rec *Recorder) Reset() {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.events = nil
+}
+
+func (rec *Recorder) add(e Event) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.events = append(rec.events, e)
+}
+
+// addResult adds e with any error from err and returns err.
+func (rec *Recorder) addResult(e Event, err error) error {
+	if err != nil {
+		e.Err = err.Error()
+	}
+	rec.add(e)
+	return err
+}
+
+type recordRegistry struct {
+	*ociregistry.Funcs
+	r   ociregistry.Interface
+	rec *Recorder
+}
+
+func (r *recordRegistry) GetBlob(ctx context.Context, repo string, digest ociregistry.Digest) (ociregistry.BlobReader, error) {
+	e := Event{Op: "GetBlob", Repo: repo, Digest: digest}
+	rd, err := r.r.GetBlob(ctx, repo, digest)
+	return r.reader(e, rd, err)
+}
+
+func (r *recordRegistry) GetBlobRange(ctx context.Context, repo string, digest ociregistry.Digest, offset0, offset1 int64) (ociregistry.BlobReader, error) {
+	size := int64(-1)
+	if offset1 >= 0 {
+		size = offset1 - offset0
+	}
+	e := Event{Op: "GetBlobRange", Repo: repo, Digest: digest, Offset: offset0, Size: size}
+	rd, err := r.r.GetBlobRange(ctx, repo, digest, offset0, offset1)
+	return r.reader(e, rd, err)
+}
+
+func (r *recordRegistry) GetManifest(ctx context.Context, repo string, digest ociregistry.Digest) (ociregistry.BlobReader, error) {
+	e := Event{Op: "GetManifest", Repo: repo, Digest: digest}
+	rd, err := r.r.GetManifest(ctx, repo, digest)
+	return r.reader(e, rd, err)
+}
+
+func (r *recordRegistry) GetTag(ctx context.Context, repo string, tagName string) (ociregistry.BlobReader, error) {
+	e := Event{Op: "GetTag", Repo: repo, Tag: tagName}
+	rd, err := r.r.GetTag(ctx, repo, tagName)
+	return r.reader(e, rd, err)
+}
+
+// reader records the start of the read operation described by e
+// and returns a reader that records its completion when closed.
+func (r *recordRegistry) reader(e Event, rd ociregistry.BlobReader, err error) (ociregistry.BlobReader, error) {
+	if err := r.rec.addResult(e, err); err != nil {
+		return nil, err
+	}
+	return &recordReader{
+		BlobReader: rd,
+		rec:        r.rec,
+		event: Event{
+			Op:     e.Op,
+			Done:   true,
+			Repo:   e.Repo,
+			Digest: rd.Descriptor().Digest,
+			Tag:    e.Tag,
+			Offset: e.Offset,
+		},
+	}, nil
+}
+
+func (r *recordRegistry) ResolveBlob(ctx context.Context, repo string, digest ociregistry.Digest) (ociregistry.Descriptor, error) {
+	desc, err := r.r.ResolveBlob(ctx, repo, digest)
+	return desc, r.rec.addResult(Event{Op: "ResolveBlob", Repo: repo, Digest: digest, Size: desc.Size}, err)
+}
+
+func (r *recordRegistry) ResolveManifest(ctx context.Context, repo string, digest ociregistry.Digest) (ociregistry.Descriptor, error) {
+	desc, err := r.r.ResolveManifest(ctx, repo, digest)
+	return desc, r.rec.addResult(Event{Op: "ResolveManifest", Repo: repo, Digest: digest, Size: desc.Size}, err)
+}
+
+func (r *recordRegistry) ResolveTag(ctx context.Context, repo string, tagName string) (ociregistry.Descriptor, error) {
+	desc, err := r.r.ResolveTag(ctx, repo, tagName)
+	return desc, r.rec.addResult(Event{Op: "ResolveTag", Repo: repo, Digest: desc.Digest, Tag: tagName, Size: desc.Size}, err)
+}
+
+func (r *recordRegistry) PushBlob(ctx context.Context, repo string, desc ociregistry.Descriptor, rd io.Reader) (ociregistry.Descriptor, error) {
+	desc1, err := r.r.PushBlob(ctx, repo, desc, rd)
+	return desc1, r.rec.addResult(Event{Op: "PushBlob", Repo: repo, Digest: desc.Digest, Size: desc.Size}, err)
+}
+
+func (r *recordRegistry) PushBlobChunked(ctx context.Context, repo string, chunkSize int) (ociregistry.BlobWriter, error) {
+	w, err := r.r.PushBlobChunked(ctx, repo, chunkSize)
+	return r.writer(Event{Op: "PushBlobChunked", Repo: repo}, w, err)
+}
+
+func (r *recordRegistry) PushBlobChunkedResume(ctx context.Context, repo, id string, offset int64, chunkSize int) (ociregistry.BlobWriter, error) {
+	w, err := r.r.PushBlobChunkedResume(ctx, repo, id, offset, chunkSize)
+	return r.writer(Event{Op: "PushBlobChunkedResume", Repo: repo, Offset: offset}, w, err)
+}
+
+// writer records the start of the chunked upload described by e
+// and returns a writer that records its completion.
+func (r *recordRegistry) writer(e Event, w ociregistry.BlobWriter, err error) (ociregistry.BlobWriter, error) {
+	if err := r.rec.addResult(e, err); err != nil {
+		return nil, err
+	}
+	return &recordWriter{
+		BlobWriter: w,
+		rec:        r.rec,
+		event: Event{
+			Op:   e.Op,
+			Done: true,
+			Repo: e.Repo,
+		},
+	}, nil
+}
+
+func (r *recordRegistry) MountBlob(ctx context.Context, fromRepo, toRepo string, digest ociregistry.Digest) (ociregistry.Descriptor, error) {
+	desc, err := r.r.MountBlob(ctx, fromRepo, toRepo, digest)
+	return desc, r.rec.addResult(Event{Op: "MountBlob", Repo: toRepo, FromRepo: fromRepo, Digest: digest}, err)
+}
+
+func (r *recordRegistry) PushManifest(ctx context.Context, repo string, tag string, contents []byte, mediaType string) (ociregistry.Descriptor, error) {
+	desc, err := r.r.PushManifest(ctx, repo, tag, contents, mediaType)
+	return desc, r.rec.addResult(Event{Op: "PushManifest", Repo: repo, Digest: desc.Digest, Tag: tag, Size: int64(len(contents))}, err)
+}
+
+func (r *recordRegistry) DeleteBlob(ctx context.Context, repo string, digest ociregistry.Digest) error {
+	return r.rec.addResult(Event{Op: "DeleteBlob", Repo: repo, Digest: digest}, r.r.DeleteBlob(ctx, repo, digest))
+}
+
+func (r *recordRegistry) DeleteManifest(ctx context.Context, repo string, digest ociregistry.Digest) error {
+	return r.rec.addResult(Event{Op: "DeleteManifest", Repo: repo, Digest: digest}, r.r.DeleteManifest(ctx, repo, digest))
+}
+
+func (r *recordRegistry) DeleteTag(ctx context.Context, repo string, name string) error {
+	return r.rec.addResult(Event{Op: "DeleteTag", Repo: repo, Tag: name}, r.r.DeleteTag(ctx, repo, name))
+}
+
+func (r *recordRegistry) Repositories(ctx context.Context, startAfter string) ociregistry.Seq[string] {
+	return recordSeq(r.rec, Event{Op: "Repositories"}, r.r.Repositories(ctx, startAfter))
+}
+
+func (r *recordRegistry) Tags(ctx context.Context, repo, startAfter string) ociregistry.Seq[string] {
+	return recordSeq(r.rec, Event{Op: "Tags", Repo: repo}, r.r.Tags(ctx, repo, startAfter))
+}
+
+func (r *recordRegistry) Referrers(ctx context.Context, repo string, digest ociregistry.Digest, artifactType string) ociregistry.Seq[ociregistry.Descriptor] {
+	return recordSeq(r.rec, Event{Op: "Referrers", Repo: repo, Digest: digest}, r.r.Referrers(ctx, repo, digest, artifactType))
+}
+
+// recordSeq returns a sequence that records the start and
+// completion of the iteration over it as described by e.
+func recordSeq[T any](rec *Recorder, e Event, it ociregistry.Seq[T]) ociregistry.Seq[T] {
+	return func(yield func(T, error) bool) {
+		rec.add(e)
+		e.Done = true
+		it(func(item T, err error) bool {
+			if err != nil {
+				e.Err = err.Error()
+				yield(item, err)
+				return false
+			}
+			e.Size++
+			return yield(item, nil)
+		})
+		rec.add(e)
+	}
+}
+
+type recordReader struct {
+	ociregistry.BlobReader
+	rec    *Recorder
+	event  Event
+	closed bool
+}
+
+func (rd *recordReader) Read(buf []byte) (int, error) {
+	n, err := rd.BlobReader.Read(buf)
+	rd.event.Size += int64(n)
+	return n, err
+}
+
+func (rd *recordReader) Close() error {
+	err := rd.BlobReader.Close()
+	if !rd.closed {
+		rd.closed = true
+		rd.rec.addResult(rd.event, err)
+	}
+	return err
+}
+
+type recordWriter struct {
+	ociregistry.BlobWriter
+	rec   *Recorder
+	event Event
+}
+
+func (w *recordWriter) Commit(digest ociregistry.Digest) (ociregistry.Descriptor, error) {
+	desc, err := w.BlobWriter.Commit(digest)
+	e := w.event
+	e.Digest = digest
+	e.Size = desc.Size
+	return desc, w.rec.addResult(e, err)
+}
+
+func (w *recordWriter) Cancel() error {
+	e := w.event
+	e.Err = "canceled"
+	err := w.BlobWriter.Cancel()
+	if err != nil {
+		e.Err = "canceled: " + err.Error()
+	}
+	w.rec.add(e)
+	return err
+}
@@ -0,0 +1,107 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocifilter
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/go-quicktest/qt"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ocimem"
+)
+
+func TestRecord(t *testing.T) {
+	ctx := context.Background()
+	r, rec := Record(ocimem.New())
+
+	// Push a config blob in one go and a layer in chunks,
+	// then a manifest that refers to them.
+	config := "{}"
+	configDesc, err := r.PushBlob(ctx, "foo", ociregistry.Descriptor{
+		MediaType: "application/json",
+		Digest:    digest.FromString(config),
+		Size:      int64(len(config)),
+	}, strings.NewReader(config))
+	qt.Assert(t, qt.IsNil(err))
+
+	layer := "some layer content"
+	w, err := r.PushBlobChunked(ctx, "foo", 0)
+	qt.Assert(t, qt.IsNil(err))
+	_, err = io.WriteString(w, layer)
+	qt.Assert(t, qt.IsNil(err))
+	layerDesc, err := w.Commit(digest.FromString(layer))
+	qt.Assert(t, qt.IsNil(err))
+
+	manifest, err := json.Marshal(ociregistry.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    configDesc,
+		Layers:    []ociregistry.Descriptor{layerDesc},
+	})
+	qt.Assert(t, qt.IsNil(err))
+	manifestDesc, err := r.PushManifest(ctx, "foo", "latest", manifest, ocispec.MediaTypeImageManifest)
+	qt.Assert(t, qt.IsNil(err))
+
+	// Pull it all back.
+	rd, err := r.GetTag(ctx, "foo", "latest")
+	qt.Assert(t, qt.IsNil(err))
+	_, err = io.ReadAll(rd)
+	qt.Assert(t, qt.IsNil(err))
+	rd.Close()
+	rd, err = r.GetBlob(ctx, "foo", layerDesc.Digest)
+	qt.Assert(t, qt.IsNil(err))
+	_, err = io.ReadAll(rd)
+	qt.Assert(t, qt.IsNil(err))
+	rd.Close()
+	_, err = r.GetBlob(ctx, "foo", digest.FromString("other"))
+	qt.Assert(t, qt.ErrorIs(err, ociregistry.ErrBlobUnknown))
+	tags, err := ociregistry.All(r.Tags(ctx, "foo", ""))
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.DeepEquals(tags, []string{"latest"}))
+
+	want := strings.NewReplacer(
+		"$config", string(configDesc.Digest),
+		"$layer", string(layerDesc.Digest),
+		"$manifest", string(manifestDesc.Digest),
+		"$other", string(digest.FromString("other")),
+		"$msize", strconv.Itoa(len(manifest)),
+	).Replace(`
+PushBlob repo=foo digest=$config size=2
+PushBlobChunked repo=foo
+PushBlobChunked done repo=foo digest=$layer size=18
+PushManifest repo=foo digest=$manifest tag=latest size=$msize
+GetTag repo=foo tag=latest
+GetTag done repo=foo digest=$manifest tag=latest size=$msize
+GetBlob repo=foo digest=$layer
+GetBlob done repo=foo digest=$layer size=18
+GetBlob repo=foo digest=$other error="blob unknown: blob unknown to registry"
+Tags repo=foo
+Tags done repo=foo size=1
+`[1:])
+	qt.Assert(t, qt.Equals(rec.String(), want))
+	qt.Assert(t, qt.HasLen(rec.Events(), 11))
+
+	rec.Reset()
+	qt.Assert(t, qt.Equals(rec.String(), ""))
+}
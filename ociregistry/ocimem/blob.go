@@ -62,6 +62,8 @@ type Buffer struct {
 	checkStartOffset int64
 	uuid             string
 	committed        bool
+	canceled         bool
+	onCancel         func(b *Buffer)
 	desc             ociregistry.Descriptor
 	commitErr        error
 }
@@ -80,13 +82,38 @@ func NewBuffer(commit func(b *Buffer) error, uuid string) *Buffer {
 	}
 }
 
+var errUploadCanceled = fmt.Errorf("%w: upload canceled", ociregistry.ErrBlobUploadUnknown)
+
+// Cancel implements [ociregistry.BlobWriter.Cancel]. After Cancel
+// has been called on an uncommitted buffer, the data written so far
+// is discarded and further writes fail. Cancel is a no-op on a
+// committed buffer.
 func (b *Buffer) Cancel() error {
 	b.mu.Lock()
-	defer b.mu.Unlock()
-	b.commitErr = fmt.Errorf("upload canceled")
+	if b.committed || b.canceled {
+		b.mu.Unlock()
+		return nil
+	}
+	b.canceled = true
+	b.buf = nil
+	b.commitErr = errUploadCanceled
+	onCancel := b.onCancel
+	b.mu.Unlock()
+	// Call onCancel without the lock held, as it
+	// might need to acquire the registry lock.
+	if onCancel != nil {
+		onCancel(b)
+	}
 	return nil
 }
 
+// isCanceled reports whether Cancel has been called.
+func (b *Buffer) isCanceled() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.canceled
+}
+
 func (b *Buffer) Close() error {
 	return nil
 }
@@ -119,6 +146,9 @@ func (b *Buffer) GetBlob() (ociregistry.Descriptor, []byte, error) {
 func (b *Buffer) Write(data []byte) (int, error) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
+	if b.canceled {
+		return 0, errUploadCanceled
+	}
 	if offset := b.checkStartOffset; offset != -1 {
 		// Can't call Buffer.Size, since we are already holding the mutex.
 		if int64(len(b.buf)) != offset {
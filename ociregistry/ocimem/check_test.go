@@ -55,6 +55,52 @@ var pushManifestTests = []struct {
 		})
 	},
 	wantError: `invalid manifest: blob for layers\[0\] not found`,
+}, {
+	testName: "NonExistentLayerReferenceAllowed",
+	config: Config{
+		AllowDanglingReferences: true,
+	},
+	preload: ocitest.RepoContent{
+		Blobs: map[string]string{
+			"a": "{}",
+		},
+	},
+	mediaType: ocispec.MediaTypeImageManifest,
+	manifestData: func(content ocitest.PushedRepoContent) []byte {
+		return mustJSONMarshal(ociregistry.Manifest{
+			MediaType: ocispec.MediaTypeImageManifest,
+			Config:    content.Blobs["a"],
+			Layers: []ociregistry.Descriptor{{
+				MediaType: "application/something",
+				Size:      1,
+				Digest:    digest.FromString("b"),
+			}},
+		})
+	},
+}, {
+	testName: "InvalidLayerReferenceWithDanglingAllowed",
+	config: Config{
+		AllowDanglingReferences: true,
+	},
+	preload: ocitest.RepoContent{
+		Blobs: map[string]string{
+			"a": "{}",
+		},
+	},
+	mediaType: ocispec.MediaTypeImageManifest,
+	manifestData: func(content ocitest.PushedRepoContent) []byte {
+		return mustJSONMarshal(ociregistry.Manifest{
+			MediaType: ocispec.MediaTypeImageManifest,
+			Config:    content.Blobs["a"],
+			Layers: []ociregistry.Descriptor{{
+				MediaType: "application/something",
+				Size:      1,
+				Digest:    "sha256:bad",
+			}},
+		})
+	},
+	// Descriptors are still checked for validity.
+	wantError: `invalid manifest: bad descriptor in layers\[0\]: .*`,
 }, {
 	testName: "NonExistentSubjectReference",
 	preload: ocitest.RepoContent{
@@ -89,6 +135,22 @@ var pushManifestTests = []struct {
 		})
 	},
 	wantError: `invalid manifest: manifest for manifests\[0\] not found`,
+}, {
+	testName: "NonExistentImageIndexManifestReferenceAllowed",
+	config: Config{
+		AllowDanglingReferences: true,
+	},
+	mediaType: ocispec.MediaTypeImageIndex,
+	manifestData: func(content ocitest.PushedRepoContent) []byte {
+		return mustJSONMarshal(ocispec.Index{
+			MediaType: ocispec.MediaTypeImageIndex,
+			Manifests: []ociregistry.Descriptor{{
+				MediaType: ocispec.MediaTypeImageManifest,
+				Size:      1,
+				Digest:    digest.FromString("a"),
+			}},
+		})
+	},
 }, {
 	testName:  "NonExistentImageIndexSubjectReference",
 	mediaType: ocispec.MediaTypeImageIndex,
@@ -583,6 +645,133 @@ func TestDeleteTag(t *testing.T) {
 	}
 }
 
+func TestImmutableTagsPerRepository(t *testing.T) {
+	ctx := context.Background()
+	r := ocitest.NewRegistry(t, NewWithConfig(&Config{
+		// ImmutableTagsFunc takes precedence.
+		ImmutableTags: true,
+		ImmutableTagsFunc: func(repo string) bool {
+			return repo == "immutable"
+		},
+	}))
+	repoContent := ocitest.RepoContent{
+		Blobs: map[string]string{
+			"a": "{}",
+		},
+		Manifests: map[string]ociregistry.Manifest{
+			"m": {
+				MediaType: ocispec.MediaTypeImageManifest,
+				Config: ociregistry.Descriptor{
+					Digest: "a",
+				},
+				Layers: []ociregistry.Descriptor{{
+					Digest: "a",
+				}},
+			},
+		},
+		Tags: map[string]string{
+			"sometag": "m",
+		},
+	}
+	content := r.MustPushContent(ocitest.RegistryContent{
+		"immutable": repoContent,
+		"mutable":   repoContent,
+	})
+	newManifest := func(repo string) []byte {
+		return mustJSONMarshal(ociregistry.Manifest{
+			MediaType: ocispec.MediaTypeImageManifest,
+			Config:    content[repo].Blobs["a"],
+			Layers:    []ociregistry.Descriptor{content[repo].Blobs["a"]},
+			Annotations: map[string]string{
+				"different": "thing",
+			},
+		})
+	}
+
+	_, err := r.R.PushManifest(ctx, "immutable", "sometag", newManifest("immutable"), ocispec.MediaTypeImageManifest)
+	qt.Assert(t, qt.ErrorMatches(err, `denied: requested access to the resource is denied: cannot overwrite tag`))
+	err = r.R.DeleteTag(ctx, "immutable", "sometag")
+	qt.Assert(t, qt.ErrorIs(err, ociregistry.ErrDenied))
+	err = r.R.DeleteManifest(ctx, "immutable", content["immutable"].Manifests["m"].Digest)
+	qt.Assert(t, qt.ErrorIs(err, ociregistry.ErrDenied))
+
+	desc, err := r.R.PushManifest(ctx, "mutable", "sometag", newManifest("mutable"), ocispec.MediaTypeImageManifest)
+	qt.Assert(t, qt.IsNil(err))
+	tagDesc, err := r.R.ResolveTag(ctx, "mutable", "sometag")
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.Equals(tagDesc.Digest, desc.Digest))
+	err = r.R.DeleteTag(ctx, "mutable", "sometag")
+	qt.Assert(t, qt.IsNil(err))
+}
+
+func TestMutableTagPatterns(t *testing.T) {
+	ctx := context.Background()
+	r := ocitest.NewRegistry(t, NewWithConfig(&Config{
+		ImmutableTags:      true,
+		MutableTagPatterns: []string{"latest", "dev-*"},
+	}))
+	content := r.MustPushContent(ocitest.RegistryContent{
+		"test": {
+			Blobs: map[string]string{
+				"a": "{}",
+			},
+			Manifests: map[string]ociregistry.Manifest{
+				"m1": {
+					MediaType: ocispec.MediaTypeImageManifest,
+					Config: ociregistry.Descriptor{
+						Digest: "a",
+					},
+				},
+				"m2": {
+					MediaType: ocispec.MediaTypeImageManifest,
+					Config: ociregistry.Descriptor{
+						Digest: "a",
+					},
+					Annotations: map[string]string{
+						"different": "thing",
+					},
+				},
+			},
+			Tags: map[string]string{
+				"latest":    "m1",
+				"dev-build": "m1",
+				"v1.0.0":    "m1",
+				"other":     "m2",
+			},
+		},
+	})["test"]
+	newManifest := mustJSONMarshal(ociregistry.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    content.Blobs["a"],
+		Annotations: map[string]string{
+			"new": "thing",
+		},
+	})
+
+	// Tags that match a pattern can be overwritten and deleted.
+	desc, err := r.R.PushManifest(ctx, "test", "latest", newManifest, ocispec.MediaTypeImageManifest)
+	qt.Assert(t, qt.IsNil(err))
+	tagDesc, err := r.R.ResolveTag(ctx, "test", "latest")
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.Equals(tagDesc.Digest, desc.Digest))
+	err = r.R.DeleteTag(ctx, "test", "dev-build")
+	qt.Assert(t, qt.IsNil(err))
+
+	// Other tags remain immutable.
+	_, err = r.R.PushManifest(ctx, "test", "v1.0.0", newManifest, ocispec.MediaTypeImageManifest)
+	qt.Assert(t, qt.ErrorMatches(err, `denied: requested access to the resource is denied: cannot overwrite tag`))
+	err = r.R.DeleteTag(ctx, "test", "v1.0.0")
+	qt.Assert(t, qt.ErrorIs(err, ociregistry.ErrDenied))
+	err = r.R.DeleteManifest(ctx, "test", content.Manifests["m1"].Digest)
+	qt.Assert(t, qt.ErrorIs(err, ociregistry.ErrDenied))
+
+	// A manifest referred to only by mutable tags can be deleted.
+	err = r.R.DeleteManifest(ctx, "test", desc.Digest)
+	qt.Assert(t, qt.IsNil(err))
+	err = r.R.DeleteManifest(ctx, "test", content.Manifests["m2"].Digest)
+	qt.Assert(t, qt.ErrorIs(err, ociregistry.ErrDenied))
+}
+
 func mustJSONMarshal(x any) []byte {
 	data, err := json.Marshal(x)
 	if err != nil {
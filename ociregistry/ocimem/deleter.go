@@ -37,8 +37,8 @@ func (r *Registry) DeleteBlob(ctx context.Context, repoName string, digest ocire
 	if !ok {
 		return nil
 	}
-	if r.cfg.ImmutableTags {
-		ok, err := refersTo(repo, repoTagIter(repo), digest)
+	if r.immutableTags(repoName) {
+		ok, err := refersTo(repo, r.immutableTagIter(repoName, repo), digest)
 		if err != nil {
 			return err
 		}
@@ -59,8 +59,8 @@ func (r *Registry) DeleteManifest(ctx context.Context, repoName string, digest o
 		return err
 	}
 	repo := r.repos[repoName]
-	if r.cfg.ImmutableTags {
-		ok, err := refersTo(repo, repoTagIter(repo), digest)
+	if r.immutableTags(repoName) {
+		ok, err := refersTo(repo, r.immutableTagIter(repoName, repo), digest)
 		if err != nil {
 			return err
 		}
@@ -83,7 +83,7 @@ func (r *Registry) DeleteTag(ctx context.Context, repoName string, tagName strin
 	if _, ok := repo.tags[tagName]; !ok {
 		return fmt.Errorf("%w: tag does not exist", ociregistry.ErrManifestUnknown)
 	}
-	if r.cfg.ImmutableTags {
+	if r.immutableTag(repoName, tagName) {
 		return errCannotDeleteTag
 	}
 	delete(repo.tags, tagName)
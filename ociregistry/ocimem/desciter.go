@@ -59,6 +59,19 @@ func repoTagIter(r *repository) descIter {
 	}
 }
 
+// immutableTagIter is like repoTagIter but
+// produces only the tags that are immutable.
+func (r *Registry) immutableTagIter(repoName string, repo *repository) descIter {
+	return func(yield func(descInfo) bool) {
+		repoTagIter(repo)(func(info descInfo) bool {
+			if !r.immutableTag(repoName, info.name) {
+				return true
+			}
+			return yield(info)
+		})
+	}
+}
+
 func descIterForType[T any](newIter func(T) descIter) func(data []byte) (descIter, error) {
 	return func(data []byte) (descIter, error) {
 		var x T
@@ -0,0 +1,341 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocimem
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ociref"
+)
+
+// This file implements import and export of OCI image layout tar archives.
+// See https://github.com/opencontainers/image-spec/blob/v1.1.0/image-layout.md
+
+// ExportTar writes the manifest in repo referred to by ref, and
+// all the manifests and blobs that it refers to, to w as a tar archive
+// in [OCI image layout] format. The ref argument may be either a tag
+// or a digest.
+//
+// The index.json in the archive holds a single entry describing the
+// manifest; if ref is a tag, the entry is annotated with it.
+// Subject manifests are not included.
+//
+// [OCI image layout]: https://github.com/opencontainers/image-spec/blob/v1.1.0/image-layout.md
+func (r *Registry) ExportTar(repoName string, ref string, w io.Writer) error {
+	// Gather all the content first so that we don't write
+	// a partial archive when some content is missing,
+	// and so that we don't hold the lock while writing.
+	desc, tag, content, err := r.exportContent(repoName, ref)
+	if err != nil {
+		return err
+	}
+	if tag != "" {
+		desc.Annotations = map[string]string{
+			ocispec.AnnotationRefName: tag,
+		}
+	}
+	layoutData, err := json.Marshal(ocispec.ImageLayout{
+		Version: ocispec.ImageLayoutVersion,
+	})
+	if err != nil {
+		return err
+	}
+	indexData, err := json.Marshal(ocispec.Index{
+		Versioned: specs.Versioned{
+			SchemaVersion: 2,
+		},
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: []ociregistry.Descriptor{desc},
+	})
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(w)
+	if err := writeTarFile(tw, ocispec.ImageLayoutFile, layoutData); err != nil {
+		return err
+	}
+	if err := writeTarFile(tw, ocispec.ImageIndexFile, indexData); err != nil {
+		return err
+	}
+	digests := make([]ociregistry.Digest, 0, len(content))
+	for dig := range content {
+		digests = append(digests, dig)
+	}
+	sort.Slice(digests, func(i, j int) bool {
+		return digests[i] < digests[j]
+	})
+	for _, dig := range digests {
+		if err := writeTarFile(tw, blobPath(dig), content[dig]); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// exportContent returns the descriptor of the manifest in repoName
+// referred to by ref, the tag if ref is a tag, and the content of
+// the manifest and everything it refers to, keyed by digest.
+// Stored content is never modified, so the returned data
+// can be used without holding r.mu.
+func (r *Registry) exportContent(repoName string, ref string) (ociregistry.Descriptor, string, map[ociregistry.Digest][]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	repo, err := r.repo(repoName)
+	if err != nil {
+		return ociregistry.Descriptor{}, "", nil, err
+	}
+	var desc ociregistry.Descriptor
+	var tag string
+	if dig, err := digest.Parse(ref); err == nil {
+		b := repo.manifests[dig]
+		if b == nil {
+			return ociregistry.Descriptor{}, "", nil, ociregistry.ErrManifestUnknown
+		}
+		desc = b.descriptor()
+	} else {
+		var ok bool
+		desc, ok = repo.tags[ref]
+		if !ok {
+			return ociregistry.Descriptor{}, "", nil, ociregistry.ErrManifestUnknown
+		}
+		tag = ref
+	}
+	content := make(map[ociregistry.Digest][]byte)
+	if err := collectManifest(repo, desc, content); err != nil {
+		return ociregistry.Descriptor{}, "", nil, err
+	}
+	return desc, tag, content, nil
+}
+
+// collectManifest adds the manifest with the given descriptor
+// and everything it refers to into content.
+func collectManifest(repo *repository, desc ociregistry.Descriptor, content map[ociregistry.Digest][]byte) (retErr error) {
+	if _, ok := content[desc.Digest]; ok {
+		return nil
+	}
+	b := repo.manifests[desc.Digest]
+	if b == nil {
+		return fmt.Errorf("manifest %s: %w", desc.Digest, ociregistry.ErrManifestUnknown)
+	}
+	content[desc.Digest] = b.data
+	iter, err := manifestReferences(b.mediaType, b.data)
+	if err != nil {
+		return err
+	}
+	iter(func(info descInfo) bool {
+		switch info.kind {
+		case kindBlob:
+			b := repo.blobs[info.desc.Digest]
+			if b == nil {
+				retErr = fmt.Errorf("blob for %s: %w", info.name, ociregistry.ErrBlobUnknown)
+				return false
+			}
+			content[info.desc.Digest] = b.data
+		case kindManifest:
+			if err := collectManifest(repo, info.desc, content); err != nil {
+				retErr = err
+				return false
+			}
+		}
+		return true
+	})
+	return retErr
+}
+
+func writeTarFile(tw *tar.Writer, name string, data []byte) error {
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0o644,
+		Size:     int64(len(data)),
+	}); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+func blobPath(dig ociregistry.Digest) string {
+	return path.Join(ocispec.ImageBlobsDir, string(dig.Algorithm()), dig.Encoded())
+}
+
+// ImportTar reads a tar archive in [OCI image layout] format from r
+// and pushes all the manifests listed in its index.json, and all the
+// content they refer to, to the given repository. Manifests annotated
+// with a tag name (the org.opencontainers.image.ref.name annotation)
+// are tagged with that name.
+//
+// The content of all manifests and blobs is checked against their
+// digests. ImportTar returns the entries in the archive's index.json.
+//
+// [OCI image layout]: https://github.com/opencontainers/image-spec/blob/v1.1.0/image-layout.md
+func (r *Registry) ImportTar(repoName string, rd io.Reader) ([]ociregistry.Descriptor, error) {
+	files := make(map[string][]byte)
+	tr := tar.NewReader(rd)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot read tar archive: %v", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read %q from tar archive: %v", hdr.Name, err)
+		}
+		files[path.Clean(hdr.Name)] = data
+	}
+	var layout ocispec.ImageLayout
+	if err := unmarshalLayoutFile(files, ocispec.ImageLayoutFile, &layout); err != nil {
+		return nil, err
+	}
+	if layout.Version != ocispec.ImageLayoutVersion {
+		return nil, fmt.Errorf("unsupported image layout version %q", layout.Version)
+	}
+	var index ocispec.Index
+	if err := unmarshalLayoutFile(files, ocispec.ImageIndexFile, &index); err != nil {
+		return nil, err
+	}
+	imp := &layoutImporter{
+		r:      r,
+		repo:   repoName,
+		files:  files,
+		pushed: make(map[ociregistry.Digest]bool),
+	}
+	for i, desc := range index.Manifests {
+		if err := imp.pushManifest(desc); err != nil {
+			return nil, fmt.Errorf("%s manifests[%d]: %v", ocispec.ImageIndexFile, i, err)
+		}
+		name := desc.Annotations[ocispec.AnnotationRefName]
+		if name == "" {
+			continue
+		}
+		if !ociref.IsValidTag(name) {
+			// Some tools record a full reference rather than just a tag.
+			ref, err := ociref.ParseRelative(name)
+			if err != nil || ref.Tag == "" {
+				continue
+			}
+			name = ref.Tag
+		}
+		if _, err := r.PushManifest(context.Background(), repoName, name, files[blobPath(desc.Digest)], desc.MediaType); err != nil {
+			return nil, fmt.Errorf("cannot tag %s as %q: %v", desc.Digest, name, err)
+		}
+	}
+	return index.Manifests, nil
+}
+
+func unmarshalLayoutFile(files map[string][]byte, name string, x any) error {
+	data, ok := files[name]
+	if !ok {
+		return fmt.Errorf("no %s file found in image layout", name)
+	}
+	if err := json.Unmarshal(data, x); err != nil {
+		return fmt.Errorf("invalid %s file: %v", name, err)
+	}
+	return nil
+}
+
+type layoutImporter struct {
+	r      *Registry
+	repo   string
+	files  map[string][]byte
+	pushed map[ociregistry.Digest]bool
+}
+
+// pushManifest pushes the manifest with the given descriptor
+// after pushing everything it refers to.
+func (imp *layoutImporter) pushManifest(desc ociregistry.Descriptor) (retErr error) {
+	if imp.pushed[desc.Digest] {
+		return nil
+	}
+	data, err := imp.content(desc)
+	if err != nil {
+		return err
+	}
+	iter, err := manifestReferences(desc.MediaType, data)
+	if err != nil {
+		return err
+	}
+	iter(func(info descInfo) bool {
+		switch info.kind {
+		case kindBlob:
+			retErr = imp.pushBlob(info.desc)
+		case kindManifest:
+			retErr = imp.pushManifest(info.desc)
+		}
+		if retErr != nil {
+			retErr = fmt.Errorf("%s: %v", info.name, retErr)
+			return false
+		}
+		return true
+	})
+	if retErr != nil {
+		return retErr
+	}
+	if _, err := imp.r.PushManifest(context.Background(), imp.repo, "", data, desc.MediaType); err != nil {
+		return err
+	}
+	imp.pushed[desc.Digest] = true
+	return nil
+}
+
+func (imp *layoutImporter) pushBlob(desc ociregistry.Descriptor) error {
+	if imp.pushed[desc.Digest] {
+		return nil
+	}
+	data, err := imp.content(desc)
+	if err != nil {
+		return err
+	}
+	if _, err := imp.r.PushBlob(context.Background(), imp.repo, desc, bytes.NewReader(data)); err != nil {
+		return err
+	}
+	imp.pushed[desc.Digest] = true
+	return nil
+}
+
+// content returns the content for the given descriptor,
+// checking that it matches.
+func (imp *layoutImporter) content(desc ociregistry.Descriptor) ([]byte, error) {
+	if err := desc.Digest.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid digest: %v", err)
+	}
+	data, ok := imp.files[blobPath(desc.Digest)]
+	if !ok {
+		return nil, fmt.Errorf("%s not found in image layout", desc.Digest)
+	}
+	if err := CheckDescriptor(desc, data); err != nil {
+		return nil, fmt.Errorf("content for %s: %v", desc.Digest, err)
+	}
+	return data, nil
+}
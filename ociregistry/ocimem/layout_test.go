@@ -0,0 +1,182 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocimem
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/go-quicktest/qt"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ociclient"
+	"cuelabs.dev/go/oci/ociregistry/ociserver"
+)
+
+func TestImportExportTar(t *testing.T) {
+	ctx := context.Background()
+
+	// Build an image layout archive by hand.
+	files := make(map[string][]byte)
+	addBlob := func(mediaType string, data []byte) ociregistry.Descriptor {
+		desc := ociregistry.Descriptor{
+			MediaType: mediaType,
+			Digest:    digest.FromBytes(data),
+			Size:      int64(len(data)),
+		}
+		files[blobPath(desc.Digest)] = data
+		return desc
+	}
+	addJSON := func(mediaType string, x any) ociregistry.Descriptor {
+		data, err := json.Marshal(x)
+		qt.Assert(t, qt.IsNil(err))
+		return addBlob(mediaType, data)
+	}
+	imageDesc := addJSON(ocispec.MediaTypeImageManifest, ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    addBlob(ocispec.MediaTypeImageConfig, []byte(`{"architecture":"amd64"}`)),
+		Layers: []ociregistry.Descriptor{
+			addBlob(ocispec.MediaTypeImageLayer, []byte("layer")),
+		},
+	})
+	indexDesc := addJSON(ocispec.MediaTypeImageIndex, ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: []ociregistry.Descriptor{imageDesc},
+	})
+	indexDesc.Annotations = map[string]string{
+		ocispec.AnnotationRefName: "v1",
+	}
+	files[ocispec.ImageLayoutFile] = []byte(`{"imageLayoutVersion":"1.0.0"}`)
+	files[ocispec.ImageIndexFile] = mustJSONMarshal(ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Manifests: []ociregistry.Descriptor{indexDesc},
+	})
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for name, data := range files {
+		qt.Assert(t, qt.IsNil(writeTarFile(tw, "./"+name, data)))
+	}
+	qt.Assert(t, qt.IsNil(tw.Close()))
+
+	r := New()
+	descs, err := r.ImportTar("foo/bar", &buf)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.DeepEquals(descs, []ociregistry.Descriptor{indexDesc}))
+
+	// Check that the content can be pulled through a server.
+	srv := httptest.NewServer(ociserver.New(r, nil))
+	defer srv.Close()
+	srvURL, _ := url.Parse(srv.URL)
+	client, err := ociclient.New(srvURL.Host, &ociclient.Options{
+		Insecure: true,
+	})
+	qt.Assert(t, qt.IsNil(err))
+	desc, err := client.ResolveTag(ctx, "foo/bar", "v1")
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.Equals(desc.Digest, indexDesc.Digest))
+	rd, err := client.GetManifest(ctx, "foo/bar", imageDesc.Digest)
+	qt.Assert(t, qt.IsNil(err))
+	data, err := io.ReadAll(rd)
+	rd.Close()
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.Equals(digest.FromBytes(data), imageDesc.Digest))
+
+	// Export the content again and check that it round-trips.
+	buf.Reset()
+	qt.Assert(t, qt.IsNil(r.ExportTar("foo/bar", "v1", &buf)))
+	r2 := New()
+	descs, err = r2.ImportTar("other", &buf)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.DeepEquals(descs, []ociregistry.Descriptor{indexDesc}))
+	for _, d := range []ociregistry.Descriptor{indexDesc, imageDesc} {
+		got, err := r2.ResolveManifest(ctx, "other", d.Digest)
+		qt.Assert(t, qt.IsNil(err))
+		qt.Assert(t, qt.Equals(got.Digest, d.Digest))
+	}
+	desc, err = r2.ResolveTag(ctx, "other", "v1")
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.Equals(desc.Digest, indexDesc.Digest))
+}
+
+func TestImportTarDigestMismatch(t *testing.T) {
+	data := []byte("layer")
+	desc := ociregistry.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    digest.FromString("something else"),
+		Size:      int64(len(data)),
+	}
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	qt.Assert(t, qt.IsNil(writeTarFile(tw, ocispec.ImageLayoutFile, []byte(`{"imageLayoutVersion":"1.0.0"}`))))
+	qt.Assert(t, qt.IsNil(writeTarFile(tw, ocispec.ImageIndexFile, mustJSONMarshal(ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Manifests: []ociregistry.Descriptor{desc},
+	}))))
+	qt.Assert(t, qt.IsNil(writeTarFile(tw, blobPath(desc.Digest), data)))
+	qt.Assert(t, qt.IsNil(tw.Close()))
+
+	_, err := New().ImportTar("foo", &buf)
+	qt.Assert(t, qt.ErrorMatches(err, `index.json manifests\[0\]: content for sha256:.*: digest mismatch`))
+}
+
+func TestExportTarUnknownManifest(t *testing.T) {
+	r := New()
+	_, err := r.PushBlob(context.Background(), "foo", ociregistry.Descriptor{
+		MediaType: "application/octet-stream",
+		Digest:    digest.FromString("x"),
+		Size:      1,
+	}, bytes.NewReader([]byte("x")))
+	qt.Assert(t, qt.IsNil(err))
+	err = r.ExportTar("foo", "latest", io.Discard)
+	qt.Assert(t, qt.ErrorIs(err, ociregistry.ErrManifestUnknown))
+}
+
+func TestExportTarDoesNotHoldLock(t *testing.T) {
+	ctx := context.Background()
+	r := New()
+	manifest := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[]}`)
+	_, err := r.PushManifest(ctx, "foo", "latest", manifest, ocispec.MediaTypeImageIndex)
+	qt.Assert(t, qt.IsNil(err))
+
+	// The writer uses the registry while the archive is
+	// being written, as a slow consumer might.
+	var buf bytes.Buffer
+	w := writerFunc(func(data []byte) (int, error) {
+		if _, err := r.ResolveTag(ctx, "foo", "latest"); err != nil {
+			return 0, err
+		}
+		return buf.Write(data)
+	})
+	err = r.ExportTar("foo", "latest", w)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.Not(qt.Equals(buf.Len(), 0)))
+}
+
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(data []byte) (int, error) {
+	return f(data)
+}
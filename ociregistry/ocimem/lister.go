@@ -22,12 +22,34 @@ import (
 	"cuelabs.dev/go/oci/ociregistry"
 )
 
+// Repositories implements [ociregistry.Lister.Repositories].
+// The repositories are always produced in lexical order, comparing
+// names byte by byte as [strings.Compare] does, so the last name
+// seen can be passed as startAfter to resume the listing.
 func (r *Registry) Repositories(ctx context.Context, startAfter string) ociregistry.Seq[string] {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	return mapKeysIter(r.repos, strings.Compare, startAfter)
 }
 
+// RepositoriesWithPrefix implements [ociregistry.PrefixLister].
+// The repositories are produced in lexical order.
+func (r *Registry) RepositoriesWithPrefix(ctx context.Context, prefix string, startAfter string) ociregistry.Seq[string] {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var repos []string
+	for name := range r.repos {
+		if strings.HasPrefix(name, prefix) && startAfter < name {
+			repos = append(repos, name)
+		}
+	}
+	slices.Sort(repos)
+	return ociregistry.SliceSeq(repos)
+}
+
+// Tags implements [ociregistry.Lister.Tags]. Like the repositories
+// produced by [Registry.Repositories], the tags are always
+// produced in lexical order.
 func (r *Registry) Tags(ctx context.Context, repoName string, startAfter string) ociregistry.Seq[string] {
 	r.mu.Lock()
 	defer r.mu.Unlock()
@@ -57,6 +79,8 @@ func (r *Registry) Referrers(ctx context.Context, repoName string, digest ocireg
 	return ociregistry.SliceSeq(referrers)
 }
 
+// mapKeysIter returns an iterator over the keys in m that are
+// after startAfter, sorted according to cmp.
 func mapKeysIter[K comparable, V any](m map[K]V, cmp func(K, K) int, startAfter K) ociregistry.Seq[K] {
 	ks := make([]K, 0, len(m))
 	for k := range m {
@@ -0,0 +1,119 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocimem
+
+import (
+	"context"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/go-quicktest/qt"
+	"github.com/opencontainers/go-digest"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ocitest"
+)
+
+func TestRepositoriesWithPrefix(t *testing.T) {
+	ctx := context.Background()
+	r := ocitest.NewRegistry(t, New())
+	content := ocitest.RepoContent{
+		Blobs: map[string]string{
+			"a": "hello",
+		},
+	}
+	r.MustPushContent(ocitest.RegistryContent{
+		"team-b/x":      content,
+		"team-a/zed":    content,
+		"team-a/alpha":  content,
+		"team-a/beta/c": content,
+		"team-ab":       content,
+		"other":         content,
+	})
+	reg := r.R.(*Registry)
+	repos, err := ociregistry.All(reg.RepositoriesWithPrefix(ctx, "team-a/", ""))
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.DeepEquals(repos, []string{"team-a/alpha", "team-a/beta/c", "team-a/zed"}))
+
+	repos, err = ociregistry.All(reg.RepositoriesWithPrefix(ctx, "team-a/", "team-a/alpha"))
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.DeepEquals(repos, []string{"team-a/beta/c", "team-a/zed"}))
+
+	repos, err = ociregistry.All(reg.RepositoriesWithPrefix(ctx, "nothing/", ""))
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.DeepEquals(repos, []string{}))
+
+	repos, err = ociregistry.All(reg.RepositoriesWithPrefix(ctx, "", ""))
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.DeepEquals(repos, []string{"other", "team-a/alpha", "team-a/beta/c", "team-a/zed", "team-ab", "team-b/x"}))
+}
+
+func TestListOrdering(t *testing.T) {
+	ctx := context.Background()
+	repos := []string{"a", "a/b", "a-b", "a.b", "a_b", "a0", "aa", "b", "z/z/z"}
+	tags := []string{"latest", "Latest", "tag1", "tag10", "tag2", "v1.0", "v1.0-rc1", "v1_0", "_x"}
+	// Names are compared byte by byte.
+	wantRepos := []string{"a", "a-b", "a.b", "a/b", "a0", "a_b", "aa", "b", "z/z/z"}
+	wantTags := []string{"Latest", "_x", "latest", "tag1", "tag10", "tag2", "v1.0", "v1.0-rc1", "v1_0"}
+	manifest := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[]}`)
+	for i := 0; i < 5; i++ {
+		// Insert the repositories and tags in a random order.
+		r := New()
+		for _, j := range rand.Perm(len(repos)) {
+			_, err := r.PushBlob(ctx, repos[j], ociregistry.Descriptor{
+				MediaType: "application/octet-stream",
+				Digest:    digest.FromString("hello"),
+				Size:      5,
+			}, strings.NewReader("hello"))
+			qt.Assert(t, qt.IsNil(err))
+		}
+		for _, j := range rand.Perm(len(tags)) {
+			_, err := r.PushManifest(ctx, "a", tags[j], manifest, "application/vnd.oci.image.index.v1+json")
+			qt.Assert(t, qt.IsNil(err))
+		}
+		gotRepos, err := ociregistry.All(r.Repositories(ctx, ""))
+		qt.Assert(t, qt.IsNil(err))
+		qt.Check(t, qt.DeepEquals(gotRepos, wantRepos))
+		gotTags, err := ociregistry.All(r.Tags(ctx, "a", ""))
+		qt.Assert(t, qt.IsNil(err))
+		qt.Check(t, qt.DeepEquals(gotTags, wantTags))
+
+		// Paginating one item at a time, using the last item
+		// seen as the cursor, produces the same sequence.
+		qt.Check(t, qt.DeepEquals(listOneByOne(t, func(last string) ociregistry.Seq[string] {
+			return r.Repositories(ctx, last)
+		}), wantRepos))
+		qt.Check(t, qt.DeepEquals(listOneByOne(t, func(last string) ociregistry.Seq[string] {
+			return r.Tags(ctx, "a", last)
+		}), wantTags))
+	}
+}
+
+// listOneByOne returns all the items produced by list by taking only
+// the first item from each call, passing the previous item as the cursor.
+func listOneByOne(t *testing.T, list func(last string) ociregistry.Seq[string]) []string {
+	var items []string
+	last := ""
+	for {
+		next, err := ociregistry.All(list(last))
+		qt.Assert(t, qt.IsNil(err))
+		if len(next) == 0 {
+			return items
+		}
+		items = append(items, next[0])
+		last = next[0]
+	}
+}
@@ -18,14 +18,19 @@ package ocimem
 
 import (
 	"fmt"
+	"path"
 	"sync"
+	"time"
 
 	"cuelabs.dev/go/oci/ociregistry"
 	"cuelabs.dev/go/oci/ociregistry/ociref"
 	"github.com/opencontainers/go-digest"
 )
 
-var _ ociregistry.Interface = (*Registry)(nil)
+var (
+	_ ociregistry.Interface    = (*Registry)(nil)
+	_ ociregistry.PrefixLister = (*Registry)(nil)
+)
 
 type Registry struct {
 	*ociregistry.Funcs
@@ -39,6 +44,34 @@ type repository struct {
 	manifests map[ociregistry.Digest]*blob
 	blobs     map[ociregistry.Digest]*blob
 	uploads   map[string]*Buffer
+
+	// canceled holds the canceled uploads in the order that
+	// they were canceled. They're kept in uploads until they
+	// expire so that they're not treated as new uploads.
+	canceled []canceledUpload
+}
+
+// canceledUpload records when an upload was canceled.
+type canceledUpload struct {
+	id   string
+	time time.Time
+}
+
+// canceledUploadTTL holds how long a canceled upload is remembered.
+const canceledUploadTTL = 10 * time.Minute
+
+// timeNow returns the current time.
+// It's a variable so it can be replaced in tests.
+var timeNow = time.Now
+
+// expireCanceledUploads forgets any canceled uploads that
+// were canceled more than canceledUploadTTL before now.
+// It must be called with the registry lock held.
+func (repo *repository) expireCanceledUploads(now time.Time) {
+	for len(repo.canceled) > 0 && now.Sub(repo.canceled[0].time) >= canceledUploadTTL {
+		delete(repo.uploads, repo.canceled[0].id)
+		repo.canceled = repo.canceled[1:]
+	}
 }
 
 type blob struct {
@@ -86,7 +119,57 @@ type Config struct {
 	// - no deletion of directly tagged manifests
 	// - no deletion of any blob or manifest that a tagged manifest
 	// refers to (TODO: not implemented yet)
+	//
+	// ImmutableTags applies to all repositories; use
+	// ImmutableTagsFunc to choose per repository.
 	ImmutableTags bool
+
+	// ImmutableTagsFunc, if non-nil, is called with a repository
+	// name to determine whether tags in that repository are
+	// immutable, with the restrictions described for ImmutableTags.
+	// It takes precedence over ImmutableTags.
+	ImmutableTagsFunc func(repo string) bool
+
+	// MutableTagPatterns holds glob patterns, in the syntax
+	// used by [path.Match], for tags that remain mutable even in
+	// repositories where tags are immutable. For example,
+	// with the pattern "latest", the latest tag can be moved
+	// and deleted while all other tags are fixed. Invalid patterns
+	// match nothing.
+	//
+	// Manifests and blobs that are referred to only by mutable tags
+	// are not protected from deletion.
+	MutableTagPatterns []string
+
+	// AllowDanglingReferences specifies that manifests can be pushed
+	// even when the blobs and manifests they refer to aren't present
+	// in the repository. This is useful when the registry is used as a
+	// cache that's filled lazily. By default, such pushes fail, as
+	// required for conformance with the spec.
+	AllowDanglingReferences bool
+}
+
+// immutableTags reports whether tags in the given
+// repository are immutable.
+func (r *Registry) immutableTags(repoName string) bool {
+	if r.cfg.ImmutableTagsFunc != nil {
+		return r.cfg.ImmutableTagsFunc(repoName)
+	}
+	return r.cfg.ImmutableTags
+}
+
+// immutableTag reports whether the given tag in the
+// given repository is immutable.
+func (r *Registry) immutableTag(repoName, tag string) bool {
+	if !r.immutableTags(repoName) {
+		return false
+	}
+	for _, pattern := range r.cfg.MutableTagPatterns {
+		if ok, _ := path.Match(pattern, tag); ok {
+			return false
+		}
+	}
+	return true
 }
 
 func (r *Registry) repo(repoName string) (*repository, error) {
@@ -62,7 +62,13 @@ func (r *Registry) PushBlobChunkedResume(ctx context.Context, repoName, id strin
 	if err != nil {
 		return nil, err
 	}
+	repo.expireCanceledUploads(timeNow())
 	b := repo.uploads[id]
+	if b != nil && b.isCanceled() {
+		// Keep the canceled upload around so that
+		// it's not treated as a new upload below.
+		return nil, errUploadCanceled
+	}
 	if b == nil {
 		b = NewBuffer(func(b *Buffer) error {
 			r.mu.Lock()
@@ -71,6 +77,16 @@ func (r *Registry) PushBlobChunkedResume(ctx context.Context, repoName, id strin
 			repo.blobs[desc.Digest] = &blob{mediaType: desc.MediaType, data: data}
 			return nil
 		}, id)
+		b.onCancel = func(b *Buffer) {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			now := timeNow()
+			repo.canceled = append(repo.canceled, canceledUpload{
+				id:   b.ID(),
+				time: now,
+			})
+			repo.expireCanceledUploads(now)
+		}
 		repo.uploads[b.ID()] = b
 	}
 	b.checkStartOffset = offset
@@ -111,7 +127,7 @@ func (r *Registry) PushManifest(ctx context.Context, repoName string, tag string
 		if !ociref.IsValidTag(tag) {
 			return ociregistry.Descriptor{}, fmt.Errorf("invalid tag")
 		}
-		if r.cfg.ImmutableTags {
+		if r.immutableTag(repoName, tag) {
 			if currDesc, ok := repo.tags[tag]; ok {
 				if dig == currDesc.Digest {
 					if currDesc.MediaType != mediaType {
@@ -161,6 +177,9 @@ func (r *Registry) checkManifest(repoName string, mediaType string, data []byte)
 			retErr = fmt.Errorf("bad descriptor in %s: %v", info.name, err)
 			return false
 		}
+		if r.cfg.AllowDanglingReferences && info.kind != kindSubjectManifest {
+			return true
+		}
 		switch info.kind {
 		case kindBlob:
 			if repo.blobs[info.desc.Digest] == nil {
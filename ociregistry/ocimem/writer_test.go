@@ -0,0 +1,67 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocimem
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-quicktest/qt"
+
+	"cuelabs.dev/go/oci/ociregistry"
+)
+
+func TestCanceledUploadsExpire(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	qt.Patch(t, &timeNow, func() time.Time {
+		return now
+	})
+	ctx := context.Background()
+	r := New()
+	startUpload := func() string {
+		w, err := r.PushBlobChunked(ctx, "foo", 0)
+		qt.Assert(t, qt.IsNil(err))
+		_, err = w.Write([]byte("hello"))
+		qt.Assert(t, qt.IsNil(err))
+		qt.Assert(t, qt.IsNil(w.Cancel()))
+		return w.ID()
+	}
+	id1 := startUpload()
+	now = now.Add(canceledUploadTTL / 2)
+	id2 := startUpload()
+
+	// Canceled uploads can't be resumed.
+	_, err := r.PushBlobChunkedResume(ctx, "foo", id1, 5, 0)
+	qt.Assert(t, qt.ErrorIs(err, ociregistry.ErrBlobUploadUnknown))
+	_, err = r.PushBlobChunkedResume(ctx, "foo", id2, 5, 0)
+	qt.Assert(t, qt.ErrorIs(err, ociregistry.ErrBlobUploadUnknown))
+
+	// Once the first upload has expired, it's forgotten
+	// but the second is still remembered.
+	now = now.Add(canceledUploadTTL / 2)
+	_, err = r.PushBlobChunkedResume(ctx, "foo", id2, 5, 0)
+	qt.Assert(t, qt.ErrorIs(err, ociregistry.ErrBlobUploadUnknown))
+	repo := r.repos["foo"]
+	qt.Assert(t, qt.IsNil(repo.uploads[id1]))
+	qt.Assert(t, qt.IsNotNil(repo.uploads[id2]))
+	qt.Assert(t, qt.HasLen(repo.canceled, 1))
+
+	now = now.Add(canceledUploadTTL)
+	_, err = r.PushBlobChunkedResume(ctx, "foo", "other", 0, 0)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.IsNil(repo.uploads[id2]))
+	qt.Assert(t, qt.HasLen(repo.canceled, 0))
+}
@@ -0,0 +1,49 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociref
+
+import "strings"
+
+// knownRegistries maps the host names that users conventionally
+// use to refer to well-known registries to the hosts that
+// requests to those registries should be sent to.
+// Registries that are accessed at the same host that
+// users refer to them by map to themselves.
+var knownRegistries = map[string]string{
+	"docker.io":            "registry-1.docker.io",
+	"index.docker.io":      "registry-1.docker.io",
+	"registry-1.docker.io": "registry-1.docker.io",
+	"ghcr.io":              "ghcr.io",
+	"quay.io":              "quay.io",
+	"gcr.io":               "gcr.io",
+	"public.ecr.aws":       "public.ecr.aws",
+	"mcr.microsoft.com":    "mcr.microsoft.com",
+	"registry.gitlab.com":  "registry.gitlab.com",
+}
+
+// KnownRegistry reports whether host (as found in [Reference.Host])
+// refers to a well-known public registry and returns the host that
+// requests to it should be sent to. For example, references to
+// Docker Hub conventionally use the host docker.io, but its API is
+// served from registry-1.docker.io.
+//
+// If host isn't a known registry, KnownRegistry returns it unchanged
+// and false. Host names are compared case-insensitively.
+func KnownRegistry(host string) (requestHost string, ok bool) {
+	if requestHost, ok := knownRegistries[strings.ToLower(host)]; ok {
+		return requestHost, true
+	}
+	return host, false
+}
@@ -0,0 +1,51 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociref
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ParseList parses a list of references, such as the contents of
+// a file listing images. References are separated by white space,
+// including newlines. A # character starts a comment that extends
+// to the end of the line. Each reference must be in the form
+// accepted by [Parse].
+//
+// If any references are invalid, ParseList returns an error
+// that reports the line number of each of them.
+func ParseList(s string) ([]Reference, error) {
+	var (
+		refs []Reference
+		errs []error
+	)
+	for i, line := range strings.Split(s, "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		for _, f := range strings.Fields(line) {
+			ref, err := Parse(f)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("line %d: %v", i+1, err))
+				continue
+			}
+			refs = append(refs, ref)
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return refs, nil
+}
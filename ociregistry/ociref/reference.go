@@ -246,3 +246,29 @@ func (ref Reference) String() string {
 	}
 	return buf.String()
 }
+
+// Canonical returns ref with any redundant information removed.
+// Currently this means that when ref has a digest, the tag is
+// dropped, because the digest alone identifies the content.
+// For example, the canonical form of foo:latest@sha256:abc...
+// is foo@sha256:abc...
+//
+// Note that this loses information about which tag was requested
+// (and hence the check that the tag refers to the digest).
+// Use the original reference when that matters.
+func (ref Reference) Canonical() Reference {
+	if ref.Digest != "" {
+		ref.Tag = ""
+	}
+	return ref
+}
+
+// Equal reports whether ref and other identify the same content,
+// ignoring any tag that's redundant because a digest is present.
+// That is, it reports whether their canonical forms (see
+// [Reference.Canonical]) are the same.
+//
+// Use == to compare references including their tags.
+func (ref Reference) Equal(other Reference) bool {
+	return ref.Canonical() == other.Canonical()
+}
@@ -526,3 +526,129 @@ func TestIsValidTag(t *testing.T) {
 		})
 	}
 }
+
+var canonicalTests = []struct {
+	testName      string
+	ref1          string
+	ref2          string
+	wantCanonical string
+	wantEqual     bool
+}{{
+	testName:      "TagAndDigestVsDigest",
+	ref1:          "foo.com/bar:latest@sha256:9d3f2b68d3b0c4d1e50e9e3b3a1c3b7ac4cf3f9e5f9d5b8a1c2e3f4a5b6c7d8e",
+	ref2:          "foo.com/bar@sha256:9d3f2b68d3b0c4d1e50e9e3b3a1c3b7ac4cf3f9e5f9d5b8a1c2e3f4a5b6c7d8e",
+	wantCanonical: "foo.com/bar@sha256:9d3f2b68d3b0c4d1e50e9e3b3a1c3b7ac4cf3f9e5f9d5b8a1c2e3f4a5b6c7d8e",
+	wantEqual:     true,
+}, {
+	testName:      "DifferentTagsSameDigest",
+	ref1:          "foo.com/bar:v1@sha256:9d3f2b68d3b0c4d1e50e9e3b3a1c3b7ac4cf3f9e5f9d5b8a1c2e3f4a5b6c7d8e",
+	ref2:          "foo.com/bar:v2@sha256:9d3f2b68d3b0c4d1e50e9e3b3a1c3b7ac4cf3f9e5f9d5b8a1c2e3f4a5b6c7d8e",
+	wantCanonical: "foo.com/bar@sha256:9d3f2b68d3b0c4d1e50e9e3b3a1c3b7ac4cf3f9e5f9d5b8a1c2e3f4a5b6c7d8e",
+	wantEqual:     true,
+}, {
+	testName:      "TagOnly",
+	ref1:          "foo.com/bar:latest",
+	ref2:          "foo.com/bar:latest",
+	wantCanonical: "foo.com/bar:latest",
+	wantEqual:     true,
+}, {
+	testName:      "DifferentTags",
+	ref1:          "foo.com/bar:v1",
+	ref2:          "foo.com/bar:v2",
+	wantCanonical: "foo.com/bar:v1",
+	wantEqual:     false,
+}, {
+	testName:      "TagVsDigest",
+	ref1:          "foo.com/bar:latest",
+	ref2:          "foo.com/bar@sha256:9d3f2b68d3b0c4d1e50e9e3b3a1c3b7ac4cf3f9e5f9d5b8a1c2e3f4a5b6c7d8e",
+	wantCanonical: "foo.com/bar:latest",
+	wantEqual:     false,
+}, {
+	testName:      "DifferentRepositories",
+	ref1:          "foo.com/bar@sha256:9d3f2b68d3b0c4d1e50e9e3b3a1c3b7ac4cf3f9e5f9d5b8a1c2e3f4a5b6c7d8e",
+	ref2:          "foo.com/baz@sha256:9d3f2b68d3b0c4d1e50e9e3b3a1c3b7ac4cf3f9e5f9d5b8a1c2e3f4a5b6c7d8e",
+	wantCanonical: "foo.com/bar@sha256:9d3f2b68d3b0c4d1e50e9e3b3a1c3b7ac4cf3f9e5f9d5b8a1c2e3f4a5b6c7d8e",
+	wantEqual:     false,
+}, {
+	testName:      "DifferentHosts",
+	ref1:          "foo.com/bar:latest@sha256:9d3f2b68d3b0c4d1e50e9e3b3a1c3b7ac4cf3f9e5f9d5b8a1c2e3f4a5b6c7d8e",
+	ref2:          "other.com/bar@sha256:9d3f2b68d3b0c4d1e50e9e3b3a1c3b7ac4cf3f9e5f9d5b8a1c2e3f4a5b6c7d8e",
+	wantCanonical: "foo.com/bar@sha256:9d3f2b68d3b0c4d1e50e9e3b3a1c3b7ac4cf3f9e5f9d5b8a1c2e3f4a5b6c7d8e",
+	wantEqual:     false,
+}}
+
+func TestCanonicalAndEqual(t *testing.T) {
+	for _, test := range canonicalTests {
+		t.Run(test.testName, func(t *testing.T) {
+			ref1, err := ParseRelative(test.ref1)
+			qt.Assert(t, qt.IsNil(err))
+			ref2, err := ParseRelative(test.ref2)
+			qt.Assert(t, qt.IsNil(err))
+			qt.Check(t, qt.Equals(ref1.Canonical().String(), test.wantCanonical))
+			qt.Check(t, qt.Equals(ref1.Equal(ref2), test.wantEqual))
+			qt.Check(t, qt.Equals(ref2.Equal(ref1), test.wantEqual))
+			qt.Check(t, qt.IsTrue(ref1.Equal(ref1)))
+		})
+	}
+}
+
+func TestParseList(t *testing.T) {
+	refs, err := ParseList(`
+# Base images.
+example.com/foo:v1   example.com/bar@sha256:c659529df24a1878f6df8d93c652280235a50b95e862d8e5cb566ee5b9ed6386
+
+localhost:5000/baz # trailing comment
+	# indented comment
+`)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.DeepEquals(refs, []Reference{{
+		Host:       "example.com",
+		Repository: "foo",
+		Tag:        "v1",
+	}, {
+		Host:       "example.com",
+		Repository: "bar",
+		Digest:     "sha256:c659529df24a1878f6df8d93c652280235a50b95e862d8e5cb566ee5b9ed6386",
+	}, {
+		Host:       "localhost:5000",
+		Repository: "baz",
+	}}))
+
+	refs, err = ParseList("example.com/foo:v1\n\nexample.com/Bad\n# comment\nnohost\n")
+	qt.Assert(t, qt.ErrorMatches(err, `line 3: invalid reference syntax \("example.com/Bad"\)\nline 5: reference does not contain host name`))
+	qt.Assert(t, qt.IsNil(refs))
+
+	refs, err = ParseList("# nothing here\n")
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.HasLen(refs, 0))
+}
+
+func TestKnownRegistry(t *testing.T) {
+	tests := []struct {
+		host            string
+		wantRequestHost string
+		wantOK          bool
+	}{
+		{"docker.io", "registry-1.docker.io", true},
+		{"index.docker.io", "registry-1.docker.io", true},
+		{"Docker.IO", "registry-1.docker.io", true},
+		{"ghcr.io", "ghcr.io", true},
+		{"quay.io", "quay.io", true},
+		{"registry.example.com", "registry.example.com", false},
+		{"localhost:5000", "localhost:5000", false},
+		{"docker.io:5000", "docker.io:5000", false},
+		{"", "", false},
+	}
+	for _, test := range tests {
+		requestHost, ok := KnownRegistry(test.host)
+		qt.Check(t, qt.Equals(requestHost, test.wantRequestHost), qt.Commentf("host %q", test.host))
+		qt.Check(t, qt.Equals(ok, test.wantOK), qt.Commentf("host %q", test.host))
+	}
+
+	// The host of a parsed reference can be used directly.
+	ref, err := Parse("docker.io/library/ubuntu:latest")
+	qt.Assert(t, qt.IsNil(err))
+	requestHost, ok := KnownRegistry(ref.Host)
+	qt.Check(t, qt.IsTrue(ok))
+	qt.Check(t, qt.Equals(requestHost, "registry-1.docker.io"))
+}
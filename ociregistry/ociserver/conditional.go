@@ -0,0 +1,109 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociserver
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/internal/ocirequest"
+)
+
+// BlobModTimer may be implemented by a backend that records
+// when blobs were stored, to enable conditional requests for
+// blobs. When the backend implements it, responses to blob GET
+// and HEAD requests include an ETag header, and a Last-Modified
+// header when the time is known, and the server honors
+// If-None-Match and If-Modified-Since headers in those requests,
+// responding with "304 Not Modified" when the client's copy
+// is current.
+//
+// The ETag is the quoted digest of the blob. As blobs are
+// content-addressed, a blob never changes once it's been stored,
+// so If-None-Match is the more useful of the two conditions.
+type BlobModTimer interface {
+	// BlobModTime returns the time that the blob with the given
+	// digest in the given repository was stored, or the zero time
+	// if that isn't known. If the blob doesn't exist, it should
+	// return an error that wraps [ociregistry.ErrBlobUnknown].
+	BlobModTime(ctx context.Context, repo string, digest ociregistry.Digest) (time.Time, error)
+}
+
+// blobModTime returns the modification time of the blob requested by rreq.
+// It reports false if the backend doesn't implement [BlobModTimer].
+func (r *registry) blobModTime(ctx context.Context, rreq *ocirequest.Request) (time.Time, bool, error) {
+	mt, ok := r.rawBackend.(BlobModTimer)
+	if !ok {
+		return time.Time{}, false, nil
+	}
+	t, err := callOptional(r, ctx, "BlobModTime", func(ctx context.Context) (time.Time, error) {
+		return mt.BlobModTime(ctx, rreq.Repo, ociregistry.Digest(rreq.Digest))
+	})
+	return t, true, err
+}
+
+// checkBlobNotModified sets the ETag and Last-Modified headers for
+// the blob requested by rreq when the backend implements [BlobModTimer],
+// and responds with "304 Not Modified" if the conditions in req
+// show that the client already has the blob. It reports whether it
+// has responded.
+func (r *registry) checkBlobNotModified(ctx context.Context, resp http.ResponseWriter, req *http.Request, rreq *ocirequest.Request) (bool, error) {
+	modTime, ok, err := r.blobModTime(ctx, rreq)
+	if !ok || err != nil {
+		return false, err
+	}
+	etag := `"` + rreq.Digest + `"`
+	resp.Header().Set("ETag", etag)
+	if !modTime.IsZero() {
+		resp.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	}
+	if !notModified(req, etag, modTime) {
+		return false, nil
+	}
+	r.setDigestHeader(resp, ociregistry.Digest(rreq.Digest))
+	resp.WriteHeader(http.StatusNotModified)
+	return true, nil
+}
+
+// notModified reports whether the conditional headers in req show
+// that the client's copy of the content with the given entity
+// tag and modification time is current. As specified by RFC 9110,
+// If-Modified-Since is ignored when If-None-Match is present.
+func notModified(req *http.Request, etag string, modTime time.Time) bool {
+	if inm := req.Header.Values("If-None-Match"); len(inm) > 0 {
+		for _, tag := range strings.Split(strings.Join(inm, ","), ",") {
+			// Use the weak comparison function, as
+			// required for If-None-Match.
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == "*" || tag == etag {
+				return true
+			}
+		}
+		return false
+	}
+	ims := req.Header.Get("If-Modified-Since")
+	if ims == "" || modTime.IsZero() {
+		return false
+	}
+	t, err := http.ParseTime(ims)
+	if err != nil {
+		return false
+	}
+	// HTTP dates have a resolution of one second.
+	return !modTime.Truncate(time.Second).After(t)
+}
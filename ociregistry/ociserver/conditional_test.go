@@ -0,0 +1,170 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociserver_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-quicktest/qt"
+	"github.com/opencontainers/go-digest"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ocimem"
+	"cuelabs.dev/go/oci/ociregistry/ociserver"
+)
+
+func TestConditionalBlobGet(t *testing.T) {
+	ctx := context.Background()
+	content := "some blob content"
+	dig := digest.FromString(content)
+	etag := `"` + string(dig) + `"`
+	modTime := time.Date(2024, time.March, 1, 12, 0, 0, 500e6, time.UTC)
+	lastModified := "Fri, 01 Mar 2024 12:00:00 GMT"
+
+	backend := &modTimeBackend{
+		Registry: ocimem.New(),
+		modTime:  modTime,
+	}
+	_, err := backend.PushBlob(ctx, "foo", ociregistry.Descriptor{
+		MediaType: "application/octet-stream",
+		Digest:    dig,
+		Size:      int64(len(content)),
+	}, strings.NewReader(content))
+	qt.Assert(t, qt.IsNil(err))
+
+	tests := []struct {
+		testName   string
+		backend    ociregistry.Interface
+		opts       *ociserver.Options
+		digest     digest.Digest
+		header     http.Header
+		wantStatus int
+		wantETag   string
+	}{{
+		testName:   "Unconditional",
+		wantStatus: http.StatusOK,
+		wantETag:   etag,
+	}, {
+		testName:   "IfNoneMatch",
+		header:     http.Header{"If-None-Match": {etag}},
+		wantStatus: http.StatusNotModified,
+		wantETag:   etag,
+	}, {
+		testName:   "IfNoneMatchList",
+		header:     http.Header{"If-None-Match": {`"other", W/` + etag}},
+		wantStatus: http.StatusNotModified,
+		wantETag:   etag,
+	}, {
+		testName:   "IfNoneMatchWildcard",
+		header:     http.Header{"If-None-Match": {"*"}},
+		wantStatus: http.StatusNotModified,
+		wantETag:   etag,
+	}, {
+		testName:   "IfNoneMatchDifferent",
+		header:     http.Header{"If-None-Match": {`"sha256:0000"`}},
+		wantStatus: http.StatusOK,
+		wantETag:   etag,
+	}, {
+		testName:   "IfModifiedSinceSame",
+		header:     http.Header{"If-Modified-Since": {lastModified}},
+		wantStatus: http.StatusNotModified,
+		wantETag:   etag,
+	}, {
+		testName:   "IfModifiedSinceEarlier",
+		header:     http.Header{"If-Modified-Since": {"Thu, 29 Feb 2024 12:00:00 GMT"}},
+		wantStatus: http.StatusOK,
+		wantETag:   etag,
+	}, {
+		testName: "IfNoneMatchTakesPrecedence",
+		header: http.Header{
+			"If-None-Match":     {`"sha256:0000"`},
+			"If-Modified-Since": {lastModified},
+		},
+		wantStatus: http.StatusOK,
+		wantETag:   etag,
+	}, {
+		testName:   "WithBackendTimeout",
+		opts:       &ociserver.Options{BackendTimeout: time.Minute},
+		header:     http.Header{"If-None-Match": {etag}},
+		wantStatus: http.StatusNotModified,
+		wantETag:   etag,
+	}, {
+		testName:   "UnknownBlob",
+		digest:     digest.FromString("other"),
+		header:     http.Header{"If-None-Match": {"*"}},
+		wantStatus: http.StatusNotFound,
+	}, {
+		testName:   "BackendWithoutModTime",
+		backend:    backend.Registry,
+		header:     http.Header{"If-None-Match": {etag}},
+		wantStatus: http.StatusOK,
+	}}
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			b := test.backend
+			if b == nil {
+				b = backend
+			}
+			d := test.digest
+			if d == "" {
+				d = dig
+			}
+			srv := httptest.NewServer(ociserver.New(b, test.opts))
+			defer srv.Close()
+			for _, method := range []string{"GET", "HEAD"} {
+				req, err := http.NewRequest(method, srv.URL+"/v2/foo/blobs/"+string(d), nil)
+				qt.Assert(t, qt.IsNil(err))
+				for k, v := range test.header {
+					req.Header[k] = v
+				}
+				resp, err := http.DefaultClient.Do(req)
+				qt.Assert(t, qt.IsNil(err))
+				body, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				qt.Assert(t, qt.Equals(resp.StatusCode, test.wantStatus), qt.Commentf("%s; body: %s", method, body))
+				qt.Check(t, qt.Equals(resp.Header.Get("ETag"), test.wantETag), qt.Commentf("%s", method))
+				if test.wantETag != "" {
+					qt.Check(t, qt.Equals(resp.Header.Get("Last-Modified"), lastModified), qt.Commentf("%s", method))
+				}
+				switch {
+				case resp.StatusCode == http.StatusNotModified:
+					qt.Check(t, qt.Equals(string(body), ""))
+				case resp.StatusCode == http.StatusOK && method == "GET":
+					qt.Check(t, qt.Equals(string(body), content))
+				}
+			}
+		})
+	}
+}
+
+// modTimeBackend implements [ociserver.BlobModTimer] by
+// reporting the same modification time for every blob.
+type modTimeBackend struct {
+	*ocimem.Registry
+	modTime time.Time
+}
+
+func (b *modTimeBackend) BlobModTime(ctx context.Context, repo string, dig ociregistry.Digest) (time.Time, error) {
+	if _, err := b.ResolveBlob(ctx, repo, dig); err != nil {
+		return time.Time{}, err
+	}
+	return b.modTime, nil
+}
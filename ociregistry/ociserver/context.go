@@ -0,0 +1,110 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociserver
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+
+	"cuelabs.dev/go/oci/ociregistry/internal/ocirequest"
+	"cuelabs.dev/go/oci/ociregistry/ociauth"
+)
+
+type requestInfoKey struct{}
+
+type requestIDKey struct{}
+
+// requestIDHeader holds the name of the header used to
+// pass request IDs in both requests and responses.
+const requestIDHeader = "X-Request-Id"
+
+// maxRequestIDLen holds the maximum length of a request ID
+// accepted from a client.
+const maxRequestIDLen = 128
+
+// contextWithRequestInfo returns ctx annotated with the parsed
+// request and the auth scope that it requires. The latter is
+// available through [ociauth.RequestInfoFromContext].
+func contextWithRequestInfo(ctx context.Context, rreq *ocirequest.Request) context.Context {
+	ctx = context.WithValue(ctx, requestInfoKey{}, requestInfo(rreq))
+	return ociauth.ContextWithRequestInfo(ctx, ociauth.RequestInfo{
+		RequiredScope: rreq.RequiredScope(),
+	})
+}
+
+// RequestInfoFromContext returns information on the parsed OCI request
+// associated with a context. The server attaches this to the context
+// passed to the backend and to the context of the
+// [http.Request] before the request is handled, so it's
+// available to any code invoked on behalf of the request.
+// The scope required by the request is available
+// through [ociauth.RequestInfoFromContext].
+//
+// It reports whether the request information was found.
+func RequestInfoFromContext(ctx context.Context) (RequestInfo, bool) {
+	info, ok := ctx.Value(requestInfoKey{}).(RequestInfo)
+	return info, ok
+}
+
+// RequestIDFromContext returns the ID of the HTTP request associated
+// with a context. The server attaches this to the context passed to
+// the backend and to the context of the [http.Request], so that logs
+// from different layers of a proxy stack can be tied together.
+//
+// The ID is taken from the X-Request-Id request header when present
+// and valid; otherwise the server generates a new one. Either way,
+// it's echoed in the X-Request-Id response header.
+//
+// It reports whether a request ID was found.
+func RequestIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(requestIDKey{}).(string)
+	return id, ok
+}
+
+func contextWithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// requestID returns the request ID from the given X-Request-Id header
+// value if it's valid, or a newly generated ID otherwise.
+func requestID(header string) string {
+	if isValidRequestID(header) {
+		return header
+	}
+	var buf [16]byte
+	rand.Read(buf[:])
+	return hex.EncodeToString(buf[:])
+}
+
+// isValidRequestID reports whether a request ID provided by a client
+// is acceptable. To avoid problems when the ID is logged or passed on
+// to other servers, only a limited set of characters is allowed.
+func isValidRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for _, c := range []byte(id) {
+		switch {
+		case 'a' <= c && c <= 'z',
+			'A' <= c && c <= 'Z',
+			'0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
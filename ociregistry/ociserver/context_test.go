@@ -0,0 +1,155 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociserver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-quicktest/qt"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ociauth"
+)
+
+func TestRequestInfoFromContext(t *testing.T) {
+	tests := []struct {
+		testName  string
+		method    string
+		url       string
+		wantReq   RequestInfo
+		wantScope string
+	}{{
+		testName: "blob-get",
+		method:   "GET",
+		url:      "/v2/foo/bar/blobs/sha256:ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff",
+		wantReq: RequestInfo{
+			Kind:   ReqBlobGet,
+			Repo:   "foo/bar",
+			Digest: "sha256:ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff",
+		},
+		wantScope: "repository:foo/bar:pull",
+	}, {
+		testName: "manifest-get-tag",
+		method:   "GET",
+		url:      "/v2/foo/manifests/latest",
+		wantReq: RequestInfo{
+			Kind: ReqManifestGet,
+			Repo: "foo",
+			Tag:  "latest",
+		},
+		wantScope: "repository:foo:pull",
+	}, {
+		testName: "manifest-put",
+		method:   "PUT",
+		url:      "/v2/foo/manifests/latest",
+		wantReq: RequestInfo{
+			Kind: ReqManifestPut,
+			Repo: "foo",
+			Tag:  "latest",
+		},
+		wantScope: "repository:foo:push",
+	}, {
+		testName: "tags-list",
+		method:   "GET",
+		url:      "/v2/foo/tags/list?n=5",
+		wantReq: RequestInfo{
+			Kind:  ReqTagsList,
+			Repo:  "foo",
+			ListN: 5,
+		},
+		wantScope: "repository:foo:pull",
+	}, {
+		testName: "catalog",
+		method:   "GET",
+		url:      "/v2/_catalog",
+		wantReq: RequestInfo{
+			Kind:  ReqCatalogList,
+			ListN: -1,
+		},
+		wantScope: "registry:catalog:*",
+	}}
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			called := false
+			checkContext := func(ctx context.Context) {
+				called = true
+				rreq, ok := RequestInfoFromContext(ctx)
+				qt.Assert(t, qt.IsTrue(ok))
+				qt.Check(t, qt.DeepEquals(rreq, test.wantReq))
+				qt.Check(t, qt.Equals(ociauth.RequestInfoFromContext(ctx).RequiredScope.String(), test.wantScope))
+			}
+			r := New(&ociregistry.Funcs{
+				NewError: func(ctx context.Context, methodName, repo string) error {
+					checkContext(ctx)
+					return ociregistry.ErrDenied
+				},
+			}, nil)
+			req := httptest.NewRequest(test.method, test.url, strings.NewReader("{}"))
+			resp := httptest.NewRecorder()
+			r.ServeHTTP(resp, req)
+			qt.Assert(t, qt.IsTrue(called))
+			qt.Check(t, qt.Equals(resp.Code, http.StatusForbidden))
+		})
+	}
+}
+
+func TestRequestInfoFromContextNotPresent(t *testing.T) {
+	_, ok := RequestInfoFromContext(context.Background())
+	qt.Assert(t, qt.IsFalse(ok))
+}
+
+func TestRequestID(t *testing.T) {
+	var backendIDs []string
+	r := New(&ociregistry.Funcs{
+		ResolveBlob_: func(ctx context.Context, repo string, digest ociregistry.Digest) (ociregistry.Descriptor, error) {
+			id, ok := RequestIDFromContext(ctx)
+			qt.Check(t, qt.IsTrue(ok))
+			backendIDs = append(backendIDs, id)
+			return ociregistry.Descriptor{}, ociregistry.ErrBlobUnknown
+		},
+	}, nil)
+	head := func(id string) string {
+		req := httptest.NewRequest("HEAD", "/v2/foo/blobs/sha256:ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff", nil)
+		if id != "" {
+			req.Header.Set("X-Request-Id", id)
+		}
+		resp := httptest.NewRecorder()
+		r.ServeHTTP(resp, req)
+		return resp.Header().Get("X-Request-Id")
+	}
+
+	// An ID is generated when none is supplied, and
+	// is different for each request.
+	id1 := head("")
+	qt.Assert(t, qt.Matches(id1, `[0-9a-f]{32}`))
+	id2 := head("")
+	qt.Assert(t, qt.Matches(id2, `[0-9a-f]{32}`))
+	qt.Assert(t, qt.Not(qt.Equals(id1, id2)))
+
+	// A client-supplied ID is preserved.
+	id3 := head("client-id.1234")
+	qt.Assert(t, qt.Equals(id3, "client-id.1234"))
+
+	// An invalid client-supplied ID is replaced.
+	id4 := head("bad id")
+	qt.Assert(t, qt.Matches(id4, `[0-9a-f]{32}`))
+
+	// The backend sees the same ID as the client.
+	qt.Assert(t, qt.DeepEquals(backendIDs, []string{id1, id2, id3, id4}))
+}
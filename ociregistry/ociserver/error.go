@@ -15,7 +15,10 @@
 package ociserver
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
 
 	"cuelabs.dev/go/oci/ociregistry"
 )
@@ -27,3 +30,132 @@ func withHTTPCode(statusCode int, err error) error {
 func badAPIUseError(f string, a ...any) error {
 	return ociregistry.NewError(fmt.Sprintf(f, a...), ociregistry.ErrUnsupported.Code(), nil)
 }
+
+// writeError is the default implementation of Options.WriteError.
+func writeError(w http.ResponseWriter, _ *http.Request, err error) {
+	data, httpStatus := ociregistry.MarshalError(err)
+	var merr *mappedError
+	if errors.As(err, &merr) {
+		httpStatus = merr.statusCode
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpStatus)
+	w.Write(data)
+}
+
+// errorHTTPStatus returns the HTTP status code that
+// will be used in the response for err.
+func errorHTTPStatus(err error) int {
+	var merr *mappedError
+	if errors.As(err, &merr) {
+		return merr.statusCode
+	}
+	_, httpStatus := ociregistry.MarshalError(err)
+	return httpStatus
+}
+
+// mapError applies Options.ErrorStatus to err.
+func (r *registry) mapError(err error) error {
+	if r.opts.ErrorStatus == nil {
+		return err
+	}
+	statusCode, code, ok := r.opts.ErrorStatus(err)
+	if !ok {
+		return err
+	}
+	if code == "" {
+		code = "UNKNOWN"
+		var ociErr ociregistry.Error
+		if errors.As(err, &ociErr) {
+			code = ociErr.Code()
+		}
+	}
+	return &mappedError{
+		err:        err,
+		statusCode: statusCode,
+		code:       code,
+	}
+}
+
+// addUnknownRepositoryDetail adds Options.UnknownRepositoryMessage
+// as the detail of err if it's a NAME_UNKNOWN error.
+func (r *registry) addUnknownRepositoryDetail(err error) error {
+	if r.opts.UnknownRepositoryMessage == "" {
+		return err
+	}
+	var ociErr ociregistry.Error
+	if !errors.As(err, &ociErr) || ociErr.Code() != ociregistry.ErrNameUnknown.Code() {
+		return err
+	}
+	detail, _ := json.Marshal(r.opts.UnknownRepositoryMessage)
+	return &detailError{
+		err:    err,
+		code:   ociErr.Code(),
+		detail: detail,
+	}
+}
+
+// detailError wraps an error, replacing its detail.
+// It implements [ociregistry.Error].
+type detailError struct {
+	err    error
+	code   string
+	detail json.RawMessage
+}
+
+func (e *detailError) Error() string {
+	return e.err.Error()
+}
+
+func (e *detailError) Unwrap() error {
+	return e.err
+}
+
+func (e *detailError) Code() string {
+	return e.code
+}
+
+func (e *detailError) Detail() json.RawMessage {
+	return e.detail
+}
+
+// mappedError represents an error whose status code
+// and error code have been determined by Options.ErrorStatus.
+// It implements [ociregistry.Error] and [ociregistry.HTTPError].
+type mappedError struct {
+	err        error
+	statusCode int
+	code       string
+}
+
+func (e *mappedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *mappedError) Unwrap() error {
+	return e.err
+}
+
+func (e *mappedError) Code() string {
+	return e.code
+}
+
+func (e *mappedError) Detail() json.RawMessage {
+	var ociErr ociregistry.Error
+	if errors.As(e.err, &ociErr) {
+		return ociErr.Detail()
+	}
+	return nil
+}
+
+func (e *mappedError) StatusCode() int {
+	return e.statusCode
+}
+
+func (e *mappedError) Response() *http.Response {
+	return nil
+}
+
+func (e *mappedError) ResponseBody() []byte {
+	return nil
+}
@@ -16,12 +16,16 @@ package ociserver
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 
 	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ocimem"
 
 	"github.com/go-quicktest/qt"
 )
@@ -91,3 +95,141 @@ func TestHTTPStatusUsedForUnknownErrorCode(t *testing.T) {
 		}},
 	}))
 }
+
+func TestOnInternalError(t *testing.T) {
+	cause := errors.New("database connection lost")
+	type call struct {
+		path string
+		info *RequestInfo
+		err  error
+	}
+	var calls []call
+	r := New(&ociregistry.Funcs{
+		GetTag_: func(ctx context.Context, repo string, tagName string) (ociregistry.BlobReader, error) {
+			if repo == "missing" {
+				return nil, ociregistry.ErrNameUnknown
+			}
+			return nil, fmt.Errorf("cannot get tag: %w", cause)
+		},
+	}, &Options{
+		OnInternalError: func(req *http.Request, info *RequestInfo, err error) {
+			calls = append(calls, call{req.URL.Path, info, err})
+		},
+	})
+	s := httptest.NewServer(r)
+	defer s.Close()
+
+	resp, err := http.Get(s.URL + "/v2/foo/manifests/sometag")
+	qt.Assert(t, qt.IsNil(err))
+	resp.Body.Close()
+	qt.Assert(t, qt.Equals(resp.StatusCode, http.StatusInternalServerError))
+	qt.Assert(t, qt.HasLen(calls, 1))
+	qt.Check(t, qt.Equals(calls[0].path, "/v2/foo/manifests/sometag"))
+	qt.Check(t, qt.ErrorIs(calls[0].err, cause))
+	qt.Assert(t, qt.IsNotNil(calls[0].info))
+	qt.Check(t, qt.Equals(calls[0].info.Kind, ReqManifestGet))
+	qt.Check(t, qt.Equals(calls[0].info.Repo, "foo"))
+
+	// Errors that don't map to 5xx are not reported.
+	resp, err = http.Get(s.URL + "/v2/missing/manifests/sometag")
+	qt.Assert(t, qt.IsNil(err))
+	resp.Body.Close()
+	qt.Assert(t, qt.Equals(resp.StatusCode, http.StatusNotFound))
+	qt.Check(t, qt.HasLen(calls, 1))
+}
+
+type quotaError struct{}
+
+func (quotaError) Error() string {
+	return "storage quota exceeded"
+}
+
+func TestErrorStatus(t *testing.T) {
+	r := New(&ociregistry.Funcs{
+		GetTag_: func(ctx context.Context, repo string, tagName string) (ociregistry.BlobReader, error) {
+			switch repo {
+			case "quota":
+				return nil, fmt.Errorf("cannot get tag: %w", quotaError{})
+			case "denied":
+				return nil, ociregistry.ErrDenied
+			}
+			return nil, ociregistry.ErrManifestUnknown
+		},
+	}, &Options{
+		ErrorStatus: func(err error) (int, string, bool) {
+			if errors.As(err, new(quotaError)) {
+				return http.StatusInsufficientStorage, "QUOTA_EXCEEDED", true
+			}
+			if errors.Is(err, ociregistry.ErrDenied) {
+				// Keep the error code but hide the
+				// resource's existence.
+				return http.StatusNotFound, "", true
+			}
+			return 0, "", false
+		},
+	})
+	s := httptest.NewServer(r)
+	defer s.Close()
+
+	tests := []struct {
+		repo       string
+		wantStatus int
+		wantCode   string
+		wantMsg    string
+	}{{
+		repo:       "quota",
+		wantStatus: http.StatusInsufficientStorage,
+		wantCode:   "QUOTA_EXCEEDED",
+		wantMsg:    "cannot get tag: storage quota exceeded",
+	}, {
+		repo:       "denied",
+		wantStatus: http.StatusNotFound,
+		wantCode:   ociregistry.ErrDenied.Code(),
+		wantMsg:    "requested access to the resource is denied",
+	}, {
+		repo:       "other",
+		wantStatus: http.StatusNotFound,
+		wantCode:   ociregistry.ErrManifestUnknown.Code(),
+		wantMsg:    "manifest unknown to registry",
+	}}
+	for _, test := range tests {
+		resp, err := http.Get(s.URL + "/v2/" + test.repo + "/manifests/sometag")
+		qt.Assert(t, qt.IsNil(err))
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		qt.Check(t, qt.Equals(resp.StatusCode, test.wantStatus), qt.Commentf("repo %s", test.repo))
+		qt.Check(t, qt.JSONEquals(body, &ociregistry.WireErrors{
+			Errors: []ociregistry.WireError{{
+				Code_:   test.wantCode,
+				Message: test.wantMsg,
+			}},
+		}), qt.Commentf("repo %s", test.repo))
+	}
+}
+
+func TestUnknownRepositoryMessage(t *testing.T) {
+	const msg = "see https://example.com/onboarding to create a repository"
+	s := httptest.NewServer(New(ocimem.New(), &Options{
+		UnknownRepositoryMessage: msg,
+	}))
+	defer s.Close()
+
+	for _, path := range []string{
+		"/v2/unknown/tags/list",
+		"/v2/unknown/manifests/sometag",
+		"/v2/unknown/blobs/sha256:ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff",
+	} {
+		resp, err := http.Get(s.URL + path)
+		qt.Assert(t, qt.IsNil(err))
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		qt.Check(t, qt.Equals(resp.StatusCode, http.StatusNotFound), qt.Commentf("path %s", path))
+		qt.Check(t, qt.JSONEquals(body, &ociregistry.WireErrors{
+			Errors: []ociregistry.WireError{{
+				Code_:   ociregistry.ErrNameUnknown.Code(),
+				Message: "repository name not known to registry",
+				Detail_: json.RawMessage(`"` + msg + `"`),
+			}},
+		}), qt.Commentf("path %s", path))
+	}
+}
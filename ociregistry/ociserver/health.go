@@ -0,0 +1,74 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"cuelabs.dev/go/oci/ociregistry"
+)
+
+// Pinger may be implemented by a backend to provide
+// a lightweight health check for [Options.HealthPath].
+type Pinger interface {
+	// Ping returns a non-nil error if the backend
+	// is not able to serve requests.
+	Ping(ctx context.Context) error
+}
+
+// handleHealth responds to a request on the health path.
+// It's not part of the OCI API, so errors are reported as
+// plain text rather than in the OCI error format.
+func (r *registry) handleHealth(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		resp.Header().Set("Allow", "GET, HEAD")
+		http.Error(resp, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	resp.Header().Set("Cache-Control", "no-store")
+	if err := r.checkHealth(req.Context()); err != nil {
+		if debug {
+			r.logf("health check failed: %v", err)
+		}
+		http.Error(resp, fmt.Sprintf("unhealthy: %v", err), http.StatusServiceUnavailable)
+		return
+	}
+	resp.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	resp.WriteHeader(http.StatusOK)
+	if req.Method == "GET" {
+		resp.Write([]byte("ok\n"))
+	}
+}
+
+func (r *registry) checkHealth(ctx context.Context) error {
+	if p, ok := r.rawBackend.(Pinger); ok {
+		_, err := callOptional(r, ctx, "Ping", func(ctx context.Context) (struct{}, error) {
+			return struct{}{}, p.Ping(ctx)
+		})
+		return err
+	}
+	var err error
+	r.backend.Repositories(ctx, "")(func(_ string, err1 error) bool {
+		err = err1
+		return false
+	})
+	if errors.Is(err, ociregistry.ErrUnsupported) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,137 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociserver
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-quicktest/qt"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ocimem"
+)
+
+var healthTests = []struct {
+	testName   string
+	backend    ociregistry.Interface
+	timeout    time.Duration
+	wantStatus int
+	wantBody   string
+}{{
+	testName:   "Healthy",
+	backend:    ocimem.New(),
+	wantStatus: http.StatusOK,
+	wantBody:   "ok\n",
+}, {
+	testName: "RepositoriesError",
+	backend: &ociregistry.Funcs{
+		Repositories_: func(ctx context.Context, startAfter string) ociregistry.Seq[string] {
+			return ociregistry.ErrorSeq[string](fmt.Errorf("database is down"))
+		},
+	},
+	wantStatus: http.StatusServiceUnavailable,
+	wantBody:   "unhealthy: database is down\n",
+}, {
+	testName:   "RepositoriesUnsupported",
+	backend:    &ociregistry.Funcs{},
+	wantStatus: http.StatusOK,
+	wantBody:   "ok\n",
+}, {
+	testName: "PingError",
+	backend: pingBackend{
+		Interface: ocimem.New(),
+		err:       fmt.Errorf("cannot reach storage"),
+	},
+	wantStatus: http.StatusServiceUnavailable,
+	wantBody:   "unhealthy: cannot reach storage\n",
+}, {
+	testName: "PingOK",
+	backend: pingBackend{
+		// The Repositories method would fail, but Ping
+		// takes precedence.
+		Interface: &ociregistry.Funcs{
+			Repositories_: func(ctx context.Context, startAfter string) ociregistry.Seq[string] {
+				return ociregistry.ErrorSeq[string](fmt.Errorf("should not be called"))
+			},
+		},
+	},
+	wantStatus: http.StatusOK,
+	wantBody:   "ok\n",
+}, {
+	testName: "PingErrorWithBackendTimeout",
+	backend: pingBackend{
+		Interface: ocimem.New(),
+		err:       fmt.Errorf("cannot reach storage"),
+	},
+	// Ping is still found when the backend
+	// is wrapped to apply the timeout.
+	timeout:    time.Minute,
+	wantStatus: http.StatusServiceUnavailable,
+	wantBody:   "unhealthy: cannot reach storage\n",
+}}
+
+func TestHealth(t *testing.T) {
+	for _, test := range healthTests {
+		t.Run(test.testName, func(t *testing.T) {
+			s := httptest.NewServer(New(test.backend, &Options{
+				HealthPath:     "/healthz",
+				BackendTimeout: test.timeout,
+			}))
+			defer s.Close()
+			resp, err := http.Get(s.URL + "/healthz")
+			qt.Assert(t, qt.IsNil(err))
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			qt.Check(t, qt.Equals(resp.StatusCode, test.wantStatus))
+			qt.Check(t, qt.Equals(string(body), test.wantBody))
+		})
+	}
+}
+
+func TestHealthMethodNotAllowed(t *testing.T) {
+	s := httptest.NewServer(New(ocimem.New(), &Options{
+		HealthPath: "/healthz",
+	}))
+	defer s.Close()
+	resp, err := http.Post(s.URL+"/healthz", "text/plain", nil)
+	qt.Assert(t, qt.IsNil(err))
+	resp.Body.Close()
+	qt.Check(t, qt.Equals(resp.StatusCode, http.StatusMethodNotAllowed))
+	qt.Check(t, qt.Equals(resp.Header.Get("Allow"), "GET, HEAD"))
+}
+
+func TestHealthPathNotConfigured(t *testing.T) {
+	s := httptest.NewServer(New(ocimem.New(), nil))
+	defer s.Close()
+	resp, err := http.Get(s.URL + "/healthz")
+	qt.Assert(t, qt.IsNil(err))
+	resp.Body.Close()
+	qt.Check(t, qt.Equals(resp.StatusCode, http.StatusNotFound))
+}
+
+type pingBackend struct {
+	ociregistry.Interface
+	err error
+}
+
+func (b pingBackend) Ping(ctx context.Context) error {
+	return b.err
+}
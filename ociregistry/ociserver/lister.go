@@ -30,8 +30,6 @@ import (
 	"cuelabs.dev/go/oci/ociregistry/internal/ocirequest"
 )
 
-const maxPageSize = 10000
-
 type catalog struct {
 	Repos []string `json:"repositories"`
 }
@@ -60,7 +58,13 @@ func (r *registry) handleTagsList(ctx context.Context, resp http.ResponseWriter,
 }
 
 func (r *registry) handleCatalogList(ctx context.Context, resp http.ResponseWriter, req *http.Request, rreq *ocirequest.Request) (_err error) {
-	repos, link, err := r.nextListResults(req, rreq, r.backend.Repositories(ctx, rreq.ListLast))
+	it := r.backend.Repositories(ctx, rreq.ListLast)
+	if r.opts.CatalogFilter != nil {
+		// Filter before paginating so that pages are full and the
+		// Link header only refers to repositories the caller can see.
+		it = filterRepositories(ctx, r.opts.CatalogFilter, it)
+	}
+	repos, link, err := r.nextListResults(req, rreq, it)
 	if err != nil {
 		return err
 	}
@@ -79,10 +83,61 @@ func (r *registry) handleCatalogList(ctx context.Context, resp http.ResponseWrit
 	return nil
 }
 
-// TODO: implement handling of artifactType querystring
+// catalogFilterBatchSize holds the maximum number of repository
+// names passed to Options.CatalogFilter at once.
+const catalogFilterBatchSize = 100
+
+// filterRepositories returns an iterator over the repository names
+// in it that are allowed by filter. The names are passed to filter
+// in batches as they're needed.
+func filterRepositories(ctx context.Context, filter func(ctx context.Context, repos []string) []string, it ociregistry.Seq[string]) ociregistry.Seq[string] {
+	return func(yield func(string, error) bool) {
+		batch := make([]string, 0, catalogFilterBatchSize)
+		stopped := false
+		// flush yields the allowed names in the current batch,
+		// reporting whether iteration should continue.
+		flush := func() bool {
+			if len(batch) == 0 {
+				return true
+			}
+			allowed := filter(ctx, batch)
+			for _, repo := range allowed {
+				if !yield(repo, nil) {
+					return false
+				}
+			}
+			batch = batch[:0]
+			return true
+		}
+		// TODO(go1.23) for repo, err := range it {
+		it(func(repo string, err error) bool {
+			if err != nil {
+				if flush() {
+					yield("", err)
+				}
+				stopped = true
+				return false
+			}
+			batch = append(batch, repo)
+			if len(batch) >= catalogFilterBatchSize && !flush() {
+				stopped = true
+				return false
+			}
+			return true
+		})
+		if !stopped {
+			flush()
+		}
+	}
+}
+
+// errReferrersDisabled is returned for requests to the referrers
+// endpoint when Options.DisableReferrersAPI is set.
+var errReferrersDisabled = withHTTPCode(http.StatusNotFound, fmt.Errorf("referrers API has been disabled"))
+
 func (r *registry) handleReferrersList(ctx context.Context, resp http.ResponseWriter, req *http.Request, rreq *ocirequest.Request) (_err error) {
 	if r.opts.DisableReferrersAPI {
-		return withHTTPCode(http.StatusNotFound, fmt.Errorf("referrers API has been disabled"))
+		return errReferrersDisabled
 	}
 
 	im := &ocispec.Index{
@@ -90,20 +145,30 @@ func (r *registry) handleReferrersList(ctx context.Context, resp http.ResponseWr
 		MediaType: mediaTypeOCIImageIndex,
 	}
 
-	// TODO support artifactType filtering
-	it := r.backend.Referrers(ctx, rreq.Repo, ociregistry.Digest(rreq.Digest), "")
+	it := r.backend.Referrers(ctx, rreq.Repo, ociregistry.Digest(rreq.Digest), rreq.ArtifactType)
+	// filtered records whether all the results match the
+	// requested artifact type. If they don't, the backend
+	// has ignored the filter and the client will need to
+	// apply it.
+	filtered := rreq.ArtifactType != ""
 	// TODO(go1.23) for desc, err := range it {
 	it(func(desc ociregistry.Descriptor, err error) bool {
 		if err != nil {
 			_err = err
 			return false
 		}
+		if desc.ArtifactType != rreq.ArtifactType {
+			filtered = false
+		}
 		im.Manifests = append(im.Manifests, desc)
 		return true
 	})
 	if _err != nil {
 		return _err
 	}
+	if filtered {
+		resp.Header().Set("OCI-Filters-Applied", "artifactType")
+	}
 	msg, err := json.Marshal(im)
 	if err != nil {
 		return err
@@ -119,9 +184,14 @@ func (r *registry) nextListResults(req *http.Request, rreq *ocirequest.Request,
 	if r.opts.MaxListPageSize > 0 && rreq.ListN > r.opts.MaxListPageSize {
 		return nil, "", ociregistry.NewError(fmt.Sprintf("query parameter n is too large (n=%d, max=%d)", rreq.ListN, r.opts.MaxListPageSize), ociregistry.ErrUnsupported.Code(), nil)
 	}
+	if rreq.ListN == 0 {
+		// An explicit n=0 asks for no items at all, which
+		// is distinct from the absence of n (ListN == -1).
+		return []string{}, "", nil
+	}
 	n := rreq.ListN
-	if n <= 0 {
-		n = maxPageSize
+	if limit := r.opts.ListPageSizeLimit; limit > 0 && (n < 0 || n > limit) {
+		n = limit
 	}
 	truncated := false
 	// TODO(go1.23) for repo, err := range itemsIter {
@@ -130,12 +200,10 @@ func (r *registry) nextListResults(req *http.Request, rreq *ocirequest.Request,
 			_err = err
 			return false
 		}
-		if rreq.ListN > 0 && len(items) >= rreq.ListN {
+		if n > 0 && len(items) >= n {
 			truncated = true
 			return false
 		}
-		// TODO we might want some way to limit on the total number
-		// of items returned in the absence of a ListN limit.
 		items = append(items, item)
 		// TODO sanity check that the items are in lexical order?
 		return true
@@ -166,5 +234,5 @@ func (r *registry) makeNextLink(req *http.Request, startAfter string) string {
 		Path:     req.URL.Path,
 		RawQuery: query.Encode(),
 	}
-	return fmt.Sprintf(`<%v>;rel="next"`, u)
+	return fmt.Sprintf(`<%s>;rel="next"`, r.absoluteLocation(req, u.String()))
 }
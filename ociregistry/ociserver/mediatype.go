@@ -25,5 +25,12 @@ const (
 	mediaTypeOCIManifestSchema1             = ocispec.MediaTypeImageManifest
 	mediaTypeOCIConfigJSON                  = ocispec.MediaTypeImageConfig
 	mediaTypeDockerConfigJSON               = "application/vnd.docker.container.image.v1+json"
+	mediaTypeDockerManifest                 = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeDockerManifestList             = "application/vnd.docker.distribution.manifest.list.v2+json"
 	mediaTypeOctetStream                    = "application/octet-stream"
+	mediaTypeDescriptor                     = ocispec.MediaTypeDescriptor
+
+	// mediaTypeArtifactManifest is the media type of artifact manifests,
+	// which were removed before version 1.1 of the image spec was released.
+	mediaTypeArtifactManifest = "application/vnd.oci.artifact.manifest.v1+json"
 )
@@ -18,6 +18,7 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -166,3 +167,60 @@ func TestProxyRequests(t *testing.T) {
 		})
 	}
 }
+
+func TestProxyUnknownBlobSize(t *testing.T) {
+	ctx := context.Background()
+	backend := ocimem.New()
+	// The content is large enough that the client doesn't
+	// read it into memory to find its size.
+	content := bytes.Repeat([]byte("some blob content "), 10000)
+	desc := ociregistry.Descriptor{
+		MediaType: "application/octet-stream",
+		Digest:    digest.FromBytes(content),
+		Size:      int64(len(content)),
+	}
+	_, err := backend.PushBlob(ctx, "foo/bar", desc, bytes.NewReader(content))
+	qt.Assert(t, qt.IsNil(err))
+
+	// The backend registry doesn't report the sizes of blobs,
+	// so the proxy doesn't know them either.
+	handler := ociserver.New(backend, nil)
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		handler.ServeHTTP(noContentLengthWriter{w}, req)
+	}))
+	defer backendServer.Close()
+	proxyServer := httptest.NewServer(ociserver.New(testClient(t, backendServer), nil))
+	defer proxyServer.Close()
+
+	resp, err := http.Get(proxyServer.URL + "/v2/foo/bar/blobs/" + string(desc.Digest))
+	qt.Assert(t, qt.IsNil(err))
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.Equals(resp.StatusCode, http.StatusOK))
+	qt.Check(t, qt.Equals(resp.ContentLength, int64(-1)))
+	qt.Check(t, qt.DeepEquals(data, content))
+
+	// The content is still verified by a client of the proxy.
+	rd, err := testClient(t, proxyServer).GetBlob(ctx, "foo/bar", desc.Digest)
+	qt.Assert(t, qt.IsNil(err))
+	defer rd.Close()
+	data, err = io.ReadAll(rd)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.DeepEquals(data, content))
+	qt.Check(t, qt.Equals(rd.Descriptor().Size, int64(len(content))))
+}
+
+// noContentLengthWriter is an [http.ResponseWriter] that removes
+// any Content-Length header from the response. It flushes the
+// response after writing the header so that the server can't
+// add the header itself.
+type noContentLengthWriter struct {
+	http.ResponseWriter
+}
+
+func (w noContentLengthWriter) WriteHeader(code int) {
+	w.Header().Del("Content-Length")
+	w.ResponseWriter.WriteHeader(code)
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
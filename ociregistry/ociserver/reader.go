@@ -15,29 +15,51 @@
 package ociserver
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io"
 	"net/http"
 
+	"github.com/opencontainers/go-digest"
+
 	"cuelabs.dev/go/oci/ociregistry"
 	"cuelabs.dev/go/oci/ociregistry/internal/ocirequest"
 )
 
 func (r *registry) handleBlobHead(ctx context.Context, resp http.ResponseWriter, req *http.Request, rreq *ocirequest.Request) error {
+	if done, err := r.checkBlobNotModified(ctx, resp, req, rreq); done || err != nil {
+		return err
+	}
 	desc, err := r.backend.ResolveBlob(ctx, rreq.Repo, ociregistry.Digest(rreq.Digest))
 	if err != nil {
 		return err
 	}
-	resp.Header().Set("Content-Length", fmt.Sprint(desc.Size))
-	resp.Header().Set("Docker-Content-Digest", string(desc.Digest))
+	setContentLength(resp, desc.Size)
+	r.setDigestHeader(resp, desc.Digest)
 	// TODO this is true in theory, but what if the backend doesn't support GetBlobRange ?
 	resp.Header().Set("Accept-Ranges", "bytes")
 	resp.WriteHeader(http.StatusOK)
 	return nil
 }
 
+// handleBlobGet serves the content of a blob.
+//
+// The content is always served exactly as stored, regardless of any
+// Accept-Encoding request header. A blob with a compressed media type
+// such as application/vnd.oci.image.layer.v1.tar+gzip is compressed as
+// part of its content rather than as a content coding, so the response
+// never has a Content-Encoding header: that would cause clients to
+// decompress the content and see bytes that don't match the digest.
+// For the same reason, the response asks intermediaries not to
+// transform the content.
+//
+// When the backend implements [BlobModTimer], conditional
+// requests are honored.
 func (r *registry) handleBlobGet(ctx context.Context, resp http.ResponseWriter, req *http.Request, rreq *ocirequest.Request) error {
+	if done, err := r.checkBlobNotModified(ctx, resp, req, rreq); done || err != nil {
+		return err
+	}
 	if r.opts.LocationsForDescriptor != nil {
 		// We need to find information on the blob before we can determine
 		// what to pass back, so resolve the blob first so we don't
@@ -68,19 +90,7 @@ func (r *registry) handleBlobGet(ctx context.Context, resp http.ResponseWriter,
 	}
 	switch len(ranges) {
 	case 0:
-		blob, err := r.backend.GetBlob(ctx, rreq.Repo, ociregistry.Digest(rreq.Digest))
-		if err != nil {
-			return err
-		}
-		defer blob.Close()
-		desc := blob.Descriptor()
-		resp.Header().Set("Content-Type", desc.MediaType)
-		resp.Header().Set("Content-Length", fmt.Sprint(desc.Size))
-		resp.Header().Set("Docker-Content-Digest", rreq.Digest)
-		resp.WriteHeader(http.StatusOK)
-
-		io.Copy(resp, blob)
-		return nil
+		return r.serveBlob(ctx, resp, rreq)
 	case 1:
 		rng := ranges[0]
 		blob, err := r.backend.GetBlobRange(ctx, rreq.Repo, ociregistry.Digest(rreq.Digest), rng.start, rng.end)
@@ -88,24 +98,39 @@ func (r *registry) handleBlobGet(ctx context.Context, resp http.ResponseWriter,
 			// TODO fall back to using GetBlob if err is ErrUnsupported?
 			return err
 		}
-		defer blob.Close()
 		desc := blob.Descriptor()
-		if rng.end == -1 || rng.end > desc.Size {
-			rng.end = desc.Size
+		if desc.Size < 0 && rng.end == -1 {
+			// The size of the blob isn't known, so we can't say
+			// where the range ends. Ignoring the Range header
+			// is allowed, so send the whole blob instead.
+			blob.Close()
+			return r.serveBlob(ctx, resp, rreq)
 		}
-		if rng.start > desc.Size {
-			return withHTTPCode(http.StatusRequestedRangeNotSatisfiable, fmt.Errorf("range starts after end of blob"))
+		defer blob.Close()
+		// total holds the size in the Content-Range header.
+		total := "*"
+		if desc.Size >= 0 {
+			if rng.end == -1 || rng.end > desc.Size {
+				rng.end = desc.Size
+			}
+			if rng.start > desc.Size {
+				return withHTTPCode(http.StatusRequestedRangeNotSatisfiable, fmt.Errorf("range starts after end of blob"))
+			}
+			total = fmt.Sprint(desc.Size)
 		}
 		if rng.end < rng.start {
 			return withHTTPCode(http.StatusRequestedRangeNotSatisfiable, fmt.Errorf("range end is before start"))
 		}
 		resp.Header().Set("Content-Type", desc.MediaType)
 		resp.Header().Set("Content-Length", fmt.Sprint(rng.end-rng.start))
-		resp.Header().Set("Docker-Content-Digest", rreq.Digest)
-		resp.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", rng.start, rng.end-1, desc.Size))
+		r.setDigestHeader(resp, ociregistry.Digest(rreq.Digest))
+		resp.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%s", rng.start, rng.end-1, total))
+		resp.Header().Set("Cache-Control", "no-transform")
 		resp.WriteHeader(http.StatusPartialContent)
 
-		io.Copy(resp, blob)
+		// Guard against backends that return more than
+		// the requested range.
+		streamContent(resp, io.LimitReader(blob, rng.end-rng.start))
 		return nil
 
 	default:
@@ -113,6 +138,102 @@ func (r *registry) handleBlobGet(ctx context.Context, resp http.ResponseWriter,
 	}
 }
 
+// serveBlob serves the whole content of the requested blob.
+func (r *registry) serveBlob(ctx context.Context, resp http.ResponseWriter, rreq *ocirequest.Request) error {
+	blob, err := r.backend.GetBlob(ctx, rreq.Repo, ociregistry.Digest(rreq.Digest))
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+	desc := blob.Descriptor()
+	resp.Header().Set("Content-Type", desc.MediaType)
+	setContentLength(resp, desc.Size)
+	resp.Header().Set("Cache-Control", "no-transform")
+	r.setDigestHeader(resp, ociregistry.Digest(rreq.Digest))
+	resp.WriteHeader(http.StatusOK)
+
+	streamContent(resp, blob)
+	return nil
+}
+
+// streamFlushInterval holds the number of bytes written
+// between flushes of the response when streaming.
+const streamFlushInterval = 1024 * 1024
+
+// streamContent copies the content of r to resp, flushing the
+// response periodically so that clients see progress on large
+// downloads. The response header has already been written by the
+// time this is called, so there's no way to report an error to
+// the client other than by terminating the response early, which
+// is what happens.
+func streamContent(resp http.ResponseWriter, r io.Reader) {
+	io.Copy(&flushWriter{
+		w:  resp,
+		rc: http.NewResponseController(resp),
+	}, r)
+}
+
+// flushWriter is an [io.Writer] that flushes the response that
+// it writes to after every streamFlushInterval bytes.
+type flushWriter struct {
+	w         http.ResponseWriter
+	rc        *http.ResponseController
+	unflushed int64
+}
+
+func (w *flushWriter) Write(buf []byte) (int, error) {
+	total := 0
+	for len(buf) > 0 {
+		// Split large writes, as made by io.WriterTo
+		// implementations, so that flushes are regular.
+		chunk := buf[:min(int64(len(buf)), streamFlushInterval-w.unflushed)]
+		n, err := w.w.Write(chunk)
+		total += n
+		w.wrote(int64(n))
+		if err != nil {
+			return total, err
+		}
+		buf = buf[n:]
+	}
+	return total, nil
+}
+
+// ReadFrom implements [io.ReaderFrom] by copying streamFlushInterval
+// bytes at a time, so that the response's own ReadFrom method,
+// which can use sendfile for file-backed content, is used
+// by io.Copy.
+func (w *flushWriter) ReadFrom(r io.Reader) (int64, error) {
+	var total int64
+	for {
+		// Note: use io.CopyN rather than calling w.w.ReadFrom
+		// directly so that we don't need to care whether
+		// w.w implements io.ReaderFrom.
+		n, err := io.CopyN(w.w, r, streamFlushInterval-w.unflushed)
+		total += n
+		w.wrote(n)
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+// wrote records that n bytes have been written,
+// flushing the response if needed.
+func (w *flushWriter) wrote(n int64) {
+	w.unflushed += n
+	if w.unflushed >= streamFlushInterval {
+		// Ignore the error: the writer might not support flushing.
+		w.rc.Flush()
+		w.unflushed = 0
+	}
+}
+
+// handleManifestGet serves a manifest. Unlike blobs, manifests
+// are always served in full: any Range header in the request is
+// ignored and the response is never 206 Partial Content.
 func (r *registry) handleManifestGet(ctx context.Context, resp http.ResponseWriter, req *http.Request, rreq *ocirequest.Request) error {
 	// TODO we could do a redirect here too if we thought it was worthwhile.
 	var mr ociregistry.BlobReader
@@ -125,17 +246,55 @@ func (r *registry) handleManifestGet(ctx context.Context, resp http.ResponseWrit
 	if err != nil {
 		return err
 	}
+	defer mr.Close()
 	desc := mr.Descriptor()
-	if !r.opts.OmitDigestFromTagGetResponse {
-		resp.Header().Set("Docker-Content-Digest", string(desc.Digest))
+	var content io.Reader = mr
+	if mayHaveSubject(desc.MediaType) || desc.Digest == "" {
+		// Read the manifest so that we can find its subject
+		// to include in the response headers and, if the
+		// backend didn't provide it, its digest.
+		limit := desc.Size
+		if limit < 0 {
+			// The size isn't known.
+			limit = maxManifestSize
+		}
+		data, err := io.ReadAll(io.LimitReader(mr, limit+1))
+		if err != nil {
+			return fmt.Errorf("cannot read manifest: %v", err)
+		}
+		if desc.Size < 0 && int64(len(data)) <= maxManifestSize {
+			desc.Size = int64(len(data))
+		}
+		if int64(len(data)) != desc.Size {
+			return fmt.Errorf("manifest size mismatch (%d/%d)", len(data), desc.Size)
+		}
+		if desc.Digest == "" {
+			desc.Digest = digest.FromBytes(data)
+		}
+		// Ignore the error: the manifest was checked when
+		// it was pushed and the header is only informational.
+		if subject, _ := subjectFromManifest(desc.MediaType, data); subject != nil {
+			resp.Header().Set("OCI-Subject", string(subject.Digest))
+		}
+		content = bytes.NewReader(data)
+	}
+	if !r.opts.OmitDigestFromTagGetResponse || rreq.Tag == "" {
+		// Clients getting a manifest by tag can use the digest
+		// to pin it without making another request.
+		r.setDigestHeader(resp, desc.Digest)
 	}
 	resp.Header().Set("Content-Type", desc.MediaType)
-	resp.Header().Set("Content-Length", fmt.Sprint(desc.Size))
+	setContentLength(resp, desc.Size)
 	resp.WriteHeader(http.StatusOK)
-	io.Copy(resp, mr)
+	io.Copy(resp, content)
 	return nil
 }
 
+// maxManifestSize holds the maximum size of a manifest of unknown
+// size that will be read into memory. This is the size that the
+// spec recommends registries should accept for manifests.
+const maxManifestSize = 4 << 20
+
 func (r *registry) handleManifestHead(ctx context.Context, resp http.ResponseWriter, req *http.Request, rreq *ocirequest.Request) error {
 	var desc ociregistry.Descriptor
 	var err error
@@ -152,10 +311,34 @@ func (r *registry) handleManifestHead(ctx context.Context, resp http.ResponseWri
 		// to expect that the digest header is set on the response
 		// even though the spec says it's only optional in this case.
 		// TODO raise an issue on the spec about this.
-		resp.Header().Set("Docker-Content-Digest", string(desc.Digest))
+		r.setDigestHeader(resp, desc.Digest)
+	}
+	if subject := manifestSubject(desc); subject != "" {
+		resp.Header().Set("OCI-Subject", string(subject))
 	}
 	resp.Header().Set("Content-Type", desc.MediaType)
-	resp.Header().Set("Content-Length", fmt.Sprint(desc.Size))
+	setContentLength(resp, desc.Size)
 	resp.WriteHeader(http.StatusOK)
 	return nil
 }
+
+// manifestSubject returns the digest of the subject of the
+// manifest with the given descriptor, or the empty string if it has
+// none or it can't be determined cheaply. The manifest content isn't
+// available from the Resolve methods, so the subject is only found
+// when the backend embeds the content in the descriptor's Data field.
+func manifestSubject(desc ociregistry.Descriptor) ociregistry.Digest {
+	if !mayHaveSubject(desc.MediaType) || desc.Data == nil {
+		return ""
+	}
+	if int64(len(desc.Data)) != desc.Size || !desc.Digest.Algorithm().Available() || desc.Digest.Algorithm().FromBytes(desc.Data) != desc.Digest {
+		return ""
+	}
+	// Ignore the error: the header that uses the
+	// result is only informational.
+	subject, _ := subjectFromManifest(desc.MediaType, desc.Data)
+	if subject == nil {
+		return ""
+	}
+	return subject.Digest
+}
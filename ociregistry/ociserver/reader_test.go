@@ -0,0 +1,341 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociserver
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"sync/atomic"
+	"testing"
+
+	"github.com/go-quicktest/qt"
+	"github.com/opencontainers/go-digest"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ocimem"
+)
+
+const largeBlobDigest = "sha256:ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff"
+
+func TestStreamContentFlushes(t *testing.T) {
+	const size = 3*streamFlushInterval + streamFlushInterval/2
+	tests := []struct {
+		testName string
+		r        func() io.Reader
+	}{{
+		testName: "Reader",
+		r: func() io.Reader {
+			var nread atomic.Int64
+			return newSyntheticBlob(size, &nread)
+		},
+	}, {
+		// bytes.Reader implements io.WriterTo, which
+		// io.Copy prefers to the writer's io.ReaderFrom.
+		testName: "WriterTo",
+		r: func() io.Reader {
+			return bytes.NewReader(make([]byte, size))
+		},
+	}}
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			w := &flushRecorder{
+				ResponseRecorder: httptest.NewRecorder(),
+			}
+			streamContent(w, test.r())
+			qt.Assert(t, qt.Equals(w.Body.Len(), size))
+			// The response is flushed after each interval;
+			// the remainder is flushed by the server when
+			// the handler returns.
+			qt.Assert(t, qt.DeepEquals(w.flushedAt, []int{
+				streamFlushInterval,
+				2 * streamFlushInterval,
+				3 * streamFlushInterval,
+			}))
+		})
+	}
+}
+
+func TestStreamContentUsesReadFrom(t *testing.T) {
+	// The response's ReadFrom method, which can use sendfile
+	// for file-backed content, is used for the copy.
+	const size = 2*streamFlushInterval + 10
+	var nread atomic.Int64
+	w := &readFromRecorder{
+		flushRecorder: flushRecorder{
+			ResponseRecorder: httptest.NewRecorder(),
+		},
+	}
+	streamContent(w, newSyntheticBlob(size, &nread))
+	qt.Assert(t, qt.Equals(w.Body.Len(), size))
+	qt.Assert(t, qt.Equals(w.readFrom, size))
+	qt.Assert(t, qt.DeepEquals(w.flushedAt, []int{
+		streamFlushInterval,
+		2 * streamFlushInterval,
+	}))
+}
+
+// readFromRecorder is a flushRecorder that implements
+// [io.ReaderFrom], recording how much is copied with it.
+type readFromRecorder struct {
+	flushRecorder
+	readFrom int
+}
+
+func (w *readFromRecorder) ReadFrom(r io.Reader) (int64, error) {
+	n, err := w.Body.ReadFrom(r)
+	w.readFrom += int(n)
+	return n, err
+}
+
+// flushRecorder records the amount of content written
+// when the response is flushed.
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushedAt []int
+}
+
+func (w *flushRecorder) Flush() {
+	w.flushedAt = append(w.flushedAt, w.Body.Len())
+	w.ResponseRecorder.Flush()
+}
+
+func TestBlobGetStreamsWithBoundedMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping large blob test in short mode")
+	}
+	// Serve a blob much larger than the amount of memory
+	// that the server should need to stream it.
+	const size = 256 * 1024 * 1024
+	const maxHeapGrowth = 32 * 1024 * 1024
+	var nread atomic.Int64
+	r := New(&ociregistry.Funcs{
+		GetBlob_: func(ctx context.Context, repo string, digest ociregistry.Digest) (ociregistry.BlobReader, error) {
+			return newSyntheticBlob(size, &nread), nil
+		},
+	}, nil)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	baseline := stats.HeapInuse
+	resp, err := http.Get(srv.URL + "/v2/foo/blobs/" + largeBlobDigest)
+	qt.Assert(t, qt.IsNil(err))
+	defer resp.Body.Close()
+	qt.Assert(t, qt.Equals(resp.StatusCode, http.StatusOK))
+
+	// Sample the heap while reading the response. Garbage counts
+	// towards the heap until it's collected, so this checks that
+	// whatever the server allocates isn't kept alive, rather than
+	// that it doesn't allocate at all.
+	var peak uint64
+	buf := make([]byte, 1024*1024)
+	n := int64(0)
+	for {
+		nr, err := io.ReadFull(resp.Body, buf)
+		n += int64(nr)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		qt.Assert(t, qt.IsNil(err))
+		if n%(16*1024*1024) == 0 {
+			runtime.ReadMemStats(&stats)
+			peak = max(peak, stats.HeapInuse)
+		}
+	}
+	qt.Assert(t, qt.Equals(n, int64(size)))
+	qt.Assert(t, qt.Equals(nread.Load(), int64(size)))
+	growth := int64(peak) - int64(baseline)
+	qt.Assert(t, qt.IsTrue(growth < maxHeapGrowth), qt.Commentf("heap grew by %d bytes", growth))
+}
+
+func TestBlobGetUnknownSize(t *testing.T) {
+	const content = "hello, world"
+	dig := digest.FromString(content)
+	reader := func(offset int64) ociregistry.BlobReader {
+		return ocimem.NewBytesReader([]byte(content)[offset:], ociregistry.Descriptor{
+			MediaType: "application/octet-stream",
+			Digest:    dig,
+			Size:      -1,
+		})
+	}
+	r := New(&ociregistry.Funcs{
+		ResolveBlob_: func(ctx context.Context, repo string, digest ociregistry.Digest) (ociregistry.Descriptor, error) {
+			return reader(0).Descriptor(), nil
+		},
+		GetBlob_: func(ctx context.Context, repo string, digest ociregistry.Digest) (ociregistry.BlobReader, error) {
+			return reader(0), nil
+		},
+		GetBlobRange_: func(ctx context.Context, repo string, digest ociregistry.Digest, offset0, offset1 int64) (ociregistry.BlobReader, error) {
+			return reader(offset0), nil
+		},
+	}, nil)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	do := func(method, rangeHeader string) (*http.Response, string) {
+		req, err := http.NewRequest(method, srv.URL+"/v2/foo/blobs/"+string(dig), nil)
+		qt.Assert(t, qt.IsNil(err))
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		qt.Assert(t, qt.IsNil(err))
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		qt.Assert(t, qt.IsNil(err))
+		return resp, string(data)
+	}
+	resp, data := do("HEAD", "")
+	qt.Assert(t, qt.Equals(resp.StatusCode, http.StatusOK))
+	qt.Check(t, qt.Equals(resp.Header.Get("Content-Length"), ""))
+
+	resp, data = do("GET", "")
+	qt.Assert(t, qt.Equals(resp.StatusCode, http.StatusOK))
+	qt.Check(t, qt.Equals(data, content))
+
+	// A range with an end can be served without the total size.
+	resp, data = do("GET", "bytes=2-4")
+	qt.Assert(t, qt.Equals(resp.StatusCode, http.StatusPartialContent))
+	qt.Check(t, qt.Equals(resp.Header.Get("Content-Range"), "bytes 2-4/*"))
+	qt.Check(t, qt.Equals(data, content[2:5]))
+
+	// An open-ended range can't, so the whole blob is returned.
+	resp, data = do("GET", "bytes=2-")
+	qt.Assert(t, qt.Equals(resp.StatusCode, http.StatusOK))
+	qt.Check(t, qt.Equals(data, content))
+}
+
+func TestBlobRangeGetStreamsOnlyRange(t *testing.T) {
+	var nread atomic.Int64
+	r := New(&ociregistry.Funcs{
+		GetBlobRange_: func(ctx context.Context, repo string, digest ociregistry.Digest, offset0, offset1 int64) (ociregistry.BlobReader, error) {
+			// Simulate a backend that ignores the requested range.
+			return newSyntheticBlob(10*1024*1024, &nread), nil
+		},
+	}, nil)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	req, err := http.NewRequest("GET", srv.URL+"/v2/foo/blobs/"+largeBlobDigest, nil)
+	qt.Assert(t, qt.IsNil(err))
+	req.Header.Set("Range", "bytes=1000-1999")
+	resp, err := http.DefaultClient.Do(req)
+	qt.Assert(t, qt.IsNil(err))
+	defer resp.Body.Close()
+	qt.Assert(t, qt.Equals(resp.StatusCode, http.StatusPartialContent))
+	n, err := io.Copy(io.Discard, resp.Body)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.Equals(n, int64(1000)))
+	qt.Check(t, qt.Equals(nread.Load(), int64(1000)))
+}
+
+func TestBlobGetIgnoresAcceptEncoding(t *testing.T) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(bytes.Repeat([]byte("some layer content "), 100))
+	zw.Close()
+	content := buf.Bytes()
+	dig := digest.FromBytes(content)
+
+	backend := ocimem.New()
+	_, err := backend.PushBlob(context.Background(), "foo", ociregistry.Descriptor{
+		MediaType: "application/vnd.oci.image.layer.v1.tar+gzip",
+		Digest:    dig,
+		Size:      int64(len(content)),
+	}, bytes.NewReader(content))
+	qt.Assert(t, qt.IsNil(err))
+	srv := httptest.NewServer(New(backend, nil))
+	defer srv.Close()
+
+	get := func(acceptEncoding, rangeHeader string) (*http.Response, []byte) {
+		req, err := http.NewRequest("GET", srv.URL+"/v2/foo/blobs/"+string(dig), nil)
+		qt.Assert(t, qt.IsNil(err))
+		// Setting Accept-Encoding explicitly stops the
+		// transport from decompressing the response itself.
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		qt.Assert(t, qt.IsNil(err))
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		qt.Assert(t, qt.IsNil(err))
+		qt.Check(t, qt.Equals(resp.Header.Get("Content-Encoding"), ""))
+		qt.Check(t, qt.Equals(resp.Header.Get("Cache-Control"), "no-transform"))
+		qt.Check(t, qt.Equals(resp.Header.Get("Docker-Content-Digest"), string(dig)))
+		return resp, data
+	}
+	for _, acceptEncoding := range []string{"", "gzip", "identity", "gzip, deflate, br"} {
+		resp, data := get(acceptEncoding, "")
+		qt.Assert(t, qt.Equals(resp.StatusCode, http.StatusOK))
+		qt.Assert(t, qt.DeepEquals(data, content))
+		qt.Assert(t, qt.Equals(digest.FromBytes(data), dig))
+
+		resp, data = get(acceptEncoding, "bytes=10-19")
+		qt.Assert(t, qt.Equals(resp.StatusCode, http.StatusPartialContent))
+		qt.Assert(t, qt.DeepEquals(data, content[10:20]))
+	}
+}
+
+// syntheticBlob is a BlobReader that generates content
+// on the fly and counts the bytes read from it.
+type syntheticBlob struct {
+	size      int64
+	remaining int64
+	nread     *atomic.Int64
+}
+
+func newSyntheticBlob(size int64, nread *atomic.Int64) *syntheticBlob {
+	return &syntheticBlob{
+		size:      size,
+		remaining: size,
+		nread:     nread,
+	}
+}
+
+func (b *syntheticBlob) Read(buf []byte) (int, error) {
+	if b.remaining == 0 {
+		return 0, io.EOF
+	}
+	n := int(min(int64(len(buf)), b.remaining))
+	for i := range buf[:n] {
+		buf[i] = 'x'
+	}
+	b.remaining -= int64(n)
+	b.nread.Add(int64(n))
+	return n, nil
+}
+
+func (b *syntheticBlob) Close() error {
+	return nil
+}
+
+func (b *syntheticBlob) Descriptor() ociregistry.Descriptor {
+	return ociregistry.Descriptor{
+		MediaType: "application/octet-stream",
+		Digest:    largeBlobDigest,
+		Size:      b.size,
+	}
+}
@@ -25,7 +25,11 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
+	"slices"
+	"strings"
 	"sync/atomic"
+	"time"
 
 	"cuelabs.dev/go/oci/ociregistry"
 	"cuelabs.dev/go/oci/ociregistry/internal/ocirequest"
@@ -49,33 +53,201 @@ type Options struct {
 	// be used and any error discarded.
 	WriteError func(w http.ResponseWriter, req *http.Request, err error)
 
+	// OnInternalError, if non-nil, is called when handling a request
+	// fails with an error that maps to a 5xx status code, before the
+	// error response is written. It is passed the original request,
+	// information on the parsed request (nil if the request could not
+	// be parsed), and the error returned by the handler. This allows
+	// the underlying cause to be logged or traced.
+	OnInternalError func(req *http.Request, info *RequestInfo, err error)
+
+	// OnUploadComplete, if non-nil, is called after each blob upload
+	// completes successfully, whether it was made with a single POST
+	// request or as a chunked upload, with the request that completed
+	// it and statistics about the upload, such as its total size, the
+	// number of chunks and how long it took. This allows operators to
+	// monitor upload performance and fragmentation.
+	//
+	// The statistics for chunked uploads are aggregated across
+	// requests by upload ID, so they will be incomplete when an
+	// upload's requests are spread across several servers. At most
+	// 10000 in-progress uploads are tracked; beyond that, the
+	// oldest are forgotten.
+	OnUploadComplete func(req *http.Request, stats UploadStats)
+
+	// ErrorStatus, if non-nil, is consulted for every error returned
+	// by a handler, before the default mapping from errors to HTTP
+	// status codes. If it returns ok=true, the response will have
+	// the given status code and, if code is non-empty, that OCI
+	// error code; otherwise the error code is derived from the
+	// error as usual. If it returns false, the default mapping is
+	// used.
+	//
+	// This allows embedders to customize how their backend's errors
+	// are surfaced, for example to report a quota error as 507
+	// (Insufficient Storage).
+	//
+	// Note that when WriteError is also set, it is passed an error
+	// that implements [ociregistry.HTTPError] with the mapped status
+	// code, but [ociregistry.WriteError] gives precedence to the
+	// status associated with any standard error code.
+	ErrorStatus func(err error) (statusCode int, code string, ok bool)
+
+	// UnknownRepositoryMessage, if non-empty, is included as the
+	// detail (a JSON string) of NAME_UNKNOWN error responses, which
+	// are returned for requests to repositories that don't exist.
+	// This allows operators to point users to documentation, for
+	// example about how to create repositories. The error code and
+	// message are unchanged.
+	UnknownRepositoryMessage string
+
+	// CatalogFilter, if non-nil, is called with batches of the
+	// repository names listed by the catalog endpoint
+	// (/v2/_catalog) and returns the names that the caller is
+	// allowed to see, in the same order. The context is derived
+	// from that of the HTTP request, so it holds anything added by
+	// authentication middleware, as well as the values described in
+	// [RequestInfoFromContext]. This allows a multi-tenant registry
+	// to list only the repositories that a caller can pull from.
+	//
+	// Filtering happens before pagination, so pages are as full
+	// as they would be without filtering, and the Link header
+	// only refers to repositories that the caller can see.
+	CatalogFilter func(ctx context.Context, repos []string) []string
+
 	// DisableReferrersAPI, when true, causes the registry to behave as if
 	// it does not understand the referrers API.
 	DisableReferrersAPI bool
 
 	// DisableSinglePostUpload, when true, causes the registry
-	// to reject uploads with a single POST request.
-	// This is useful in combination with LocationsForDescriptor
-	// to cause uploaded blob content to flow through
-	// another server.
+	// to refuse to complete uploads with a single POST request.
+	// A POST to /v2/<name>/blobs/uploads/?digest=<digest> is
+	// treated as the start of a chunked upload instead: any content
+	// in the request body is discarded and the registry responds
+	// with 202 Accepted and a Location header, as permitted by
+	// the distribution spec. The client must then upload the
+	// content to that location. This applies even when the blob
+	// is already present in the repository.
+	//
+	// This is useful for backends that cannot support monolithic
+	// uploads and, in combination with LocationsForDescriptor, to
+	// cause uploaded blob content to flow through another server.
 	DisableSinglePostUpload bool
 
+	// AllowedDigestAlgorithms, if non-empty, holds the digest
+	// algorithms (for example "sha256") that the server accepts.
+	// Requests that use a digest with any other algorithm, whether in
+	// the URL path or in the digest or mount query parameters, fail
+	// with a DIGEST_INVALID error.
+	AllowedDigestAlgorithms []string
+
+	// BackendTimeout, if > 0, limits the time taken by each call
+	// to the backend. When it's exceeded, the context passed to
+	// the backend is canceled and the client receives a 504
+	// (Gateway Timeout) response.
+	//
+	// For calls that return a reader or writer, the timeout
+	// applies only to obtaining it, not to the subsequent
+	// transfer of content; similarly, PushBlob is not subject to
+	// the timeout. For list operations, it applies to the whole
+	// iteration.
+	BackendTimeout time.Duration
+
+	// RetryBackend causes the server to retry a manifest push or
+	// a monolithic blob upload once when the backend fails with an
+	// error that looks transient: a network error or a response with
+	// status 429, 502, 503 or 504. This is useful when the backend is
+	// a remote registry, as when proxying with ociclient. The content
+	// of blob uploads is buffered in memory so that it can be sent
+	// again, so only content no larger than RetryBackendMaxSize
+	// is retried.
+	RetryBackend bool
+
+	// RetryBackendMaxSize holds the maximum size of content for which
+	// a push is retried when RetryBackend is set. If it's <= 0,
+	// 4 MiB is used.
+	RetryBackendMaxSize int64
+
 	// MaxListPageSize, if > 0, causes the list endpoints to return an
 	// error if the page size is greater than that. This emulates
 	// a quirk of AWS ECR where it refuses request for any
 	// page size > 1000.
 	MaxListPageSize int
 
+	// ListPageSizeLimit, if > 0, limits the number of items
+	// returned by the list endpoints in a single response, even when
+	// the client asks for more or doesn't specify a page size.
+	// When a response is truncated, it includes a Link header
+	// so that the client can fetch the rest (unless
+	// OmitLinkHeaderFromResponses is set). This bounds the
+	// size of responses. Unlike MaxListPageSize, it doesn't cause
+	// requests for larger pages to fail.
+	ListPageSizeLimit int
+
+	// ValidateManifestReferences causes the server to check,
+	// before pushing a manifest to the backend, that all the blobs
+	// referred to by an image manifest and all the manifests
+	// referred to by an image index (or their Docker equivalents)
+	// are already present in the repository, responding with a
+	// MANIFEST_BLOB_UNKNOWN error if not. This is useful for
+	// backends that don't enforce that themselves.
+	ValidateManifestReferences bool
+
+	// RejectDeprecatedArtifactManifest causes the server to reject
+	// pushes of manifests with the deprecated artifact manifest
+	// media type (application/vnd.oci.artifact.manifest.v1+json)
+	// with a MANIFEST_INVALID error, nudging clients towards
+	// using image manifests with an artifactType field instead.
+	// By default such manifests are accepted for compatibility.
+	RejectDeprecatedArtifactManifest bool
+
+	// EchoManifestDescriptor causes the server to respond to a
+	// successful manifest push with a JSON-encoded OCI descriptor
+	// (media type application/vnd.oci.descriptor.v1+json) holding
+	// the media type, digest and size of the manifest, for clients
+	// that read the result from the body rather than from the
+	// Location and Docker-Content-Digest headers. By default the
+	// body is empty, as the spec describes.
+	EchoManifestDescriptor bool
+
 	// OmitDigestFromTagGetResponse causes the registry
 	// to omit the Docker-Content-Digest header from a tag
 	// GET response, mimicking the behavior of registries that
 	// do the same (for example AWS ECR).
 	OmitDigestFromTagGetResponse bool
 
+	// OmitContentDigestHeader causes the server to omit the
+	// Docker-Content-Digest header from all responses, mimicking
+	// registries that don't send it, so that the fallback paths in
+	// clients can be tested. Clients can still determine the digest
+	// when it's part of the request or can be computed from the
+	// response body, but not when doing a HEAD request for a tag.
+	OmitContentDigestHeader bool
+
 	// OmitLinkHeaderFromResponses causes the server
 	// to leave out the Link header from list responses.
 	OmitLinkHeaderFromResponses bool
 
+	// AbsoluteLocations causes the URLs in Location and Link
+	// response headers that refer to the server itself to be absolute
+	// rather than host-relative (for example
+	// "https://registry.example.com/v2/foo/blobs/uploads/id" rather
+	// than "/v2/foo/blobs/uploads/id"), as required by some clients
+	// and proxies.
+	//
+	// The scheme and host are taken from BaseURL if it's non-nil, and
+	// otherwise from the request: the Host header, with the https
+	// scheme if the connection uses TLS or http if not.
+	AbsoluteLocations bool
+
+	// BaseURL, if non-nil, holds the URL that clients use to reach
+	// the server, for use when AbsoluteLocations is set. This is
+	// useful when the server sits behind a proxy, so the request
+	// doesn't reflect the URL used by the client. Any path in BaseURL
+	// is prepended to the path of each location. Any user information
+	// in BaseURL is ignored, so that it isn't exposed to clients.
+	BaseURL *url.URL
+
 	// LocationForUploadID transforms an upload ID as returned by
 	// ocirequest.BlobWriter.ID to the absolute URL location
 	// as returned by the upload endpoints.
@@ -108,6 +280,24 @@ type Options struct {
 	// isn't always what is wanted?
 	LocationsForDescriptor func(isManifest bool, desc ociregistry.Descriptor) ([]string, error)
 
+	// HealthPath, if non-empty, holds a path (for example "/healthz")
+	// that will respond to GET and HEAD requests with a 200 status
+	// if the backend appears to be healthy or 503 if not. It
+	// should be outside the /v2/ namespace.
+	//
+	// If the backend implements [Pinger], its Ping method is used
+	// to check health; otherwise the server checks that the
+	// first entry of the Repositories iterator can be obtained
+	// without error. A backend that does not support listing
+	// repositories is considered to be healthy.
+	HealthPath string
+
+	// RootHandler, if non-nil, is used to serve requests for paths
+	// outside the /v2/ namespace (other than HealthPath), for
+	// example to show a landing page or redirect to documentation.
+	// If it's nil, such requests receive a 404 response.
+	RootHandler http.Handler
+
 	DebugID string
 }
 
@@ -120,6 +310,11 @@ var debugID int32
 //
 // The returned handler should be registered at the site root.
 //
+// Each request is given an ID, available to the backend through
+// [RequestIDFromContext] and returned in the X-Request-Id response
+// header. A valid ID supplied in the X-Request-Id request header
+// is used in preference to a generated one.
+//
 // # Errors
 //
 // All HTTP responses will be JSON, formatted according to the
@@ -135,16 +330,22 @@ func New(backend ociregistry.Interface, opts *Options) http.Handler {
 		opts = new(Options)
 	}
 	r := &registry{
-		opts:    *opts,
-		backend: backend,
+		opts:       *opts,
+		backend:    backend,
+		rawBackend: backend,
+	}
+	if r.opts.BackendTimeout > 0 {
+		r.timeouts = &timeoutBackend{
+			backend: backend,
+			timeout: r.opts.BackendTimeout,
+		}
+		r.backend = r.timeouts
 	}
 	if r.opts.DebugID == "" {
 		r.opts.DebugID = fmt.Sprintf("ociserver%d", atomic.AddInt32(&debugID, 1))
 	}
 	if r.opts.WriteError == nil {
-		r.opts.WriteError = func(w http.ResponseWriter, _ *http.Request, err error) {
-			ociregistry.WriteError(w, err)
-		}
+		r.opts.WriteError = writeError
 	}
 	return r
 }
@@ -156,6 +357,18 @@ func (r *registry) logf(f string, a ...any) {
 type registry struct {
 	opts    Options
 	backend ociregistry.Interface
+
+	// rawBackend holds the backend as passed to New, before
+	// any wrapping for Options.BackendTimeout. It's used to check
+	// for optional interfaces such as [Pinger], whose methods
+	// should be called with callOptional.
+	rawBackend ociregistry.Interface
+
+	// timeouts holds the wrapper that applies Options.BackendTimeout,
+	// or nil if there's no timeout.
+	timeouts *timeoutBackend
+
+	uploads uploadTracker
 }
 
 var handlers = []func(r *registry, ctx context.Context, w http.ResponseWriter, req *http.Request, rreq *ocirequest.Request) error{
@@ -169,6 +382,7 @@ var handlers = []func(r *registry, ctx context.Context, w http.ResponseWriter, r
 	ocirequest.ReqBlobUploadInfo:     (*registry).handleBlobUploadInfo,
 	ocirequest.ReqBlobUploadChunk:    (*registry).handleBlobUploadChunk,
 	ocirequest.ReqBlobCompleteUpload: (*registry).handleBlobCompleteUpload,
+	ocirequest.ReqBlobUploadCancel:   (*registry).handleBlobUploadCancel,
 	ocirequest.ReqManifestGet:        (*registry).handleManifestGet,
 	ocirequest.ReqManifestHead:       (*registry).handleManifestHead,
 	ocirequest.ReqManifestPut:        (*registry).handleManifestPut,
@@ -179,7 +393,28 @@ var handlers = []func(r *registry, ctx context.Context, w http.ResponseWriter, r
 }
 
 func (r *registry) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
-	if rerr := r.v2(resp, req); rerr != nil {
+	id := requestID(req.Header.Get(requestIDHeader))
+	resp.Header().Set(requestIDHeader, id)
+	req = req.WithContext(contextWithRequestID(req.Context(), id))
+	if r.opts.HealthPath != "" && req.URL.Path == r.opts.HealthPath {
+		r.handleHealth(resp, req)
+		return
+	}
+	if r.opts.RootHandler != nil && req.URL.Path != "/v2" && !strings.HasPrefix(req.URL.Path, "/v2/") {
+		r.opts.RootHandler.ServeHTTP(resp, req)
+		return
+	}
+	if rreq, rerr := r.v2(resp, req); rerr != nil {
+		rerr = r.mapError(rerr)
+		rerr = r.addUnknownRepositoryDetail(rerr)
+		if r.opts.OnInternalError != nil && errorHTTPStatus(rerr) >= 500 {
+			var info *RequestInfo
+			if rreq != nil {
+				info = new(RequestInfo)
+				*info = requestInfo(rreq)
+			}
+			r.opts.OnInternalError(req, info, rerr)
+		}
 		r.opts.WriteError(resp, req, rerr)
 		return
 	}
@@ -187,7 +422,7 @@ func (r *registry) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 
 // https://docs.docker.com/registry/spec/api/#api-version-check
 // https://github.com/opencontainers/distribution-spec/blob/master/spec.md#api-version-check
-func (r *registry) v2(resp http.ResponseWriter, req *http.Request) (_err error) {
+func (r *registry) v2(resp http.ResponseWriter, req *http.Request) (_ *ocirequest.Request, _err error) {
 	if debug {
 		r.logf("registry.v2 %v %s {", req.Method, req.URL)
 		defer func() {
@@ -199,13 +434,34 @@ func (r *registry) v2(resp http.ResponseWriter, req *http.Request) (_err error)
 		}()
 	}
 
+	if req.Method == "OPTIONS" {
+		return nil, r.handleOptions(resp, req)
+	}
 	rreq, err := ocirequest.Parse(req.Method, req.URL)
 	if err != nil {
 		resp.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
-		return handlerErrorForRequestParseError(err)
+		return nil, handlerErrorForRequestParseError(err)
 	}
+	if err := r.checkDigestAlgorithm(rreq); err != nil {
+		return rreq, err
+	}
+	ctx := contextWithRequestInfo(req.Context(), rreq)
+	req = req.WithContext(ctx)
 	handle := handlers[rreq.Kind]
-	return handle(r, req.Context(), resp, req, rreq)
+	return rreq, handle(r, ctx, resp, req, rreq)
+}
+
+// checkDigestAlgorithm checks that any digest in rreq
+// uses one of the algorithms in Options.AllowedDigestAlgorithms.
+func (r *registry) checkDigestAlgorithm(rreq *ocirequest.Request) error {
+	if len(r.opts.AllowedDigestAlgorithms) == 0 || rreq.Digest == "" {
+		return nil
+	}
+	alg := ociregistry.Digest(rreq.Digest).Algorithm()
+	if !slices.Contains(r.opts.AllowedDigestAlgorithms, string(alg)) {
+		return fmt.Errorf("%w: digest algorithm %q is not allowed", ociregistry.ErrDigestInvalid, alg)
+	}
+	return nil
 }
 
 func (r *registry) handlePing(ctx context.Context, resp http.ResponseWriter, req *http.Request, rreq *ocirequest.Request) error {
@@ -213,7 +469,66 @@ func (r *registry) handlePing(ctx context.Context, resp http.ResponseWriter, req
 	return nil
 }
 
-func (r *registry) setLocationHeader(resp http.ResponseWriter, isManifest bool, desc ociregistry.Descriptor, defaultLocation string) error {
+// optionsMethods holds the set of methods that are checked
+// when responding to an OPTIONS request, in the order
+// that they'll appear in the Allow header.
+var optionsMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"}
+
+// handleOptions responds to an OPTIONS request by advertising
+// the methods that are supported by the endpoint. The allowed
+// set is derived by asking ocirequest.Parse which methods it
+// understands for the URL and checking that there is
+// a handler for the resulting request kind.
+func (r *registry) handleOptions(resp http.ResponseWriter, req *http.Request) error {
+	var allowed []string
+	var parseErr error
+	parsedOK := false
+	for _, method := range optionsMethods {
+		rreq, err := ocirequest.Parse(method, req.URL)
+		if err != nil {
+			if errors.Is(err, ocirequest.ErrMethodNotAllowed) {
+				continue
+			}
+			// The method is understood for this endpoint but
+			// other parts of the request aren't valid for it
+			// (for example a missing digest query parameter on
+			// an upload PUT). Record the error in case no method
+			// is valid at all, but still consider the method to
+			// be allowed.
+			if parseErr == nil {
+				parseErr = err
+			}
+			allowed = append(allowed, method)
+			continue
+		}
+		parsedOK = true
+		if rreq.Kind == ocirequest.ReqPing && method != "GET" && method != "HEAD" {
+			// The ping endpoint is lenient about the method used,
+			// but only GET and HEAD are meaningful.
+			continue
+		}
+		if handlers[rreq.Kind] == nil {
+			continue
+		}
+		if rreq.Kind == ocirequest.ReqReferrersList && r.opts.DisableReferrersAPI {
+			// Respond as a request for the referrers
+			// would, as if the endpoint didn't exist.
+			return errReferrersDisabled
+		}
+		allowed = append(allowed, method)
+	}
+	if !parsedOK {
+		if parseErr == nil {
+			parseErr = &ocirequest.ParseError{Err: ocirequest.ErrNotFound}
+		}
+		return handlerErrorForRequestParseError(parseErr)
+	}
+	resp.Header().Set("Allow", strings.Join(allowed, ", "))
+	resp.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (r *registry) setLocationHeader(resp http.ResponseWriter, req *http.Request, isManifest bool, desc ociregistry.Descriptor, defaultLocation string) error {
 	loc := defaultLocation
 	if r.opts.LocationsForDescriptor != nil {
 		locs, err := r.opts.LocationsForDescriptor(isManifest, desc)
@@ -228,11 +543,64 @@ func (r *registry) setLocationHeader(resp http.ResponseWriter, isManifest bool,
 			loc = locs[0] // TODO select arbitrary location from the slice
 		}
 	}
-	resp.Header().Set("Location", loc)
-	resp.Header().Set("Docker-Content-Digest", string(desc.Digest))
+	resp.Header().Set("Location", r.absoluteLocation(req, loc))
+	r.setDigestHeader(resp, desc.Digest)
 	return nil
 }
 
+// setDigestHeader sets the Docker-Content-Digest response
+// header unless Options.OmitContentDigestHeader is set.
+func (r *registry) setDigestHeader(resp http.ResponseWriter, dig ociregistry.Digest) {
+	if !r.opts.OmitContentDigestHeader {
+		resp.Header().Set("Docker-Content-Digest", string(dig))
+	}
+}
+
+// setContentLength sets the Content-Length response header
+// to size, unless the size is unknown (negative), in which
+// case the header is omitted.
+func setContentLength(resp http.ResponseWriter, size int64) {
+	if size >= 0 {
+		resp.Header().Set("Content-Length", fmt.Sprint(size))
+	}
+}
+
+// absoluteLocation returns the location to use in a Location or Link
+// header for the given host-relative location. When
+// Options.AbsoluteLocations is set, it's resolved against
+// Options.BaseURL or, if that's nil, the URL used to make the request;
+// otherwise it's returned unchanged, as are locations that are
+// already absolute.
+func (r *registry) absoluteLocation(req *http.Request, loc string) string {
+	if !r.opts.AbsoluteLocations {
+		return loc
+	}
+	u, err := url.Parse(loc)
+	if err != nil || u.IsAbs() {
+		return loc
+	}
+	base := r.opts.BaseURL
+	if base == nil {
+		base = &url.URL{
+			Scheme: "http",
+			Host:   req.Host,
+		}
+		if req.TLS != nil {
+			base.Scheme = "https"
+		}
+	}
+	// Any credentials in BaseURL are deliberately not
+	// included: they'd be exposed to every client.
+	u.Scheme = base.Scheme
+	u.Host = base.Host
+	// Keep the escaping of both paths, which might
+	// not be the default escaping of the result.
+	rawPath := strings.TrimSuffix(base.EscapedPath(), "/") + u.EscapedPath()
+	u.Path = strings.TrimSuffix(base.Path, "/") + u.Path
+	u.RawPath = rawPath
+	return u.String()
+}
+
 // ParseError represents an error that can happen when parsing.
 // The Err field holds one of the possible error values below.
 type ParseError struct {
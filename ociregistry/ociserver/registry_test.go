@@ -15,17 +15,25 @@
 package ociserver_test
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"slices"
 	"strings"
 	"testing"
 
+	"cuelabs.dev/go/oci/ociregistry"
 	"cuelabs.dev/go/oci/ociregistry/ocimem"
 	"cuelabs.dev/go/oci/ociregistry/ociserver"
 	"github.com/go-quicktest/qt"
 	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 const (
@@ -420,6 +428,42 @@ func TestCalls(t *testing.T) {
 			Body:     "foo",
 			WantBody: `{"errors":[{"code":"UNSUPPORTED","message":"we don't understand your Content-Range"}]}`,
 		},
+		{
+			Description:   "Chunk_upload_reversed_content_range",
+			Method:        "PATCH",
+			URL:           "/v2/foo/blobs/uploads/MQ",
+			RequestHeader: map[string]string{"Content-Range": "5-2"},
+			WantCode:      http.StatusRequestedRangeNotSatisfiable,
+			Body:          "foo",
+			WantBody:      `{"errors":[{"code":"BLOB_UPLOAD_INVALID","message":"blob upload invalid: invalid Content-Range \"5-2\": range offsets out of bounds: end 2 precedes start 5"}]}`,
+		},
+		{
+			Description:   "Chunk_upload_negative_content_range",
+			Method:        "PATCH",
+			URL:           "/v2/foo/blobs/uploads/MQ",
+			RequestHeader: map[string]string{"Content-Range": "-3-0"},
+			WantCode:      http.StatusRequestedRangeNotSatisfiable,
+			Body:          "foo",
+			WantBody:      `{"errors":[{"code":"BLOB_UPLOAD_INVALID","message":"blob upload invalid: invalid Content-Range \"-3-0\": range offsets out of bounds: offset -3 is negative"}]}`,
+		},
+		{
+			Description:   "Chunk_upload_overflowing_content_range",
+			Method:        "PATCH",
+			URL:           "/v2/foo/blobs/uploads/MQ",
+			RequestHeader: map[string]string{"Content-Range": "9223372036854775805-9223372036854775807"},
+			WantCode:      http.StatusRequestedRangeNotSatisfiable,
+			Body:          "foo",
+			WantBody:      `{"errors":[{"code":"BLOB_UPLOAD_INVALID","message":"blob upload invalid: invalid Content-Range \"9223372036854775805-9223372036854775807\": range offsets out of bounds: end 9223372036854775807 is too large"}]}`,
+		},
+		{
+			Description:   "Chunk_upload_content_range_near_max",
+			Method:        "PATCH",
+			URL:           "/v2/foo/blobs/uploads/MQ",
+			RequestHeader: map[string]string{"Content-Range": "9223372036854775804-9223372036854775806"},
+			WantCode:      http.StatusRequestedRangeNotSatisfiable,
+			Body:          "foo",
+			WantBody:      `{"errors":[{"code":"RANGE_INVALID","message":"cannot copy blob data: invalid offset 9223372036854775804 in resumed upload (actual offset 0): range invalid: invalid content range"}]}`,
+		},
 		{
 			Description:   "Chunk_upload_overlaps_previous_data",
 			Method:        "PATCH",
@@ -443,6 +487,26 @@ func TestCalls(t *testing.T) {
 				"Location": "/v2/foo/blobs/uploads/MQ",
 			},
 		},
+		{
+			Description: "Chunk_upload_first_chunk_without_content_range",
+			Method:      "PATCH",
+			URL:         "/v2/foo/blobs/uploads/MQ",
+			WantCode:    http.StatusAccepted,
+			Body:        "foo",
+			WantHeader: map[string]string{
+				"Range":    "0-2",
+				"Location": "/v2/foo/blobs/uploads/MQ",
+			},
+		},
+		{
+			Description: "Chunk_upload_later_chunk_without_content_range",
+			Method:      "PATCH",
+			URL:         "/v2/foo/blobs/uploads/MQ",
+			BlobStream:  map[string]string{"MQ": "foo"},
+			WantCode:    http.StatusRequestedRangeNotSatisfiable,
+			Body:        "bar",
+			WantBody:    `{"errors":[{"code":"BLOB_UPLOAD_INVALID","message":"blob upload invalid: Content-Range required on chunk at offset 3"}]}`,
+		},
 		{
 			Description: "DELETE_Unknown_name",
 			Method:      "DELETE",
@@ -488,6 +552,22 @@ func TestCalls(t *testing.T) {
 			WantCode:    http.StatusOK,
 			WantBody:    `{"name":"foo","tags":["latest"]}`,
 		},
+		{
+			Description: "limit_tags_zero",
+			Manifests:   map[string]string{"foo/manifests/latest": "foo", "foo/manifests/tag1": "foo"},
+			Method:      "GET",
+			URL:         "/v2/foo/tags/list?n=0",
+			WantCode:    http.StatusOK,
+			WantBody:    `{"name":"foo","tags":[]}`,
+		},
+		{
+			Description: "list_tags_no_limit",
+			Manifests:   map[string]string{"foo/manifests/latest": "foo", "foo/manifests/tag1": "foo"},
+			Method:      "GET",
+			URL:         "/v2/foo/tags/list",
+			WantCode:    http.StatusOK,
+			WantBody:    `{"name":"foo","tags":["latest","tag1"]}`,
+		},
 		{
 			Description: "offset_tags",
 			Manifests:   map[string]string{"foo/manifests/latest": "foo", "foo/manifests/tag1": "foo"},
@@ -511,6 +591,30 @@ func TestCalls(t *testing.T) {
 			WantCode:    http.StatusOK,
 			WantBody:    `{"repositories":["bar","foo"]}`,
 		},
+		{
+			Description: "list_repos_no_limit",
+			Manifests:   map[string]string{"foo/manifests/latest": "foo", "bar/manifests/latest": "bar"},
+			Method:      "GET",
+			URL:         "/v2/_catalog",
+			WantCode:    http.StatusOK,
+			WantBody:    `{"repositories":["bar","foo"]}`,
+		},
+		{
+			Description: "limit_repos",
+			Manifests:   map[string]string{"foo/manifests/latest": "foo", "bar/manifests/latest": "bar"},
+			Method:      "GET",
+			URL:         "/v2/_catalog?n=1",
+			WantCode:    http.StatusOK,
+			WantBody:    `{"repositories":["bar"]}`,
+		},
+		{
+			Description: "limit_repos_zero",
+			Manifests:   map[string]string{"foo/manifests/latest": "foo", "bar/manifests/latest": "bar"},
+			Method:      "GET",
+			URL:         "/v2/_catalog?n=0",
+			WantCode:    http.StatusOK,
+			WantBody:    `{"repositories":[]}`,
+		},
 		{
 			Description: "fetch_references",
 			Method:      "GET",
@@ -557,6 +661,69 @@ func TestCalls(t *testing.T) {
 			WantCode:    http.StatusBadRequest,
 			WantBody:    `{"errors":[{"code":"UNKNOWN","message":"badly formed digest"}]}`,
 		},
+		{
+			Description: "OPTIONS_blob",
+			Method:      "OPTIONS",
+			URL:         "/v2/foo/blobs/" + digestOf("foo"),
+			WantCode:    http.StatusNoContent,
+			WantHeader:  map[string]string{"Allow": "GET, HEAD, DELETE"},
+		},
+		{
+			Description: "OPTIONS_manifest_by_tag",
+			Method:      "OPTIONS",
+			URL:         "/v2/foo/manifests/latest",
+			WantCode:    http.StatusNoContent,
+			WantHeader:  map[string]string{"Allow": "GET, HEAD, PUT, DELETE"},
+		},
+		{
+			Description: "OPTIONS_manifest_by_digest",
+			Method:      "OPTIONS",
+			URL:         "/v2/foo/manifests/" + digestOf("foo"),
+			WantCode:    http.StatusNoContent,
+			WantHeader:  map[string]string{"Allow": "GET, HEAD, PUT, DELETE"},
+		},
+		{
+			Description: "OPTIONS_tags_list",
+			Method:      "OPTIONS",
+			URL:         "/v2/foo/tags/list",
+			WantCode:    http.StatusNoContent,
+			WantHeader:  map[string]string{"Allow": "GET"},
+		},
+		{
+			Description: "OPTIONS_upload_start",
+			Method:      "OPTIONS",
+			URL:         "/v2/foo/blobs/uploads/",
+			WantCode:    http.StatusNoContent,
+			WantHeader:  map[string]string{"Allow": "POST"},
+		},
+		{
+			Description: "OPTIONS_upload_session",
+			Method:      "OPTIONS",
+			URL:         "/v2/foo/blobs/uploads/MQ",
+			WantCode:    http.StatusNoContent,
+			WantHeader:  map[string]string{"Allow": "GET, PUT, PATCH, DELETE"},
+		},
+		{
+			Description: "OPTIONS_referrers",
+			Method:      "OPTIONS",
+			URL:         "/v2/foo/referrers/" + digestOf("foo"),
+			WantCode:    http.StatusNoContent,
+			WantHeader:  map[string]string{"Allow": "GET"},
+		},
+		{
+			Description: "OPTIONS_ping",
+			Method:      "OPTIONS",
+			URL:         "/v2/",
+			WantCode:    http.StatusNoContent,
+			WantHeader:  map[string]string{"Allow": "GET, HEAD"},
+		},
+		{
+			Description: "OPTIONS_bad_digest",
+			Method:      "OPTIONS",
+			URL:         "/v2/foo/blobs/sha256:asd",
+			WantCode:    http.StatusBadRequest,
+			WantBody:    `{"errors":[{"code":"UNKNOWN","message":"badly formed digest"}]}`,
+		},
 		{
 			skip:        true,
 			Description: "fetch_references,_bad_method",
@@ -669,3 +836,1206 @@ func TestCalls(t *testing.T) {
 func digestOf(s string) string {
 	return string(digest.FromString(s))
 }
+
+func TestOptionsReferrersDisabled(t *testing.T) {
+	srv := httptest.NewServer(ociserver.New(ocimem.New(), &ociserver.Options{
+		DisableReferrersAPI: true,
+	}))
+	defer srv.Close()
+	for _, method := range []string{"GET", "OPTIONS"} {
+		req, err := http.NewRequest(method, srv.URL+"/v2/foo/referrers/"+digestOf("foo"), nil)
+		qt.Assert(t, qt.IsNil(err))
+		resp, err := http.DefaultClient.Do(req)
+		qt.Assert(t, qt.IsNil(err))
+		resp.Body.Close()
+		qt.Check(t, qt.Equals(resp.StatusCode, http.StatusNotFound), qt.Commentf("%s", method))
+		qt.Check(t, qt.Equals(resp.Header.Get("Allow"), ""), qt.Commentf("%s", method))
+	}
+}
+
+func TestManifestSubjectHeader(t *testing.T) {
+	backend := &embeddedDataBackend{
+		Registry: ocimem.New(),
+	}
+	srv := httptest.NewServer(ociserver.New(backend, nil))
+	defer srv.Close()
+
+	subject := digestOf("subject")
+	manifest := fmt.Sprintf(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[],"subject":{"mediaType":"application/vnd.oci.image.manifest.v1+json","digest":%q,"size":7}}`, subject)
+	noSubjectManifest := `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[]}`
+	for _, m := range []struct {
+		tag     string
+		content string
+	}{{"withsubject", manifest}, {"nosubject", noSubjectManifest}} {
+		req, err := http.NewRequest("PUT", srv.URL+"/v2/foo/manifests/"+m.tag, strings.NewReader(m.content))
+		qt.Assert(t, qt.IsNil(err))
+		req.Header.Set("Content-Type", "application/vnd.oci.image.index.v1+json")
+		resp, err := http.DefaultClient.Do(req)
+		qt.Assert(t, qt.IsNil(err))
+		resp.Body.Close()
+		qt.Assert(t, qt.Equals(resp.StatusCode, http.StatusCreated))
+	}
+
+	backend.embed = true
+	for _, method := range []string{"GET", "HEAD"} {
+		for _, path := range []string{"withsubject", digestOf(manifest)} {
+			req, err := http.NewRequest(method, srv.URL+"/v2/foo/manifests/"+path, nil)
+			qt.Assert(t, qt.IsNil(err))
+			resp, err := http.DefaultClient.Do(req)
+			qt.Assert(t, qt.IsNil(err))
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			qt.Check(t, qt.Equals(resp.StatusCode, http.StatusOK))
+			qt.Check(t, qt.Equals(resp.Header.Get("OCI-Subject"), subject), qt.Commentf("%s %s", method, path))
+			if method == "GET" {
+				qt.Check(t, qt.Equals(string(body), manifest))
+			}
+		}
+		req, err := http.NewRequest(method, srv.URL+"/v2/foo/manifests/nosubject", nil)
+		qt.Assert(t, qt.IsNil(err))
+		resp, err := http.DefaultClient.Do(req)
+		qt.Assert(t, qt.IsNil(err))
+		resp.Body.Close()
+		qt.Check(t, qt.Equals(resp.StatusCode, http.StatusOK))
+		qt.Check(t, qt.Equals(resp.Header.Get("OCI-Subject"), ""), qt.Commentf("%s", method))
+	}
+
+	// When the backend doesn't embed the content in the descriptor,
+	// a HEAD request doesn't fetch the manifest to find the subject.
+	backend.embed = false
+	backend.gets = 0
+	resp, err := http.Head(srv.URL + "/v2/foo/manifests/withsubject")
+	qt.Assert(t, qt.IsNil(err))
+	resp.Body.Close()
+	qt.Check(t, qt.Equals(resp.StatusCode, http.StatusOK))
+	qt.Check(t, qt.Equals(resp.Header.Get("OCI-Subject"), ""))
+	qt.Check(t, qt.Equals(backend.gets, 0))
+}
+
+// embeddedDataBackend is a registry that, when embed is set,
+// includes the content of manifests in the Data field of the
+// descriptors returned by ResolveTag and ResolveManifest.
+// It counts the calls to GetTag and GetManifest in gets.
+type embeddedDataBackend struct {
+	*ocimem.Registry
+	embed bool
+	gets  int
+}
+
+func (b *embeddedDataBackend) GetTag(ctx context.Context, repo string, tag string) (ociregistry.BlobReader, error) {
+	b.gets++
+	return b.Registry.GetTag(ctx, repo, tag)
+}
+
+func (b *embeddedDataBackend) GetManifest(ctx context.Context, repo string, dig ociregistry.Digest) (ociregistry.BlobReader, error) {
+	b.gets++
+	return b.Registry.GetManifest(ctx, repo, dig)
+}
+
+func (b *embeddedDataBackend) ResolveTag(ctx context.Context, repo string, tag string) (ociregistry.Descriptor, error) {
+	desc, err := b.Registry.ResolveTag(ctx, repo, tag)
+	if err != nil {
+		return ociregistry.Descriptor{}, err
+	}
+	return b.withData(ctx, repo, desc)
+}
+
+func (b *embeddedDataBackend) ResolveManifest(ctx context.Context, repo string, dig ociregistry.Digest) (ociregistry.Descriptor, error) {
+	desc, err := b.Registry.ResolveManifest(ctx, repo, dig)
+	if err != nil {
+		return ociregistry.Descriptor{}, err
+	}
+	return b.withData(ctx, repo, desc)
+}
+
+func (b *embeddedDataBackend) withData(ctx context.Context, repo string, desc ociregistry.Descriptor) (ociregistry.Descriptor, error) {
+	if !b.embed {
+		return desc, nil
+	}
+	rd, err := b.Registry.GetManifest(ctx, repo, desc.Digest)
+	if err != nil {
+		return ociregistry.Descriptor{}, err
+	}
+	defer rd.Close()
+	desc.Data, err = io.ReadAll(rd)
+	return desc, err
+}
+
+func TestValidateManifestReferences(t *testing.T) {
+	ctx := context.Background()
+	mem := ocimem.New()
+	config := []byte("{}")
+	configDesc := ociregistry.Descriptor{
+		MediaType: "application/vnd.oci.image.config.v1+json",
+		Digest:    digest.FromBytes(config),
+		Size:      int64(len(config)),
+	}
+	_, err := mem.PushBlob(ctx, "foo", configDesc, bytes.NewReader(config))
+	qt.Assert(t, qt.IsNil(err))
+
+	// The backend doesn't check manifest references itself.
+	var pushed []string
+	backend := &ociregistry.Funcs{
+		ResolveBlob_:     mem.ResolveBlob,
+		ResolveManifest_: mem.ResolveManifest,
+		PushManifest_: func(ctx context.Context, repo string, tag string, contents []byte, mediaType string) (ociregistry.Descriptor, error) {
+			pushed = append(pushed, tag)
+			return ociregistry.Descriptor{
+				MediaType: mediaType,
+				Digest:    digest.FromBytes(contents),
+				Size:      int64(len(contents)),
+			}, nil
+		},
+	}
+	srv := httptest.NewServer(ociserver.New(backend, &ociserver.Options{
+		ValidateManifestReferences: true,
+	}))
+	defer srv.Close()
+
+	missing := digestOf("missing")
+	putManifest := func(tag string, mediaType string, manifest string) *http.Response {
+		req, err := http.NewRequest("PUT", srv.URL+"/v2/foo/manifests/"+tag, strings.NewReader(manifest))
+		qt.Assert(t, qt.IsNil(err))
+		req.Header.Set("Content-Type", mediaType)
+		resp, err := http.DefaultClient.Do(req)
+		qt.Assert(t, qt.IsNil(err))
+		return resp
+	}
+	imageManifest := func(mediaType string, layers string) string {
+		return fmt.Sprintf(`{"schemaVersion":2,"mediaType":%q,"config":{"mediaType":%q,"digest":%q,"size":%d},"layers":[%s]}`, mediaType, configDesc.MediaType, configDesc.Digest, configDesc.Size, layers)
+	}
+	index := func(mediaType string, manifests string) string {
+		return fmt.Sprintf(`{"schemaVersion":2,"mediaType":%q,"manifests":[%s]}`, mediaType, manifests)
+	}
+	missingLayer := fmt.Sprintf(`{"mediaType":"application/vnd.oci.image.layer.v1.tar","digest":%q,"size":7}`, missing)
+	missingManifest := fmt.Sprintf(`{"mediaType":"application/vnd.oci.image.manifest.v1+json","digest":%q,"size":7}`, missing)
+
+	for _, test := range []struct {
+		mediaType string
+		bad       string
+		good      string
+	}{{
+		mediaType: "application/vnd.oci.image.manifest.v1+json",
+		bad:       imageManifest("application/vnd.oci.image.manifest.v1+json", missingLayer),
+		good:      imageManifest("application/vnd.oci.image.manifest.v1+json", ""),
+	}, {
+		mediaType: "application/vnd.docker.distribution.manifest.v2+json",
+		bad:       imageManifest("application/vnd.docker.distribution.manifest.v2+json", missingLayer),
+		good:      imageManifest("application/vnd.docker.distribution.manifest.v2+json", ""),
+	}, {
+		mediaType: "application/vnd.oci.image.index.v1+json",
+		bad:       index("application/vnd.oci.image.index.v1+json", missingManifest),
+		good:      index("application/vnd.oci.image.index.v1+json", ""),
+	}, {
+		mediaType: "application/vnd.docker.distribution.manifest.list.v2+json",
+		bad:       index("application/vnd.docker.distribution.manifest.list.v2+json", missingManifest),
+		good:      index("application/vnd.docker.distribution.manifest.list.v2+json", ""),
+	}} {
+		t.Run(test.mediaType, func(t *testing.T) {
+			pushed = nil
+			resp := putManifest("bad", test.mediaType, test.bad)
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			qt.Check(t, qt.Equals(resp.StatusCode, http.StatusNotFound))
+			qt.Check(t, qt.StringContains(string(body), `"code":"MANIFEST_BLOB_UNKNOWN"`))
+			qt.Check(t, qt.StringContains(string(body), missing))
+
+			resp = putManifest("good", test.mediaType, test.good)
+			resp.Body.Close()
+			qt.Check(t, qt.Equals(resp.StatusCode, http.StatusCreated))
+			qt.Check(t, qt.DeepEquals(pushed, []string{"good"}))
+		})
+	}
+}
+
+func TestReferrersFiltersApplied(t *testing.T) {
+	subject := digestOf("subject")
+	referrers := []ociregistry.Descriptor{{
+		MediaType:    "application/vnd.oci.image.manifest.v1+json",
+		Digest:       digest.FromString("sbom"),
+		Size:         4,
+		ArtifactType: "application/vnd.example.sbom",
+	}, {
+		MediaType:    "application/vnd.oci.image.manifest.v1+json",
+		Digest:       digest.FromString("sig"),
+		Size:         3,
+		ArtifactType: "application/vnd.example.signature",
+	}}
+	for _, test := range []struct {
+		testName     string
+		honorFilter  bool
+		artifactType string
+		wantHeader   string
+		wantCount    int
+	}{{
+		testName:     "BackendFilters",
+		honorFilter:  true,
+		artifactType: "application/vnd.example.sbom",
+		wantHeader:   "artifactType",
+		wantCount:    1,
+	}, {
+		testName:     "BackendIgnoresFilter",
+		honorFilter:  false,
+		artifactType: "application/vnd.example.sbom",
+		wantHeader:   "",
+		wantCount:    2,
+	}, {
+		testName:    "NoFilter",
+		honorFilter: true,
+		wantHeader:  "",
+		wantCount:   2,
+	}} {
+		t.Run(test.testName, func(t *testing.T) {
+			backend := &ociregistry.Funcs{
+				Referrers_: func(ctx context.Context, repo string, digest ociregistry.Digest, artifactType string) ociregistry.Seq[ociregistry.Descriptor] {
+					var descs []ociregistry.Descriptor
+					for _, desc := range referrers {
+						if test.honorFilter && artifactType != "" && desc.ArtifactType != artifactType {
+							continue
+						}
+						descs = append(descs, desc)
+					}
+					return ociregistry.SliceSeq(descs)
+				},
+			}
+			srv := httptest.NewServer(ociserver.New(backend, nil))
+			defer srv.Close()
+			u := srv.URL + "/v2/foo/referrers/" + subject
+			if test.artifactType != "" {
+				u += "?artifactType=" + url.QueryEscape(test.artifactType)
+			}
+			resp, err := http.Get(u)
+			qt.Assert(t, qt.IsNil(err))
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			qt.Assert(t, qt.Equals(resp.StatusCode, http.StatusOK))
+			qt.Check(t, qt.Equals(resp.Header.Get("OCI-Filters-Applied"), test.wantHeader))
+			var index ocispec.Index
+			qt.Assert(t, qt.IsNil(json.Unmarshal(body, &index)))
+			qt.Check(t, qt.HasLen(index.Manifests, test.wantCount))
+		})
+	}
+}
+
+func TestManifestPutIfNoneMatch(t *testing.T) {
+	srv := httptest.NewServer(ociserver.New(ocimem.New(), nil))
+	defer srv.Close()
+
+	putManifest := func(path string, content string, ifNoneMatch string) *http.Response {
+		req, err := http.NewRequest("PUT", srv.URL+path, strings.NewReader(content))
+		qt.Assert(t, qt.IsNil(err))
+		req.Header.Set("Content-Type", "application/vnd.oci.image.index.v1+json")
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		qt.Assert(t, qt.IsNil(err))
+		resp.Body.Close()
+		return resp
+	}
+	manifest1 := `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[]}`
+	manifest2 := `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[],"annotations":{"x":"y"}}`
+
+	// The tag is absent, so the create succeeds.
+	resp := putManifest("/v2/foo/manifests/sometag", manifest1, "*")
+	qt.Assert(t, qt.Equals(resp.StatusCode, http.StatusCreated))
+
+	// The tag is now present, so a second create fails
+	// and leaves the tag unchanged.
+	resp = putManifest("/v2/foo/manifests/sometag", manifest2, "*")
+	qt.Assert(t, qt.Equals(resp.StatusCode, http.StatusPreconditionFailed))
+	resp, err := http.Head(srv.URL + "/v2/foo/manifests/sometag")
+	qt.Assert(t, qt.IsNil(err))
+	resp.Body.Close()
+	qt.Check(t, qt.Equals(resp.Header.Get("Docker-Content-Digest"), digestOf(manifest1)))
+
+	// Without the header, the tag is overwritten as usual.
+	resp = putManifest("/v2/foo/manifests/sometag", manifest2, "")
+	qt.Assert(t, qt.Equals(resp.StatusCode, http.StatusCreated))
+
+	// The precondition doesn't apply to pushes by digest.
+	resp = putManifest("/v2/foo/manifests/"+digestOf(manifest1), manifest1, "*")
+	qt.Assert(t, qt.Equals(resp.StatusCode, http.StatusCreated))
+}
+
+func TestDisableSinglePostUpload(t *testing.T) {
+	content := "some content"
+	dig := digestOf(content)
+	postBlob := func(srvURL string) *http.Response {
+		resp, err := http.Post(srvURL+"/v2/foo/blobs/uploads/?digest="+dig, "application/octet-stream", strings.NewReader(content))
+		qt.Assert(t, qt.IsNil(err))
+		resp.Body.Close()
+		return resp
+	}
+	ctx := context.Background()
+
+	// By default, a single POST completes the upload.
+	r := ocimem.New()
+	srv := httptest.NewServer(ociserver.New(r, nil))
+	defer srv.Close()
+	resp := postBlob(srv.URL)
+	qt.Assert(t, qt.Equals(resp.StatusCode, http.StatusCreated))
+	qt.Assert(t, qt.Equals(resp.Header.Get("Location"), "/v2/foo/blobs/"+dig))
+	_, err := r.ResolveBlob(ctx, "foo", ociregistry.Digest(dig))
+	qt.Assert(t, qt.IsNil(err))
+
+	// With the option set, the POST only starts the upload.
+	r = ocimem.New()
+	srv1 := httptest.NewServer(ociserver.New(r, &ociserver.Options{
+		DisableSinglePostUpload: true,
+	}))
+	defer srv1.Close()
+	resp = postBlob(srv1.URL)
+	qt.Assert(t, qt.Equals(resp.StatusCode, http.StatusAccepted))
+	qt.Assert(t, qt.Equals(resp.Header.Get("Range"), "0-0"))
+	location := resp.Header.Get("Location")
+	qt.Assert(t, qt.StringContains(location, "/v2/foo/blobs/uploads/"))
+	_, err = r.ResolveBlob(ctx, "foo", ociregistry.Digest(dig))
+	qt.Assert(t, qt.ErrorIs(err, ociregistry.ErrBlobUnknown))
+
+	// The upload can then be completed at the returned location.
+	u, err := url.Parse(srv1.URL)
+	qt.Assert(t, qt.IsNil(err))
+	u, err = u.Parse(location)
+	qt.Assert(t, qt.IsNil(err))
+	q := u.Query()
+	q.Set("digest", dig)
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequest("PUT", u.String(), strings.NewReader(content))
+	qt.Assert(t, qt.IsNil(err))
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err = http.DefaultClient.Do(req)
+	qt.Assert(t, qt.IsNil(err))
+	resp.Body.Close()
+	qt.Assert(t, qt.Equals(resp.StatusCode, http.StatusCreated))
+	desc, err := r.ResolveBlob(ctx, "foo", ociregistry.Digest(dig))
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.Equals(desc.Size, int64(len(content))))
+
+	// Now that the blob is present, a single POST still
+	// only starts an upload session.
+	resp = postBlob(srv1.URL)
+	qt.Assert(t, qt.Equals(resp.StatusCode, http.StatusAccepted))
+	qt.Assert(t, qt.StringContains(resp.Header.Get("Location"), "/v2/foo/blobs/uploads/"))
+}
+
+func TestManifestGetIgnoresRange(t *testing.T) {
+	srv := httptest.NewServer(ociserver.New(ocimem.New(), nil))
+	defer srv.Close()
+
+	manifest := `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[]}`
+	req, err := http.NewRequest("PUT", srv.URL+"/v2/foo/manifests/sometag", strings.NewReader(manifest))
+	qt.Assert(t, qt.IsNil(err))
+	req.Header.Set("Content-Type", "application/vnd.oci.image.index.v1+json")
+	resp, err := http.DefaultClient.Do(req)
+	qt.Assert(t, qt.IsNil(err))
+	resp.Body.Close()
+	qt.Assert(t, qt.Equals(resp.StatusCode, http.StatusCreated))
+
+	for _, path := range []string{
+		"/v2/foo/manifests/sometag",
+		"/v2/foo/manifests/" + digestOf(manifest),
+	} {
+		for _, rangeHeader := range []string{"bytes=0-9", "bytes=5-", "bytes=1000-2000"} {
+			req, err := http.NewRequest("GET", srv.URL+path, nil)
+			qt.Assert(t, qt.IsNil(err))
+			req.Header.Set("Range", rangeHeader)
+			resp, err := http.DefaultClient.Do(req)
+			qt.Assert(t, qt.IsNil(err))
+			data, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			qt.Assert(t, qt.IsNil(err))
+			qt.Assert(t, qt.Equals(resp.StatusCode, http.StatusOK), qt.Commentf("%s with Range %s", path, rangeHeader))
+			qt.Assert(t, qt.Equals(resp.Header.Get("Content-Range"), ""))
+			qt.Assert(t, qt.Equals(string(data), manifest))
+		}
+	}
+}
+
+func TestBlobMount(t *testing.T) {
+	content := "some content"
+	dig := digestOf(content)
+	ctx := context.Background()
+	post := func(srvURL, query string) *http.Response {
+		resp, err := http.Post(srvURL+"/v2/foo/blobs/uploads/?"+query, "", nil)
+		qt.Assert(t, qt.IsNil(err))
+		resp.Body.Close()
+		return resp
+	}
+	// completeUpload uploads the content to the given upload location.
+	completeUpload := func(srvURL, location string) {
+		u, err := url.Parse(srvURL)
+		qt.Assert(t, qt.IsNil(err))
+		u, err = u.Parse(location)
+		qt.Assert(t, qt.IsNil(err))
+		q := u.Query()
+		q.Set("digest", dig)
+		u.RawQuery = q.Encode()
+		req, err := http.NewRequest("PUT", u.String(), strings.NewReader(content))
+		qt.Assert(t, qt.IsNil(err))
+		req.Header.Set("Content-Type", "application/octet-stream")
+		resp, err := http.DefaultClient.Do(req)
+		qt.Assert(t, qt.IsNil(err))
+		resp.Body.Close()
+		qt.Assert(t, qt.Equals(resp.StatusCode, http.StatusCreated))
+	}
+
+	r := ocimem.New()
+	_, err := r.PushBlob(ctx, "bar", ociregistry.Descriptor{
+		MediaType: "application/octet-stream",
+		Digest:    ociregistry.Digest(dig),
+		Size:      int64(len(content)),
+	}, strings.NewReader(content))
+	qt.Assert(t, qt.IsNil(err))
+	srv := httptest.NewServer(ociserver.New(r, nil))
+	defer srv.Close()
+
+	// Without a from parameter, the POST starts a regular upload.
+	resp := post(srv.URL, "mount="+dig)
+	qt.Assert(t, qt.Equals(resp.StatusCode, http.StatusAccepted))
+	_, err = r.ResolveBlob(ctx, "foo", ociregistry.Digest(dig))
+	qt.Assert(t, qt.ErrorIs(err, ociregistry.ErrBlobUnknown))
+	completeUpload(srv.URL, resp.Header.Get("Location"))
+	desc, err := r.ResolveBlob(ctx, "foo", ociregistry.Digest(dig))
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.Equals(desc.Size, int64(len(content))))
+
+	// Once the blob is present, there's nothing to upload.
+	resp = post(srv.URL, "mount="+dig)
+	qt.Assert(t, qt.Equals(resp.StatusCode, http.StatusCreated))
+	qt.Assert(t, qt.Equals(resp.Header.Get("Location"), "/v2/foo/blobs/"+dig))
+
+	// With a from parameter, the blob is mounted.
+	r = ocimem.New()
+	_, err = r.PushBlob(ctx, "bar", ociregistry.Descriptor{
+		MediaType: "application/octet-stream",
+		Digest:    ociregistry.Digest(dig),
+		Size:      int64(len(content)),
+	}, strings.NewReader(content))
+	qt.Assert(t, qt.IsNil(err))
+	srv1 := httptest.NewServer(ociserver.New(r, nil))
+	defer srv1.Close()
+	resp = post(srv1.URL, "mount="+dig+"&from=bar")
+	qt.Assert(t, qt.Equals(resp.StatusCode, http.StatusCreated))
+	qt.Assert(t, qt.Equals(resp.Header.Get("Location"), "/v2/foo/blobs/"+dig))
+	_, err = r.ResolveBlob(ctx, "foo", ociregistry.Digest(dig))
+	qt.Assert(t, qt.IsNil(err))
+
+	// When the backend can't mount, the server falls back
+	// to a regular upload.
+	r = ocimem.New()
+	srv2 := httptest.NewServer(ociserver.New(noMountRegistry{r}, nil))
+	defer srv2.Close()
+	resp = post(srv2.URL, "mount="+dig+"&from=bar")
+	qt.Assert(t, qt.Equals(resp.StatusCode, http.StatusAccepted))
+	completeUpload(srv2.URL, resp.Header.Get("Location"))
+	_, err = r.ResolveBlob(ctx, "foo", ociregistry.Digest(dig))
+	qt.Assert(t, qt.IsNil(err))
+
+	// When the source repository or blob doesn't exist,
+	// the server falls back to a regular upload too.
+	r = ocimem.New()
+	_, err = r.PushBlob(ctx, "bar", ociregistry.Descriptor{
+		MediaType: "application/octet-stream",
+		Digest:    ociregistry.Digest(digestOf("other content")),
+		Size:      int64(len("other content")),
+	}, strings.NewReader("other content"))
+	qt.Assert(t, qt.IsNil(err))
+	srv3 := httptest.NewServer(ociserver.New(r, nil))
+	defer srv3.Close()
+	for _, from := range []string{"bar", "nonexistent"} {
+		resp = post(srv3.URL, "mount="+dig+"&from="+from)
+		qt.Assert(t, qt.Equals(resp.StatusCode, http.StatusAccepted), qt.Commentf("from %s", from))
+		qt.Assert(t, qt.StringContains(resp.Header.Get("Location"), "/v2/foo/blobs/uploads/"))
+	}
+	completeUpload(srv3.URL, resp.Header.Get("Location"))
+	_, err = r.ResolveBlob(ctx, "foo", ociregistry.Digest(dig))
+	qt.Assert(t, qt.IsNil(err))
+
+	// With DisableSinglePostUpload, a session is started
+	// even when the blob is already present.
+	srv4 := httptest.NewServer(ociserver.New(r, &ociserver.Options{
+		DisableSinglePostUpload: true,
+	}))
+	defer srv4.Close()
+	resp = post(srv4.URL, "mount="+dig)
+	qt.Assert(t, qt.Equals(resp.StatusCode, http.StatusAccepted))
+	qt.Assert(t, qt.StringContains(resp.Header.Get("Location"), "/v2/foo/blobs/uploads/"))
+}
+
+type noMountRegistry struct {
+	ociregistry.Interface
+}
+
+func (noMountRegistry) MountBlob(ctx context.Context, fromRepo, toRepo string, digest ociregistry.Digest) (ociregistry.Descriptor, error) {
+	return ociregistry.Descriptor{}, ociregistry.ErrUnsupported
+}
+
+func TestAllowedDigestAlgorithms(t *testing.T) {
+	content := "some content"
+	sha256Digest := string(digest.SHA256.FromString(content))
+	sha512Digest := string(digest.SHA512.FromString(content))
+	tests := []struct {
+		testName   string
+		allowed    []string
+		method     string
+		path       string
+		body       string
+		wantStatus int
+	}{{
+		testName:   "UploadAllowed",
+		allowed:    []string{"sha256"},
+		method:     "POST",
+		path:       "/v2/foo/blobs/uploads/?digest=" + sha256Digest,
+		body:       content,
+		wantStatus: http.StatusCreated,
+	}, {
+		testName:   "UploadDisallowed",
+		allowed:    []string{"sha256"},
+		method:     "POST",
+		path:       "/v2/foo/blobs/uploads/?digest=" + sha512Digest,
+		body:       content,
+		wantStatus: http.StatusBadRequest,
+	}, {
+		testName:   "BlobGetSHA512Allowed",
+		allowed:    []string{"sha256", "sha512"},
+		method:     "GET",
+		path:       "/v2/foo/blobs/" + sha512Digest,
+		wantStatus: http.StatusNotFound,
+	}, {
+		testName:   "BlobGetAnyAllowedByDefault",
+		method:     "GET",
+		path:       "/v2/foo/blobs/" + sha512Digest,
+		wantStatus: http.StatusNotFound,
+	}, {
+		testName:   "BlobGetDisallowed",
+		allowed:    []string{"sha256"},
+		method:     "GET",
+		path:       "/v2/foo/blobs/" + sha512Digest,
+		wantStatus: http.StatusBadRequest,
+	}, {
+		testName:   "MountDisallowed",
+		allowed:    []string{"sha256"},
+		method:     "POST",
+		path:       "/v2/foo/blobs/uploads/?mount=" + sha512Digest + "&from=bar",
+		wantStatus: http.StatusBadRequest,
+	}, {
+		testName:   "ManifestPutDisallowed",
+		allowed:    []string{"sha256"},
+		method:     "PUT",
+		path:       "/v2/foo/manifests/" + string(digest.SHA512.FromString("{}")),
+		body:       "{}",
+		wantStatus: http.StatusBadRequest,
+	}, {
+		testName:   "ManifestGetByTag",
+		allowed:    []string{"sha256"},
+		method:     "GET",
+		path:       "/v2/foo/manifests/latest",
+		wantStatus: http.StatusNotFound,
+	}}
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			srv := httptest.NewServer(ociserver.New(ocimem.New(), &ociserver.Options{
+				AllowedDigestAlgorithms: test.allowed,
+			}))
+			defer srv.Close()
+			req, err := http.NewRequest(test.method, srv.URL+test.path, strings.NewReader(test.body))
+			qt.Assert(t, qt.IsNil(err))
+			req.Header.Set("Content-Type", "application/octet-stream")
+			resp, err := http.DefaultClient.Do(req)
+			qt.Assert(t, qt.IsNil(err))
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			qt.Assert(t, qt.Equals(resp.StatusCode, test.wantStatus), qt.Commentf("body: %s", body))
+			if test.wantStatus == http.StatusBadRequest {
+				qt.Assert(t, qt.StringContains(string(body), `"code":"DIGEST_INVALID"`))
+			}
+		})
+	}
+}
+
+func TestManifestDigestHeaderByTag(t *testing.T) {
+	ctx := context.Background()
+	manifest := `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[]}`
+	backend := ocimem.New()
+	_, err := backend.PushManifest(ctx, "foo", "sometag", []byte(manifest), "application/vnd.oci.image.index.v1+json")
+	qt.Assert(t, qt.IsNil(err))
+
+	do := func(srvURL, method, path string) *http.Response {
+		req, err := http.NewRequest(method, srvURL+path, nil)
+		qt.Assert(t, qt.IsNil(err))
+		resp, err := http.DefaultClient.Do(req)
+		qt.Assert(t, qt.IsNil(err))
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		qt.Assert(t, qt.IsNil(err))
+		qt.Assert(t, qt.Equals(resp.StatusCode, http.StatusOK), qt.Commentf("body: %s", body))
+		if method == "GET" {
+			qt.Assert(t, qt.Equals(string(body), manifest))
+		}
+		return resp
+	}
+
+	srv := httptest.NewServer(ociserver.New(backend, nil))
+	defer srv.Close()
+	for _, method := range []string{"GET", "HEAD"} {
+		resp := do(srv.URL, method, "/v2/foo/manifests/sometag")
+		qt.Check(t, qt.Equals(resp.Header.Get("Docker-Content-Digest"), digestOf(manifest)), qt.Commentf("method %s", method))
+	}
+
+	// When the backend doesn't provide the digest, it's computed from the content.
+	noDigestSrv := httptest.NewServer(ociserver.New(&ociregistry.Funcs{
+		GetTag_: func(ctx context.Context, repo string, tagName string) (ociregistry.BlobReader, error) {
+			return ocimem.NewBytesReader([]byte(manifest), ociregistry.Descriptor{
+				MediaType: "application/vnd.oci.image.index.v1+json",
+				Size:      int64(len(manifest)),
+			}), nil
+		},
+	}, nil))
+	defer noDigestSrv.Close()
+	resp := do(noDigestSrv.URL, "GET", "/v2/foo/manifests/sometag")
+	qt.Check(t, qt.Equals(resp.Header.Get("Docker-Content-Digest"), digestOf(manifest)))
+
+	// OmitDigestFromTagGetResponse only affects GET requests by tag.
+	omitSrv := httptest.NewServer(ociserver.New(backend, &ociserver.Options{
+		OmitDigestFromTagGetResponse: true,
+	}))
+	defer omitSrv.Close()
+	resp = do(omitSrv.URL, "GET", "/v2/foo/manifests/sometag")
+	qt.Check(t, qt.Equals(resp.Header.Get("Docker-Content-Digest"), ""))
+	resp = do(omitSrv.URL, "HEAD", "/v2/foo/manifests/sometag")
+	qt.Check(t, qt.Equals(resp.Header.Get("Docker-Content-Digest"), digestOf(manifest)))
+	resp = do(omitSrv.URL, "GET", "/v2/foo/manifests/"+digestOf(manifest))
+	qt.Check(t, qt.Equals(resp.Header.Get("Docker-Content-Digest"), digestOf(manifest)))
+}
+
+func TestManifestPutMediaTypeFromContent(t *testing.T) {
+	const indexType = "application/vnd.oci.image.index.v1+json"
+	index := `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[]}`
+	tests := []struct {
+		testName      string
+		contentType   string
+		content       string
+		wantStatus    int
+		wantMediaType string
+	}{{
+		testName:      "NoContentTypeWithMediaType",
+		content:       index,
+		wantStatus:    http.StatusCreated,
+		wantMediaType: indexType,
+	}, {
+		testName:      "OctetStreamWithMediaType",
+		contentType:   "application/octet-stream",
+		content:       index,
+		wantStatus:    http.StatusCreated,
+		wantMediaType: indexType,
+	}, {
+		testName:      "ExplicitContentType",
+		contentType:   "application/vnd.example.thing.v1+json",
+		content:       index,
+		wantStatus:    http.StatusCreated,
+		wantMediaType: "application/vnd.example.thing.v1+json",
+	}, {
+		testName:      "NoContentTypeNoMediaType",
+		content:       `{"schemaVersion":2,"manifests":[]}`,
+		wantStatus:    http.StatusCreated,
+		wantMediaType: "application/octet-stream",
+	}, {
+		testName:   "NoContentTypeInvalidMediaType",
+		content:    `{"schemaVersion":2,"mediaType":"not a media type","manifests":[]}`,
+		wantStatus: http.StatusBadRequest,
+	}, {
+		testName:      "NoContentTypeNotJSON",
+		content:       "foo",
+		wantStatus:    http.StatusCreated,
+		wantMediaType: "application/octet-stream",
+	}}
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			srv := httptest.NewServer(ociserver.New(ocimem.New(), nil))
+			defer srv.Close()
+			req, err := http.NewRequest("PUT", srv.URL+"/v2/foo/manifests/sometag", strings.NewReader(test.content))
+			qt.Assert(t, qt.IsNil(err))
+			if test.contentType != "" {
+				req.Header.Set("Content-Type", test.contentType)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			qt.Assert(t, qt.IsNil(err))
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			qt.Assert(t, qt.IsNil(err))
+			qt.Assert(t, qt.Equals(resp.StatusCode, test.wantStatus), qt.Commentf("body: %s", body))
+			if test.wantStatus != http.StatusCreated {
+				qt.Assert(t, qt.StringContains(string(body), "MANIFEST_INVALID"))
+				return
+			}
+			resp, err = http.Head(srv.URL + "/v2/foo/manifests/sometag")
+			qt.Assert(t, qt.IsNil(err))
+			resp.Body.Close()
+			qt.Check(t, qt.Equals(resp.Header.Get("Content-Type"), test.wantMediaType))
+		})
+	}
+}
+
+type testUserKey struct{}
+
+func TestCatalogFilter(t *testing.T) {
+	ctx := context.Background()
+	backend := ocimem.New()
+	for _, repo := range []string{"alice/a", "alice/b", "bob/c", "shared"} {
+		_, err := backend.PushManifest(ctx, repo, "latest", []byte("foo"), "application/octet-stream")
+		qt.Assert(t, qt.IsNil(err))
+	}
+	handler := ociserver.New(backend, &ociserver.Options{
+		CatalogFilter: func(ctx context.Context, repos []string) []string {
+			user, _ := ctx.Value(testUserKey{}).(string)
+			var allowed []string
+			for _, repo := range repos {
+				if repo == "shared" || strings.HasPrefix(repo, user+"/") {
+					allowed = append(allowed, repo)
+				}
+			}
+			return allowed
+		},
+	})
+	// Simulate authentication middleware that records
+	// the caller's identity in the request context.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx := context.WithValue(req.Context(), testUserKey{}, req.Header.Get("X-User"))
+		handler.ServeHTTP(w, req.WithContext(ctx))
+	}))
+	defer srv.Close()
+
+	list := func(user, path string) ([]string, string) {
+		req, err := http.NewRequest("GET", srv.URL+path, nil)
+		qt.Assert(t, qt.IsNil(err))
+		req.Header.Set("X-User", user)
+		resp, err := http.DefaultClient.Do(req)
+		qt.Assert(t, qt.IsNil(err))
+		defer resp.Body.Close()
+		qt.Assert(t, qt.Equals(resp.StatusCode, http.StatusOK))
+		var body struct {
+			Repos []string `json:"repositories"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		qt.Assert(t, qt.IsNil(err))
+		return body.Repos, resp.Header.Get("Link")
+	}
+
+	repos, _ := list("alice", "/v2/_catalog")
+	qt.Check(t, qt.DeepEquals(repos, []string{"alice/a", "alice/b", "shared"}))
+	repos, _ = list("bob", "/v2/_catalog")
+	qt.Check(t, qt.DeepEquals(repos, []string{"bob/c", "shared"}))
+
+	// Pages are filtered before pagination, so they're full
+	// and the Link header never names a hidden repository.
+	repos, link := list("bob", "/v2/_catalog?n=1")
+	qt.Check(t, qt.DeepEquals(repos, []string{"bob/c"}))
+	qt.Check(t, qt.Equals(link, `</v2/_catalog?last=bob%2Fc&n=1>;rel="next"`))
+	repos, link = list("bob", "/v2/_catalog?n=1&last=bob%2Fc")
+	qt.Check(t, qt.DeepEquals(repos, []string{"shared"}))
+	qt.Check(t, qt.Equals(link, ""))
+
+	// Walk the pages for each user, checking that
+	// every cursor is a repository they can see.
+	for _, user := range []string{"alice", "bob", "nobody"} {
+		visible := map[string]bool{}
+		for _, repo := range []string{"alice/a", "alice/b", "bob/c", "shared"} {
+			if repo == "shared" || strings.HasPrefix(repo, user+"/") {
+				visible[repo] = true
+			}
+		}
+		var all []string
+		path := "/v2/_catalog?n=1"
+		for path != "" {
+			repos, link := list(user, path)
+			all = append(all, repos...)
+			path = ""
+			if link != "" {
+				u, err := url.Parse(strings.TrimSuffix(strings.TrimPrefix(link, "<"), `>;rel="next"`))
+				qt.Assert(t, qt.IsNil(err))
+				last := u.Query().Get("last")
+				qt.Check(t, qt.IsTrue(visible[last]), qt.Commentf("user %s, cursor %q", user, last))
+				qt.Check(t, qt.HasLen(repos, 1))
+				path = u.String()
+			}
+		}
+		qt.Check(t, qt.HasLen(all, len(visible)), qt.Commentf("user %s", user))
+	}
+}
+
+func TestCatalogFilterManyRepositories(t *testing.T) {
+	ctx := context.Background()
+	backend := ocimem.New()
+	var want []string
+	for i := range 250 {
+		repo := fmt.Sprintf("repo%03d", i)
+		_, err := backend.PushManifest(ctx, repo, "latest", []byte("foo"), "application/octet-stream")
+		qt.Assert(t, qt.IsNil(err))
+		if i%3 == 0 {
+			want = append(want, repo)
+		}
+	}
+	var calls int
+	srv := httptest.NewServer(ociserver.New(backend, &ociserver.Options{
+		CatalogFilter: func(ctx context.Context, repos []string) []string {
+			calls++
+			var allowed []string
+			for _, repo := range repos {
+				if slices.Contains(want, repo) {
+					allowed = append(allowed, repo)
+				}
+			}
+			return allowed
+		},
+	}))
+	defer srv.Close()
+	var repos []string
+	path := "/v2/_catalog?n=30"
+	for path != "" {
+		resp, err := http.Get(srv.URL + path)
+		qt.Assert(t, qt.IsNil(err))
+		var body struct {
+			Repos []string `json:"repositories"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		qt.Assert(t, qt.IsNil(err))
+		repos = append(repos, body.Repos...)
+		path = strings.TrimSuffix(strings.TrimPrefix(resp.Header.Get("Link"), "<"), `>;rel="next"`)
+		if path != "" {
+			// Every page but the last is full.
+			qt.Assert(t, qt.HasLen(body.Repos, 30))
+		}
+	}
+	qt.Check(t, qt.DeepEquals(repos, want))
+	// The filter is called with batches of names rather than once per page.
+	qt.Check(t, qt.IsTrue(calls < 10), qt.Commentf("%d calls", calls))
+}
+
+func TestAbsoluteLocations(t *testing.T) {
+	tests := []struct {
+		testName     string
+		opts         *ociserver.Options
+		wantLocation string // prefix of the upload location
+		wantLink     string
+	}{{
+		testName:     "Default",
+		wantLocation: "/v2/foo/blobs/uploads/",
+		wantLink:     `</v2/foo/tags/list?last=a&n=1>;rel="next"`,
+	}, {
+		testName: "FromRequest",
+		opts: &ociserver.Options{
+			AbsoluteLocations: true,
+		},
+		wantLocation: "http://{host}/v2/foo/blobs/uploads/",
+		wantLink:     `<http://{host}/v2/foo/tags/list?last=a&n=1>;rel="next"`,
+	}, {
+		testName: "WithBaseURL",
+		opts: &ociserver.Options{
+			AbsoluteLocations: true,
+			BaseURL: &url.URL{
+				Scheme: "https",
+				Host:   "registry.example.com",
+				Path:   "/prefix/",
+			},
+		},
+		wantLocation: "https://registry.example.com/prefix/v2/foo/blobs/uploads/",
+		wantLink:     `<https://registry.example.com/prefix/v2/foo/tags/list?last=a&n=1>;rel="next"`,
+	}, {
+		testName: "WithBaseURLCredentialsAndEscapedPath",
+		opts: &ociserver.Options{
+			AbsoluteLocations: true,
+			BaseURL: &url.URL{
+				Scheme:  "https",
+				User:    url.UserPassword("someuser", "somepassword"),
+				Host:    "registry.example.com",
+				Path:    "/a b/x/y/",
+				RawPath: "/a%20b/x%2Fy/",
+			},
+		},
+		wantLocation: "https://registry.example.com/a%20b/x%2Fy/v2/foo/blobs/uploads/",
+		wantLink:     `<https://registry.example.com/a%20b/x%2Fy/v2/foo/tags/list?last=a&n=1>;rel="next"`,
+	}}
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			backend := ocimem.New()
+			for _, tag := range []string{"a", "b"} {
+				_, err := backend.PushManifest(context.Background(), "foo", tag, []byte("foo"), "application/octet-stream")
+				qt.Assert(t, qt.IsNil(err))
+			}
+			srv := httptest.NewServer(ociserver.New(backend, test.opts))
+			defer srv.Close()
+			host := strings.TrimPrefix(srv.URL, "http://")
+
+			resp, err := http.Post(srv.URL+"/v2/foo/blobs/uploads/", "", nil)
+			qt.Assert(t, qt.IsNil(err))
+			resp.Body.Close()
+			qt.Assert(t, qt.Equals(resp.StatusCode, http.StatusAccepted))
+			qt.Check(t, qt.Matches(resp.Header.Get("Location"), regexp.QuoteMeta(strings.ReplaceAll(test.wantLocation, "{host}", host))+`\w+`))
+
+			resp, err = http.Get(srv.URL + "/v2/foo/tags/list?n=1")
+			qt.Assert(t, qt.IsNil(err))
+			resp.Body.Close()
+			qt.Assert(t, qt.Equals(resp.StatusCode, http.StatusOK))
+			qt.Check(t, qt.Equals(resp.Header.Get("Link"), strings.ReplaceAll(test.wantLink, "{host}", host)))
+		})
+	}
+}
+
+func TestListPageSizeLimit(t *testing.T) {
+	ctx := context.Background()
+	backend := ocimem.New()
+	for _, tag := range []string{"t1", "t2", "t3", "t4", "t5"} {
+		_, err := backend.PushManifest(ctx, "foo", tag, []byte("foo"), "application/octet-stream")
+		qt.Assert(t, qt.IsNil(err))
+	}
+	for _, repo := range []string{"bar", "baz"} {
+		_, err := backend.PushManifest(ctx, repo, "latest", []byte("foo"), "application/octet-stream")
+		qt.Assert(t, qt.IsNil(err))
+	}
+	srv := httptest.NewServer(ociserver.New(backend, &ociserver.Options{
+		ListPageSizeLimit: 2,
+	}))
+	defer srv.Close()
+
+	list := func(path string, field string) ([]string, string) {
+		resp, err := http.Get(srv.URL + path)
+		qt.Assert(t, qt.IsNil(err))
+		defer resp.Body.Close()
+		qt.Assert(t, qt.Equals(resp.StatusCode, http.StatusOK))
+		var body map[string]json.RawMessage
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		qt.Assert(t, qt.IsNil(err))
+		var items []string
+		err = json.Unmarshal(body[field], &items)
+		qt.Assert(t, qt.IsNil(err))
+		return items, resp.Header.Get("Link")
+	}
+
+	tags, link := list("/v2/foo/tags/list?n=1000000", "tags")
+	qt.Check(t, qt.DeepEquals(tags, []string{"t1", "t2"}))
+	qt.Check(t, qt.Equals(link, `</v2/foo/tags/list?last=t2&n=1000000>;rel="next"`))
+
+	tags, link = list("/v2/foo/tags/list", "tags")
+	qt.Check(t, qt.DeepEquals(tags, []string{"t1", "t2"}))
+	qt.Check(t, qt.Equals(link, `</v2/foo/tags/list?last=t2>;rel="next"`))
+
+	// Smaller pages are unaffected.
+	tags, link = list("/v2/foo/tags/list?n=1", "tags")
+	qt.Check(t, qt.DeepEquals(tags, []string{"t1"}))
+	qt.Check(t, qt.Equals(link, `</v2/foo/tags/list?last=t1&n=1>;rel="next"`))
+
+	// Following the links yields all the tags.
+	var all []string
+	path := "/v2/foo/tags/list?n=1000000"
+	for path != "" {
+		tags, link := list(path, "tags")
+		all = append(all, tags...)
+		path = ""
+		if link != "" {
+			path = strings.TrimSuffix(strings.TrimPrefix(link, "<"), `>;rel="next"`)
+		}
+	}
+	qt.Check(t, qt.DeepEquals(all, []string{"t1", "t2", "t3", "t4", "t5"}))
+
+	repos, link := list("/v2/_catalog?n=100", "repositories")
+	qt.Check(t, qt.DeepEquals(repos, []string{"bar", "baz"}))
+	qt.Check(t, qt.Equals(link, `</v2/_catalog?last=baz&n=100>;rel="next"`))
+}
+
+func TestBlobUploadInfoRange(t *testing.T) {
+	backend := ocimem.New()
+	srv := httptest.NewServer(ociserver.New(backend, nil))
+	defer srv.Close()
+	do := func(srvURL, method, path, contentRange, body string) *http.Response {
+		req, err := http.NewRequest(method, srvURL+path, strings.NewReader(body))
+		qt.Assert(t, qt.IsNil(err))
+		if contentRange != "" {
+			req.Header.Set("Content-Range", contentRange)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		qt.Assert(t, qt.IsNil(err))
+		data, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		qt.Assert(t, qt.IsTrue(resp.StatusCode < 300), qt.Commentf("%s %s: %s", method, path, data))
+		return resp
+	}
+	infoRange := func(srvURL, location string) string {
+		resp := do(srvURL, "GET", location, "", "")
+		qt.Check(t, qt.Equals(resp.StatusCode, http.StatusNoContent))
+		qt.Check(t, qt.Equals(resp.Header.Get("Location"), location))
+		return resp.Header.Get("Range")
+	}
+
+	resp := do(srv.URL, "POST", "/v2/foo/blobs/uploads/", "", "")
+	location := resp.Header.Get("Location")
+	qt.Check(t, qt.Equals(infoRange(srv.URL, location), "0-0"))
+
+	resp = do(srv.URL, "PATCH", location, "0-4", "hello")
+	qt.Check(t, qt.Equals(resp.Header.Get("Range"), "0-4"))
+	qt.Check(t, qt.Equals(infoRange(srv.URL, location), "0-4"))
+
+	resp = do(srv.URL, "PATCH", location, "5-10", " world")
+	qt.Check(t, qt.Equals(resp.Header.Get("Range"), "0-10"))
+	qt.Check(t, qt.Equals(infoRange(srv.URL, location), "0-10"))
+
+	// A new server using the same backend, as after a restart,
+	// reports the same progress and allows the upload to be
+	// resumed from there.
+	srv.Close()
+	srv = httptest.NewServer(ociserver.New(backend, nil))
+	defer srv.Close()
+	qt.Check(t, qt.Equals(infoRange(srv.URL, location), "0-10"))
+	do(srv.URL, "PATCH", location, "11-11", "!")
+	qt.Check(t, qt.Equals(infoRange(srv.URL, location), "0-11"))
+	dig := digestOf("hello world!")
+	do(srv.URL, "PUT", location+"?digest="+dig, "", "")
+
+	rd, err := backend.GetBlob(context.Background(), "foo", ociregistry.Digest(dig))
+	qt.Assert(t, qt.IsNil(err))
+	defer rd.Close()
+	data, err := io.ReadAll(rd)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.Equals(string(data), "hello world!"))
+}
+
+func TestRejectDeprecatedArtifactManifest(t *testing.T) {
+	const artifactType = "application/vnd.oci.artifact.manifest.v1+json"
+	manifest := `{"mediaType":"application/vnd.oci.artifact.manifest.v1+json","artifactType":"application/vnd.example","blobs":[]}`
+	tests := []struct {
+		testName    string
+		reject      bool
+		contentType string
+		wantStatus  int
+	}{{
+		testName:    "Accepted",
+		contentType: artifactType,
+		wantStatus:  http.StatusCreated,
+	}, {
+		testName:    "Rejected",
+		reject:      true,
+		contentType: artifactType,
+		wantStatus:  http.StatusBadRequest,
+	}, {
+		testName:    "RejectedWithParameters",
+		reject:      true,
+		contentType: artifactType + "; charset=utf-8",
+		wantStatus:  http.StatusBadRequest,
+	}, {
+		testName:   "RejectedFromContent",
+		reject:     true,
+		wantStatus: http.StatusBadRequest,
+	}, {
+		testName:    "RejectedWithImageManifestContentType",
+		reject:      true,
+		contentType: "application/vnd.oci.image.manifest.v1+json",
+		wantStatus:  http.StatusBadRequest,
+	}}
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			srv := httptest.NewServer(ociserver.New(ocimem.New(), &ociserver.Options{
+				RejectDeprecatedArtifactManifest: test.reject,
+			}))
+			defer srv.Close()
+			req, err := http.NewRequest("PUT", srv.URL+"/v2/foo/manifests/latest", strings.NewReader(manifest))
+			qt.Assert(t, qt.IsNil(err))
+			if test.contentType != "" {
+				req.Header.Set("Content-Type", test.contentType)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			qt.Assert(t, qt.IsNil(err))
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			qt.Assert(t, qt.Equals(resp.StatusCode, test.wantStatus), qt.Commentf("body: %s", body))
+			if test.wantStatus != http.StatusCreated {
+				qt.Check(t, qt.StringContains(string(body), `"code":"MANIFEST_INVALID"`))
+			}
+		})
+	}
+
+	// Image manifests are unaffected.
+	srv := httptest.NewServer(ociserver.New(ocimem.New(), &ociserver.Options{
+		RejectDeprecatedArtifactManifest: true,
+	}))
+	defer srv.Close()
+	req, err := http.NewRequest("PUT", srv.URL+"/v2/foo/manifests/latest", strings.NewReader(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[]}`))
+	qt.Assert(t, qt.IsNil(err))
+	resp, err := http.DefaultClient.Do(req)
+	qt.Assert(t, qt.IsNil(err))
+	resp.Body.Close()
+	qt.Check(t, qt.Equals(resp.StatusCode, http.StatusCreated))
+}
+
+func TestBlobUploadCancel(t *testing.T) {
+	srv := httptest.NewServer(ociserver.New(ocimem.New(), nil))
+	defer srv.Close()
+	do := func(method, path, contentRange, body string) (*http.Response, string) {
+		req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		qt.Assert(t, qt.IsNil(err))
+		if contentRange != "" {
+			req.Header.Set("Content-Range", contentRange)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		qt.Assert(t, qt.IsNil(err))
+		data, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, string(data)
+	}
+	resp, _ := do("POST", "/v2/foo/blobs/uploads/", "", "")
+	qt.Assert(t, qt.Equals(resp.StatusCode, http.StatusAccepted))
+	location := resp.Header.Get("Location")
+	resp, _ = do("PATCH", location, "0-4", "hello")
+	qt.Assert(t, qt.Equals(resp.StatusCode, http.StatusAccepted))
+
+	resp, _ = do("DELETE", location, "", "")
+	qt.Assert(t, qt.Equals(resp.StatusCode, http.StatusNoContent))
+
+	// All further operations on the session fail.
+	for _, test := range []struct {
+		method, path, contentRange, body string
+	}{
+		{"GET", location, "", ""},
+		{"PATCH", location, "5-10", " world"},
+		{"PATCH", location, "0-4", "hello"},
+		{"PUT", location + "?digest=" + digestOf("hello"), "", ""},
+		{"DELETE", location, "", ""},
+	} {
+		resp, body := do(test.method, test.path, test.contentRange, test.body)
+		qt.Check(t, qt.Equals(resp.StatusCode, http.StatusNotFound), qt.Commentf("%s %s", test.method, test.path))
+		qt.Check(t, qt.StringContains(body, `"code":"BLOB_UPLOAD_UNKNOWN"`), qt.Commentf("%s %s", test.method, test.path))
+	}
+}
+
+func TestEchoManifestDescriptor(t *testing.T) {
+	const mediaType = "application/vnd.oci.image.index.v1+json"
+	manifest := `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[]}`
+	for _, echo := range []bool{false, true} {
+		t.Run(fmt.Sprint(echo), func(t *testing.T) {
+			srv := httptest.NewServer(ociserver.New(ocimem.New(), &ociserver.Options{
+				EchoManifestDescriptor: echo,
+			}))
+			defer srv.Close()
+			req, err := http.NewRequest("PUT", srv.URL+"/v2/foo/manifests/latest", strings.NewReader(manifest))
+			qt.Assert(t, qt.IsNil(err))
+			req.Header.Set("Content-Type", mediaType)
+			resp, err := http.DefaultClient.Do(req)
+			qt.Assert(t, qt.IsNil(err))
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			qt.Assert(t, qt.Equals(resp.StatusCode, http.StatusCreated), qt.Commentf("body: %s", body))
+			dig := digest.FromString(manifest)
+			qt.Check(t, qt.Equals(resp.Header.Get("Docker-Content-Digest"), string(dig)))
+			if !echo {
+				qt.Check(t, qt.Equals(string(body), ""))
+				return
+			}
+			qt.Check(t, qt.Equals(resp.Header.Get("Content-Type"), "application/vnd.oci.descriptor.v1+json"))
+			qt.Check(t, qt.JSONEquals(body, ociregistry.Descriptor{
+				MediaType: mediaType,
+				Digest:    dig,
+				Size:      int64(len(manifest)),
+			}))
+		})
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociserver
+
+import (
+	"fmt"
+	"net/url"
+
+	"cuelabs.dev/go/oci/ociregistry/internal/ocirequest"
+)
+
+// RequestKind identifies an endpoint of the OCI distribution API.
+type RequestKind int
+
+const (
+	// ReqPing is GET /v2/.
+	ReqPing = RequestKind(ocirequest.ReqPing)
+
+	// ReqBlobGet is GET /v2/<name>/blobs/<digest>.
+	ReqBlobGet = RequestKind(ocirequest.ReqBlobGet)
+
+	// ReqBlobHead is HEAD /v2/<name>/blobs/<digest>.
+	ReqBlobHead = RequestKind(ocirequest.ReqBlobHead)
+
+	// ReqBlobDelete is DELETE /v2/<name>/blobs/<digest>.
+	ReqBlobDelete = RequestKind(ocirequest.ReqBlobDelete)
+
+	// ReqBlobStartUpload is POST /v2/<name>/blobs/uploads/.
+	ReqBlobStartUpload = RequestKind(ocirequest.ReqBlobStartUpload)
+
+	// ReqBlobUploadBlob is POST /v2/<name>/blobs/uploads/?digest=<digest>.
+	ReqBlobUploadBlob = RequestKind(ocirequest.ReqBlobUploadBlob)
+
+	// ReqBlobMount is POST /v2/<name>/blobs/uploads/?mount=<digest>&from=<other_name>.
+	ReqBlobMount = RequestKind(ocirequest.ReqBlobMount)
+
+	// ReqBlobUploadInfo is GET /v2/<name>/blobs/uploads/<reference>.
+	ReqBlobUploadInfo = RequestKind(ocirequest.ReqBlobUploadInfo)
+
+	// ReqBlobUploadChunk is PATCH /v2/<name>/blobs/uploads/<reference>.
+	ReqBlobUploadChunk = RequestKind(ocirequest.ReqBlobUploadChunk)
+
+	// ReqBlobCompleteUpload is PUT /v2/<name>/blobs/uploads/<reference>?digest=<digest>.
+	ReqBlobCompleteUpload = RequestKind(ocirequest.ReqBlobCompleteUpload)
+
+	// ReqManifestGet is GET /v2/<name>/manifests/<tagOrDigest>.
+	ReqManifestGet = RequestKind(ocirequest.ReqManifestGet)
+
+	// ReqManifestHead is HEAD /v2/<name>/manifests/<tagOrDigest>.
+	ReqManifestHead = RequestKind(ocirequest.ReqManifestHead)
+
+	// ReqManifestPut is PUT /v2/<name>/manifests/<tagOrDigest>.
+	ReqManifestPut = RequestKind(ocirequest.ReqManifestPut)
+
+	// ReqManifestDelete is DELETE /v2/<name>/manifests/<tagOrDigest>.
+	ReqManifestDelete = RequestKind(ocirequest.ReqManifestDelete)
+
+	// ReqTagsList is GET /v2/<name>/tags/list.
+	ReqTagsList = RequestKind(ocirequest.ReqTagsList)
+
+	// ReqReferrersList is GET /v2/<name>/referrers/<digest>.
+	ReqReferrersList = RequestKind(ocirequest.ReqReferrersList)
+
+	// ReqCatalogList is GET /v2/_catalog. It's not part of the OCI spec.
+	ReqCatalogList = RequestKind(ocirequest.ReqCatalogList)
+
+	// ReqBlobUploadCancel is DELETE /v2/<name>/blobs/uploads/<reference>.
+	ReqBlobUploadCancel = RequestKind(ocirequest.ReqBlobUploadCancel)
+)
+
+var requestKindNames = []string{
+	ReqPing:               "Ping",
+	ReqBlobGet:            "BlobGet",
+	ReqBlobHead:           "BlobHead",
+	ReqBlobDelete:         "BlobDelete",
+	ReqBlobStartUpload:    "BlobStartUpload",
+	ReqBlobUploadBlob:     "BlobUploadBlob",
+	ReqBlobMount:          "BlobMount",
+	ReqBlobUploadInfo:     "BlobUploadInfo",
+	ReqBlobUploadChunk:    "BlobUploadChunk",
+	ReqBlobCompleteUpload: "BlobCompleteUpload",
+	ReqManifestGet:        "ManifestGet",
+	ReqManifestHead:       "ManifestHead",
+	ReqManifestPut:        "ManifestPut",
+	ReqManifestDelete:     "ManifestDelete",
+	ReqTagsList:           "TagsList",
+	ReqReferrersList:      "ReferrersList",
+	ReqCatalogList:        "CatalogList",
+	ReqBlobUploadCancel:   "BlobUploadCancel",
+}
+
+func (k RequestKind) String() string {
+	if k >= 0 && int(k) < len(requestKindNames) {
+		return requestKindNames[k]
+	}
+	return fmt.Sprintf("RequestKind(%d)", int(k))
+}
+
+// RequestInfo holds the information parsed from the method and URL
+// of an OCI distribution API request. Fields that aren't relevant
+// to the kind of request are empty.
+type RequestInfo struct {
+	Kind RequestKind
+
+	// Repo holds the repository name. It's empty for
+	// ReqPing and ReqCatalogList.
+	Repo string
+
+	// Digest holds the digest used in the request: for blob requests,
+	// upload completion, mounts, referrers, and manifest requests
+	// that refer to a digest rather than a tag.
+	Digest string
+
+	// Tag holds the tag used by manifest requests that
+	// refer to a tag rather than a digest.
+	Tag string
+
+	// FromRepo holds the repository to mount from for ReqBlobMount.
+	FromRepo string
+
+	// UploadID holds the opaque upload identifier for
+	// ReqBlobUploadInfo, ReqBlobUploadChunk, ReqBlobCompleteUpload
+	// and ReqBlobUploadCancel.
+	UploadID string
+
+	// ListN holds the maximum number of items to return for
+	// list requests, or -1 if no limit was specified.
+	ListN int
+
+	// ListLast holds the item that list results start after, if any.
+	ListLast string
+
+	// ArtifactType holds the artifact type that referrers
+	// are filtered by, if any.
+	ArtifactType string
+}
+
+// ParseRequest parses the given HTTP method and URL as an OCI
+// distribution API request using the same rules as the server,
+// so it can be used to build routers or middleware that
+// understand registry requests. The URL's path should
+// start with /v2.
+//
+// The returned error is suitable for passing to
+// [ociregistry.WriteError]: it implements [ociregistry.HTTPError]
+// with the status code that the server would respond with.
+func ParseRequest(method string, u *url.URL) (RequestInfo, error) {
+	rreq, err := ocirequest.Parse(method, u)
+	if err != nil {
+		return RequestInfo{}, handlerErrorForRequestParseError(err)
+	}
+	return requestInfo(rreq), nil
+}
+
+func requestInfo(rreq *ocirequest.Request) RequestInfo {
+	return RequestInfo{
+		Kind:         RequestKind(rreq.Kind),
+		Repo:         rreq.Repo,
+		Digest:       rreq.Digest,
+		Tag:          rreq.Tag,
+		FromRepo:     rreq.FromRepo,
+		UploadID:     rreq.UploadID,
+		ListN:        rreq.ListN,
+		ListLast:     rreq.ListLast,
+		ArtifactType: rreq.ArtifactType,
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociserver_test
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/go-quicktest/qt"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ociserver"
+)
+
+const testDigest = "sha256:ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff"
+
+var parseRequestTests = []struct {
+	testName   string
+	method     string
+	url        string
+	want       ociserver.RequestInfo
+	wantStatus int
+}{{
+	testName: "Ping",
+	method:   "GET",
+	url:      "/v2/",
+	want: ociserver.RequestInfo{
+		Kind: ociserver.ReqPing,
+	},
+}, {
+	testName: "BlobHead",
+	method:   "HEAD",
+	url:      "/v2/foo/bar/blobs/" + testDigest,
+	want: ociserver.RequestInfo{
+		Kind:   ociserver.ReqBlobHead,
+		Repo:   "foo/bar",
+		Digest: testDigest,
+	},
+}, {
+	testName: "BlobMount",
+	method:   "POST",
+	url:      "/v2/foo/blobs/uploads/?mount=" + testDigest + "&from=other/repo",
+	want: ociserver.RequestInfo{
+		Kind:     ociserver.ReqBlobMount,
+		Repo:     "foo",
+		Digest:   testDigest,
+		FromRepo: "other/repo",
+	},
+}, {
+	testName: "BlobUploadChunk",
+	method:   "PATCH",
+	url:      "/v2/foo/blobs/uploads/c29tZWlk", // base64 of "someid"
+	want: ociserver.RequestInfo{
+		Kind:     ociserver.ReqBlobUploadChunk,
+		Repo:     "foo",
+		UploadID: "someid",
+	},
+}, {
+	testName: "ManifestGetByTag",
+	method:   "GET",
+	url:      "/v2/foo/manifests/latest",
+	want: ociserver.RequestInfo{
+		Kind: ociserver.ReqManifestGet,
+		Repo: "foo",
+		Tag:  "latest",
+	},
+}, {
+	testName: "ManifestPutByDigest",
+	method:   "PUT",
+	url:      "/v2/foo/manifests/" + testDigest,
+	want: ociserver.RequestInfo{
+		Kind:   ociserver.ReqManifestPut,
+		Repo:   "foo",
+		Digest: testDigest,
+	},
+}, {
+	testName: "TagsList",
+	method:   "GET",
+	url:      "/v2/foo/tags/list?n=10&last=v1",
+	want: ociserver.RequestInfo{
+		Kind:     ociserver.ReqTagsList,
+		Repo:     "foo",
+		ListN:    10,
+		ListLast: "v1",
+	},
+}, {
+	testName: "ReferrersList",
+	method:   "GET",
+	url:      "/v2/foo/referrers/" + testDigest + "?artifactType=application/x-foo",
+	want: ociserver.RequestInfo{
+		Kind:         ociserver.ReqReferrersList,
+		Repo:         "foo",
+		Digest:       testDigest,
+		ListN:        -1,
+		ArtifactType: "application/x-foo",
+	},
+}, {
+	testName: "Catalog",
+	method:   "GET",
+	url:      "/v2/_catalog",
+	want: ociserver.RequestInfo{
+		Kind:  ociserver.ReqCatalogList,
+		ListN: -1,
+	},
+}, {
+	testName:   "NotFound",
+	method:     "GET",
+	url:        "/v2/foo/other",
+	wantStatus: http.StatusNotFound,
+}, {
+	testName:   "BadDigest",
+	method:     "GET",
+	url:        "/v2/foo/blobs/sha256:bad",
+	wantStatus: http.StatusBadRequest,
+}, {
+	testName:   "MethodNotAllowed",
+	method:     "POST",
+	url:        "/v2/foo/manifests/latest",
+	wantStatus: http.StatusMethodNotAllowed,
+}}
+
+func TestParseRequest(t *testing.T) {
+	for _, test := range parseRequestTests {
+		t.Run(test.testName, func(t *testing.T) {
+			u, err := url.Parse(test.url)
+			qt.Assert(t, qt.IsNil(err))
+			info, err := ociserver.ParseRequest(test.method, u)
+			if test.wantStatus != 0 {
+				var herr ociregistry.HTTPError
+				qt.Assert(t, qt.IsTrue(errors.As(err, &herr)))
+				qt.Assert(t, qt.Equals(herr.StatusCode(), test.wantStatus))
+				return
+			}
+			qt.Assert(t, qt.IsNil(err))
+			qt.Assert(t, qt.DeepEquals(info, test.want))
+		})
+	}
+}
+
+func TestRequestKindString(t *testing.T) {
+	qt.Check(t, qt.Equals(ociserver.ReqManifestGet.String(), "ManifestGet"))
+	qt.Check(t, qt.Equals(ociserver.ReqCatalogList.String(), "CatalogList"))
+	qt.Check(t, qt.Equals(ociserver.RequestKind(-1).String(), "RequestKind(-1)"))
+}
@@ -0,0 +1,110 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociserver
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+
+	"cuelabs.dev/go/oci/ociregistry"
+)
+
+// defaultRetryBackendMaxSize holds the default value
+// of Options.RetryBackendMaxSize.
+const defaultRetryBackendMaxSize = 4 << 20
+
+func (r *registry) retryBackendMaxSize() int64 {
+	if r.opts.RetryBackendMaxSize > 0 {
+		return r.opts.RetryBackendMaxSize
+	}
+	return defaultRetryBackendMaxSize
+}
+
+// shouldRetry reports whether a backend call that failed with err
+// and whose content has the given size should be retried.
+func (r *registry) shouldRetry(ctx context.Context, size int64, err error) bool {
+	return r.opts.RetryBackend &&
+		size >= 0 && size <= r.retryBackendMaxSize() &&
+		ctx.Err() == nil &&
+		isTransientError(err)
+}
+
+// isTransientError reports whether err is likely to be caused by
+// a temporary condition, so that retrying the operation might succeed:
+// a network error, such as a refused or reset connection or a timeout,
+// or an HTTP response with a status that indicates a temporary failure.
+// Context errors, including those from Options.BackendTimeout, are
+// never transient: retrying would only wait for the timeout again.
+func isTransientError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, errBackendTimeout) {
+		return false
+	}
+	var herr ociregistry.HTTPError
+	if errors.As(err, &herr) {
+		switch herr.StatusCode() {
+		case http.StatusTooManyRequests,
+			http.StatusBadGateway,
+			http.StatusServiceUnavailable,
+			http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+	// Any error from a network operation, such as a dropped
+	// connection, might not happen again.
+	var operr *net.OpError
+	if errors.As(err, &operr) {
+		return true
+	}
+	var nerr net.Error
+	return errors.As(err, &nerr) && nerr.Timeout()
+}
+
+// pushManifest pushes a manifest to the backend,
+// retrying once on a transient error if Options.RetryBackend is set.
+func (r *registry) pushManifest(ctx context.Context, repo, tag string, data []byte, mediaType string) (ociregistry.Descriptor, error) {
+	desc, err := r.backend.PushManifest(ctx, repo, tag, data, mediaType)
+	if err != nil && r.shouldRetry(ctx, int64(len(data)), err) {
+		desc, err = r.backend.PushManifest(ctx, repo, tag, data, mediaType)
+	}
+	return desc, err
+}
+
+// pushBlob pushes a blob to the backend. If Options.RetryBackend is
+// set and the blob is small enough, the content is buffered so that
+// the push can be retried once on a transient error.
+func (r *registry) pushBlob(ctx context.Context, repo string, desc ociregistry.Descriptor, body io.Reader) (ociregistry.Descriptor, error) {
+	if !r.opts.RetryBackend || desc.Size < 0 || desc.Size > r.retryBackendMaxSize() {
+		return r.backend.PushBlob(ctx, repo, desc, body)
+	}
+	data, err := io.ReadAll(io.LimitReader(body, desc.Size+1))
+	if err != nil {
+		return ociregistry.Descriptor{}, fmt.Errorf("cannot read content: %v", err)
+	}
+	desc1, err := r.backend.PushBlob(ctx, repo, desc, bytes.NewReader(data))
+	if err != nil && r.shouldRetry(ctx, int64(len(data)), err) {
+		desc1, err = r.backend.PushBlob(ctx, repo, desc, bytes.NewReader(data))
+	}
+	return desc1, err
+}
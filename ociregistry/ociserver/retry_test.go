@@ -0,0 +1,202 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociserver_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/go-quicktest/qt"
+	"github.com/opencontainers/go-digest"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ocimem"
+	"cuelabs.dev/go/oci/ociregistry/ociserver"
+)
+
+func TestRetryBackend(t *testing.T) {
+	manifest := `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[]}`
+	blob := "some blob content"
+	unavailable := ociregistry.NewHTTPError(errors.New("try again later"), http.StatusServiceUnavailable, nil, nil)
+	tests := []struct {
+		testName   string
+		opts       *ociserver.Options
+		failErr    error
+		wantStatus int
+		wantCalls  int
+	}{{
+		testName:   "Disabled",
+		failErr:    unavailable,
+		wantStatus: http.StatusServiceUnavailable,
+		wantCalls:  1,
+	}, {
+		testName: "Transient",
+		opts: &ociserver.Options{
+			RetryBackend: true,
+		},
+		failErr:    unavailable,
+		wantStatus: http.StatusCreated,
+		wantCalls:  2,
+	}, {
+		testName: "NotTransient",
+		opts: &ociserver.Options{
+			RetryBackend: true,
+		},
+		failErr:    ociregistry.ErrDenied,
+		wantStatus: http.StatusForbidden,
+		wantCalls:  1,
+	}, {
+		testName: "ConnectionReset",
+		opts: &ociserver.Options{
+			RetryBackend: true,
+		},
+		failErr: fmt.Errorf("cannot push: %w", &net.OpError{
+			Op:  "read",
+			Net: "tcp",
+			Err: os.NewSyscallError("read", syscall.ECONNRESET),
+		}),
+		wantStatus: http.StatusCreated,
+		wantCalls:  2,
+	}, {
+		testName: "ConnectionRefused",
+		opts: &ociserver.Options{
+			RetryBackend: true,
+		},
+		failErr:    fmt.Errorf("cannot push: %w", syscall.ECONNREFUSED),
+		wantStatus: http.StatusCreated,
+		wantCalls:  2,
+	}, {
+		testName: "DeadlineExceeded",
+		opts: &ociserver.Options{
+			RetryBackend: true,
+		},
+		// context.DeadlineExceeded implements net.Error,
+		// but it's not transient.
+		failErr:    fmt.Errorf("cannot push: %w", context.DeadlineExceeded),
+		wantStatus: http.StatusInternalServerError,
+		wantCalls:  1,
+	}, {
+		testName: "TooLarge",
+		opts: &ociserver.Options{
+			RetryBackend:        true,
+			RetryBackendMaxSize: 10,
+		},
+		failErr:    unavailable,
+		wantStatus: http.StatusServiceUnavailable,
+		wantCalls:  1,
+	}}
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			backend := &failOnceBackend{
+				Registry: ocimem.New(),
+				err:      test.failErr,
+			}
+			srv := httptest.NewServer(ociserver.New(backend, test.opts))
+			defer srv.Close()
+			do := func(method, path, contentType, body string) *http.Response {
+				req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+				qt.Assert(t, qt.IsNil(err))
+				req.Header.Set("Content-Type", contentType)
+				resp, err := http.DefaultClient.Do(req)
+				qt.Assert(t, qt.IsNil(err))
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+				return resp
+			}
+
+			resp := do("PUT", "/v2/foo/manifests/latest", "application/vnd.oci.image.index.v1+json", manifest)
+			qt.Check(t, qt.Equals(resp.StatusCode, test.wantStatus))
+			qt.Check(t, qt.Equals(backend.manifestCalls, test.wantCalls))
+
+			resp = do("POST", "/v2/foo/blobs/uploads/?digest="+string(digest.FromString(blob)), "application/octet-stream", blob)
+			qt.Check(t, qt.Equals(resp.StatusCode, test.wantStatus))
+			qt.Check(t, qt.Equals(backend.blobCalls, test.wantCalls))
+		})
+	}
+}
+
+// failOnceBackend fails the first call to each of
+// PushManifest and PushBlob with err.
+type failOnceBackend struct {
+	*ocimem.Registry
+	err           error
+	manifestCalls int
+	blobCalls     int
+}
+
+func (b *failOnceBackend) PushManifest(ctx context.Context, repo string, tag string, contents []byte, mediaType string) (ociregistry.Descriptor, error) {
+	b.manifestCalls++
+	if b.manifestCalls == 1 {
+		return ociregistry.Descriptor{}, b.err
+	}
+	return b.Registry.PushManifest(ctx, repo, tag, contents, mediaType)
+}
+
+func (b *failOnceBackend) PushBlob(ctx context.Context, repo string, desc ociregistry.Descriptor, r io.Reader) (ociregistry.Descriptor, error) {
+	b.blobCalls++
+	if b.blobCalls == 1 {
+		// Consume the content as a real backend would.
+		io.Copy(io.Discard, r)
+		return ociregistry.Descriptor{}, b.err
+	}
+	return b.Registry.PushBlob(ctx, repo, desc, r)
+}
+
+func TestRetryBackendTimeout(t *testing.T) {
+	backend := &blockOnceBackend{
+		Registry: ocimem.New(),
+	}
+	srv := httptest.NewServer(ociserver.New(backend, &ociserver.Options{
+		RetryBackend:   true,
+		BackendTimeout: 50 * time.Millisecond,
+	}))
+	defer srv.Close()
+	manifest := `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[]}`
+	req, err := http.NewRequest("PUT", srv.URL+"/v2/foo/manifests/latest", strings.NewReader(manifest))
+	qt.Assert(t, qt.IsNil(err))
+	req.Header.Set("Content-Type", "application/vnd.oci.image.index.v1+json")
+	resp, err := http.DefaultClient.Do(req)
+	qt.Assert(t, qt.IsNil(err))
+	resp.Body.Close()
+	// A push that timed out isn't retried.
+	qt.Check(t, qt.Equals(resp.StatusCode, http.StatusGatewayTimeout))
+	qt.Check(t, qt.Equals(backend.calls.Load(), int32(1)))
+}
+
+// blockOnceBackend blocks the first call to PushManifest
+// until its context is done.
+type blockOnceBackend struct {
+	*ocimem.Registry
+	calls atomic.Int32
+}
+
+func (b *blockOnceBackend) PushManifest(ctx context.Context, repo string, tag string, contents []byte, mediaType string) (ociregistry.Descriptor, error) {
+	if b.calls.Add(1) == 1 {
+		<-ctx.Done()
+		return ociregistry.Descriptor{}, ctx.Err()
+	}
+	return b.Registry.PushManifest(ctx, repo, tag, contents, mediaType)
+}
@@ -0,0 +1,75 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociserver
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-quicktest/qt"
+
+	"cuelabs.dev/go/oci/ociregistry/ocimem"
+)
+
+func TestRootHandler(t *testing.T) {
+	var paths []string
+	s := httptest.NewServer(New(ocimem.New(), &Options{
+		HealthPath: "/healthz",
+		RootHandler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			paths = append(paths, req.URL.Path)
+			w.Write([]byte("welcome"))
+		}),
+	}))
+	defer s.Close()
+
+	for _, path := range []string{"/", "/docs"} {
+		resp, err := http.Get(s.URL + path)
+		qt.Assert(t, qt.IsNil(err))
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		qt.Check(t, qt.Equals(resp.StatusCode, http.StatusOK))
+		qt.Check(t, qt.Equals(string(body), "welcome"))
+	}
+
+	resp, err := http.Get(s.URL + "/v2/")
+	qt.Assert(t, qt.IsNil(err))
+	resp.Body.Close()
+	qt.Check(t, qt.Equals(resp.StatusCode, http.StatusOK))
+	qt.Check(t, qt.Equals(resp.Header.Get("Docker-Distribution-API-Version"), "registry/2.0"))
+
+	resp, err = http.Get(s.URL + "/v2/foo/manifests/latest")
+	qt.Assert(t, qt.IsNil(err))
+	resp.Body.Close()
+	qt.Check(t, qt.Equals(resp.StatusCode, http.StatusNotFound))
+
+	resp, err = http.Get(s.URL + "/healthz")
+	qt.Assert(t, qt.IsNil(err))
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	qt.Check(t, qt.Equals(string(body), "ok\n"))
+
+	qt.Check(t, qt.DeepEquals(paths, []string{"/", "/docs"}))
+}
+
+func TestRootHandlerNotConfigured(t *testing.T) {
+	s := httptest.NewServer(New(ocimem.New(), nil))
+	defer s.Close()
+	resp, err := http.Get(s.URL + "/")
+	qt.Assert(t, qt.IsNil(err))
+	resp.Body.Close()
+	qt.Check(t, qt.Equals(resp.StatusCode, http.StatusNotFound))
+}
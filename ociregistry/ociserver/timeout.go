@@ -0,0 +1,278 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"cuelabs.dev/go/oci/ociregistry"
+)
+
+var errBackendTimeout = errors.New("backend operation timed out")
+
+// timeoutBackend wraps a backend, applying a timeout to each operation.
+// See [Options.BackendTimeout].
+type timeoutBackend struct {
+	*ociregistry.Funcs
+	backend ociregistry.Interface
+	timeout time.Duration
+}
+
+// start returns a context derived from ctx that will be canceled
+// when the timeout expires unless the returned stop function
+// is called first. The stop function reports whether
+// the timeout has expired; the cancel function releases
+// the context's resources.
+func (b *timeoutBackend) start(ctx context.Context) (_ context.Context, stop func() bool, cancel func()) {
+	ctx, cancelCause := context.WithCancelCause(ctx)
+	t := time.AfterFunc(b.timeout, func() {
+		cancelCause(errBackendTimeout)
+	})
+	stop = func() bool {
+		return !t.Stop()
+	}
+	cancel = func() {
+		t.Stop()
+		cancelCause(context.Canceled)
+	}
+	return ctx, stop, cancel
+}
+
+// timeoutError returns the error to return when the timeout
+// has expired during an operation that returned err.
+func (b *timeoutBackend) timeoutError(method string, err error) error {
+	if err == nil {
+		err = errBackendTimeout
+	} else if !errors.Is(err, errBackendTimeout) {
+		err = fmt.Errorf("%w: %w", errBackendTimeout, err)
+	}
+	return withHTTPCode(http.StatusGatewayTimeout, fmt.Errorf("%s exceeded %v: %w", method, b.timeout, err))
+}
+
+// call calls f with a context that's canceled when the timeout expires.
+func call[T any](b *timeoutBackend, ctx context.Context, method string, f func(ctx context.Context) (T, error)) (T, error) {
+	ctx, stop, cancel := b.start(ctx)
+	defer cancel()
+	x, err := f(ctx)
+	if stop() {
+		return x, b.timeoutError(method, err)
+	}
+	return x, err
+}
+
+// callStream is like call except that the timeout applies only to
+// obtaining the result, which remains usable until
+// it's closed.
+func callStream[T io.Closer](b *timeoutBackend, ctx context.Context, method string, f func(ctx context.Context) (T, error), wrap func(x T, cancel func()) T) (T, error) {
+	ctx, stop, cancel := b.start(ctx)
+	x, err := f(ctx)
+	if stop() {
+		cancel()
+		if err == nil {
+			x.Close()
+		}
+		var zero T
+		return zero, b.timeoutError(method, err)
+	}
+	if err != nil {
+		cancel()
+		return x, err
+	}
+	return wrap(x, cancel), nil
+}
+
+// callSeq is like call except that the timeout applies
+// to the whole iteration.
+func callSeq[T any](b *timeoutBackend, ctx context.Context, method string, f func(ctx context.Context) ociregistry.Seq[T]) ociregistry.Seq[T] {
+	return func(yield func(T, error) bool) {
+		ctx, _, cancel := b.start(ctx)
+		defer cancel()
+		f(ctx)(func(x T, err error) bool {
+			if err != nil && errors.Is(context.Cause(ctx), errBackendTimeout) {
+				err = b.timeoutError(method, err)
+			}
+			return yield(x, err)
+		})
+	}
+}
+
+func (b *timeoutBackend) GetBlob(ctx context.Context, repo string, digest ociregistry.Digest) (ociregistry.BlobReader, error) {
+	return callStream(b, ctx, "GetBlob", func(ctx context.Context) (ociregistry.BlobReader, error) {
+		return b.backend.GetBlob(ctx, repo, digest)
+	}, newTimeoutBlobReader)
+}
+
+func (b *timeoutBackend) GetBlobRange(ctx context.Context, repo string, digest ociregistry.Digest, offset0, offset1 int64) (ociregistry.BlobReader, error) {
+	return callStream(b, ctx, "GetBlobRange", func(ctx context.Context) (ociregistry.BlobReader, error) {
+		return b.backend.GetBlobRange(ctx, repo, digest, offset0, offset1)
+	}, newTimeoutBlobReader)
+}
+
+func (b *timeoutBackend) GetManifest(ctx context.Context, repo string, digest ociregistry.Digest) (ociregistry.BlobReader, error) {
+	return callStream(b, ctx, "GetManifest", func(ctx context.Context) (ociregistry.BlobReader, error) {
+		return b.backend.GetManifest(ctx, repo, digest)
+	}, newTimeoutBlobReader)
+}
+
+func (b *timeoutBackend) GetTag(ctx context.Context, repo string, tagName string) (ociregistry.BlobReader, error) {
+	return callStream(b, ctx, "GetTag", func(ctx context.Context) (ociregistry.BlobReader, error) {
+		return b.backend.GetTag(ctx, repo, tagName)
+	}, newTimeoutBlobReader)
+}
+
+func (b *timeoutBackend) ResolveBlob(ctx context.Context, repo string, digest ociregistry.Digest) (ociregistry.Descriptor, error) {
+	return call(b, ctx, "ResolveBlob", func(ctx context.Context) (ociregistry.Descriptor, error) {
+		return b.backend.ResolveBlob(ctx, repo, digest)
+	})
+}
+
+func (b *timeoutBackend) ResolveManifest(ctx context.Context, repo string, digest ociregistry.Digest) (ociregistry.Descriptor, error) {
+	return call(b, ctx, "ResolveManifest", func(ctx context.Context) (ociregistry.Descriptor, error) {
+		return b.backend.ResolveManifest(ctx, repo, digest)
+	})
+}
+
+func (b *timeoutBackend) ResolveTag(ctx context.Context, repo string, tagName string) (ociregistry.Descriptor, error) {
+	return call(b, ctx, "ResolveTag", func(ctx context.Context) (ociregistry.Descriptor, error) {
+		return b.backend.ResolveTag(ctx, repo, tagName)
+	})
+}
+
+// PushBlob is not subject to the timeout because its duration
+// depends on how fast the client uploads the content.
+func (b *timeoutBackend) PushBlob(ctx context.Context, repo string, desc ociregistry.Descriptor, r io.Reader) (ociregistry.Descriptor, error) {
+	return b.backend.PushBlob(ctx, repo, desc, r)
+}
+
+func (b *timeoutBackend) PushBlobChunked(ctx context.Context, repo string, chunkSize int) (ociregistry.BlobWriter, error) {
+	return callStream(b, ctx, "PushBlobChunked", func(ctx context.Context) (ociregistry.BlobWriter, error) {
+		return b.backend.PushBlobChunked(ctx, repo, chunkSize)
+	}, newTimeoutBlobWriter)
+}
+
+func (b *timeoutBackend) PushBlobChunkedResume(ctx context.Context, repo, id string, offset int64, chunkSize int) (ociregistry.BlobWriter, error) {
+	return callStream(b, ctx, "PushBlobChunkedResume", func(ctx context.Context) (ociregistry.BlobWriter, error) {
+		return b.backend.PushBlobChunkedResume(ctx, repo, id, offset, chunkSize)
+	}, newTimeoutBlobWriter)
+}
+
+func (b *timeoutBackend) MountBlob(ctx context.Context, fromRepo, toRepo string, digest ociregistry.Digest) (ociregistry.Descriptor, error) {
+	return call(b, ctx, "MountBlob", func(ctx context.Context) (ociregistry.Descriptor, error) {
+		return b.backend.MountBlob(ctx, fromRepo, toRepo, digest)
+	})
+}
+
+func (b *timeoutBackend) PushManifest(ctx context.Context, repo string, tag string, contents []byte, mediaType string) (ociregistry.Descriptor, error) {
+	return call(b, ctx, "PushManifest", func(ctx context.Context) (ociregistry.Descriptor, error) {
+		return b.backend.PushManifest(ctx, repo, tag, contents, mediaType)
+	})
+}
+
+func (b *timeoutBackend) DeleteBlob(ctx context.Context, repo string, digest ociregistry.Digest) error {
+	_, err := call(b, ctx, "DeleteBlob", func(ctx context.Context) (struct{}, error) {
+		return struct{}{}, b.backend.DeleteBlob(ctx, repo, digest)
+	})
+	return err
+}
+
+func (b *timeoutBackend) DeleteManifest(ctx context.Context, repo string, digest ociregistry.Digest) error {
+	_, err := call(b, ctx, "DeleteManifest", func(ctx context.Context) (struct{}, error) {
+		return struct{}{}, b.backend.DeleteManifest(ctx, repo, digest)
+	})
+	return err
+}
+
+func (b *timeoutBackend) DeleteTag(ctx context.Context, repo string, name string) error {
+	_, err := call(b, ctx, "DeleteTag", func(ctx context.Context) (struct{}, error) {
+		return struct{}{}, b.backend.DeleteTag(ctx, repo, name)
+	})
+	return err
+}
+
+func (b *timeoutBackend) Repositories(ctx context.Context, startAfter string) ociregistry.Seq[string] {
+	return callSeq(b, ctx, "Repositories", func(ctx context.Context) ociregistry.Seq[string] {
+		return b.backend.Repositories(ctx, startAfter)
+	})
+}
+
+func (b *timeoutBackend) Tags(ctx context.Context, repo string, startAfter string) ociregistry.Seq[string] {
+	return callSeq(b, ctx, "Tags", func(ctx context.Context) ociregistry.Seq[string] {
+		return b.backend.Tags(ctx, repo, startAfter)
+	})
+}
+
+func (b *timeoutBackend) Referrers(ctx context.Context, repo string, digest ociregistry.Digest, artifactType string) ociregistry.Seq[ociregistry.Descriptor] {
+	return callSeq(b, ctx, "Referrers", func(ctx context.Context) ociregistry.Seq[ociregistry.Descriptor] {
+		return b.backend.Referrers(ctx, repo, digest, artifactType)
+	})
+}
+
+// callOptional calls f, which calls the given method of an optional
+// interface implemented by r.rawBackend, applying
+// Options.BackendTimeout if it's set.
+func callOptional[T any](r *registry, ctx context.Context, method string, f func(ctx context.Context) (T, error)) (T, error) {
+	if r.timeouts == nil {
+		return f(ctx)
+	}
+	return call(r.timeouts, ctx, method, f)
+}
+
+// timeoutBlobReader cancels the context used to create
+// the underlying reader when it's closed.
+type timeoutBlobReader struct {
+	ociregistry.BlobReader
+	cancel func()
+}
+
+func newTimeoutBlobReader(r ociregistry.BlobReader, cancel func()) ociregistry.BlobReader {
+	return &timeoutBlobReader{
+		BlobReader: r,
+		cancel:     cancel,
+	}
+}
+
+func (r *timeoutBlobReader) Close() error {
+	defer r.cancel()
+	return r.BlobReader.Close()
+}
+
+// timeoutBlobWriter cancels the context used to create
+// the underlying writer when it's closed or canceled.
+type timeoutBlobWriter struct {
+	ociregistry.BlobWriter
+	cancel func()
+}
+
+func newTimeoutBlobWriter(w ociregistry.BlobWriter, cancel func()) ociregistry.BlobWriter {
+	return &timeoutBlobWriter{
+		BlobWriter: w,
+		cancel:     cancel,
+	}
+}
+
+func (w *timeoutBlobWriter) Close() error {
+	defer w.cancel()
+	return w.BlobWriter.Close()
+}
+
+func (w *timeoutBlobWriter) Cancel() error {
+	defer w.cancel()
+	return w.BlobWriter.Cancel()
+}
@@ -0,0 +1,152 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociserver_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-quicktest/qt"
+	"github.com/opencontainers/go-digest"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ocimem"
+	"cuelabs.dev/go/oci/ociregistry/ociserver"
+)
+
+func TestBackendTimeout(t *testing.T) {
+	ctx := context.Background()
+	mem := ocimem.New()
+	content := "some content"
+	desc := ociregistry.Descriptor{
+		MediaType: "application/octet-stream",
+		Digest:    digest.FromString(content),
+		Size:      int64(len(content)),
+	}
+	_, err := mem.PushBlob(ctx, "foo", desc, strings.NewReader(content))
+	qt.Assert(t, qt.IsNil(err))
+
+	backend := &slowBackend{
+		Registry: mem,
+		reading:  make(chan struct{}),
+		release:  make(chan struct{}),
+	}
+	srv := httptest.NewServer(ociserver.New(backend, &ociserver.Options{
+		BackendTimeout: 100 * time.Millisecond,
+	}))
+	defer srv.Close()
+
+	get := func(method, path string) (*http.Response, string) {
+		req, err := http.NewRequest(method, srv.URL+path, nil)
+		qt.Assert(t, qt.IsNil(err))
+		resp, err := http.DefaultClient.Do(req)
+		qt.Assert(t, qt.IsNil(err))
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		qt.Assert(t, qt.IsNil(err))
+		return resp, string(body)
+	}
+
+	// A GET whose reader is returned promptly succeeds even though
+	// transferring its content takes longer than the timeout.
+	// The content is held back until a HEAD request started
+	// after the transfer began has timed out.
+	type result struct {
+		resp *http.Response
+		body string
+	}
+	blobGet := make(chan result)
+	go func() {
+		resp, body := get("GET", "/v2/foo/blobs/"+string(desc.Digest))
+		blobGet <- result{resp, body}
+	}()
+	<-backend.reading
+
+	// A blocked HEAD request times out.
+	resp, _ := get("HEAD", "/v2/foo/blobs/"+string(desc.Digest))
+	qt.Assert(t, qt.Equals(resp.StatusCode, http.StatusGatewayTimeout))
+
+	close(backend.release)
+	r := <-blobGet
+	qt.Assert(t, qt.Equals(r.resp.StatusCode, http.StatusOK), qt.Commentf("body: %s", r.body))
+	qt.Assert(t, qt.Equals(r.body, content))
+
+	// A GET whose reader is blocked from being obtained times out.
+	resp, body := get("GET", "/v2/foo/manifests/sometag")
+	qt.Assert(t, qt.Equals(resp.StatusCode, http.StatusGatewayTimeout), qt.Commentf("body: %s", body))
+	qt.Assert(t, qt.StringContains(body, "timed out"))
+
+	// Fast operations are unaffected.
+	resp, _ = get("GET", "/v2/foo/tags/list")
+	qt.Assert(t, qt.Equals(resp.StatusCode, http.StatusOK))
+}
+
+// slowBackend blocks in ResolveBlob and GetTag until the context
+// is done. Reading blob content closes reading on the first read
+// and then blocks until release is closed.
+type slowBackend struct {
+	*ocimem.Registry
+	reading     chan struct{}
+	readingOnce sync.Once
+	release     chan struct{}
+}
+
+func (b *slowBackend) ResolveBlob(ctx context.Context, repo string, digest ociregistry.Digest) (ociregistry.Descriptor, error) {
+	<-ctx.Done()
+	return ociregistry.Descriptor{}, ctx.Err()
+}
+
+func (b *slowBackend) GetTag(ctx context.Context, repo string, tagName string) (ociregistry.BlobReader, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (b *slowBackend) GetBlob(ctx context.Context, repo string, digest ociregistry.Digest) (ociregistry.BlobReader, error) {
+	r, err := b.Registry.GetBlob(ctx, repo, digest)
+	if err != nil {
+		return nil, err
+	}
+	return &slowReader{
+		BlobReader: r,
+		ctx:        ctx,
+		b:          b,
+	}, nil
+}
+
+// slowReader blocks before each read until its backend's release
+// channel is closed, failing if its context is canceled in the meantime.
+type slowReader struct {
+	ociregistry.BlobReader
+	ctx context.Context
+	b   *slowBackend
+}
+
+func (r *slowReader) Read(buf []byte) (int, error) {
+	r.b.readingOnce.Do(func() {
+		close(r.b.reading)
+	})
+	select {
+	case <-r.b.release:
+	case <-r.ctx.Done():
+		return 0, r.ctx.Err()
+	}
+	return r.BlobReader.Read(buf)
+}
@@ -0,0 +1,181 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociserver
+
+import (
+	"container/list"
+	"net/http"
+	"sync"
+	"time"
+
+	"cuelabs.dev/go/oci/ociregistry"
+)
+
+// UploadStats holds information about a completed blob upload,
+// as passed to Options.OnUploadComplete.
+type UploadStats struct {
+	// Repo holds the repository that the blob was uploaded to.
+	Repo string
+
+	// Digest holds the digest of the uploaded blob.
+	Digest ociregistry.Digest
+
+	// Size holds the total size of the blob in bytes.
+	Size int64
+
+	// Chunks holds the number of requests that carried blob
+	// content: 1 for a single POST or a POST-then-PUT upload,
+	// and the number of non-empty PATCH and PUT requests
+	// for a chunked upload.
+	Chunks int
+
+	// Duration holds the time from the start of the upload
+	// to its completion. For a chunked upload, the start is the
+	// request that started the upload session or, when that was
+	// not seen by this server, the first request seen for the upload.
+	Duration time.Duration
+}
+
+// maxTrackedUploads holds the maximum number of in-progress
+// uploads for which statistics are kept. Uploads that are
+// abandoned are never completed, so when the limit is
+// exceeded the oldest uploads are forgotten.
+const maxTrackedUploads = 10000
+
+// uploadTracker aggregates statistics across the requests
+// that make up chunked uploads.
+type uploadTracker struct {
+	mu      sync.Mutex
+	uploads map[uploadKey]*uploadProgress
+	// order holds the keys of the uploads in the
+	// order they were first seen, oldest first.
+	order list.List
+}
+
+type uploadKey struct {
+	repo string
+	id   string
+}
+
+type uploadProgress struct {
+	start  time.Time
+	chunks int
+	// elem holds the upload's element in uploadTracker.order.
+	elem *list.Element
+}
+
+// progress returns the progress record for the given
+// upload, creating it if needed. It must be called with t.mu held.
+func (t *uploadTracker) progress(key uploadKey, now time.Time) *uploadProgress {
+	p := t.uploads[key]
+	if p != nil {
+		return p
+	}
+	if t.uploads == nil {
+		t.uploads = make(map[uploadKey]*uploadProgress)
+	}
+	if len(t.uploads) >= maxTrackedUploads {
+		t.remove(t.order.Front().Value.(uploadKey))
+	}
+	p = &uploadProgress{
+		start: now,
+		elem:  t.order.PushBack(key),
+	}
+	t.uploads[key] = p
+	return p
+}
+
+// remove forgets the given upload. It must be called with t.mu held.
+func (t *uploadTracker) remove(key uploadKey) {
+	if p := t.uploads[key]; p != nil {
+		t.order.Remove(p.elem)
+		delete(t.uploads, key)
+	}
+}
+
+// rename changes the key of the given upload without changing
+// its position in the eviction order. It must be called with
+// t.mu held.
+func (t *uploadTracker) rename(oldKey, newKey uploadKey) {
+	p := t.uploads[oldKey]
+	if p == nil {
+		return
+	}
+	delete(t.uploads, oldKey)
+	t.remove(newKey)
+	p.elem.Value = newKey
+	t.uploads[newKey] = p
+}
+
+// uploadStarted records the start of a chunked upload.
+func (r *registry) uploadStarted(repo, id string, start time.Time) {
+	if r.opts.OnUploadComplete == nil {
+		return
+	}
+	r.uploads.mu.Lock()
+	defer r.uploads.mu.Unlock()
+	r.uploads.progress(uploadKey{repo, id}, start)
+}
+
+// uploadChunk records a request that's part of a chunked upload,
+// and whether it carried any content. The backend may change the
+// upload's ID as a result of the request, in which case newID
+// holds the ID to use from now on.
+func (r *registry) uploadChunk(repo, id, newID string, start time.Time, hasContent bool) {
+	if r.opts.OnUploadComplete == nil {
+		return
+	}
+	r.uploads.mu.Lock()
+	defer r.uploads.mu.Unlock()
+	key := uploadKey{repo, id}
+	p := r.uploads.progress(key, start)
+	if hasContent {
+		p.chunks++
+	}
+	if newID != id {
+		r.uploads.rename(key, uploadKey{repo, newID})
+	}
+}
+
+// uploadCompleted calls Options.OnUploadComplete, if set, with the
+// statistics for the given completed chunked upload, and forgets it.
+func (r *registry) uploadCompleted(req *http.Request, repo, id string, desc ociregistry.Descriptor) {
+	if r.opts.OnUploadComplete == nil {
+		return
+	}
+	now := time.Now()
+	key := uploadKey{repo, id}
+	r.uploads.mu.Lock()
+	p := r.uploads.progress(key, now)
+	r.uploads.remove(key)
+	r.uploads.mu.Unlock()
+	r.opts.OnUploadComplete(req, UploadStats{
+		Repo:     repo,
+		Digest:   desc.Digest,
+		Size:     desc.Size,
+		Chunks:   p.chunks,
+		Duration: now.Sub(p.start),
+	})
+}
+
+// uploadCanceled forgets any statistics for the given upload.
+func (r *registry) uploadCanceled(repo, id string) {
+	if r.opts.OnUploadComplete == nil {
+		return
+	}
+	r.uploads.mu.Lock()
+	defer r.uploads.mu.Unlock()
+	r.uploads.remove(uploadKey{repo, id})
+}
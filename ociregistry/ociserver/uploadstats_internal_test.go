@@ -0,0 +1,53 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociserver
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-quicktest/qt"
+)
+
+func TestUploadTrackerEvictsOldest(t *testing.T) {
+	var tr uploadTracker
+	key := func(i int) uploadKey {
+		return uploadKey{repo: "foo", id: fmt.Sprint(i)}
+	}
+	now := time.Now()
+	for i := range maxTrackedUploads {
+		tr.progress(key(i), now)
+	}
+	// Renaming an upload doesn't change its age, and
+	// removing one makes room for another.
+	tr.rename(key(0), key(-1))
+	tr.remove(key(1))
+	tr.progress(key(maxTrackedUploads), now)
+	qt.Assert(t, qt.HasLen(tr.uploads, maxTrackedUploads))
+	qt.Assert(t, qt.Equals(tr.order.Len(), maxTrackedUploads))
+
+	// Adding another upload evicts the oldest one.
+	tr.progress(key(maxTrackedUploads+1), now)
+	qt.Assert(t, qt.HasLen(tr.uploads, maxTrackedUploads))
+	qt.Assert(t, qt.Equals(tr.order.Len(), maxTrackedUploads))
+	qt.Check(t, qt.IsNil(tr.uploads[key(-1)]))
+	qt.Check(t, qt.IsNotNil(tr.uploads[key(2)]))
+
+	tr.progress(key(maxTrackedUploads+2), now)
+	qt.Check(t, qt.IsNil(tr.uploads[key(2)]))
+	qt.Check(t, qt.IsNotNil(tr.uploads[key(3)]))
+	qt.Check(t, qt.IsNotNil(tr.uploads[key(maxTrackedUploads+2)]))
+}
@@ -0,0 +1,112 @@
+// Copyright 2024 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociserver_test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-quicktest/qt"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ocimem"
+	"cuelabs.dev/go/oci/ociregistry/ociserver"
+)
+
+func TestOnUploadComplete(t *testing.T) {
+	var stats []ociserver.UploadStats
+	srv := httptest.NewServer(ociserver.New(ocimem.New(), &ociserver.Options{
+		OnUploadComplete: func(req *http.Request, s ociserver.UploadStats) {
+			qt.Check(t, qt.Equals(req.Method, "PUT"))
+			stats = append(stats, s)
+		},
+	}))
+	defer srv.Close()
+	do := func(method, path, contentRange, body string) *http.Response {
+		req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		qt.Assert(t, qt.IsNil(err))
+		if contentRange != "" {
+			req.Header.Set("Content-Range", contentRange)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		qt.Assert(t, qt.IsNil(err))
+		data, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		qt.Assert(t, qt.IsTrue(resp.StatusCode < 300), qt.Commentf("%s %s: %s", method, path, data))
+		return resp
+	}
+	// chunkedUpload uploads the given chunks with PATCH requests,
+	// followed by a PUT request holding the final chunk.
+	chunkedUpload := func(patches []string, final string) {
+		location := do("POST", "/v2/foo/blobs/uploads/", "", "").Header.Get("Location")
+		offset := 0
+		for _, chunk := range patches {
+			resp := do("PATCH", location, fmt.Sprintf("%d-%d", offset, offset+len(chunk)-1), chunk)
+			location = resp.Header.Get("Location")
+			offset += len(chunk)
+		}
+		contentRange := ""
+		if final != "" {
+			contentRange = fmt.Sprintf("%d-%d", offset, offset+len(final)-1)
+		}
+		content := strings.Join(patches, "") + final
+		do("PUT", location+"?digest="+digestOf(content), contentRange, final)
+	}
+
+	chunkedUpload([]string{"hello", " ", "world"}, "!")
+	qt.Assert(t, qt.HasLen(stats, 1))
+	qt.Check(t, qt.Equals(stats[0].Repo, "foo"))
+	qt.Check(t, qt.Equals(stats[0].Digest, ociregistry.Digest(digestOf("hello world!"))))
+	qt.Check(t, qt.Equals(stats[0].Size, int64(len("hello world!"))))
+	qt.Check(t, qt.Equals(stats[0].Chunks, 4))
+	qt.Check(t, qt.IsTrue(stats[0].Duration > 0))
+
+	// A closing PUT with no content isn't counted as a chunk.
+	stats = nil
+	chunkedUpload([]string{"abc", "def"}, "")
+	qt.Assert(t, qt.HasLen(stats, 1))
+	qt.Check(t, qt.Equals(stats[0].Size, int64(6)))
+	qt.Check(t, qt.Equals(stats[0].Chunks, 2))
+
+	// POST-then-PUT.
+	stats = nil
+	chunkedUpload(nil, "whole blob")
+	qt.Assert(t, qt.HasLen(stats, 1))
+	qt.Check(t, qt.Equals(stats[0].Size, int64(len("whole blob"))))
+	qt.Check(t, qt.Equals(stats[0].Chunks, 1))
+}
+
+func TestOnUploadCompleteSinglePost(t *testing.T) {
+	var stats []ociserver.UploadStats
+	srv := httptest.NewServer(ociserver.New(ocimem.New(), &ociserver.Options{
+		OnUploadComplete: func(req *http.Request, s ociserver.UploadStats) {
+			stats = append(stats, s)
+		},
+	}))
+	defer srv.Close()
+	content := "some content"
+	resp, err := http.Post(srv.URL+"/v2/foo/blobs/uploads/?digest="+digestOf(content), "application/octet-stream", strings.NewReader(content))
+	qt.Assert(t, qt.IsNil(err))
+	resp.Body.Close()
+	qt.Assert(t, qt.Equals(resp.StatusCode, http.StatusCreated))
+	qt.Assert(t, qt.HasLen(stats, 1))
+	qt.Check(t, qt.Equals(stats[0].Digest, ociregistry.Digest(digestOf(content))))
+	qt.Check(t, qt.Equals(stats[0].Size, int64(len(content))))
+	qt.Check(t, qt.Equals(stats[0].Chunks, 1))
+}
@@ -17,10 +17,13 @@ package ociserver
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
@@ -31,12 +34,15 @@ import (
 
 func (r *registry) handleBlobUploadBlob(ctx context.Context, resp http.ResponseWriter, req *http.Request, rreq *ocirequest.Request) error {
 	if r.opts.DisableSinglePostUpload {
+		// The spec allows a registry to ignore the content
+		// and treat the request as the start of an upload session.
 		return r.handleBlobStartUpload(ctx, resp, req, rreq)
 	}
+	start := time.Now()
 	// TODO check that Content-Type is application/octet-stream?
 	mediaType := mediaTypeOctetStream
 
-	desc, err := r.backend.PushBlob(req.Context(), rreq.Repo, ociregistry.Descriptor{
+	desc, err := r.pushBlob(req.Context(), rreq.Repo, ociregistry.Descriptor{
 		MediaType: mediaType,
 		Size:      req.ContentLength,
 		Digest:    ociregistry.Digest(rreq.Digest),
@@ -44,23 +50,51 @@ func (r *registry) handleBlobUploadBlob(ctx context.Context, resp http.ResponseW
 	if err != nil {
 		return err
 	}
-	if err := r.setLocationHeader(resp, false, desc, "/v2/"+rreq.Repo+"/blobs/"+string(desc.Digest)); err != nil {
+	if err := r.setLocationHeader(resp, req, false, desc, "/v2/"+rreq.Repo+"/blobs/"+string(desc.Digest)); err != nil {
 		return err
 	}
 	resp.WriteHeader(http.StatusCreated)
+	if r.opts.OnUploadComplete != nil {
+		r.opts.OnUploadComplete(req, UploadStats{
+			Repo:     rreq.Repo,
+			Digest:   desc.Digest,
+			Size:     desc.Size,
+			Chunks:   1,
+			Duration: time.Since(start),
+		})
+	}
 	return nil
 }
 
 func (r *registry) handleBlobStartUpload(ctx context.Context, resp http.ResponseWriter, req *http.Request, rreq *ocirequest.Request) error {
+	if rreq.Digest != "" && !r.opts.DisableSinglePostUpload {
+		// The client asked to mount a blob without saying where from,
+		// or this is a single POST upload being treated as the start
+		// of a session. If the blob is already in the repository,
+		// there's nothing to upload; otherwise start a regular upload,
+		// which the client will complete with the digest as usual.
+		//
+		// When single POST uploads are disabled, an upload session is
+		// always started, so that content always flows as configured.
+		if desc, err := r.backend.ResolveBlob(ctx, rreq.Repo, ociregistry.Digest(rreq.Digest)); err == nil {
+			if err := r.setLocationHeader(resp, req, false, desc, "/v2/"+rreq.Repo+"/blobs/"+rreq.Digest); err != nil {
+				return err
+			}
+			resp.WriteHeader(http.StatusCreated)
+			return nil
+		}
+	}
 	// Start a chunked upload. When r.backend is ociclient, this should
 	// just result in a single POST request that starts the upload.
+	start := time.Now()
 	w, err := r.backend.PushBlobChunked(ctx, rreq.Repo, 0)
 	if err != nil {
 		return err
 	}
 	defer w.Close()
+	r.uploadStarted(rreq.Repo, w.ID(), start)
 
-	resp.Header().Set("Location", r.locationForUploadID(rreq.Repo, w.ID()))
+	resp.Header().Set("Location", r.locationForUploadID(req, rreq.Repo, w.ID()))
 	resp.Header().Set("Range", "0-0")
 	// TODO: reject chunks which don't follow this minimum length.
 	// If any reasonable clients are broken by this, we can always reconsider,
@@ -79,34 +113,52 @@ func (r *registry) handleBlobUploadInfo(ctx context.Context, resp http.ResponseW
 	if err != nil {
 		return err
 	}
-	defer w.Close()
-	resp.Header().Set("Location", r.locationForUploadID(rreq.Repo, w.ID()))
+	// Close the writer before asking for its size, as we do when
+	// writing a chunk, so that the reported range only covers data that
+	// the backend has actually received: a client resuming the upload
+	// will continue from the end of that range.
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("cannot close BlobWriter: %w", err)
+	}
+	resp.Header().Set("Location", r.locationForUploadID(req, rreq.Repo, w.ID()))
 	resp.Header().Set("Range", ocirequest.RangeString(0, w.Size()))
 	resp.WriteHeader(http.StatusNoContent)
 	return nil
 }
 
 func (r *registry) handleBlobUploadChunk(ctx context.Context, resp http.ResponseWriter, req *http.Request, rreq *ocirequest.Request) error {
+	reqStart := time.Now()
 	// Note that the spec requires chunked upload PATCH requests to include Content-Range,
 	// but the conformance tests do not actually follow that as of the time of writing.
-	// Allow the missing header to result in start=0, meaning we assume it's the first chunk.
+	// Allow the header to be missing on the first chunk only: we resume the
+	// upload from wherever it has got to and reject the chunk if that isn't the start.
 	start, end, err := chunkRange(req)
 	if err != nil {
 		return err
 	}
-
-	w, err := r.backend.PushBlobChunkedResume(ctx, rreq.Repo, rreq.UploadID, start, int(end-start))
+	offset := start
+	hasRange := req.Header.Get("Content-Range") != ""
+	if !hasRange {
+		offset = -1
+	}
+	w, err := r.backend.PushBlobChunkedResume(ctx, rreq.Repo, rreq.UploadID, offset, int(end-start))
 	if err != nil {
 		return err
 	}
-	if _, err := io.Copy(w, req.Body); err != nil {
+	if !hasRange && w.Size() != 0 {
+		w.Close()
+		return fmt.Errorf("%w: Content-Range required on chunk at offset %d", ociregistry.ErrBlobUploadInvalid, w.Size())
+	}
+	n, err := io.Copy(w, req.Body)
+	if err != nil {
 		w.Close()
 		return fmt.Errorf("cannot copy blob data: %w", err)
 	}
 	if err := w.Close(); err != nil {
 		return fmt.Errorf("cannot close BlobWriter: %w", err)
 	}
-	resp.Header().Set("Location", r.locationForUploadID(rreq.Repo, w.ID()))
+	r.uploadChunk(rreq.Repo, rreq.UploadID, w.ID(), reqStart, n > 0)
+	resp.Header().Set("Location", r.locationForUploadID(req, rreq.Repo, w.ID()))
 	resp.Header().Set("Range", ocirequest.RangeString(0, w.Size()))
 	resp.WriteHeader(http.StatusAccepted)
 	return nil
@@ -131,32 +183,64 @@ func (r *registry) handleBlobCompleteUpload(ctx context.Context, resp http.Respo
 		return err
 	}
 
+	reqStart := time.Now()
 	w, err := r.backend.PushBlobChunkedResume(ctx, rreq.Repo, rreq.UploadID, start, int(end-start))
 	if err != nil {
 		return err
 	}
 	defer w.Close()
 
-	if _, err := io.Copy(w, req.Body); err != nil {
+	n, err := io.Copy(w, req.Body)
+	if err != nil {
 		return fmt.Errorf("failed to copy data to %T: %v", w, err)
 	}
+	r.uploadChunk(rreq.Repo, rreq.UploadID, rreq.UploadID, reqStart, n > 0)
 	desc, err := w.Commit(ociregistry.Digest(rreq.Digest))
 	if err != nil {
 		return err
 	}
-	if err := r.setLocationHeader(resp, false, desc, "/v2/"+rreq.Repo+"/blobs/"+string(desc.Digest)); err != nil {
+	if err := r.setLocationHeader(resp, req, false, desc, "/v2/"+rreq.Repo+"/blobs/"+string(desc.Digest)); err != nil {
 		return err
 	}
 	resp.WriteHeader(http.StatusCreated)
+	r.uploadCompleted(req, rreq.Repo, rreq.UploadID, desc)
+	return nil
+}
+
+func (r *registry) handleBlobUploadCancel(ctx context.Context, resp http.ResponseWriter, req *http.Request, rreq *ocirequest.Request) error {
+	// Resume the upload without writing to it so that we can cancel it.
+	// As for handleBlobUploadInfo, an offset of -1 causes the backend
+	// to retrieve the upload information.
+	w, err := r.backend.PushBlobChunkedResume(ctx, rreq.Repo, rreq.UploadID, -1, 0)
+	if err != nil {
+		return err
+	}
+	if err := w.Cancel(); err != nil {
+		return err
+	}
+	r.uploadCanceled(rreq.Repo, rreq.UploadID)
+	resp.WriteHeader(http.StatusNoContent)
 	return nil
 }
 
 func (r *registry) handleBlobMount(ctx context.Context, resp http.ResponseWriter, req *http.Request, rreq *ocirequest.Request) error {
 	desc, err := r.backend.MountBlob(ctx, rreq.FromRepo, rreq.Repo, ociregistry.Digest(rreq.Digest))
+	if errors.Is(err, ociregistry.ErrUnsupported) ||
+		errors.Is(err, ociregistry.ErrBlobUnknown) ||
+		errors.Is(err, ociregistry.ErrNameUnknown) {
+		// The backend can't mount blobs, or the blob to mount
+		// doesn't exist in the source repository, so start a regular
+		// upload instead as the spec requires. The client can then
+		// push the blob to the returned location.
+		return r.handleBlobStartUpload(ctx, resp, req, &ocirequest.Request{
+			Kind: ocirequest.ReqBlobStartUpload,
+			Repo: rreq.Repo,
+		})
+	}
 	if err != nil {
 		return err
 	}
-	if err := r.setLocationHeader(resp, true, desc, "/v2/"+rreq.Repo+"/blobs/"+rreq.Digest); err != nil {
+	if err := r.setLocationHeader(resp, req, true, desc, "/v2/"+rreq.Repo+"/blobs/"+rreq.Digest); err != nil {
 		return err
 	}
 	resp.WriteHeader(http.StatusCreated)
@@ -164,16 +248,22 @@ func (r *registry) handleBlobMount(ctx context.Context, resp http.ResponseWriter
 }
 
 func (r *registry) handleManifestPut(ctx context.Context, resp http.ResponseWriter, req *http.Request, rreq *ocirequest.Request) error {
-	mediaType := req.Header.Get("Content-Type")
-	if mediaType == "" {
-		mediaType = mediaTypeOctetStream
-	}
 	// TODO check that the media type is valid?
 	// TODO size limit
 	data, err := io.ReadAll(req.Body)
 	if err != nil {
 		return fmt.Errorf("cannot read content: %v", err)
 	}
+	mediaType, err := manifestMediaType(req.Header.Get("Content-Type"), data)
+	if err != nil {
+		return err
+	}
+	// Check the mediaType field in the content too, so that
+	// an artifact manifest can't be pushed under another
+	// media type to avoid the check.
+	if r.opts.RejectDeprecatedArtifactManifest && (isArtifactManifest(mediaType) || isArtifactManifest(contentMediaType(data))) {
+		return fmt.Errorf("%w: artifact manifests are deprecated; use an image manifest with an artifactType field instead", ociregistry.ErrManifestInvalid)
+	}
 	dig := digest.FromBytes(data)
 	var tag string
 	if rreq.Tag != "" {
@@ -183,32 +273,86 @@ func (r *registry) handleManifestPut(ctx context.Context, resp http.ResponseWrit
 			return ociregistry.ErrDigestInvalid
 		}
 	}
-	subjectDesc, err := subjectFromManifest(req.Header.Get("Content-Type"), data)
+	subjectDesc, err := subjectFromManifest(mediaType, data)
 	if err != nil {
 		return fmt.Errorf("invalid manifest JSON: %v", err)
 	}
-	desc, err := r.backend.PushManifest(ctx, rreq.Repo, tag, data, mediaType)
+	if tag != "" && req.Header.Get("If-None-Match") == "*" {
+		if err := r.checkTagAbsent(ctx, rreq.Repo, tag); err != nil {
+			return err
+		}
+	}
+	if r.opts.ValidateManifestReferences {
+		if err := r.checkManifestReferences(ctx, rreq.Repo, mediaType, data); err != nil {
+			return err
+		}
+	}
+	desc, err := r.pushManifest(ctx, rreq.Repo, tag, data, mediaType)
 	if err != nil {
 		return err
 	}
-	if err := r.setLocationHeader(resp, false, desc, "/v2/"+rreq.Repo+"/manifests/"+string(desc.Digest)); err != nil {
+	if err := r.setLocationHeader(resp, req, false, desc, "/v2/"+rreq.Repo+"/manifests/"+string(desc.Digest)); err != nil {
 		return err
 	}
 	if subjectDesc != nil {
 		resp.Header().Set("OCI-Subject", string(subjectDesc.Digest))
 	}
 	// TODO OCI-Subject header?
+	if r.opts.EchoManifestDescriptor {
+		msg, err := json.Marshal(ociregistry.Descriptor{
+			MediaType: mediaType,
+			Digest:    desc.Digest,
+			Size:      int64(len(data)),
+		})
+		if err != nil {
+			return err
+		}
+		resp.Header().Set("Content-Type", mediaTypeDescriptor)
+		resp.Header().Set("Content-Length", strconv.Itoa(len(msg)))
+		resp.WriteHeader(http.StatusCreated)
+		resp.Write(msg)
+		return nil
+	}
 	resp.WriteHeader(http.StatusCreated)
 	return nil
 }
 
+// manifestMediaType returns the media type to store for a manifest
+// pushed with the given Content-Type header.
+//
+// When the header is absent or application/octet-stream and the
+// content is a JSON object with a mediaType field, that media type is
+// used instead, and the push is rejected with MANIFEST_INVALID if it
+// isn't a valid media type. Other content is stored as
+// application/octet-stream as before.
+func manifestMediaType(contentType string, data []byte) (string, error) {
+	if contentType != "" && contentType != mediaTypeOctetStream {
+		return contentType, nil
+	}
+	var m struct {
+		MediaType *string `json:"mediaType"`
+	}
+	if json.Unmarshal(data, &m) != nil || m.MediaType == nil {
+		return mediaTypeOctetStream, nil
+	}
+	if _, _, err := mime.ParseMediaType(*m.MediaType); err != nil {
+		return "", ociregistry.NewError(fmt.Sprintf("invalid mediaType field %q in manifest", *m.MediaType), ociregistry.ErrManifestInvalid.Code(), nil)
+	}
+	return *m.MediaType, nil
+}
+
+// contentMediaType returns the mediaType field of the
+// given manifest content, or the empty string if there's none.
+func contentMediaType(data []byte) string {
+	var m struct {
+		MediaType string `json:"mediaType"`
+	}
+	json.Unmarshal(data, &m)
+	return m.MediaType
+}
+
 func subjectFromManifest(contentType string, data []byte) (*ociregistry.Descriptor, error) {
-	switch contentType {
-	case ocispec.MediaTypeImageManifest,
-		ocispec.MediaTypeImageIndex:
-		break
-		// TODO other manifest media types.
-	default:
+	if !mayHaveSubject(contentType) {
 		return nil, nil
 	}
 	var m struct {
@@ -220,22 +364,109 @@ func subjectFromManifest(contentType string, data []byte) (*ociregistry.Descript
 	return m.Subject, nil
 }
 
-func (r *registry) locationForUploadID(repo string, uploadID string) string {
+// checkTagAbsent implements "create only" semantics for tag pushes
+// with an "If-None-Match: *" header, returning a 412 (Precondition
+// Failed) error if the tag already exists.
+//
+// Note that this is not atomic: the tag could be created by
+// another client between this check and the push.
+func (r *registry) checkTagAbsent(ctx context.Context, repo, tag string) error {
+	_, err := r.backend.ResolveTag(ctx, repo, tag)
+	switch {
+	case err == nil:
+		return withHTTPCode(http.StatusPreconditionFailed, fmt.Errorf("tag %q already exists", tag))
+	case errors.Is(err, ociregistry.ErrManifestUnknown), errors.Is(err, ociregistry.ErrNameUnknown):
+		return nil
+	}
+	return err
+}
+
+// checkManifestReferences checks that all the blobs and manifests
+// referred to by the given manifest are present in the repository.
+// Subjects are not checked, because the spec allows them to
+// be dangling. Manifests of unknown media type are not checked.
+func (r *registry) checkManifestReferences(ctx context.Context, repo string, mediaType string, data []byte) error {
+	var blobs, manifests []ociregistry.Descriptor
+	switch mediaType {
+	case ocispec.MediaTypeImageManifest, mediaTypeDockerManifest:
+		// Docker image manifests have the same
+		// structure as OCI image manifests.
+		var m ociregistry.Manifest
+		if err := json.Unmarshal(data, &m); err != nil {
+			return fmt.Errorf("%w: invalid manifest JSON: %v", ociregistry.ErrManifestInvalid, err)
+		}
+		blobs = append(blobs, m.Config)
+		blobs = append(blobs, m.Layers...)
+	case ocispec.MediaTypeImageIndex, mediaTypeDockerManifestList:
+		var m ocispec.Index
+		if err := json.Unmarshal(data, &m); err != nil {
+			return fmt.Errorf("%w: invalid index JSON: %v", ociregistry.ErrManifestInvalid, err)
+		}
+		manifests = m.Manifests
+	default:
+		return nil
+	}
+	for _, desc := range blobs {
+		if _, err := r.backend.ResolveBlob(ctx, repo, desc.Digest); err != nil {
+			if errors.Is(err, ociregistry.ErrBlobUnknown) || errors.Is(err, ociregistry.ErrNameUnknown) {
+				return fmt.Errorf("%w: blob %s", ociregistry.ErrManifestBlobUnknown, desc.Digest)
+			}
+			return err
+		}
+	}
+	for _, desc := range manifests {
+		if _, err := r.backend.ResolveManifest(ctx, repo, desc.Digest); err != nil {
+			if errors.Is(err, ociregistry.ErrManifestUnknown) || errors.Is(err, ociregistry.ErrNameUnknown) {
+				return fmt.Errorf("%w: manifest %s", ociregistry.ErrManifestBlobUnknown, desc.Digest)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// mayHaveSubject reports whether manifests of the
+// given media type can hold a subject field.
+func mayHaveSubject(contentType string) bool {
+	switch contentType {
+	case ocispec.MediaTypeImageManifest,
+		ocispec.MediaTypeImageIndex:
+		return true
+		// TODO other manifest media types.
+	}
+	return false
+}
+
+// isArtifactManifest reports whether the given media type
+// is that of the deprecated artifact manifest.
+func isArtifactManifest(mediaType string) bool {
+	mt, _, err := mime.ParseMediaType(mediaType)
+	return err == nil && mt == mediaTypeArtifactManifest
+}
+
+func (r *registry) locationForUploadID(req *http.Request, repo string, uploadID string) string {
 	_, loc := (&ocirequest.Request{
 		Kind:     ocirequest.ReqBlobUploadInfo,
 		Repo:     repo,
 		UploadID: uploadID,
 	}).MustConstruct()
-	return loc
+	return r.absoluteLocation(req, loc)
 }
 
 func chunkRange(req *http.Request) (start, end int64, _ error) {
 	var rangeOK bool
 	if s := req.Header.Get("Content-Range"); s != "" {
-		start, end, rangeOK = ocirequest.ParseRange(s)
-		if !rangeOK {
+		var err error
+		start, end, err = ocirequest.ParseRangeErr(s)
+		if err != nil {
+			if errors.Is(err, ocirequest.ErrRangeValue) {
+				// The range is well formed but can't be satisfied,
+				// so don't pass the offsets on to the backend.
+				return 0, 0, fmt.Errorf("%w: invalid Content-Range %q: %v", ociregistry.ErrBlobUploadInvalid, s, err)
+			}
 			return 0, 0, badAPIUseError("we don't understand your Content-Range")
 		}
+		rangeOK = true
 	}
 
 	if rangeOK && req.ContentLength >= 0 {